@@ -0,0 +1,255 @@
+// Copyright (c) 2014-2015, Daniel Martí <mvdan@mvdan.cc>
+// See LICENSE for licensing information
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mvdan/pastecat/storage"
+)
+
+const (
+	// Default and maximum number of pastes per page when listing
+	defaultPageSize = 50
+	maxPageSize     = 1000
+)
+
+type adminHandler struct {
+	h *httpHandler
+	// secret is the token requests must carry, if empty when they are
+	// authenticated by their client certificate instead
+	secret string
+}
+
+type pasteEntry struct {
+	ID      string    `json:"id"`
+	URL     string    `json:"url"`
+	Size    int64     `json:"size"`
+	Created time.Time `json:"created"`
+	Views   int64     `json:"views"`
+	Token   string    `json:"token,omitempty"`
+	Owner   string    `json:"owner,omitempty"`
+}
+
+func (h adminHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !h.authorized(r) {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	switch {
+	case r.URL.Path == "/admin/pastes" && r.Method == "GET":
+		h.handleList(w, r)
+	case r.URL.Path == "/admin/pastes" && r.Method == "DELETE":
+		h.handleBulkDelete(w, r)
+	case strings.HasPrefix(r.URL.Path, "/admin/pastes/") && r.Method == "DELETE":
+		h.handleDelete(w, r)
+	case r.URL.Path == "/admin/deletions" && r.Method == "GET":
+		h.handleDeletions(w, r)
+	default:
+		http.Error(w, unknownAction, http.StatusBadRequest)
+	}
+}
+
+func (h adminHandler) authorized(r *http.Request) bool {
+	if h.secret == "" {
+		return r.TLS != nil && len(r.TLS.VerifiedChains) > 0
+	}
+	return secretsEqual(bearerToken(r), h.secret)
+}
+
+// actor returns who is making an admin request, for the audit log. That is
+// the common name of their client certificate, if they used one.
+func (h adminHandler) actor(r *http.Request) string {
+	if name := clientCertName(r); name != "" {
+		return "admin " + name
+	}
+	return "admin"
+}
+
+func listOptionsFromForm(r *http.Request) (opts storage.ListOptions, err error) {
+	atoi := func(name string, def int) int {
+		value := r.FormValue(name)
+		if value == "" || err != nil {
+			return def
+		}
+		var n int
+		if n, err = strconv.Atoi(value); err == nil && n < 0 {
+			err = strconv.ErrRange
+		}
+		return n
+	}
+	opts.Offset = atoi("offset", 0)
+	opts.Limit = atoi("limit", defaultPageSize)
+	if opts.Limit == 0 || opts.Limit > maxPageSize {
+		opts.Limit = maxPageSize
+	}
+	opts.SortBy = r.FormValue("sort")
+	opts.Reverse = r.FormValue("reverse") == "1"
+	opts.MinSize = int64(atoi("min_size", 0))
+	if value := r.FormValue("created_after"); value != "" && err == nil {
+		opts.CreatedAfter, err = time.Parse(time.RFC3339, value)
+	}
+	if value := r.FormValue("created_before"); value != "" && err == nil {
+		opts.CreatedBefore, err = time.Parse(time.RFC3339, value)
+	}
+	opts.Token = r.FormValue("token")
+	opts.Owner = r.FormValue("owner")
+	if ip := r.FormValue("ip"); ip != "" {
+		opts.IPHash = hashIP(ip)
+	}
+	return opts, err
+}
+
+func (h adminHandler) handleList(w http.ResponseWriter, r *http.Request) {
+	opts, err := listOptionsFromForm(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	writeListing(w, h.h.store, opts)
+}
+
+// writeListing replies with a page of the pastes in the store matching the
+// options, as JSON.
+func writeListing(w http.ResponseWriter, store storage.Store, opts storage.ListOptions) {
+	entries, total, err := storage.List(store, opts)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	page := struct {
+		Total  int          `json:"total"`
+		Offset int          `json:"offset"`
+		Pastes []pasteEntry `json:"pastes"`
+	}{
+		Total:  total,
+		Offset: opts.Offset,
+		Pastes: make([]pasteEntry, len(entries)),
+	}
+	for i, e := range entries {
+		page.Pastes[i] = newPasteEntry(e)
+	}
+	writeJSON(w, page)
+}
+
+func newPasteEntry(e storage.Entry) pasteEntry {
+	return pasteEntry{
+		ID:      e.ID.String(),
+		URL:     pasteURL(e.ID, e.Meta),
+		Size:    e.Size,
+		Created: e.Created(e.ModTime),
+		Views:   e.Views,
+		Token:   e.Token,
+		Owner:   e.Owner,
+	}
+}
+
+func (h adminHandler) handleDelete(w http.ResponseWriter, r *http.Request) {
+	id, err := storage.IDFromString(r.URL.Path[len("/admin/pastes/"):])
+	if err != nil {
+		http.Error(w, invalidID, http.StatusBadRequest)
+		return
+	}
+	sp, done := h.h.storeSpan(r, "Delete"), timePhase(r, "store")
+	err = h.h.deletePaste(id, reasonAdmin, h.actor(r))
+	sp.endWith(err)
+	done()
+	if err != nil {
+		h.h.storeError(w, r, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleBulkDelete deletes all the pastes uploaded by a token, user or
+// address, optionally within a time range.
+func (h adminHandler) handleBulkDelete(w http.ResponseWriter, r *http.Request) {
+	opts, err := listOptionsFromForm(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if opts.Token == "" && opts.Owner == "" && opts.IPHash == "" {
+		http.Error(w, "a token, owner or ip is required", http.StatusBadRequest)
+		return
+	}
+	opts.Offset, opts.Limit = 0, 0
+	entries, _, err := storage.List(h.h.store, opts)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var result struct {
+		Deleted int `json:"deleted"`
+		Failed  int `json:"failed"`
+	}
+	for _, e := range entries {
+		sp, done := h.h.storeSpan(r, "Delete"), timePhase(r, "store")
+		err := h.h.deletePaste(e.ID, reasonAdmin, h.actor(r))
+		sp.endWith(err)
+		done()
+		switch {
+		case err == nil:
+			result.Deleted++
+		case err != storage.ErrPasteNotFound:
+			log.Printf("Unknown error on admin DELETE of %s: %v", e.ID, err)
+			result.Failed++
+		}
+	}
+	writeJSON(w, result)
+}
+
+func (h adminHandler) handleDeletions(w http.ResponseWriter, r *http.Request) {
+	if h.h.audit == nil {
+		http.Error(w, "audit log not enabled", http.StatusNotFound)
+		return
+	}
+	id, reason := r.FormValue("id"), r.FormValue("reason")
+	ds, err := h.h.audit.deletions(func(d *deletion) bool {
+		return (id == "" || d.ID == id) && (reason == "" || d.Reason == reason)
+	})
+	if err != nil {
+		log.Printf("Could not read audit log: %v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if ds == nil {
+		ds = []deletion{}
+	}
+	writeJSON(w, ds)
+}
+
+// hashIP returns the hash of an address by which pastes uploaded from it
+// can be found.
+func hashIP(addr string) string {
+	if ip := net.ParseIP(addr); ip != nil {
+		addr = ip.String()
+	}
+	sum := sha256.Sum256([]byte(addr))
+	return hex.EncodeToString(sum[:])
+}
+
+// uploaderHash returns the hash of the address a paste is uploaded from,
+// if those are recorded.
+func uploaderHash(addr string) string {
+	if !*hashIPs {
+		return ""
+	}
+	return hashIP(addr)
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Printf("Error encoding JSON response: %v", err)
+	}
+}
@@ -0,0 +1,115 @@
+// Copyright (c) 2014-2015, Daniel Martí <mvdan@mvdan.cc>
+// See LICENSE for licensing information
+
+package main
+
+import (
+	"errors"
+	"expvar"
+	"fmt"
+	"log"
+	"net/http"
+	"sync/atomic"
+
+	"github.com/mvdan/pastecat/storage"
+)
+
+// storageLevel is how close the pastes are to filling -M, deciding which
+// uploads are admitted.
+type storageLevel int32
+
+const (
+	levelOK storageLevel = iota
+	// Uploads are accepted with a warning
+	levelWarn
+	// Only uploads from identified clients are accepted
+	levelAnonymous
+	// No uploads are accepted
+	levelFull
+)
+
+var levelNames = [...]string{"ok", "warn", "anonymous", "full"}
+
+func (l storageLevel) String() string { return levelNames[l] }
+
+var errAnonymousRefused = errors.New("storage is nearly full, only accepting uploads from identified clients")
+
+var (
+	// Uploads warned about, and refused, per storage level
+	admissionVars = expvar.NewMap("admission")
+
+	// The last storage level seen, to log when it changes
+	lastLevel int32
+)
+
+func init() {
+	expvar.Publish("storage_level", expvar.Func(func() interface{} {
+		return storageLevel(atomic.LoadInt32(&lastLevel)).String()
+	}))
+}
+
+// storageUse returns the percentage of -M that the pastes use, or zero if
+// there is no such limit.
+func storageUse(stats *storage.Stats) float64 {
+	if stats.MaxStorage <= 0 {
+		return 0
+	}
+	_, stg := stats.Report()
+	return float64(stg*100) / float64(stats.MaxStorage)
+}
+
+// level returns the storage level that the pastes are at, logging whenever
+// it changes.
+func (h *httpHandler) level() storageLevel {
+	use := storageUse(h.stats)
+	level := levelOK
+	switch {
+	case h.stats.MaxStorage > 0 && use >= 100:
+		level = levelFull
+	case *anonPercent > 0 && use >= float64(*anonPercent):
+		level = levelAnonymous
+	case *warnPercent > 0 && use >= float64(*warnPercent):
+		level = levelWarn
+	}
+	if old := storageLevel(atomic.SwapInt32(&lastLevel, int32(level))); old != level {
+		log.Printf("Storage is %.2f%% full, going from level %s to %s", use, old, level)
+	}
+	return level
+}
+
+// admit returns whether an upload by owner may be stored, and the error to
+// refuse it with if not. Anonymous clients have no owner.
+func (h *httpHandler) admit(owner string) (storageLevel, error) {
+	level := h.level()
+	switch {
+	case level == levelFull:
+		admissionVars.Add("refused", 1)
+		return level, storage.ErrReachedMaxStorage
+	case level == levelAnonymous && owner == "":
+		admissionVars.Add("refused_anonymous", 1)
+		return level, errAnonymousRefused
+	case level >= levelWarn:
+		admissionVars.Add("warned", 1)
+	}
+	return level, nil
+}
+
+// admitUpload is like admit, replying with the refusal if the upload may
+// not be stored, and adding a warning header if it is stored while the
+// storage is filling up.
+func (h *httpHandler) admitUpload(w http.ResponseWriter, owner string) bool {
+	level, err := h.admit(owner)
+	switch err {
+	case nil:
+	case errAnonymousRefused:
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return false
+	default:
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return false
+	}
+	if level >= levelWarn {
+		w.Header().Set("Warning", fmt.Sprintf(`199 - "storage is %.f%% full"`, storageUse(h.stats)))
+	}
+	return true
+}
@@ -0,0 +1,231 @@
+// Copyright (c) 2014-2015, Daniel Martí <mvdan@mvdan.cc>
+// See LICENSE for licensing information
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"html/template"
+	"strconv"
+	"strings"
+)
+
+const ansiEscape = 0x1b
+
+// The 16 standard colors of terminals, as xterm shows them
+var ansiColors = [16]string{
+	"#000000", "#cd0000", "#00cd00", "#cdcd00",
+	"#0000ee", "#cd00cd", "#00cdcd", "#e5e5e5",
+	"#7f7f7f", "#ff0000", "#00ff00", "#ffff00",
+	"#5c5cff", "#ff00ff", "#00ffff", "#ffffff",
+}
+
+// ansiColor returns one of the 256 colors of xterm as CSS
+func ansiColor(n int) string {
+	switch {
+	case n < 16:
+		return ansiColors[n]
+	case n < 232:
+		n -= 16
+		level := func(v int) int {
+			if v == 0 {
+				return 0
+			}
+			return 55 + 40*v
+		}
+		return fmt.Sprintf("#%02x%02x%02x", level(n/36), level(n/6%6), level(n%6))
+	}
+	gray := 8 + 10*(n-232)
+	return fmt.Sprintf("#%02x%02x%02x", gray, gray, gray)
+}
+
+// ansiStyle is the state set by SGR escape sequences
+type ansiStyle struct {
+	fg, bg    string
+	bold, dim bool
+	italic    bool
+	underline bool
+}
+
+func (s ansiStyle) css() string {
+	var props []string
+	if s.fg != "" {
+		props = append(props, "color:"+s.fg)
+	}
+	if s.bg != "" {
+		props = append(props, "background-color:"+s.bg)
+	}
+	if s.bold {
+		props = append(props, "font-weight:bold")
+	}
+	if s.dim {
+		props = append(props, "opacity:0.7")
+	}
+	if s.italic {
+		props = append(props, "font-style:italic")
+	}
+	if s.underline {
+		props = append(props, "text-decoration:underline")
+	}
+	return strings.Join(props, ";")
+}
+
+// extendedColor parses the arguments of SGR 38 and 48, returning the color
+// and how many arguments it took.
+func extendedColor(args []int) (string, int) {
+	switch {
+	case len(args) >= 2 && args[0] == 5 && args[1] < 256:
+		return ansiColor(args[1]), 2
+	case len(args) >= 4 && args[0] == 2:
+		return fmt.Sprintf("#%02x%02x%02x", args[1]&0xff, args[2]&0xff, args[3]&0xff), 4
+	}
+	return "", len(args)
+}
+
+// apply updates the style given the parameters of an SGR sequence
+func (s *ansiStyle) apply(params []int) {
+	if len(params) == 0 {
+		params = []int{0}
+	}
+	for i := 0; i < len(params); i++ {
+		switch p := params[i]; {
+		case p == 0:
+			*s = ansiStyle{}
+		case p == 1:
+			s.bold = true
+		case p == 2:
+			s.dim = true
+		case p == 3:
+			s.italic = true
+		case p == 4:
+			s.underline = true
+		case p == 22:
+			s.bold, s.dim = false, false
+		case p == 23:
+			s.italic = false
+		case p == 24:
+			s.underline = false
+		case p >= 30 && p <= 37:
+			s.fg = ansiColors[p-30]
+		case p == 38:
+			color, n := extendedColor(params[i+1:])
+			s.fg = color
+			i += n
+		case p == 39:
+			s.fg = ""
+		case p >= 40 && p <= 47:
+			s.bg = ansiColors[p-40]
+		case p == 48:
+			color, n := extendedColor(params[i+1:])
+			s.bg = color
+			i += n
+		case p == 49:
+			s.bg = ""
+		case p >= 90 && p <= 97:
+			s.fg = ansiColors[p-90+8]
+		case p >= 100 && p <= 107:
+			s.bg = ansiColors[p-100+8]
+		}
+	}
+}
+
+// skipEscape returns the length of the escape sequence at the start of b,
+// along with the parameters of the sequence if it is an SGR one.
+func skipEscape(b []byte) (n int, sgr []int, isSGR bool) {
+	if len(b) < 2 {
+		return len(b), nil, false
+	}
+	switch b[1] {
+	case '[': // CSI: parameters, intermediates and a final byte
+		i := 2
+		for i < len(b) && b[i] >= 0x30 && b[i] <= 0x3f {
+			i++
+		}
+		params := string(b[2:i])
+		for i < len(b) && b[i] >= 0x20 && b[i] <= 0x2f {
+			i++
+		}
+		if i == len(b) {
+			return i, nil, false
+		}
+		if b[i] != 'm' {
+			return i + 1, nil, false
+		}
+		for _, field := range strings.Split(params, ";") {
+			v, _ := strconv.Atoi(field)
+			sgr = append(sgr, v)
+		}
+		if params == "" {
+			sgr = nil
+		}
+		return i + 1, sgr, true
+	case ']': // OSC: ends with BEL or ST
+		for i := 2; i < len(b); i++ {
+			if b[i] == 0x07 {
+				return i + 1, nil, false
+			}
+			if b[i] == ansiEscape && i+1 < len(b) && b[i+1] == '\\' {
+				return i + 2, nil, false
+			}
+		}
+		return len(b), nil, false
+	}
+	return 2, nil, false
+}
+
+// hasANSIColors reports whether content holds any SGR escape sequences
+func hasANSIColors(content []byte) bool {
+	for {
+		i := bytes.IndexByte(content, ansiEscape)
+		if i < 0 {
+			return false
+		}
+		n, _, isSGR := skipEscape(content[i:])
+		if isSGR {
+			return true
+		}
+		content = content[i+n:]
+	}
+}
+
+// renderANSI renders content as preformatted HTML, converting its color and
+// text attribute escape sequences to styled spans and dropping any other
+// escape sequences.
+func renderANSI(content []byte) template.HTML {
+	var buf bytes.Buffer
+	buf.WriteString(`<pre style="white-space:pre-wrap">`)
+	var style ansiStyle
+	open := false
+	for len(content) > 0 {
+		i := bytes.IndexByte(content, ansiEscape)
+		if i < 0 {
+			i = len(content)
+		}
+		if i > 0 {
+			css := style.css()
+			if css != "" && !open {
+				fmt.Fprintf(&buf, `<span style="%s">`, css)
+				open = true
+			}
+			template.HTMLEscape(&buf, content[:i])
+			content = content[i:]
+			continue
+		}
+		n, params, isSGR := skipEscape(content)
+		content = content[n:]
+		if !isSGR {
+			continue
+		}
+		if open {
+			buf.WriteString("</span>")
+			open = false
+		}
+		style.apply(params)
+	}
+	if open {
+		buf.WriteString("</span>")
+	}
+	buf.WriteString("</pre>")
+	return template.HTML(buf.String())
+}
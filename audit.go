@@ -0,0 +1,80 @@
+// Copyright (c) 2014-2015, Daniel Martí <mvdan@mvdan.cc>
+// See LICENSE for licensing information
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// Reasons for which a paste may be deleted
+const (
+	reasonExpiry = "expiry"
+	reasonAdmin  = "admin"
+	reasonReads  = "reads"
+	reasonOwner  = "owner"
+
+	reasonDeleteToken = "delete-token"
+)
+
+type deletion struct {
+	Time   time.Time `json:"time"`
+	ID     string    `json:"id"`
+	Reason string    `json:"reason"`
+	Actor  string    `json:"actor,omitempty"`
+}
+
+// auditLog is an append-only log of deletions, one JSON object per line
+type auditLog struct {
+	sync.Mutex
+	file *os.File
+}
+
+func openAuditLog(path string) (*auditLog, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return &auditLog{file: f}, nil
+}
+
+func (l *auditLog) record(d deletion) error {
+	if l == nil {
+		return nil
+	}
+	line, err := json.Marshal(d)
+	if err != nil {
+		return err
+	}
+	l.Lock()
+	defer l.Unlock()
+	_, err = l.file.Write(append(line, '\n'))
+	return err
+}
+
+// deletions returns the recorded deletions accepted by match, oldest first.
+func (l *auditLog) deletions(match func(d *deletion) bool) ([]deletion, error) {
+	l.Lock()
+	info, err := l.file.Stat()
+	l.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	var ds []deletion
+	scanner := bufio.NewScanner(io.NewSectionReader(l.file, 0, info.Size()))
+	for scanner.Scan() {
+		var d deletion
+		if err := json.Unmarshal(scanner.Bytes(), &d); err != nil {
+			return nil, err
+		}
+		if match(&d) {
+			ds = append(ds, d)
+		}
+	}
+	return ds, scanner.Err()
+}
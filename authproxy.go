@@ -0,0 +1,60 @@
+// Copyright (c) 2014-2015, Daniel Martí <mvdan@mvdan.cc>
+// See LICENSE for licensing information
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// authProxy trusts a header naming the user, set by a reverse proxy which
+// logs users in, on the requests coming from the proxy's addresses
+type authProxy struct {
+	header  string
+	proxies []*net.IPNet
+}
+
+// newAuthProxy trusts header on the requests from the given addresses or
+// networks in CIDR notation.
+func newAuthProxy(header string, proxies []string) (*authProxy, error) {
+	p := &authProxy{header: header}
+	for _, proxy := range proxies {
+		if !strings.Contains(proxy, "/") {
+			if ip := net.ParseIP(proxy); ip == nil {
+				return nil, fmt.Errorf("invalid proxy address %q", proxy)
+			} else if ip.To4() != nil {
+				proxy += "/32"
+			} else {
+				proxy += "/128"
+			}
+		}
+		_, ipnet, err := net.ParseCIDR(proxy)
+		if err != nil {
+			return nil, fmt.Errorf("invalid proxy network %q", proxy)
+		}
+		p.proxies = append(p.proxies, ipnet)
+	}
+	return p, nil
+}
+
+// user returns the user named by the header, if the request came from a
+// trusted proxy.
+func (p *authProxy) user(r *http.Request) string {
+	if p == nil {
+		return ""
+	}
+	user := strings.TrimSpace(r.Header.Get(p.header))
+	if user == "" {
+		return ""
+	}
+	ip := net.ParseIP(clientHost(r))
+	for _, ipnet := range p.proxies {
+		if ip != nil && ipnet.Contains(ip) {
+			return user
+		}
+	}
+	return ""
+}
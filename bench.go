@@ -0,0 +1,243 @@
+// Copyright (c) 2014-2015, Daniel Martí <mvdan@mvdan.cc>
+// See LICENSE for licensing information
+
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"math/rand"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mvdan/pastecat/storage"
+)
+
+// Operations performed by the benchmark
+const (
+	benchUpload = "upload"
+	benchRead   = "read"
+	benchDelete = "delete"
+)
+
+type benchResult struct {
+	op   string
+	took time.Duration
+	err  error
+}
+
+type bench struct {
+	url        string
+	adminToken string
+	minSize    int
+	maxSize    int
+	readRatio  float64
+	delRatio   float64
+	client     *http.Client
+
+	// Set by the flags, before being checked
+	minBytes, maxBytes storage.ByteSize
+	duration           time.Duration
+	workers            int
+
+	// Pastes uploaded and not yet deleted
+	sync.Mutex
+	pastes []string
+}
+
+// benchFlags returns the flags of the benchmark, which set the fields of b.
+func benchFlags(b *bench) *flag.FlagSet {
+	fs := flag.NewFlagSet("bench", flag.ExitOnError)
+	b.minBytes, b.maxBytes = storage.ByteSize(100), 64*storage.KB
+	fs.StringVar(&b.url, "url", "http://localhost:8080", "URL of the instance to benchmark")
+	fs.StringVar(&b.adminToken, "admin-token", "", "Admin token of the instance, to also delete pastes")
+	fs.Var(&b.minBytes, "min-size", "Minimum size of the uploaded pastes")
+	fs.Var(&b.maxBytes, "max-size", "Maximum size of the uploaded pastes")
+	fs.Float64Var(&b.readRatio, "reads", 0.7, "Ratio of operations that are reads")
+	fs.Float64Var(&b.delRatio, "deletes", 0.1, "Ratio of operations that are deletes")
+	fs.DurationVar(&b.duration, "duration", 10*time.Second, "How long to run the benchmark for")
+	fs.IntVar(&b.workers, "c", 8, "Number of concurrent clients")
+	return fs
+}
+
+func runBench(args []string) {
+	var b bench
+	benchFlags(&b).Parse(args)
+
+	b.url = strings.TrimSuffix(b.url, "/")
+	b.minSize, b.maxSize = int(b.minBytes), int(b.maxBytes)
+	if b.minSize < 1 || b.maxSize < b.minSize {
+		log.Fatalf("Invalid paste size range %s to %s", b.minBytes, b.maxBytes)
+	}
+	if b.adminToken == "" {
+		b.delRatio = 0
+	}
+	b.client = &http.Client{Timeout: 30 * time.Second}
+
+	results := make(chan benchResult)
+	stop := time.After(b.duration)
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < b.workers; i++ {
+		wg.Add(1)
+		go func(seed int64) {
+			defer wg.Done()
+			rnd := rand.New(rand.NewSource(seed))
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				results <- b.step(rnd)
+			}
+		}(time.Now().UnixNano() + int64(i))
+	}
+	go func() {
+		<-stop
+		close(done)
+		wg.Wait()
+		close(results)
+	}()
+
+	took := make(map[string][]time.Duration)
+	errs := make(map[string]int)
+	for res := range results {
+		took[res.op] = append(took[res.op], res.took)
+		if res.err != nil {
+			errs[res.op]++
+		}
+	}
+	printBenchReport(os.Stdout, took, errs, b.duration)
+}
+
+func (b *bench) step(rnd *rand.Rand) benchResult {
+	p := rnd.Float64()
+	b.Lock()
+	n := len(b.pastes)
+	b.Unlock()
+	switch {
+	case n > 0 && p < b.delRatio:
+		return b.timed(benchDelete, func() error { return b.delete(rnd) })
+	case n > 0 && p < b.delRatio+b.readRatio:
+		return b.timed(benchRead, func() error { return b.read(rnd) })
+	}
+	return b.timed(benchUpload, func() error { return b.upload(rnd) })
+}
+
+func (b *bench) timed(op string, f func() error) benchResult {
+	start := time.Now()
+	err := f()
+	return benchResult{op: op, took: time.Since(start), err: err}
+}
+
+func (b *bench) upload(rnd *rand.Rand) error {
+	content := make([]byte, b.minSize+rnd.Intn(b.maxSize-b.minSize+1))
+	for i := range content {
+		content[i] = 'a' + byte(rnd.Intn(26))
+	}
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	mw.WriteField(fieldName, string(content))
+	mw.Close()
+	resp, err := b.client.Post(b.url, mw.FormDataContentType(), &body)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	out, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("upload got %s", resp.Status)
+	}
+	url := strings.TrimSpace(string(out))
+	b.Lock()
+	b.pastes = append(b.pastes, url[strings.LastIndex(url, "/")+1:])
+	b.Unlock()
+	return nil
+}
+
+func (b *bench) pick(rnd *rand.Rand, remove bool) string {
+	b.Lock()
+	defer b.Unlock()
+	if len(b.pastes) == 0 {
+		return ""
+	}
+	i := rnd.Intn(len(b.pastes))
+	id := b.pastes[i]
+	if remove {
+		b.pastes[i] = b.pastes[len(b.pastes)-1]
+		b.pastes = b.pastes[:len(b.pastes)-1]
+	}
+	return id
+}
+
+func (b *bench) read(rnd *rand.Rand) error {
+	resp, err := b.client.Get(b.url + "/" + b.pick(rnd, false))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if _, err := io.Copy(ioutil.Discard, resp.Body); err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("read got %s", resp.Status)
+	}
+	return nil
+}
+
+func (b *bench) delete(rnd *rand.Rand) error {
+	req, err := http.NewRequest("DELETE", b.url+"/admin/pastes/"+b.pick(rnd, true), nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+b.adminToken)
+	resp, err := b.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent {
+		return fmt.Errorf("delete got %s", resp.Status)
+	}
+	return nil
+}
+
+type durations []time.Duration
+
+func (d durations) Len() int           { return len(d) }
+func (d durations) Less(i, j int) bool { return d[i] < d[j] }
+func (d durations) Swap(i, j int)      { d[i], d[j] = d[j], d[i] }
+
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	return sorted[int(float64(len(sorted)-1)*p)].Round(time.Microsecond)
+}
+
+func printBenchReport(w io.Writer, took map[string][]time.Duration, errs map[string]int, elapsed time.Duration) {
+	fmt.Fprintf(w, "%-8s %8s %8s %8s %10s %10s %10s %10s\n",
+		"op", "count", "errors", "req/s", "p50", "p90", "p99", "max")
+	for _, op := range []string{benchUpload, benchRead, benchDelete} {
+		ds := took[op]
+		if len(ds) == 0 {
+			continue
+		}
+		sort.Sort(durations(ds))
+		fmt.Fprintf(w, "%-8s %8d %7.2f%% %8.1f %10s %10s %10s %10s\n", op, len(ds),
+			float64(errs[op]*100)/float64(len(ds)),
+			float64(len(ds))/elapsed.Seconds(),
+			percentile(ds, 0.5), percentile(ds, 0.9),
+			percentile(ds, 0.99), percentile(ds, 1))
+	}
+}
@@ -0,0 +1,148 @@
+// Copyright (c) 2014-2015, Daniel Martí <mvdan@mvdan.cc>
+// See LICENSE for licensing information
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"unicode/utf16"
+	"unicode/utf8"
+
+	"github.com/mvdan/pastecat/storage"
+)
+
+var errBinary = errors.New("content does not look like text")
+
+// How much of the content to look at when telling text from binary
+const sniffLen = 8 << 10
+
+var (
+	bomUTF8    = []byte{0xef, 0xbb, 0xbf}
+	bomUTF16LE = []byte{0xff, 0xfe}
+	bomUTF16BE = []byte{0xfe, 0xff}
+)
+
+// Characters of windows-1252 from 0x80 to 0x9f, where it differs from
+// latin-1. Zero means the byte is undefined.
+var cp1252 = [32]rune{
+	0x20ac, 0, 0x201a, 0x0192, 0x201e, 0x2026, 0x2020, 0x2021,
+	0x02c6, 0x2030, 0x0160, 0x2039, 0x0152, 0, 0x017d, 0,
+	0, 0x2018, 0x2019, 0x201c, 0x201d, 0x2022, 0x2013, 0x2014,
+	0x02dc, 0x2122, 0x0161, 0x203a, 0x0153, 0, 0x017e, 0x0178,
+}
+
+// isTextControl reports whether a control character may appear in text
+func isTextControl(b byte) bool {
+	switch b {
+	case '\b', '\t', '\n', '\v', '\f', '\r', 0x1b:
+		return true
+	}
+	return false
+}
+
+// looksLikeText reports whether the start of valid UTF-8 content is free
+// of control characters that text does not hold.
+func looksLikeText(content []byte) bool {
+	if len(content) > sniffLen {
+		content = content[:sniffLen]
+	}
+	for _, b := range content {
+		if (b < 0x20 || b == 0x7f) && !isTextControl(b) {
+			return false
+		}
+	}
+	return true
+}
+
+// decodeUTF16 transcodes UTF-16 text to UTF-8, if it has an even size.
+func decodeUTF16(content []byte, bigEndian bool) ([]byte, bool) {
+	if len(content)%2 != 0 {
+		return nil, false
+	}
+	units := make([]uint16, len(content)/2)
+	for i := range units {
+		hi, lo := content[2*i+1], content[2*i]
+		if bigEndian {
+			hi, lo = lo, hi
+		}
+		units[i] = uint16(hi)<<8 | uint16(lo)
+	}
+	var buf bytes.Buffer
+	for _, r := range utf16.Decode(units) {
+		buf.WriteRune(r)
+	}
+	out := buf.Bytes()
+	return out, looksLikeText(out)
+}
+
+// decodeCP1252 transcodes windows-1252 text, a superset of latin-1's
+// printable characters, to UTF-8.
+func decodeCP1252(content []byte) ([]byte, bool) {
+	var buf bytes.Buffer
+	buf.Grow(len(content))
+	for _, b := range content {
+		switch {
+		case b < 0x80:
+			if (b < 0x20 || b == 0x7f) && !isTextControl(b) {
+				return nil, false
+			}
+			buf.WriteByte(b)
+		case b < 0xa0:
+			r := cp1252[b-0x80]
+			if r == 0 {
+				return nil, false
+			}
+			buf.WriteRune(r)
+		default:
+			buf.WriteRune(rune(b))
+		}
+	}
+	return buf.Bytes(), true
+}
+
+// prepareContent normalizes the content of a new paste or version,
+// recording in meta whether it is binary and its hash. Encrypted content
+// is kept as is, and is never text.
+func prepareContent(content []byte, meta *storage.Meta) ([]byte, error) {
+	if meta.Encrypted {
+		meta.Binary = true
+		meta.Hash = contentHash(content)
+		return content, nil
+	}
+	content, text := normalizeText(content)
+	if !text && *rejectBinary {
+		return nil, errBinary
+	}
+	meta.Binary = !text
+	meta.Hash = contentHash(content)
+	return content, nil
+}
+
+// normalizeText transcodes text in UTF-16 with a byte order mark or in
+// windows-1252 to UTF-8, dropping any UTF-8 byte order mark. It also
+// reports whether the content is text at all; if not, it is returned as
+// is.
+func normalizeText(content []byte) ([]byte, bool) {
+	switch {
+	case bytes.HasPrefix(content, bomUTF8):
+		if rest := content[len(bomUTF8):]; utf8.Valid(rest) && looksLikeText(rest) {
+			return rest, true
+		}
+	case bytes.HasPrefix(content, bomUTF16LE):
+		if out, ok := decodeUTF16(content[len(bomUTF16LE):], false); ok {
+			return out, true
+		}
+	case bytes.HasPrefix(content, bomUTF16BE):
+		if out, ok := decodeUTF16(content[len(bomUTF16BE):], true); ok {
+			return out, true
+		}
+	}
+	if utf8.Valid(content) {
+		return content, looksLikeText(content)
+	}
+	if out, ok := decodeCP1252(content); ok {
+		return out, true
+	}
+	return content, false
+}
@@ -0,0 +1,346 @@
+// Copyright (c) 2014-2015, Daniel Martí <mvdan@mvdan.cc>
+// See LICENSE for licensing information
+
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/mvdan/pastecat/storage"
+)
+
+// subcommand is run as `pastecat name args...` instead of the server.
+type subcommand struct {
+	name string
+	// What it takes after its name, and one line describing it
+	args, usage string
+	// Returns its flags, if any, to complete them and list them in the
+	// man page
+	flags func() *flag.FlagSet
+	run   func(args []string)
+}
+
+// Shells that completions can be generated for
+var completionShells = []string{"bash", "zsh", "fish"}
+
+// Set up in init, as some subcommands list all of them
+var subcommands []subcommand
+
+func init() {
+	subcommands = []subcommand{
+		{
+			name:  "bench",
+			args:  "[flags]",
+			usage: "Benchmark an instance by uploading, reading and deleting pastes",
+			flags: func() *flag.FlagSet { return benchFlags(new(bench)) },
+			run:   runBench,
+		},
+		{
+			name:  "completion",
+			args:  strings.Join(completionShells, "|"),
+			usage: "Print the completion script for a shell",
+			run:   runCompletion,
+		},
+		{
+			name:  "doctor",
+			args:  "[flags] [store]",
+			usage: "Check that the server would work with the same flags and store, and print what to fix",
+			flags: func() *flag.FlagSet { return flag.CommandLine },
+			run:   runDoctor,
+		},
+		{
+			name:  "man",
+			usage: "Print the man page",
+			run:   runMan,
+		},
+	}
+}
+
+// findSubcommand returns the subcommand called name, if there is one.
+func findSubcommand(name string) (subcommand, bool) {
+	for _, cmd := range subcommands {
+		if cmd.name == name {
+			return cmd, true
+		}
+	}
+	return subcommand{}, false
+}
+
+// cliFlag is a flag as listed in completions and the man page.
+type cliFlag struct {
+	name, arg, usage, def string
+	isBool                bool
+}
+
+// cliFlags returns the flags in fs, sorted by name.
+func cliFlags(fs *flag.FlagSet) []cliFlag {
+	var flags []cliFlag
+	fs.VisitAll(func(f *flag.Flag) {
+		arg, usage := flag.UnquoteUsage(f)
+		cf := cliFlag{name: f.Name, arg: arg, usage: usage}
+		if b, ok := f.Value.(interface{ IsBoolFlag() bool }); ok && b.IsBoolFlag() {
+			cf.isBool = true
+		}
+		switch f.DefValue {
+		case "", "0", "0s", "false", "[]", storage.ByteSize(0).String():
+		default:
+			cf.def = f.DefValue
+		}
+		flags = append(flags, cf)
+	})
+	return flags
+}
+
+func runCompletion(args []string) {
+	if len(args) != 1 {
+		log.Fatalf("Usage: pastecat completion %s", strings.Join(completionShells, "|"))
+	}
+	w := bufio.NewWriter(os.Stdout)
+	switch args[0] {
+	case "bash":
+		writeBashCompletion(w)
+	case "zsh":
+		writeZshCompletion(w)
+	case "fish":
+		writeFishCompletion(w)
+	default:
+		log.Fatalf("Unknown shell %q, want one of %s", args[0], strings.Join(completionShells, ", "))
+	}
+	if err := w.Flush(); err != nil {
+		log.Fatalf("Could not write the completion: %v", err)
+	}
+}
+
+// flagWords returns the flags as words to complete, with their dash.
+func flagWords(flags []cliFlag) string {
+	var words []string
+	for _, f := range flags {
+		words = append(words, "-"+f.name)
+	}
+	return strings.Join(words, " ")
+}
+
+func writeBashCompletion(w io.Writer) {
+	var names []string
+	for _, cmd := range subcommands {
+		names = append(names, cmd.name)
+	}
+	fmt.Fprintf(w, `# bash completion for pastecat, generated by "pastecat completion bash"
+_pastecat() {
+	local cur=${COMP_WORDS[COMP_CWORD]}
+	if [[ $COMP_CWORD -eq 1 && $cur != -* ]]; then
+		COMPREPLY=($(compgen -W %q -- "$cur"))
+		return
+	fi
+	case ${COMP_WORDS[1]} in
+`, strings.Join(names, " "))
+	for _, cmd := range subcommands {
+		words := ""
+		if cmd.name == "completion" {
+			words = strings.Join(completionShells, " ")
+		} else if cmd.flags != nil {
+			words = flagWords(cliFlags(cmd.flags()))
+		}
+		if words == "" {
+			fmt.Fprintf(w, "\t%s) ;;\n", cmd.name)
+			continue
+		}
+		fmt.Fprintf(w, "\t%s) COMPREPLY=($(compgen -W %q -- \"$cur\")) ;;\n", cmd.name, words)
+	}
+	fmt.Fprintf(w, `	*) COMPREPLY=($(compgen -W %q -- "$cur")) ;;
+	esac
+}
+complete -o default -F _pastecat pastecat
+`, flagWords(cliFlags(flag.CommandLine)))
+}
+
+// zshQuote quotes s as a single word for zsh.
+func zshQuote(s string) string {
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
+
+// zshDesc escapes s to be the description of a flag or command, between
+// brackets.
+func zshDesc(s string) string {
+	return strings.NewReplacer(`[`, `\[`, `]`, `\]`).Replace(s)
+}
+
+// writeZshArguments writes the _arguments call completing flags.
+func writeZshArguments(w io.Writer, flags []cliFlag) {
+	fmt.Fprint(w, "_arguments")
+	for _, f := range flags {
+		spec := "-" + f.name + "[" + zshDesc(f.usage) + "]"
+		if !f.isBool {
+			arg := f.arg
+			if arg == "" {
+				arg = "value"
+			}
+			spec += ":" + arg + ":"
+			if strings.Contains(strings.ToLower(f.usage), "file") ||
+				strings.Contains(strings.ToLower(f.usage), "directory") {
+				spec += "_files"
+			}
+		}
+		fmt.Fprintf(w, " \\\n\t\t\t%s", zshQuote(spec))
+	}
+	fmt.Fprintln(w)
+}
+
+func writeZshCompletion(w io.Writer) {
+	fmt.Fprint(w, `#compdef pastecat
+# zsh completion for pastecat, generated by "pastecat completion zsh"
+
+_pastecat() {
+	if (( CURRENT == 2 )) && [[ $words[2] != -* ]]; then
+		_values command`)
+	for _, cmd := range subcommands {
+		fmt.Fprintf(w, " \\\n\t\t\t%s", zshQuote(cmd.name+"["+zshDesc(cmd.usage)+"]"))
+	}
+	fmt.Fprint(w, `
+		return
+	fi
+	case $words[2] in
+`)
+	for _, cmd := range subcommands {
+		fmt.Fprintf(w, "\t%s)\n", cmd.name)
+		switch {
+		case cmd.name == "completion":
+			fmt.Fprintf(w, "\t\t_values shell %s\n", strings.Join(completionShells, " "))
+		case cmd.flags != nil:
+			fmt.Fprint(w, "\t\tshift words\n\t\t(( CURRENT-- ))\n\t\t")
+			writeZshArguments(w, cliFlags(cmd.flags()))
+		}
+		fmt.Fprint(w, "\t\t;;\n")
+	}
+	fmt.Fprint(w, "\t*)\n\t\t")
+	writeZshArguments(w, cliFlags(flag.CommandLine))
+	fmt.Fprint(w, `		;;
+	esac
+}
+
+_pastecat "$@"
+`)
+}
+
+// fishQuote quotes s as a single word for fish.
+func fishQuote(s string) string {
+	return "'" + strings.NewReplacer(`\`, `\\`, `'`, `\'`).Replace(s) + "'"
+}
+
+// writeFishFlags writes the completions of flags, under condition.
+func writeFishFlags(w io.Writer, condition string, flags []cliFlag) {
+	for _, f := range flags {
+		fmt.Fprintf(w, "complete -c pastecat -n %s -o %s -d %s", fishQuote(condition), f.name, fishQuote(f.usage))
+		if !f.isBool {
+			fmt.Fprint(w, " -r")
+		}
+		fmt.Fprintln(w)
+	}
+}
+
+func writeFishCompletion(w io.Writer) {
+	fmt.Fprintln(w, `# fish completion for pastecat, generated by "pastecat completion fish"`)
+	var names []string
+	for _, cmd := range subcommands {
+		names = append(names, cmd.name)
+		fmt.Fprintf(w, "complete -c pastecat -f -n __fish_use_subcommand -a %s -d %s\n",
+			cmd.name, fishQuote(cmd.usage))
+	}
+	for _, cmd := range subcommands {
+		seen := "__fish_seen_subcommand_from " + cmd.name
+		switch {
+		case cmd.name == "completion":
+			fmt.Fprintf(w, "complete -c pastecat -f -n %s -a %s\n",
+				fishQuote(seen), fishQuote(strings.Join(completionShells, " ")))
+		case cmd.flags != nil:
+			writeFishFlags(w, seen, cliFlags(cmd.flags()))
+		}
+	}
+	writeFishFlags(w, "not __fish_seen_subcommand_from "+strings.Join(names, " "), cliFlags(flag.CommandLine))
+}
+
+// roffEscape escapes s to be written as text in a man page.
+func roffEscape(s string) string {
+	s = strings.NewReplacer(`\`, `\e`, `-`, `\-`).Replace(s)
+	if strings.HasPrefix(s, ".") || strings.HasPrefix(s, "'") {
+		s = `\&` + s
+	}
+	return s
+}
+
+// writeManFlags writes the flags as the paragraphs of a man page section.
+func writeManFlags(w io.Writer, flags []cliFlag) {
+	for _, f := range flags {
+		fmt.Fprintln(w, ".TP")
+		if f.isBool {
+			fmt.Fprintf(w, ".B \\-%s\n", roffEscape(f.name))
+		} else {
+			arg := f.arg
+			if arg == "" {
+				arg = "value"
+			}
+			fmt.Fprintf(w, ".BI \\-%s \" %s\"\n", roffEscape(f.name), roffEscape(arg))
+		}
+		usage := f.usage
+		if f.def != "" {
+			usage += fmt.Sprintf(" (default %s)", f.def)
+		}
+		fmt.Fprintln(w, roffEscape(usage))
+	}
+}
+
+func runMan(args []string) {
+	if len(args) != 0 {
+		log.Fatalf("Usage: pastecat man")
+	}
+	w := bufio.NewWriter(os.Stdout)
+	fmt.Fprint(w, `.TH PASTECAT 1
+.SH NAME
+pastecat \- simple and self\-hosted pastebin service
+.SH SYNOPSIS
+.B pastecat
+.RI [ flags ]
+`)
+	for _, cmd := range subcommands {
+		fmt.Fprintf(w, ".br\n.B pastecat %s\n", cmd.name)
+		if cmd.args != "" {
+			fmt.Fprintln(w, roffEscape(cmd.args))
+		}
+	}
+	fmt.Fprint(w, `.SH DESCRIPTION
+.B pastecat
+serves pastes uploaded via HTTP, keeping them in one of a variety of
+storage backends and removing them after a certain period of time.
+Pastes are uploaded with a form field, like:
+.PP
+.nf
+.RS
+$ echo foo | curl \-F "paste=<\-" http://my.site
+.RE
+.fi
+.SH OPTIONS
+`)
+	writeManFlags(w, cliFlags(flag.CommandLine))
+	fmt.Fprintln(w, ".SH COMMANDS")
+	for _, cmd := range subcommands {
+		fmt.Fprintf(w, ".SS %s\n%s\n", cmd.name, roffEscape(cmd.usage))
+		// Those taking the server's flags have them listed above
+		if cmd.flags != nil && cmd.flags() != flag.CommandLine {
+			fmt.Fprintln(w, ".RS")
+			writeManFlags(w, cliFlags(cmd.flags()))
+			fmt.Fprintln(w, ".RE")
+		}
+	}
+	fmt.Fprint(w, `.SH SEE ALSO
+https://github.com/mvdan/pastecat
+`)
+	if err := w.Flush(); err != nil {
+		log.Fatalf("Could not write the man page: %v", err)
+	}
+}
@@ -0,0 +1,514 @@
+// Copyright (c) 2014-2015, Daniel Martí <mvdan@mvdan.cc>
+// See LICENSE for licensing information
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/raft"
+	raftboltdb "github.com/hashicorp/raft-boltdb/v2"
+
+	"github.com/mvdan/pastecat/storage"
+)
+
+// Operations on pastes replicated among the nodes of a cluster
+const (
+	opPut    = "put"
+	opUpdate = "update"
+	opDelete = "delete"
+)
+
+// How many random ids to try for a new paste in a cluster
+const clusterIDTries = 10
+
+const (
+	// How long to wait for a change to be applied
+	clusterApplyTimeout = 10 * time.Second
+	// How long the nodes wait for each other's messages
+	clusterIOTimeout = 10 * time.Second
+	// How many connections to keep open to each node
+	clusterMaxPool = 3
+	// How many snapshots to keep
+	clusterSnapshots = 2
+	// Prefix of the snapshots being taken, before they are persisted
+	clusterPendingPrefix = "pending-snapshot-"
+)
+
+var (
+	errClusterUnavailable = errors.New("the cluster is unavailable")
+	errNoLeader           = errors.New("no leader is known")
+	errIDTaken            = errors.New("paste id already taken")
+	errEditConflict       = errors.New("the paste was edited since")
+)
+
+// clusterErrors are the errors that applying a command may return
+var clusterErrors = []error{
+	storage.ErrPasteNotFound,
+	storage.ErrReachedMaxNumber,
+	storage.ErrReachedMaxStorage,
+	storage.ErrDiskFull,
+	errIDTaken,
+	errEditConflict,
+}
+
+// clusterCommand is a change to the pastes, applied by every node in the
+// same order
+type clusterCommand struct {
+	Op   string       `json:"op"`
+	ID   string       `json:"id"`
+	Meta storage.Meta `json:"meta,omitempty"`
+	// ModTime is when a new paste was uploaded
+	ModTime time.Time `json:"mod_time,omitempty"`
+	Content []byte    `json:"content,omitempty"`
+}
+
+// snapshotPaste is each of the pastes held in a snapshot
+type snapshotPaste struct {
+	ID string `json:"id"`
+	syncedPaste
+}
+
+// clusterReply is what the leader replies with to a forwarded command
+type clusterReply struct {
+	// Index is where the command is in the log, once applied
+	Index uint64 `json:"index,omitempty"`
+	Error string `json:"error,omitempty"`
+}
+
+// cluster replicates the changes to pastes among a fixed set of nodes via
+// Raft, so that each node holds all pastes and any of them can take
+// uploads. Expiries happen on each node at the same time, as pastes are
+// copied along with their modification time. Implements raft.FSM.
+type cluster struct {
+	h      *httpHandler
+	dir    string
+	secret string
+	raft   *raft.Raft
+	layer  *clusterLayer
+	// client forwards commands to the leader
+	client *http.Client
+}
+
+// newCluster starts the node at self, bootstrapping the cluster with the
+// peers if its log in dir is empty. The log is kept in a Bolt database,
+// along with the snapshots.
+func newCluster(h *httpHandler, self string, peers []string, dir, secret string) (*cluster, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	// Left behind if stopped while taking them
+	pending, _ := filepath.Glob(filepath.Join(dir, clusterPendingPrefix+"*"))
+	for _, name := range pending {
+		os.Remove(name)
+	}
+	c := &cluster{
+		h:      h,
+		dir:    dir,
+		secret: secret,
+		layer:  newClusterLayer(self, secret),
+		client: &http.Client{Timeout: clusterApplyTimeout + clusterIOTimeout},
+	}
+	logger := hclog.New(&hclog.LoggerOptions{
+		Name:   "raft",
+		Level:  hclog.Warn,
+		Output: log.Writer(),
+	})
+	conf := raft.DefaultConfig()
+	conf.LocalID = raft.ServerID(self)
+	conf.Logger = logger
+	// Sooner than by default, as the log holds whole pastes
+	conf.SnapshotThreshold = 1024
+	conf.TrailingLogs = 128
+
+	store, err := raftboltdb.NewBoltStore(filepath.Join(dir, "raft.db"))
+	if err != nil {
+		return nil, err
+	}
+	snaps, err := raft.NewFileSnapshotStoreWithLogger(dir, clusterSnapshots, logger)
+	if err != nil {
+		store.Close()
+		return nil, err
+	}
+	trans := raft.NewNetworkTransportWithConfig(&raft.NetworkTransportConfig{
+		Stream:  c.layer,
+		MaxPool: clusterMaxPool,
+		Timeout: clusterIOTimeout,
+		Logger:  logger,
+	})
+	fail := func(err error) (*cluster, error) {
+		trans.Close()
+		store.Close()
+		return nil, err
+	}
+	exists, err := raft.HasExistingState(store, store, snaps)
+	if err != nil {
+		return fail(err)
+	}
+	if !exists {
+		var servers []raft.Server
+		for _, node := range append([]string{self}, peers...) {
+			servers = append(servers, raft.Server{
+				ID:      raft.ServerID(node),
+				Address: raft.ServerAddress(node),
+			})
+		}
+		err := raft.BootstrapCluster(conf, store, store, snaps, trans, raft.Configuration{Servers: servers})
+		if err != nil {
+			return fail(err)
+		}
+	}
+	if c.raft, err = raft.NewRaft(conf, c, store, store, snaps, trans); err != nil {
+		return fail(err)
+	}
+	return c, nil
+}
+
+// knownError returns the error of the cluster with the same message, if
+// any.
+func knownError(msg string) error {
+	for _, err := range clusterErrors {
+		if err.Error() == msg {
+			return err
+		}
+	}
+	return nil
+}
+
+// applyLeader applies an encoded command if this node is the leader,
+// returning its index in the log and the error that applying it gave.
+func (c *cluster) applyLeader(b []byte) (uint64, error) {
+	f := c.raft.Apply(b, clusterApplyTimeout)
+	if err := f.Error(); err != nil {
+		return 0, err
+	}
+	err, _ := f.Response().(error)
+	return f.Index(), err
+}
+
+// apply applies an encoded command via the leader, returning the error
+// that applying it gave once this node has applied it too, so that what
+// was changed can be read from it right away.
+func (c *cluster) apply(b []byte) error {
+	if c.raft.State() == raft.Leader {
+		_, err := c.applyLeader(b)
+		return err
+	}
+	leader, _ := c.raft.LeaderWithID()
+	if leader == "" {
+		return errNoLeader
+	}
+	req, err := http.NewRequest("POST", strings.TrimSuffix(string(leader), "/")+clusterProposePath, bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+c.secret)
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s: %s", req.URL, resp.Status)
+	}
+	var reply clusterReply
+	if err := json.NewDecoder(resp.Body).Decode(&reply); err != nil {
+		return err
+	}
+	if reply.Error == "" {
+		c.waitApplied(reply.Index)
+		return nil
+	}
+	if err := knownError(reply.Error); err != nil {
+		return err
+	}
+	return errors.New(reply.Error)
+}
+
+// waitApplied waits for this node to apply the log up to index. The
+// change was made either way, so it only gives up after a while.
+func (c *cluster) waitApplied(index uint64) {
+	deadline := time.Now().Add(clusterApplyTimeout)
+	for c.raft.AppliedIndex() < index && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// propose applies a command on all nodes, returning once the leader has
+// applied it.
+func (c *cluster) propose(cmd clusterCommand) error {
+	b, err := json.Marshal(cmd)
+	if err != nil {
+		return err
+	}
+	err = c.apply(b)
+	if err == nil {
+		return nil
+	}
+	if knownError(err.Error()) == err {
+		return err
+	}
+	log.Printf("Could not replicate a %s of %s: %v", cmd.Op, cmd.ID, err)
+	return errClusterUnavailable
+}
+
+// ServeHTTP serves the other nodes, which connect to the transport or
+// forward commands to the leader.
+func (c *cluster) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !secretsEqual(bearerToken(r), c.secret) {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	switch r.URL.Path {
+	case clusterPrefix:
+		c.layer.accept(w, r)
+	case clusterProposePath:
+		if r.Method != "POST" {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		b, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		var reply clusterReply
+		if reply.Index, err = c.applyLeader(b); err != nil {
+			reply.Error = err.Error()
+		}
+		writeJSON(w, reply)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// put stores a new paste under a random id, which each node checks to be
+// unused.
+func (c *cluster) put(content []byte, meta storage.Meta) (storage.ID, error) {
+	modTime := time.Now()
+	for try := 0; try < clusterIDTries; try++ {
+		var id storage.ID
+		if _, err := rand.Read(id[:]); err != nil {
+			return id, err
+		}
+		err := c.propose(clusterCommand{
+			Op:      opPut,
+			ID:      id.String(),
+			Meta:    meta,
+			ModTime: modTime,
+			Content: content,
+		})
+		if err != errIDTaken {
+			return id, err
+		}
+	}
+	return storage.ID{}, storage.ErrNoUnusedIDFound
+}
+
+// lifeLeft returns how long a paste has left to live, and false if it
+// already expired.
+func lifeLeft(meta storage.Meta, modTime time.Time) (time.Duration, bool) {
+	lt := meta.EffectiveLifeTime(*lifeTime)
+	if lt == 0 {
+		return 0, true
+	}
+	left := modTime.Add(lt).Sub(time.Now())
+	return left, left > 0
+}
+
+// store copies a paste into the local store, setting up its deletion.
+// Pastes that already expired are skipped, as commands are applied again
+// after a restart.
+func (c *cluster) store(id storage.ID, p syncedPaste) error {
+	left, alive := lifeLeft(p.Meta, p.Meta.Created(p.ModTime))
+	if !alive {
+		return nil
+	}
+	if err := c.h.copyPaste(id, p); err != nil {
+		return err
+	}
+	storage.SetupPasteDeletion(c.h.store, c.h.stats, c.h.expired, id, left)
+	return nil
+}
+
+// Apply applies a command committed to the log. Commands may be applied
+// again after a restart, which has no effect.
+func (c *cluster) Apply(l *raft.Log) interface{} {
+	return c.applyCommand(l.Data)
+}
+
+func (c *cluster) applyCommand(b []byte) error {
+	var cmd clusterCommand
+	if err := json.Unmarshal(b, &cmd); err != nil {
+		return err
+	}
+	id, err := storage.IDFromString(cmd.ID)
+	if err != nil {
+		return err
+	}
+	switch cmd.Op {
+	case opPut:
+		if _, e, err := c.h.pasteSize(id); err != nil {
+			return err
+		} else if e {
+			return errIDTaken
+		}
+		return c.store(id, syncedPaste{
+			Meta:    cmd.Meta,
+			ModTime: cmd.ModTime,
+			Content: cmd.Content,
+		})
+	case opUpdate:
+		info, err := storage.Stat(c.h.store, id)
+		if err != nil {
+			return err
+		}
+		// Edits made on other nodes may not have been applied when
+		// the edit was checked
+		if len(info.Versions) != len(cmd.Meta.Versions) {
+			return errEditConflict
+		}
+		return c.h.updatePaste(id, cmd.Content, cmd.Meta)
+	case opDelete:
+		return c.h.dropPaste(id)
+	}
+	return errors.New("unknown cluster operation: " + cmd.Op)
+}
+
+// Snapshot writes all pastes to a file right away, as the store keeps
+// changing while the snapshot is persisted.
+func (c *cluster) Snapshot() (raft.FSMSnapshot, error) {
+	f, err := ioutil.TempFile(c.dir, clusterPendingPrefix)
+	if err != nil {
+		return nil, err
+	}
+	w := bufio.NewWriter(f)
+	err = c.writeSnapshot(w)
+	if err == nil {
+		err = w.Flush()
+	}
+	if err1 := f.Close(); err == nil {
+		err = err1
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return nil, err
+	}
+	return clusterSnapshot(f.Name()), nil
+}
+
+// clusterSnapshot is the file a snapshot was written to
+type clusterSnapshot string
+
+func (s clusterSnapshot) Persist(sink raft.SnapshotSink) error {
+	f, err := os.Open(string(s))
+	if err != nil {
+		sink.Cancel()
+		return err
+	}
+	defer f.Close()
+	if _, err := io.Copy(sink, f); err != nil {
+		sink.Cancel()
+		return err
+	}
+	return sink.Close()
+}
+
+func (s clusterSnapshot) Release() {
+	os.Remove(string(s))
+}
+
+// writeSnapshot writes all pastes as a stream of JSON values.
+func (c *cluster) writeSnapshot(w io.Writer) error {
+	var ids []storage.ID
+	err := c.h.store.Iterate(func(id storage.ID, info storage.Info) bool {
+		ids = append(ids, id)
+		return true
+	})
+	if err != nil {
+		return err
+	}
+	enc := json.NewEncoder(w)
+	for _, id := range ids {
+		p, err := c.h.readPaste(id)
+		if err == storage.ErrPasteNotFound {
+			// Expired since
+			continue
+		} else if err != nil {
+			return err
+		}
+		if err := enc.Encode(snapshotPaste{ID: id.String(), syncedPaste: p}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Restore makes the local store hold the pastes in a snapshot, copying
+// only those that changed.
+func (c *cluster) Restore(rc io.ReadCloser) error {
+	defer rc.Close()
+	return c.restore(rc)
+}
+
+func (c *cluster) restore(r io.Reader) error {
+	local := make(map[storage.ID]storage.Info)
+	err := c.h.store.Iterate(func(id storage.ID, info storage.Info) bool {
+		local[id] = info
+		return true
+	})
+	if err != nil {
+		return err
+	}
+	dec := json.NewDecoder(bufio.NewReader(r))
+	for {
+		var p snapshotPaste
+		if err := dec.Decode(&p); err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+		id, err := storage.IDFromString(p.ID)
+		if err != nil {
+			return err
+		}
+		if _, alive := lifeLeft(p.Meta, p.Meta.Created(p.ModTime)); !alive {
+			continue
+		}
+		if info, e := local[id]; e && info.Hash != "" && info.Hash == p.Meta.Hash &&
+			len(info.Versions) == len(p.Meta.Versions) {
+			delete(local, id)
+			continue
+		}
+		switch err := c.store(id, p.syncedPaste); err {
+		case nil:
+		case storage.ErrReachedMaxNumber, storage.ErrReachedMaxStorage, storage.ErrDiskFull:
+			// Skipped rather than retried, as it may never fit, and
+			// failing would stop the node
+			log.Printf("Could not restore %s: %v", id, err)
+		default:
+			return err
+		}
+		delete(local, id)
+	}
+	for id := range local {
+		if err := c.h.dropPaste(id); err != nil && err != storage.ErrPasteNotFound {
+			return err
+		}
+	}
+	return nil
+}
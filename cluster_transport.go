@@ -0,0 +1,170 @@
+// Copyright (c) 2014-2015, Daniel Martí <mvdan@mvdan.cc>
+// See LICENSE for licensing information
+
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/raft"
+)
+
+// Path under which the nodes of a cluster talk to each other
+const (
+	clusterPrefix      = "/raft/"
+	clusterProposePath = clusterPrefix + "propose"
+)
+
+// Protocol that the requests between nodes are upgraded to, to carry Raft
+// messages
+const clusterProtocol = "pastecat-raft"
+
+var errClusterClosed = errors.New("the cluster transport is closed")
+
+// clusterAddr is the address of a node, which is its URL
+type clusterAddr string
+
+func (a clusterAddr) Network() string { return "http" }
+func (a clusterAddr) String() string  { return string(a) }
+
+// bufferedConn is a connection whose first bytes were already read into r
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c bufferedConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+// clusterLayer carries the connections between nodes over HTTP requests
+// upgraded to clusterProtocol, so that nodes reach each other at their URL
+// on the same listener as everything else. Implements raft.StreamLayer.
+type clusterLayer struct {
+	self   string
+	secret string
+
+	conns     chan net.Conn
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func newClusterLayer(self, secret string) *clusterLayer {
+	return &clusterLayer{
+		self:   self,
+		secret: secret,
+		conns:  make(chan net.Conn),
+		done:   make(chan struct{}),
+	}
+}
+
+func (l *clusterLayer) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.done:
+		return nil, errClusterClosed
+	}
+}
+
+func (l *clusterLayer) Close() error {
+	l.closeOnce.Do(func() { close(l.done) })
+	return nil
+}
+
+func (l *clusterLayer) Addr() net.Addr {
+	return clusterAddr(l.self)
+}
+
+// Dial connects to the node at address, which is its URL.
+func (l *clusterLayer) Dial(address raft.ServerAddress, timeout time.Duration) (net.Conn, error) {
+	u, err := url.Parse(string(address))
+	if err != nil {
+		return nil, err
+	}
+	host := u.Host
+	if u.Port() == "" {
+		port := "80"
+		if u.Scheme == "https" {
+			port = "443"
+		}
+		host = net.JoinHostPort(u.Hostname(), port)
+	}
+	conn, err := net.DialTimeout("tcp", host, timeout)
+	if err != nil {
+		return nil, err
+	}
+	conn.SetDeadline(time.Now().Add(timeout))
+	if u.Scheme == "https" {
+		tc := tls.Client(conn, &tls.Config{
+			ServerName: u.Hostname(),
+			// As HTTP/2 requests cannot be upgraded
+			NextProtos: []string{"http/1.1"},
+		})
+		if err := tc.Handshake(); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		conn = tc
+	}
+	req, err := http.NewRequest("GET", strings.TrimSuffix(string(address), "/")+clusterPrefix, nil)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+l.secret)
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", clusterProtocol)
+	if err := req.Write(conn); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		conn.Close()
+		return nil, fmt.Errorf("%s: %s", req.URL, resp.Status)
+	}
+	conn.SetDeadline(time.Time{})
+	return bufferedConn{Conn: conn, r: br}, nil
+}
+
+// accept takes over the connection of a request to upgrade it, handing it
+// to the transport.
+func (l *clusterLayer) accept(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("Upgrade") != clusterProtocol {
+		http.Error(w, "upgrade required", http.StatusUpgradeRequired)
+		return
+	}
+	conn, brw, err := http.NewResponseController(w).Hijack()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	// Those of the server do not apply once taken over
+	conn.SetDeadline(time.Time{})
+	fmt.Fprintf(brw, "HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: %s\r\n\r\n", clusterProtocol)
+	if err := brw.Flush(); err != nil {
+		conn.Close()
+		return
+	}
+	select {
+	case l.conns <- bufferedConn{Conn: conn, r: brw.Reader}:
+	case <-l.done:
+		conn.Close()
+	}
+}
@@ -0,0 +1,121 @@
+// Copyright (c) 2014-2015, Daniel Martí <mvdan@mvdan.cc>
+// See LICENSE for licensing information
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Compatibility layers with other pastebin services
+const (
+	compatSprunge  = "sprunge"
+	compatIxio     = "ixio"
+	compatHastebin = "hastebin"
+	compatPastebin = "pastebin"
+	compatTransfer = "transfer"
+	compatGist     = "gist"
+)
+
+// Form field names accepted for uploads by each compatibility layer, if
+// any
+var compatFields = map[string]string{
+	compatSprunge:  "sprunge",
+	compatIxio:     "f:1",
+	compatHastebin: "",
+	compatPastebin: "",
+	compatTransfer: "file",
+	compatGist:     "",
+}
+
+// compatSet holds the enabled compatibility layers
+type compatSet map[string]bool
+
+func (c compatSet) String() string {
+	var names []string
+	for name := range c {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ",")
+}
+
+func (c compatSet) Set(value string) error {
+	for _, name := range strings.Split(value, ",") {
+		if _, e := compatFields[name]; !e {
+			return fmt.Errorf("unknown compatibility layer '%s'", name)
+		}
+		c[name] = true
+	}
+	return nil
+}
+
+// fieldNames returns the form field names to accept uploads from
+func (c compatSet) fieldNames() []string {
+	names := []string{fieldName}
+	for name := range c {
+		if field := compatFields[name]; field != "" {
+			names = append(names, field)
+		}
+	}
+	return names
+}
+
+// maxReads returns how many times the paste uploaded by the request may be
+// read, as set via ix.io's "read:1" field.
+func (c compatSet) maxReads(r *http.Request) (int, error) {
+	value := r.FormValue("read:1")
+	if !c[compatIxio] || value == "" {
+		return 0, nil
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid number of reads '%s'", value)
+	}
+	return n, nil
+}
+
+// splitPath splits a GET path into the paste id and the name of a file
+// within the paste, if any. ix.io also allows a trailing "+" after the id,
+// which we ignore.
+func (c compatSet) splitPath(path string) (hexID, file string) {
+	hexID = path[1:]
+	if i := strings.IndexByte(hexID, '/'); i >= 0 {
+		hexID, file = hexID[:i], hexID[i+1:]
+	}
+	if c[compatIxio] {
+		hexID = strings.TrimSuffix(hexID, "+")
+	}
+	return hexID, file
+}
+
+// ignoresFile reports whether a path may have anything after the paste id
+// even if the paste is not made of multiple files, like ix.io's "/lang"
+// or 0x0.st's and transfer.sh's "/filename".
+func (c compatSet) ignoresFile() bool {
+	return c[compatIxio] || c[compatTransfer]
+}
+
+// Maximum length of the file names kept for pastes
+const maxFilename = 255
+
+// filename returns the file name to keep for a paste uploaded from a file
+// with the given name, if any.
+func (c compatSet) filename(name string) string {
+	if !c[compatTransfer] {
+		return ""
+	}
+	name = path.Base(strings.Replace(name, "\\", "/", -1))
+	if name == "." || name == "/" || name == ".." {
+		return ""
+	}
+	if len(name) > maxFilename {
+		name = name[:maxFilename]
+	}
+	return name
+}
@@ -0,0 +1,177 @@
+// Copyright (c) 2014-2015, Daniel Martí <mvdan@mvdan.cc>
+// See LICENSE for licensing information
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/mvdan/pastecat/storage"
+)
+
+// gistHandler implements a subset of GitHub's Gist API. Each gist is a
+// paste made of multiple files, concatenated in order of their names.
+type gistHandler struct {
+	h *httpHandler
+}
+
+type gistFile struct {
+	Filename string `json:"filename,omitempty"`
+	Type     string `json:"type,omitempty"`
+	Size     int64  `json:"size,omitempty"`
+	RawURL   string `json:"raw_url,omitempty"`
+	Content  string `json:"content"`
+}
+
+type gist struct {
+	ID          string              `json:"id,omitempty"`
+	URL         string              `json:"url,omitempty"`
+	HTMLURL     string              `json:"html_url,omitempty"`
+	Description string              `json:"description"`
+	Public      bool                `json:"public"`
+	CreatedAt   string              `json:"created_at,omitempty"`
+	Files       map[string]gistFile `json:"files"`
+}
+
+func (gh gistHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch {
+	case r.URL.Path == "/gists" && r.Method == "POST":
+		gh.handlePost(w, r)
+	case strings.HasPrefix(r.URL.Path, "/gists/") && r.Method == "GET":
+		gh.handleGet(w, r, r.URL.Path[len("/gists/"):])
+	default:
+		http.Error(w, unknownAction, http.StatusBadRequest)
+	}
+}
+
+func validGistFilename(name string) bool {
+	return name != "" && name != "." && name != ".." &&
+		len(name) <= maxFilename && !strings.ContainsAny(name, "/\\")
+}
+
+func (gh gistHandler) handlePost(w http.ResponseWriter, r *http.Request) {
+	meta, ok := gh.h.uploadMeta(w, r)
+	if !ok {
+		return
+	}
+	limit := gh.h.sizeLimit(r, apiMaxSize)
+	r.Body = http.MaxBytesReader(w, r.Body, limit)
+	done := timePhase(r, "read body")
+	var g gist
+	err := json.NewDecoder(r.Body).Decode(&g)
+	done()
+	if isTooLarge(err) {
+		replyTooLarge(w, r, limit)
+		return
+	}
+	if err != nil {
+		http.Error(w, fmt.Sprintf("invalid gist: %v", err), http.StatusBadRequest)
+		return
+	}
+	var names []string
+	for name := range g.Files {
+		if !validGistFilename(name) {
+			http.Error(w, fmt.Sprintf("invalid file name '%s'", name), http.StatusBadRequest)
+			return
+		}
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var content []byte
+	for _, name := range names {
+		data := g.Files[name].Content
+		meta.Files = append(meta.Files, storage.File{
+			Name: name,
+			Size: int64(len(data)),
+		})
+		content = append(content, data...)
+	}
+	if len(content) == 0 {
+		http.Error(w, "no paste provided", http.StatusBadRequest)
+		return
+	}
+	meta.Title = g.Description
+	// Secret gists are never listed, and public ones only if the listing
+	// is enabled
+	meta.Listed = g.Public && *recentCount > 0
+	id, ok := gh.h.newPaste(w, r, content, meta)
+	if !ok {
+		return
+	}
+	created, err := newGist(id, meta, time.Now(), strings.NewReader(string(content)))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	writeJSON(w, created)
+}
+
+func (gh gistHandler) handleGet(w http.ResponseWriter, r *http.Request, hexID string) {
+	id, err := storage.IDFromString(hexID)
+	if err != nil {
+		http.Error(w, invalidID, http.StatusBadRequest)
+		return
+	}
+	paste, ok := gh.h.getPaste(w, r, id)
+	if !ok {
+		return
+	}
+	defer gh.h.donePaste(id, paste)
+	g, err := newGist(id, paste.Meta(), paste.Meta().Created(paste.ModTime()), paste)
+	if err == nil && len(paste.Meta().Files) == 0 {
+		// Not uploaded as a gist, so present it as a single file
+		var data []byte
+		if data, err = ioutil.ReadAll(paste); err == nil {
+			g.Files[id.String()] = gistFile{
+				Filename: id.String(),
+				Type:     "text/plain",
+				Size:     paste.Size(),
+				RawURL:   pasteURL(id, paste.Meta()),
+				Content:  string(data),
+			}
+		}
+	}
+	if err != nil {
+		replyStoreError(w, r, err)
+		return
+	}
+	writeJSON(w, g)
+}
+
+// newGist builds the gist of a paste, reading the contents of its files in
+// order from content.
+func newGist(id storage.ID, meta storage.Meta, created time.Time, content io.Reader) (gist, error) {
+	g := gist{
+		ID:          id.String(),
+		URL:         fmt.Sprintf("%s/gists/%s", *siteURL, id),
+		HTMLURL:     pasteURL(id, meta),
+		Description: meta.Title,
+		Public:      meta.Listed,
+		CreatedAt:   created.UTC().Format(time.RFC3339),
+		Files:       make(map[string]gistFile, len(meta.Files)),
+	}
+	for _, f := range meta.Files {
+		data, err := ioutil.ReadAll(io.LimitReader(content, f.Size))
+		if err != nil {
+			return g, err
+		}
+		g.Files[f.Name] = gistFile{
+			Filename: f.Name,
+			Type:     "text/plain",
+			Size:     f.Size,
+			RawURL:   fmt.Sprintf("%s/%s/%s", *siteURL, id, url.PathEscape(f.Name)),
+			Content:  string(data),
+		}
+	}
+	return g, nil
+}
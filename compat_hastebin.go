@@ -0,0 +1,85 @@
+// Copyright (c) 2014-2015, Daniel Martí <mvdan@mvdan.cc>
+// See LICENSE for licensing information
+
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"github.com/mvdan/pastecat/storage"
+)
+
+// hastebinHandler implements hastebin's API, where pastes are uploaded as
+// the raw body of a POST to /documents and keys are paste ids.
+type hastebinHandler struct {
+	h *httpHandler
+}
+
+func (hb hastebinHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch {
+	case r.URL.Path == "/documents" && r.Method == "POST":
+		hb.handlePost(w, r)
+	case strings.HasPrefix(r.URL.Path, "/documents/") && r.Method == "GET":
+		hb.handleGet(w, r, r.URL.Path[len("/documents/"):], false)
+	case strings.HasPrefix(r.URL.Path, "/raw/") && r.Method == "GET":
+		hb.handleGet(w, r, r.URL.Path[len("/raw/"):], true)
+	default:
+		http.Error(w, unknownAction, http.StatusBadRequest)
+	}
+}
+
+func (hb hastebinHandler) handlePost(w http.ResponseWriter, r *http.Request) {
+	meta, ok := hb.h.uploadMeta(w, r)
+	if !ok {
+		return
+	}
+	limit := hb.h.sizeLimit(r, apiMaxSize)
+	r.Body = http.MaxBytesReader(w, r.Body, limit)
+	done := timePhase(r, "read body")
+	content, err := ioutil.ReadAll(r.Body)
+	done()
+	if isTooLarge(err) {
+		replyTooLarge(w, r, limit)
+		return
+	}
+	if err != nil || len(content) == 0 {
+		http.Error(w, "no paste provided", http.StatusBadRequest)
+		return
+	}
+	id, ok := hb.h.newPaste(w, r, content, meta)
+	if !ok {
+		return
+	}
+	writeJSON(w, struct {
+		Key string `json:"key"`
+	}{id.String()})
+}
+
+func (hb hastebinHandler) handleGet(w http.ResponseWriter, r *http.Request, key string, raw bool) {
+	id, err := storage.IDFromString(key)
+	if err != nil {
+		http.Error(w, invalidID, http.StatusBadRequest)
+		return
+	}
+	paste, ok := hb.h.getPaste(w, r, id)
+	if !ok {
+		return
+	}
+	defer hb.h.donePaste(id, paste)
+	if raw {
+		setHeaders(w.Header(), id, paste)
+		http.ServeContent(w, r, "", paste.ModTime(), paste)
+		return
+	}
+	data, err := ioutil.ReadAll(paste)
+	if err != nil {
+		replyStoreError(w, r, err)
+		return
+	}
+	writeJSON(w, struct {
+		Key  string `json:"key"`
+		Data string `json:"data"`
+	}{id.String(), string(data)})
+}
@@ -0,0 +1,97 @@
+// Copyright (c) 2014-2015, Daniel Martí <mvdan@mvdan.cc>
+// See LICENSE for licensing information
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// Lifetimes of pastebin.com's api_paste_expire_date values. Never ("N")
+// means the lifetime of all pastes.
+var pastebinExpiry = map[string]time.Duration{
+	"N":   0,
+	"10M": 10 * time.Minute,
+	"1H":  time.Hour,
+	"1D":  24 * time.Hour,
+	"1W":  7 * 24 * time.Hour,
+	"2W":  14 * 24 * time.Hour,
+	"1M":  30 * 24 * time.Hour,
+	"6M":  180 * 24 * time.Hour,
+	"1Y":  365 * 24 * time.Hour,
+}
+
+// Values of pastebin.com's api_paste_private, by whether they ask for the
+// paste to be listed publicly. Unlisted and private pastes are never listed.
+var pastebinListed = map[string]bool{
+	"0": true,
+	"1": false,
+	"2": false,
+}
+
+// pastebinHandler emulates pastebin.com's api_post.php for creating
+// pastes. Public pastes are only listed if the listing is enabled, and
+// api_dev_key is ignored.
+type pastebinHandler struct {
+	h *httpHandler
+}
+
+func pastebinError(w http.ResponseWriter, msg string) {
+	http.Error(w, "Bad API request, "+msg, http.StatusBadRequest)
+}
+
+func (pb pastebinHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		pastebinError(w, "use POST request, not GET")
+		return
+	}
+	meta, ok := pb.h.uploadMeta(w, r)
+	if !ok {
+		return
+	}
+	limit := pb.h.sizeLimit(r, apiMaxSize)
+	r.Body = http.MaxBytesReader(w, r.Body, limit)
+	done := timePhase(r, "read body")
+	err := r.ParseForm()
+	done()
+	if isTooLarge(err) {
+		replyTooLarge(w, r, limit)
+		return
+	}
+	if err != nil {
+		pastebinError(w, err.Error())
+		return
+	}
+	if option := r.PostFormValue("api_option"); option != "paste" {
+		pastebinError(w, "invalid api_option")
+		return
+	}
+	content := r.PostFormValue("api_paste_code")
+	if content == "" {
+		pastebinError(w, "api_paste_code was empty")
+		return
+	}
+	if expire := r.PostFormValue("api_paste_expire_date"); expire != "" {
+		lt, e := pastebinExpiry[expire]
+		if !e || (perPasteLifeTimes() && lt > 0 && checkLifeTime(lt) != nil) {
+			pastebinError(w, "invalid api_paste_expire_date")
+			return
+		}
+		meta.LifeTime = lt
+	}
+	if private := r.PostFormValue("api_paste_private"); private != "" {
+		listed, e := pastebinListed[private]
+		if !e {
+			pastebinError(w, "invalid api_paste_private")
+			return
+		}
+		meta.Listed = listed && *recentCount > 0
+	}
+	id, ok := pb.h.newPaste(w, r, []byte(content), meta)
+	if !ok {
+		return
+	}
+	fmt.Fprint(w, pasteURL(id, meta))
+}
@@ -0,0 +1,41 @@
+// Copyright (c) 2014-2015, Daniel Martí <mvdan@mvdan.cc>
+// See LICENSE for licensing information
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+)
+
+// handlePut takes uploads like transfer.sh's "curl -T file http://host/name",
+// where the body is the paste and the path its file name.
+func (h *httpHandler) handlePut(w http.ResponseWriter, r *http.Request) {
+	meta, ok := h.uploadMeta(w, r)
+	if !ok {
+		return
+	}
+	if meta.Filename = compat.filename(r.URL.Path); meta.Filename == "" {
+		http.Error(w, "no file name provided", http.StatusBadRequest)
+		return
+	}
+	limit := h.sizeLimit(r, apiMaxSize)
+	r.Body = http.MaxBytesReader(w, r.Body, limit)
+	done := timePhase(r, "read body")
+	content, err := ioutil.ReadAll(r.Body)
+	done()
+	if isTooLarge(err) {
+		replyTooLarge(w, r, limit)
+		return
+	}
+	if err != nil || len(content) == 0 {
+		http.Error(w, "no paste provided", http.StatusBadRequest)
+		return
+	}
+	id, ok := h.newPaste(w, r, content, meta)
+	if !ok {
+		return
+	}
+	fmt.Fprintln(w, pasteURL(id, meta))
+}
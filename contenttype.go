@@ -0,0 +1,52 @@
+// Copyright (c) 2014-2015, Daniel Martí <mvdan@mvdan.cc>
+// See LICENSE for licensing information
+
+package main
+
+import (
+	"fmt"
+	"mime"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// Name of the HTTP form field giving the Content-Type to serve a paste with
+const contentTypeField = "content_type"
+
+// Content-Types that pastes may be served with instead of text/plain. Types
+// that browsers would render, like HTML, SVG or XML, which may hold XHTML,
+// must never be allowed.
+var pasteTypes = map[string]bool{
+	"application/json": true,
+	"application/yaml": true,
+	"text/csv":         true,
+	"text/markdown":    true,
+}
+
+// pasteTypeNames returns the Content-Types in pasteTypes, sorted.
+func pasteTypeNames() []string {
+	var names []string
+	for name := range pasteTypes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// formContentType returns the Content-Type that an upload asked to be
+// served with, if any, which must be one of pasteTypes.
+func formContentType(r *http.Request) (string, error) {
+	value := strings.TrimSpace(r.FormValue(contentTypeField))
+	if value == "" {
+		return "", nil
+	}
+	// Parameters like the charset are dropped, as the content is served
+	// as stored
+	mediaType, _, err := mime.ParseMediaType(value)
+	if err != nil || !pasteTypes[mediaType] {
+		return "", fmt.Errorf("invalid %s value '%s', want one of %s",
+			contentTypeField, value, strings.Join(pasteTypeNames(), ", "))
+	}
+	return mediaType, nil
+}
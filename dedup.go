@@ -0,0 +1,125 @@
+// Copyright (c) 2014-2015, Daniel Martí <mvdan@mvdan.cc>
+// See LICENSE for licensing information
+
+package main
+
+import (
+	"expvar"
+	"net/http"
+	"reflect"
+	"sync"
+	"time"
+
+	"github.com/mvdan/pastecat/storage"
+)
+
+// Uploads answered with an existing paste holding the same content
+var dedupCount = expvar.NewInt("dedup_uploads")
+
+// dupIndex finds the pastes holding some content by its hash, so that
+// uploading it again can be answered with an existing paste
+type dupIndex struct {
+	mu  sync.Mutex
+	ids map[string][]storage.ID
+}
+
+// newDupIndex indexes the pastes in a store whose hash is known.
+func newDupIndex(s storage.Store) (*dupIndex, error) {
+	d := &dupIndex{ids: make(map[string][]storage.ID)}
+	err := s.Iterate(func(id storage.ID, info storage.Info) bool {
+		if info.Hash != "" {
+			d.ids[info.Hash] = append(d.ids[info.Hash], id)
+		}
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+func (d *dupIndex) add(hash string, id storage.ID) {
+	if d == nil || hash == "" {
+		return
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.ids[hash] = append(d.ids[hash], id)
+}
+
+func (d *dupIndex) remove(hash string, id storage.ID) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	ids := d.ids[hash]
+	for i, other := range ids {
+		if other == id {
+			ids = append(ids[:i:i], ids[i+1:]...)
+			break
+		}
+	}
+	if len(ids) == 0 {
+		delete(d.ids, hash)
+	} else {
+		d.ids[hash] = ids
+	}
+}
+
+// find returns an existing paste that can be given to the uploader of a
+// new one, as it holds the same content. Pastes that were deleted or edited
+// since they were indexed are forgotten along the way.
+func (d *dupIndex) find(s storage.Store, meta storage.Meta) (storage.ID, storage.Info, bool) {
+	if d == nil || meta.Hash == "" {
+		return storage.ID{}, storage.Info{}, false
+	}
+	d.mu.Lock()
+	ids := append([]storage.ID(nil), d.ids[meta.Hash]...)
+	d.mu.Unlock()
+	for _, id := range ids {
+		info, err := storage.Stat(s, id)
+		if err == storage.ErrPasteNotFound || (err == nil && info.Hash != meta.Hash) {
+			d.remove(meta.Hash, id)
+			continue
+		}
+		if err == nil && reusable(info, meta) {
+			return id, info, true
+		}
+	}
+	return storage.ID{}, storage.Info{}, false
+}
+
+// reusable reports whether an existing paste can stand in for a new one
+// with the same content, meaning that the new one would look the same and
+// that the existing one will live for at least half as long as the new one
+// would. Otherwise, pastes with a lifetime could never stand in for others.
+func reusable(info storage.Info, meta storage.Meta) bool {
+	old := info.Meta
+	if old.MaxReads > 0 || meta.MaxReads > 0 {
+		return false
+	}
+	if old.Owner != meta.Owner || old.Token != meta.Token ||
+		old.Filename != meta.Filename || old.Title != meta.Title ||
+		old.ContentType != meta.ContentType ||
+		old.Listed != meta.Listed || old.Encrypted != meta.Encrypted ||
+		old.Binary != meta.Binary || !reflect.DeepEqual(old.Files, meta.Files) {
+		return false
+	}
+	oldLife := old.EffectiveLifeTime(*lifeTime)
+	if oldLife == 0 {
+		return true
+	}
+	newLife := meta.EffectiveLifeTime(*lifeTime)
+	if newLife == 0 {
+		return false
+	}
+	return !old.Created(info.ModTime).Add(oldLife).Before(time.Now().Add(newLife / 2))
+}
+
+// setDupHeaders is like setUploadHeaders, but for an existing paste given
+// to an uploader, who gets neither its delete nor its edit url.
+func setDupHeaders(header http.Header, id storage.ID, info storage.Info) {
+	header.Set("Location", pasteURL(id, info.Meta))
+	header.Add("X-Paste-Id", id.String())
+	if lifeTime := info.EffectiveLifeTime(*lifeTime); lifeTime > 0 {
+		header.Add("X-Expires", info.Created(info.ModTime).Add(lifeTime).UTC().Format(http.TimeFormat))
+	}
+}
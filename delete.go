@@ -0,0 +1,96 @@
+// Copyright (c) 2014-2015, Daniel Martí <mvdan@mvdan.cc>
+// See LICENSE for licensing information
+
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/mvdan/pastecat/storage"
+)
+
+// Query parameter holding the secret allowing the uploader to delete a
+// paste
+const deleteParam = "delete"
+
+// newPasteToken returns a new secret token for the uploader of a paste
+func newPasteToken() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// hashPasteToken returns the hash of a paste token, which is what is
+// stored along with the paste.
+func hashPasteToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// checkPasteToken reports whether token is the secret whose hash was stored
+// along with a paste, in constant time. Pastes without a hash accept none.
+func checkPasteToken(hash, token string) bool {
+	if hash == "" || token == "" {
+		return false
+	}
+	return secretsEqual(hash, hashPasteToken(token))
+}
+
+func deleteURL(id storage.ID, token string) string {
+	return fmt.Sprintf("%s/%s?%s=%s", *siteURL, id, deleteParam, url.QueryEscape(token))
+}
+
+// setUploadHeaders sets the headers describing a new paste, so that clients
+// don't need to parse the body.
+func setUploadHeaders(header http.Header, id storage.ID, meta storage.Meta, deleteToken, writeToken string) {
+	header.Set("Location", pasteURL(id, meta))
+	// Added rather than set, as one request may upload many pastes
+	header.Add("X-Paste-Id", id.String())
+	if lifeTime := meta.EffectiveLifeTime(*lifeTime); lifeTime > 0 {
+		header.Add("X-Expires", time.Now().Add(lifeTime).UTC().Format(http.TimeFormat))
+	}
+	header.Add("X-Delete-Url", deleteURL(id, deleteToken))
+	header.Add("X-Edit-Url", editURL(id, writeToken))
+}
+
+// handleDelete deletes a paste given the delete token it was uploaded
+// with, like "DELETE /a63d03b9?delete=<token>".
+func (h *httpHandler) handleDelete(w http.ResponseWriter, r *http.Request) {
+	hexID, _ := compat.splitPath(r.URL.Path)
+	id, err := storage.IDFromString(hexID)
+	if err != nil {
+		http.Error(w, invalidID, http.StatusBadRequest)
+		return
+	}
+	// Stat, as checking the token should not count as a view
+	sp, done := h.storeSpan(r, "Stat"), timePhase(r, "store")
+	info, err := storage.Stat(h.store, id)
+	sp.endWith(err)
+	done()
+	if err != nil {
+		h.storeError(w, r, err)
+		return
+	}
+	token := r.FormValue(deleteParam)
+	if !checkPasteToken(info.DeleteHash, token) {
+		http.Error(w, "invalid delete token", http.StatusForbidden)
+		return
+	}
+	sp, done = h.storeSpan(r, "Delete"), timePhase(r, "store")
+	err = h.deletePaste(id, reasonDeleteToken, clientActor(r))
+	sp.endWith(err)
+	done()
+	if err != nil {
+		h.storeError(w, r, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
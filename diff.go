@@ -0,0 +1,167 @@
+// Copyright (c) 2014-2015, Daniel Martí <mvdan@mvdan.cc>
+// See LICENSE for licensing information
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"html/template"
+	"io"
+	"strings"
+)
+
+// Styles of the lines of a unified diff
+const (
+	diffHeaderStyle = "font-weight:bold"
+	diffHunkStyle   = "color:#6f42c1;background-color:#f1f8ff"
+	diffAddStyle    = "background-color:#e6ffed"
+	diffDelStyle    = "background-color:#ffeef0"
+)
+
+// diffLines splits content into lines, keeping their line endings
+func diffLines(content []byte) [][]byte {
+	var lines [][]byte
+	for len(content) > 0 {
+		i := bytes.IndexByte(content, '\n') + 1
+		if i == 0 {
+			i = len(content)
+		}
+		lines = append(lines, content[:i])
+		content = content[i:]
+	}
+	return lines
+}
+
+// startsDiffFile reports whether the i-th line starts the diff of a file,
+// either via a "diff" command line or via a pair of "---" and "+++" lines
+// not preceded by one.
+func startsDiffFile(lines [][]byte, i int, inHeader bool) bool {
+	if bytes.HasPrefix(lines[i], []byte("diff ")) {
+		return true
+	}
+	return !inHeader && bytes.HasPrefix(lines[i], []byte("--- ")) &&
+		i+1 < len(lines) && bytes.HasPrefix(lines[i+1], []byte("+++ "))
+}
+
+// isUnifiedDiff reports whether content looks like a unified diff, going
+// by its start.
+func isUnifiedDiff(content []byte) bool {
+	if len(content) > sniffLen {
+		content = content[:sniffLen]
+	}
+	lines := diffLines(content)
+	for i := range lines {
+		if startsDiffFile(lines, i, false) {
+			for _, line := range lines[i:] {
+				if bytes.HasPrefix(line, []byte("@@ -")) {
+					return true
+				}
+			}
+			return false
+		}
+	}
+	return false
+}
+
+// diffFileName returns the name of the file changed by a diff, given the
+// lines of its header.
+func diffFileName(header [][]byte) string {
+	var name string
+	for _, line := range header {
+		s := strings.TrimRight(string(line), "\r\n")
+		var path string
+		switch {
+		case strings.HasPrefix(s, "+++ "):
+			path = s[4:]
+		case strings.HasPrefix(s, "--- ") && name == "":
+			path = s[4:]
+		case strings.HasPrefix(s, "diff --git ") && name == "":
+			if i := strings.LastIndex(s, " b/"); i >= 0 {
+				path = s[i+1:]
+			}
+		default:
+			continue
+		}
+		if i := strings.IndexByte(path, '\t'); i >= 0 {
+			path = path[:i]
+		}
+		if path == "/dev/null" {
+			continue
+		}
+		if strings.HasPrefix(path, "a/") || strings.HasPrefix(path, "b/") {
+			path = path[2:]
+		}
+		name = path
+	}
+	return name
+}
+
+func writeDiffLine(w io.Writer, line []byte, style string) {
+	if style == "" {
+		template.HTMLEscape(w, line)
+		return
+	}
+	fmt.Fprintf(w, `<span style="%s">`, style)
+	template.HTMLEscape(w, line)
+	io.WriteString(w, "</span>")
+}
+
+// renderDiff renders a unified diff as HTML, coloring added and removed
+// lines and putting the diff of each file in a collapsible section.
+// Anything before the first file, like the headers of an email, is kept
+// as is.
+func renderDiff(content []byte) template.HTML {
+	var buf bytes.Buffer
+	lines := diffLines(content)
+	i := 0
+	for i < len(lines) && !startsDiffFile(lines, i, false) {
+		i++
+	}
+	if i > 0 {
+		buf.WriteString(`<pre style="white-space:pre-wrap">`)
+		for _, line := range lines[:i] {
+			template.HTMLEscape(&buf, line)
+		}
+		buf.WriteString("</pre>\n")
+	}
+	for i < len(lines) {
+		start := i
+		inHeader := true
+		i++
+		for i < len(lines) && !startsDiffFile(lines, i, inHeader) {
+			if bytes.HasPrefix(lines[i], []byte("@@")) {
+				inHeader = false
+			}
+			i++
+		}
+		file := lines[start:i]
+		hunks := len(file)
+		for j, line := range file {
+			if bytes.HasPrefix(line, []byte("@@")) {
+				hunks = j
+				break
+			}
+		}
+		buf.WriteString("<details open>\n<summary><code>")
+		template.HTMLEscape(&buf, []byte(diffFileName(file[:hunks])))
+		buf.WriteString(`</code></summary>`)
+		buf.WriteString(`<pre style="white-space:pre-wrap">`)
+		for j, line := range file {
+			style := ""
+			switch {
+			case j < hunks:
+				style = diffHeaderStyle
+			case line[0] == '@':
+				style = diffHunkStyle
+			case line[0] == '+':
+				style = diffAddStyle
+			case line[0] == '-':
+				style = diffDelStyle
+			}
+			writeDiffLine(&buf, line, style)
+		}
+		buf.WriteString("</pre>\n</details>\n")
+	}
+	return template.HTML(buf.String())
+}
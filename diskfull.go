@@ -0,0 +1,86 @@
+// Copyright (c) 2014-2015, Daniel Martí <mvdan@mvdan.cc>
+// See LICENSE for licensing information
+
+package main
+
+import (
+	"expvar"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/mvdan/pastecat/storage"
+)
+
+// How long uploads and edits are refused for once the disk is full, before
+// trying to store them again
+const diskFullPause = 1 * time.Minute
+
+// How many times the disk was found to be full
+var diskFullCount = expvar.NewInt("disk_full")
+
+// diskGuard makes the server read-only for a while once the disk is full,
+// rather than failing every upload and edit in turn. Deleting pastes is
+// still allowed, as it frees space.
+type diskGuard struct {
+	mu    sync.Mutex
+	until time.Time
+}
+
+func newDiskGuard() *diskGuard {
+	g := &diskGuard{}
+	expvar.Publish("read_only", expvar.Func(func() interface{} {
+		return g.retryAfter() > 0
+	}))
+	return g
+}
+
+// full records that the disk is full.
+func (g *diskGuard) full() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	now := time.Now()
+	if now.Before(g.until) {
+		return
+	}
+	g.until = now.Add(diskFullPause)
+	diskFullCount.Add(1)
+	log.Printf("The disk is full, refusing uploads and edits for %s", diskFullPause)
+}
+
+// retryAfter returns how long uploads and edits are refused for, if they
+// are.
+func (g *diskGuard) retryAfter() time.Duration {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.until.Sub(time.Now())
+}
+
+// refuse replies that the disk is full, and when to try again.
+func (g *diskGuard) refuse(w http.ResponseWriter) {
+	wait := g.retryAfter()
+	if wait <= 0 {
+		wait = diskFullPause
+	}
+	w.Header().Set("Retry-After", fmt.Sprintf("%.f", math.Ceil(wait.Seconds())))
+	http.Error(w, storage.ErrDiskFull.Error(), http.StatusInsufficientStorage)
+}
+
+// guard refuses the requests that would store more data while the disk is
+// full.
+func (g *diskGuard) guard(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case "GET", "HEAD", "OPTIONS", "DELETE":
+		default:
+			if g.retryAfter() > 0 {
+				g.refuse(w)
+				return
+			}
+		}
+		h.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,311 @@
+// Copyright (c) 2014-2015, Daniel Martí <mvdan@mvdan.cc>
+// See LICENSE for licensing information
+
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/mvdan/pastecat/storage"
+)
+
+// Levels of the findings of the doctor
+const (
+	findingOK   = "ok"
+	findingWarn = "warn"
+	findingFail = "FAIL"
+)
+
+// finding is something the doctor checked, along with what to do about it
+// if it is not ok.
+type finding struct {
+	level, msg, hint string
+}
+
+// doctor checks that an instance would start up and serve pastes with the
+// flags and store it is given, without starting it.
+type doctor struct {
+	findings []finding
+}
+
+func (d *doctor) ok(format string, args ...interface{}) {
+	d.findings = append(d.findings, finding{level: findingOK, msg: fmt.Sprintf(format, args...)})
+}
+
+func (d *doctor) warn(hint, format string, args ...interface{}) {
+	d.findings = append(d.findings, finding{findingWarn, fmt.Sprintf(format, args...), hint})
+}
+
+func (d *doctor) fail(hint, format string, args ...interface{}) {
+	d.findings = append(d.findings, finding{findingFail, fmt.Sprintf(format, args...), hint})
+}
+
+// runDoctor takes the same flags and store arguments as the server.
+func runDoctor(args []string) {
+	flag.CommandLine.Parse(args)
+	var d doctor
+	if err := checkFlags(); err != nil {
+		d.fail("fix the flags given", "%v", err)
+	} else {
+		d.ok("the flags are valid")
+	}
+	d.checkFiles()
+	storeArgs := flag.Args()
+	if len(storeArgs) == 0 {
+		storeArgs = []string{"fs"}
+	}
+	storageType, params, err := parseStoreArgs(storeArgs)
+	if err != nil {
+		d.fail("see the list of storage backends in the README", "invalid store: %v", err)
+	} else {
+		d.checkDirs(storageType, params)
+		d.checkURL()
+		// Last, as stores chdir into their directory
+		d.checkStore(storageType, params)
+	}
+
+	failed := false
+	for _, f := range d.findings {
+		fmt.Printf("%-4s %s\n", f.level, f.msg)
+		if f.hint != "" {
+			fmt.Printf("     -> %s\n", f.hint)
+		}
+		failed = failed || f.level == findingFail
+	}
+	if failed {
+		os.Exit(1)
+	}
+}
+
+// checkFiles checks that the files given via flags can be loaded.
+func (d *doctor) checkFiles() {
+	if *tokensPath != "" {
+		if tokens, err := loadTokens(*tokensPath); err != nil {
+			d.fail("fix or remove the tokens file", "could not load -tokens: %v", err)
+		} else {
+			d.ok("loaded %d upload tokens", len(tokens))
+		}
+	}
+	if *signKey != "" {
+		if _, err := loadSigner(*signKey); err != nil {
+			d.fail("give a minisign secret key without a password", "could not load -sign-key: %v", err)
+		} else {
+			d.ok("loaded the signing key")
+		}
+	}
+	if *tlsCert != "" && *tlsKey != "" {
+		if _, err := tls.LoadX509KeyPair(*tlsCert, *tlsKey); err != nil {
+			d.fail("give a PEM certificate and the key it was issued for", "could not load the TLS certificate: %v", err)
+		} else {
+			d.ok("loaded the TLS certificate")
+		}
+	}
+	if *clientCA != "" {
+		if _, err := ioutil.ReadFile(*clientCA); err != nil {
+			d.fail("give a readable PEM file", "could not read -client-ca: %v", err)
+		}
+	}
+	if *messagesDir != "" {
+		if err := loadCatalogs(*messagesDir); err != nil {
+			d.fail("fix the message catalogs", "could not load -messages: %v", err)
+		} else {
+			d.ok("loaded the message catalogs")
+		}
+	}
+}
+
+// checkDirs checks that the directories pastes and other files are kept
+// in can be written to, and have enough free space.
+func (d *doctor) checkDirs(storageType string, params map[string]string) {
+	// Named after what they are given by
+	dirs := map[string]string{
+		"-tus-dir":    *tusDir,
+		"-mirror-dir": *mirrorDir,
+	}
+	if defaults, err := storage.Params(storageType); err == nil {
+		if dir, ok := defaults["dir"]; ok {
+			if params["dir"] != "" {
+				dir = params["dir"]
+			}
+			dirs[storageType+" dir"] = dir
+		}
+	}
+	if *clusterSelf != "" {
+		dirs["-cluster-dir"] = *clusterDir
+	}
+	if *statsFile != "" {
+		dirs["-stats-file"] = filepath.Dir(*statsFile)
+	}
+	if *auditPath != "" {
+		dirs["-audit-log"] = filepath.Dir(*auditPath)
+	}
+	var names []string
+	for name, dir := range dirs {
+		if dir != "" {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		d.checkDir(name, dirs[name])
+	}
+}
+
+func (d *doctor) checkDir(name, dir string) {
+	// Where to check for writes and space, which is the parent for
+	// directories that will be created
+	at := dir
+	info, err := os.Stat(dir)
+	if os.IsNotExist(err) {
+		at = filepath.Dir(filepath.Clean(dir))
+		if _, err := os.Stat(at); err != nil {
+			d.fail(fmt.Sprintf("create %s", dir), "%s %s does not exist, nor does its parent", name, dir)
+			return
+		}
+		d.warn("", "%s %s does not exist yet, and will be created", name, dir)
+	} else if err != nil {
+		d.fail("check the permissions of its parents", "could not stat %s %s: %v", name, dir, err)
+		return
+	} else if !info.IsDir() {
+		d.fail("give a directory instead", "%s %s is not a directory", name, dir)
+		return
+	}
+	f, err := ioutil.TempFile(at, ".doctor-")
+	if err != nil {
+		d.fail(fmt.Sprintf("let the user running pastecat write to %s", at),
+			"%s %s is not writable: %v", name, dir, err)
+		return
+	}
+	f.Close()
+	os.Remove(f.Name())
+	free, err := freeSpace(at)
+	switch {
+	case err != nil:
+		d.ok("%s %s is writable, with unknown free space", name, dir)
+	case free < uint64(maxStorage):
+		d.warn("free some space or lower -M, as uploads fail once the disk is full",
+			"%s %s only has %s free, less than -M %s", name, dir, storage.ByteSize(free), maxStorage)
+	default:
+		d.ok("%s %s is writable, with %s free", name, dir, storage.ByteSize(free))
+	}
+}
+
+// checkStore checks that the store can be opened, and that a paste can be
+// stored in it, read back and deleted. The store is opened with the
+// configured lifetime, so that only the pastes that the server would find
+// expired on startup are deleted, and not at all if a running instance
+// holds it exclusively.
+func (d *doctor) checkStore(storageType string, params map[string]string) {
+	stats := &storage.Stats{}
+	store, err := storage.Open(storageType, params, storage.Config{
+		Stats:    stats,
+		OnExpire: func(storage.ID, time.Time) {},
+		LifeTime: *lifeTime,
+		Layout:   fsLayout(),
+	})
+	if err == storage.ErrDirInUse || err == storage.ErrDirHeld {
+		d.warn("stop the running instance to check the store",
+			"the store %s is locked by a running instance (%v), so no test paste was written", storageType, err)
+		return
+	}
+	if err != nil {
+		d.fail("check the parameters of the store, and that it is reachable",
+			"could not open the store %s: %v", storageType, err)
+		return
+	}
+	if c, ok := store.(io.Closer); ok {
+		defer c.Close()
+	}
+	n, stg := stats.Report()
+	d.ok("opened the store %s, holding %d pastes using %s", storageType, n, storage.ByteSize(stg))
+
+	content := []byte("pastecat doctor\n")
+	stats.Track(int64(len(content)))
+	id, err := store.Put(content, storage.Meta{LifeTime: time.Minute})
+	if err != nil {
+		d.fail("check that the store is writable and has space left",
+			"could not store a test paste: %v", err)
+		return
+	}
+	paste, err := store.Get(id)
+	if err != nil {
+		d.fail("check that the store is consistent", "could not fetch the test paste %s: %v", id, err)
+	} else {
+		got, err := ioutil.ReadAll(paste)
+		paste.Close()
+		if err != nil || !bytes.Equal(got, content) {
+			d.fail("check that the store is consistent", "the test paste %s was not read back as stored", id)
+		} else {
+			d.ok("stored and read back a test paste")
+		}
+	}
+	if err := store.Delete(id); err != nil {
+		d.warn(fmt.Sprintf("delete the paste %s by hand", id), "could not delete the test paste: %v", err)
+	}
+}
+
+// checkURL checks that -u reaches the address the server listens on, by
+// serving a secret on it and fetching it via -u. If the address is in use,
+// such as by a running instance, only checks that -u is reachable.
+func (d *doctor) checkURL() {
+	if *shards != "" && *shardSelf == "" {
+		return
+	}
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		d.fail("", "could not generate a secret: %v", err)
+		return
+	}
+	secret := hex.EncodeToString(b)
+	client := &http.Client{Timeout: 10 * time.Second}
+	l, err := net.Listen("tcp", *listen)
+	if err != nil {
+		resp, err := client.Get(strings.TrimSuffix(*siteURL, "/") + versionPath)
+		if err != nil {
+			d.fail("check -u and -l", "could not listen on %s, nor reach %s: %v", *listen, *siteURL, err)
+			return
+		}
+		resp.Body.Close()
+		d.warn("stop the instance using it to check that -u reaches -l",
+			"could not listen on %s, but %s replied with %s", *listen, *siteURL, resp.Status)
+		return
+	}
+	defer l.Close()
+	srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, secret)
+	})}
+	if *tlsCert != "" && *tlsKey != "" {
+		go srv.ServeTLS(l, *tlsCert, *tlsKey)
+	} else {
+		go srv.Serve(l)
+	}
+	defer srv.Close()
+	resp, err := client.Get(strings.TrimSuffix(*siteURL, "/") + "/doctor")
+	if err != nil {
+		d.fail(fmt.Sprintf("make %s resolve to this host and route to %s", *siteURL, *listen),
+			"could not reach %s: %v", *siteURL, err)
+		return
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+	if err != nil || string(body) != secret {
+		d.fail(fmt.Sprintf("make %s route to %s, and not to another server", *siteURL, *listen),
+			"%s did not reach the listener on %s", *siteURL, *listen)
+		return
+	}
+	d.ok("%s reaches the listener on %s", *siteURL, *listen)
+}
@@ -0,0 +1,162 @@
+// Copyright (c) 2014-2015, Daniel Martí <mvdan@mvdan.cc>
+// See LICENSE for licensing information
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mvdan/pastecat/storage"
+)
+
+// Query parameter holding the secret allowing the uploader to edit a paste
+const writeParam = "write"
+
+// Prefix of the path after a paste's id to fetch one of its previous
+// versions with, like "/a63d03b9/v/1"
+const versionPrefix = "v/"
+
+func editURL(id storage.ID, token string) string {
+	return fmt.Sprintf("%s/%s?%s=%s", *siteURL, id, writeParam, url.QueryEscape(token))
+}
+
+func versionURL(id storage.ID, version int) string {
+	return fmt.Sprintf("%s/%s/%s%d", *siteURL, id, versionPrefix, version)
+}
+
+// versionFromFile returns the number of the previous version that the
+// path after a paste's id points to, if it points to one.
+func versionFromFile(file string) (int, bool) {
+	if !strings.HasPrefix(file, versionPrefix) {
+		return 0, false
+	}
+	version, err := strconv.Atoi(file[len(versionPrefix):])
+	if err != nil || version < 1 {
+		return 0, false
+	}
+	return version, true
+}
+
+// editLock serializes edits, so that the paste checked against If-Match is
+// still the one being replaced
+var editLock sync.Mutex
+
+// handleEdit replaces the content of a paste given the write token it was
+// uploaded with, like "PUT /a63d03b9?write=<token>". The previous content
+// is kept as a version of the paste. If-Match may hold the ETag of the
+// content being edited, to not overwrite someone else's edit.
+func (h *httpHandler) handleEdit(w http.ResponseWriter, r *http.Request) {
+	hexID, file := compat.splitPath(r.URL.Path)
+	id, err := storage.IDFromString(hexID)
+	if err != nil || file != "" {
+		http.Error(w, invalidID, http.StatusBadRequest)
+		return
+	}
+	limit := h.sizeLimit(r, apiMaxSize)
+	r.Body = http.MaxBytesReader(w, r.Body, limit)
+	done := timePhase(r, "read body")
+	content, err := ioutil.ReadAll(r.Body)
+	done()
+	if isTooLarge(err) {
+		replyTooLarge(w, r, limit)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if len(content) == 0 {
+		http.Error(w, errNoPaste.Error(), http.StatusBadRequest)
+		return
+	}
+	editLock.Lock()
+	defer editLock.Unlock()
+	// Stat, as checking the token should not count as a view
+	sp, done := h.storeSpan(r, "Stat"), timePhase(r, "store")
+	info, err := storage.Stat(h.store, id)
+	sp.endWith(err)
+	done()
+	if err != nil {
+		h.storeError(w, r, err)
+		return
+	}
+	meta, etag := info.Meta, metaETag(id, info.Meta, info.ModTime)
+	if at, ok := h.outlived(id, meta, info.ModTime); ok {
+		replyExpired(w, at)
+		return
+	}
+	token := r.URL.Query().Get(writeParam)
+	if !checkPasteToken(meta.WriteHash, token) {
+		http.Error(w, "invalid write token", http.StatusForbidden)
+		return
+	}
+	if ifMatch := r.Header.Get("If-Match"); ifMatch != "" && !etagMatches(ifMatch, etag) {
+		w.Header().Set("Etag", etag)
+		http.Error(w, "the paste was edited since", http.StatusPreconditionFailed)
+		return
+	}
+	// Edited content no longer holds the same files
+	meta.Files = nil
+	if content, err = prepareContent(content, &meta); err != nil {
+		http.Error(w, err.Error(), http.StatusUnsupportedMediaType)
+		return
+	}
+	sp, done = h.storeSpan(r, "Update"), timePhase(r, "store")
+	err = h.update(id, content, meta)
+	sp.endWith(err)
+	done()
+	switch err {
+	case nil:
+	case errEditConflict:
+		http.Error(w, err.Error(), http.StatusPreconditionFailed)
+		return
+	case errClusterUnavailable:
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	default:
+		h.storeError(w, r, err)
+		return
+	}
+	w.Header().Set("Etag", `"`+meta.Hash+`"`)
+	w.Header().Set("X-Version-Url", versionURL(id, len(meta.Versions)+1))
+	fmt.Fprintln(w, pasteURL(id, meta))
+}
+
+// update replaces the content of a paste, keeping its previous content as a
+// version.
+func (h *httpHandler) update(id storage.ID, content []byte, meta storage.Meta) error {
+	if h.cluster != nil {
+		return h.cluster.propose(clusterCommand{
+			Op:      opUpdate,
+			ID:      id.String(),
+			Meta:    meta,
+			Content: content,
+		})
+	}
+	return h.updatePaste(id, content, meta)
+}
+
+// updatePaste replaces the content of a paste in the store once there is
+// space for it.
+func (h *httpHandler) updatePaste(id storage.ID, content []byte, meta storage.Meta) error {
+	size := int64(len(content))
+	if err := h.stats.Grow(size); err != nil {
+		return err
+	}
+	if err := h.store.Update(id, content, meta); err != nil {
+		if err == storage.ErrDiskFull {
+			h.disk.full()
+		}
+		h.stats.Shrink(size)
+		return err
+	}
+	h.usage.Track(id, meta, time.Now(), size)
+	return nil
+}
@@ -0,0 +1,73 @@
+// Copyright (c) 2014-2015, Daniel Martí <mvdan@mvdan.cc>
+// See LICENSE for licensing information
+
+package main
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Window that zstd decoders are recommended to support by RFC 8878, and
+// what encoders use by default when they don't know the size of the input
+const zstdMinWindow = 8 << 20
+
+// zstdMaxWindow returns the largest window that zstd bodies may use, which
+// is maxSize rounded up to a power of two, as no paste may be larger.
+// Otherwise, a client could make the server allocate a huge window.
+func zstdMaxWindow(maxSize int64) uint64 {
+	window := uint64(zstdMinWindow)
+	for window < uint64(maxSize) && window < zstd.MaxWindowSize {
+		window <<= 1
+	}
+	return window
+}
+
+// decompressBody transparently decompresses request bodies sent with a
+// Content-Encoding. Handlers still limit the size of the decompressed
+// body, while the compressed body is limited to maxSize here.
+func decompressBody(h http.Handler, maxSize int64) http.Handler {
+	maxWindow := zstdMaxWindow(maxSize)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		encoding := strings.ToLower(strings.TrimSpace(r.Header.Get("Content-Encoding")))
+		var body io.ReadCloser
+		switch encoding {
+		case "", "identity":
+			h.ServeHTTP(w, r)
+			return
+		case "gzip", "x-gzip":
+			zr, err := gzip.NewReader(http.MaxBytesReader(w, r.Body, maxSize))
+			if err != nil {
+				http.Error(w, fmt.Sprintf("invalid gzip body: %v", err), http.StatusBadRequest)
+				return
+			}
+			body = zr
+		case "zstd":
+			// Decoding in the handler's goroutine, as bodies are small
+			zr, err := zstd.NewReader(http.MaxBytesReader(w, r.Body, maxSize),
+				zstd.WithDecoderConcurrency(1), zstd.WithDecoderMaxWindow(maxWindow))
+			if err != nil {
+				http.Error(w, fmt.Sprintf("invalid zstd body: %v", err), http.StatusBadRequest)
+				return
+			}
+			body = zr.IOReadCloser()
+		default:
+			http.Error(w, fmt.Sprintf("unsupported content encoding '%s'", encoding),
+				http.StatusUnsupportedMediaType)
+			return
+		}
+		defer body.Close()
+		r.Body = struct {
+			io.Reader
+			io.Closer
+		}{body, r.Body}
+		r.Header.Del("Content-Encoding")
+		r.ContentLength = -1
+		h.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,75 @@
+// Copyright (c) 2014-2015, Daniel Martí <mvdan@mvdan.cc>
+// See LICENSE for licensing information
+
+package main
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/mvdan/pastecat/storage"
+)
+
+const (
+	// Name of the HTTP form field flagging an upload as encrypted by the
+	// client
+	encryptedField = "encrypted"
+	// Path of the web form encrypting pastes in the browser
+	encryptPage = "/encrypt"
+	// Content-Type of encrypted pastes, which are opaque
+	encryptedContentType = "application/octet-stream"
+)
+
+var errEncryptedDisabled = errors.New("encrypted pastes are not enabled")
+
+// formEncrypted returns whether an upload was encrypted by the client,
+// which is only accepted if encrypted pastes are enabled.
+func formEncrypted(r *http.Request) (bool, error) {
+	value := r.FormValue(encryptedField)
+	if value == "" {
+		return false, nil
+	}
+	encrypted, err := strconv.ParseBool(value)
+	if err != nil {
+		return false, fmt.Errorf("invalid %s value '%s'", encryptedField, value)
+	}
+	if encrypted && !*encryptedMode {
+		return false, errEncryptedDisabled
+	}
+	return encrypted, nil
+}
+
+// wantsDecryptPage reports whether an encrypted paste should be served as
+// the page decrypting it, which browsers prefer to the opaque content.
+func wantsDecryptPage(r *http.Request) bool {
+	return negotiate(r, encryptedContentType, "text/html") == "text/html"
+}
+
+// serveDecryptPage serves a page holding an encrypted paste, which decrypts
+// it with the key in the fragment of the url. The content is part of the
+// page so that fetching it counts as a single read.
+func serveDecryptPage(w http.ResponseWriter, r *http.Request, id storage.ID, paste storage.Paste) {
+	done := timePhase(r, "read paste")
+	b, err := ioutil.ReadAll(paste)
+	done()
+	if err != nil {
+		replyStoreError(w, r, err)
+		return
+	}
+	setHeaders(w.Header(), id, paste)
+	// The page is a different representation of the paste
+	w.Header().Del("Etag")
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	err = tmpl.ExecuteTemplate(w, "decrypt", struct {
+		ID   storage.ID
+		Data string
+	}{id, base64.StdEncoding.EncodeToString(b)})
+	if err != nil {
+		log.Printf("Error executing template for %s: %v", r.URL.Path, err)
+	}
+}
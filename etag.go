@@ -0,0 +1,63 @@
+// Copyright (c) 2014-2015, Daniel Martí <mvdan@mvdan.cc>
+// See LICENSE for licensing information
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/mvdan/pastecat/storage"
+)
+
+func contentHash(content []byte) string {
+	sum := sha256.Sum256(content)
+	return hex.EncodeToString(sum[:])
+}
+
+// pasteETag returns the entity tag of a paste, which is the hash of its
+// content if it is known.
+func pasteETag(id storage.ID, paste storage.Paste) string {
+	return metaETag(id, paste.Meta(), paste.ModTime())
+}
+
+// metaETag returns the entity tag of a paste given its attributes.
+func metaETag(id storage.ID, meta storage.Meta, modTime time.Time) string {
+	if meta.Hash != "" {
+		return `"` + meta.Hash + `"`
+	}
+	// Precise enough to tell apart versions of a paste
+	return fmt.Sprintf(`"%d-%s"`, modTime.UnixNano(), id)
+}
+
+// etagMatches reports whether an If-Match header matches an entity tag,
+// using the strong comparison.
+func etagMatches(ifMatch, etag string) bool {
+	for _, tag := range strings.Split(ifMatch, ",") {
+		tag = strings.TrimSpace(tag)
+		if tag == "*" || tag == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// notModified reports whether a conditional GET or HEAD request can be
+// replied to with 304 Not Modified, like http.ServeContent does.
+func notModified(r *http.Request, etag string, modTime time.Time) bool {
+	if inm := r.Header.Get("If-None-Match"); inm != "" {
+		for _, tag := range strings.Split(inm, ",") {
+			tag = strings.TrimPrefix(strings.TrimSpace(tag), "W/")
+			if tag == "*" || tag == strings.TrimPrefix(etag, "W/") {
+				return true
+			}
+		}
+		return false
+	}
+	ims, err := http.ParseTime(r.Header.Get("If-Modified-Since"))
+	return err == nil && !modTime.Truncate(time.Second).After(ims)
+}
@@ -0,0 +1,76 @@
+// Copyright (c) 2014-2015, Daniel Martí <mvdan@mvdan.cc>
+// See LICENSE for licensing information
+
+package main
+
+import (
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Header set on the requests made to peers, so that they don't ask their
+// own peers in turn
+const peerHeader = "X-Pastecat-Peer"
+
+// federation tries the configured peers for the pastes that are not found
+// locally, so that many instances act as one
+type federation struct {
+	peers  []string
+	client *http.Client
+}
+
+func newFederation(peers []string) *federation {
+	f := &federation{
+		client: &http.Client{
+			Timeout: 30 * time.Second,
+			// Redirects are passed on to the client
+			CheckRedirect: func(req *http.Request, via []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		},
+	}
+	for _, peer := range peers {
+		f.peers = append(f.peers, strings.TrimSuffix(peer, "/"))
+	}
+	return f
+}
+
+// serve replies to a request with the response of the first peer that
+// has the paste, returning false if none does.
+func (f *federation) serve(w http.ResponseWriter, r *http.Request) bool {
+	if r.Header.Get(peerHeader) != "" {
+		return false
+	}
+	for _, peer := range f.peers {
+		req, err := http.NewRequest(r.Method, peer+r.URL.RequestURI(), nil)
+		if err != nil {
+			log.Printf("Could not ask peer %s: %v", peer, err)
+			continue
+		}
+		for name, values := range r.Header {
+			req.Header[name] = values
+		}
+		req.Header.Set(peerHeader, "1")
+		resp, err := f.client.Do(req)
+		if err != nil {
+			log.Printf("Could not ask peer %s: %v", peer, err)
+			continue
+		}
+		switch resp.StatusCode {
+		case http.StatusNotFound, http.StatusGone:
+			resp.Body.Close()
+			continue
+		}
+		for name, values := range resp.Header {
+			w.Header()[name] = values
+		}
+		w.WriteHeader(resp.StatusCode)
+		io.Copy(w, resp.Body)
+		resp.Body.Close()
+		return true
+	}
+	return false
+}
@@ -0,0 +1,84 @@
+// Copyright (c) 2014-2015, Daniel Martí <mvdan@mvdan.cc>
+// See LICENSE for licensing information
+
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+
+	"github.com/mvdan/pastecat/storage"
+)
+
+// Name of the action after a paste's id to fork it
+const forkAction = "fork"
+
+// handleFork creates a new paste with the content of an existing one, or
+// with an edited version of it if a paste is uploaded along.
+func (h *httpHandler) handleFork(w http.ResponseWriter, r *http.Request) {
+	hexID, _ := compat.splitPath(r.URL.Path)
+	id, err := storage.IDFromString(hexID)
+	if err != nil {
+		http.Error(w, invalidID, http.StatusBadRequest)
+		return
+	}
+	meta, ok := h.uploadMeta(w, r)
+	if !ok {
+		return
+	}
+	limit := h.sizeLimit(r, apiMaxSize)
+	r.Body = http.MaxBytesReader(w, r.Body, limit)
+	done := timePhase(r, "read body")
+	uploads, err := getContentFromForm(r)
+	done()
+	if isTooLarge(err) {
+		replyTooLarge(w, r, limit)
+		return
+	}
+	if err != nil && err != errNoPaste {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if len(uploads) > 1 {
+		http.Error(w, "only one paste can be forked at once", http.StatusBadRequest)
+		return
+	}
+	if meta.LifeTime, err = formLifeTime(r); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	// Only applies to the uploaded edit, if any
+	encrypted, err := formEncrypted(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	paste, ok := h.getPaste(w, r, id)
+	if !ok {
+		return
+	}
+	orig := paste.Meta()
+	var content []byte
+	if len(uploads) == 1 {
+		content = uploads[0].content
+		meta.Encrypted = encrypted
+	} else {
+		content, err = ioutil.ReadAll(paste)
+		// The fork holds the same files only if it is not edited
+		meta.Files = orig.Files
+		meta.Encrypted = orig.Encrypted
+	}
+	h.donePaste(id, paste)
+	if err != nil {
+		replyStoreError(w, r, err)
+		return
+	}
+	meta.Filename = orig.Filename
+	meta.Title = orig.Title
+	meta.ContentType = orig.ContentType
+	newID, ok := h.newPaste(w, r, content, meta)
+	if !ok {
+		return
+	}
+	writeCreated(w, r, []createdPaste{{newID.String(), pasteURL(newID, meta), meta.Encrypted}})
+}
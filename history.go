@@ -0,0 +1,111 @@
+// Copyright (c) 2014-2015, Daniel Martí <mvdan@mvdan.cc>
+// See LICENSE for licensing information
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/mvdan/pastecat/storage"
+)
+
+// Names of the actions after a paste's id to list its revisions and to
+// diff two of them
+const (
+	historyAction = "history"
+	diffAction    = "diff"
+)
+
+type revision struct {
+	Version int       `json:"version"`
+	URL     string    `json:"url"`
+	ModTime time.Time `json:"mod_time"`
+	Size    int64     `json:"size"`
+}
+
+// revisions returns all the revisions of a paste, from its first version
+// to its current content.
+func revisions(id storage.ID, paste storage.Paste) []revision {
+	versions := paste.Meta().Versions
+	revs := make([]revision, 0, len(versions)+1)
+	for i, v := range versions {
+		revs = append(revs, revision{i + 1, versionURL(id, i+1), v.ModTime.UTC(), v.Size})
+	}
+	return append(revs, revision{len(versions) + 1, pasteURL(id, paste.Meta()),
+		paste.ModTime().UTC(), paste.Size()})
+}
+
+// serveHistory lists the revisions of a paste, one per line or as JSON.
+func serveHistory(w http.ResponseWriter, r *http.Request, id storage.ID, paste storage.Paste) {
+	revs := revisions(id, paste)
+	if negotiate(r, "text/plain", "application/json") == "application/json" {
+		writeJSON(w, revs)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	for _, rev := range revs {
+		fmt.Fprintf(w, "%d\t%s\t%s\t%s\n", rev.Version,
+			rev.ModTime.Format(time.RFC3339), storage.ByteSize(rev.Size), rev.URL)
+	}
+}
+
+// serveDiff serves a unified diff between two revisions of a paste, given
+// as "from" and "to". They default to the last edit of the paste.
+func (h *httpHandler) serveDiff(w http.ResponseWriter, r *http.Request, id storage.ID, paste storage.Paste) {
+	revs := revisions(id, paste)
+	number := func(name string, def int) (int, bool) {
+		value := r.FormValue(name)
+		if value == "" {
+			return def, def >= 1
+		}
+		n, err := strconv.Atoi(value)
+		return n, err == nil && n >= 1 && n <= len(revs)
+	}
+	to, ok := number("to", len(revs))
+	if !ok {
+		http.Error(w, "invalid revision", http.StatusBadRequest)
+		return
+	}
+	from, ok := number("from", to-1)
+	if !ok {
+		http.Error(w, "invalid revision", http.StatusBadRequest)
+		return
+	}
+	var contents [2][]byte
+	for i, n := range [...]int{from, to} {
+		rev := paste
+		if n < len(revs) {
+			if rev, ok = h.getPasteVersion(w, r, id, n); !ok {
+				return
+			}
+			defer rev.Close()
+		}
+		if rev.Meta().Binary {
+			http.Error(w, "cannot diff binary revisions", http.StatusUnsupportedMediaType)
+			return
+		}
+		b, err := ioutil.ReadAll(io.NewSectionReader(rev, 0, rev.Size()))
+		if err != nil {
+			replyStoreError(w, r, err)
+			return
+		}
+		contents[i] = b
+	}
+	var buf bytes.Buffer
+	writeUnifiedDiff(&buf, revs[from-1].URL, revs[to-1].URL, contents[0], contents[1])
+	if view := r.FormValue(viewParam); view != "" {
+		serveView(w, r, view, id, paste, &buf)
+		return
+	}
+	setHeaders(w.Header(), id, paste)
+	// The diff is not a representation of the paste
+	w.Header().Del("Etag")
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	buf.WriteTo(w)
+}
@@ -0,0 +1,246 @@
+// Copyright (c) 2014-2015, Daniel Martí <mvdan@mvdan.cc>
+// See LICENSE for licensing information
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Language that the templates and messages are written in
+const defaultLang = "en"
+
+// catalog maps messages in English to their translation
+type catalog map[string]string
+
+// catalogs holds the available translations, by lowercase language tag
+var catalogs = map[string]catalog{
+	"es": {
+		"Set up an alias:":    "Crea un alias:",
+		"Upload a new paste:": "Sube un nuevo paste:",
+		"Fetch it:":           "Descárgalo:",
+
+		`You can also use the <a href="form">web form</a>.`:                                     `También puedes usar el <a href="form">formulario web</a>.`,
+		`Pastes uploaded with listed=1 are shown among the <a href="recent">recent pastes</a>:`: `Los pastes subidos con listed=1 aparecen entre los <a href="recent">pastes recientes</a>:`,
+
+		`Logged in as %s. See <a href="me/">your pastes</a> or <a href="auth/logout">log out</a>.`: `Sesión iniciada como %s. Mira <a href="me/">tus pastes</a> o <a href="auth/logout">cierra la sesión</a>.`,
+		`Uploads require you to <a href="auth/login">log in</a>, or an upload token.`:              `Para subir pastes debes <a href="auth/login">iniciar sesión</a>, o usar un token de subida.`,
+
+		"The <a href=\"encrypt\">encrypting form</a> encrypts pastes in your browser,\nkeeping the key in the url so that this server cannot read them.": "El <a href=\"encrypt\">formulario de cifrado</a> cifra los pastes en tu navegador,\nguardando la clave en la url para que este servidor no pueda leerlos.",
+
+		"The maximum size per paste is %s.":                              "El tamaño máximo por paste es %s.",
+		"Each paste will be deleted after %s.":                           "Cada paste se borrará tras %s.",
+		"Pastes of %s or more will be deleted after %s.":                 "Los pastes de %s o más se borrarán tras %s.",
+		"Each paste may pick its lifetime via the lifetime field, like:": "Cada paste puede elegir su duración con el campo lifetime, así:",
+
+		"There are currently %s pastes using %s.\nSee <a href=\"stats\">stats</a> for details.": "Hay %s pastes ocupando %s.\nMira las <a href=\"stats\">estadísticas</a> para más detalles.",
+
+		"Bad Request":              "Petición incorrecta",
+		"Unauthorized":             "No autorizado",
+		"Forbidden":                "Prohibido",
+		"Not Found":                "No encontrado",
+		"Gone":                     "Ya no existe",
+		"Request Entity Too Large": "Petición demasiado grande",
+		"Unsupported Media Type":   "Tipo de contenido no soportado",
+		"Too Many Requests":        "Demasiadas peticiones",
+		"Internal Server Error":    "Error interno del servidor",
+		"Service Unavailable":      "Servicio no disponible",
+		"Insufficient Storage":     "Almacenamiento insuficiente",
+
+		invalidID:     "id de paste no válido",
+		unknownAction: "acción no soportada",
+		fileNotFound:  "no se encontró el fichero en el paste",
+
+		"paste could not be found":          "no se encontró el paste",
+		"no paste provided":                 "no se proporcionó ningún paste",
+		"no space left on the disk":         "no queda espacio en el disco",
+		"reached maximum number of pastes":  "se alcanzó el número máximo de pastes",
+		"reached maximum storage of pastes": "se alcanzó el almacenamiento máximo de pastes",
+		"content does not look like text":   "el contenido no parece texto",
+		"encrypted pastes are not enabled":  "los pastes cifrados no están habilitados",
+		"the public listing is not enabled": "el listado público no está habilitado",
+		"login required":                    "se requiere iniciar sesión",
+		"unknown token":                     "token desconocido",
+		"storage quota exceeded":            "cuota de almacenamiento superada",
+		"http: request body too large":      "http: cuerpo de la petición demasiado grande",
+	},
+}
+
+// loadCatalogs adds the catalogs in dir, each a JSON object named after its
+// language like "es.json", replacing any built-in one for the language.
+func loadCatalogs(dir string) error {
+	paths, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return err
+	}
+	for _, path := range paths {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		var c catalog
+		if err := json.Unmarshal(data, &c); err != nil {
+			return fmt.Errorf("%s: %v", path, err)
+		}
+		lang := strings.ToLower(strings.TrimSuffix(filepath.Base(path), ".json"))
+		catalogs[lang] = c
+	}
+	return nil
+}
+
+// hasLang reports whether messages can be shown in a language.
+func hasLang(lang string) bool {
+	_, e := catalogs[lang]
+	return e || lang == defaultLang
+}
+
+// requestLang returns the language to reply to a request in, which is the
+// one preferred by its Accept-Language header among those available unless
+// a language is forced.
+func requestLang(r *http.Request) string {
+	if *forceLang != "" {
+		return *forceLang
+	}
+	best, bestQ := defaultLang, 0.0
+	for _, part := range strings.Split(r.Header.Get("Accept-Language"), ",") {
+		params := strings.Split(part, ";")
+		lang := strings.ToLower(strings.TrimSpace(params[0]))
+		if !hasLang(lang) {
+			// Fall back to the primary language, like "pt" for "pt-br"
+			if i := strings.IndexByte(lang, '-'); i > 0 {
+				lang = lang[:i]
+			}
+			if !hasLang(lang) {
+				continue
+			}
+		}
+		q := 1.0
+		for _, param := range params[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				if v, err := strconv.ParseFloat(param[2:], 64); err == nil {
+					q = v
+				}
+			}
+		}
+		if q > bestQ {
+			best, bestQ = lang, q
+		}
+	}
+	return best
+}
+
+// translate returns the translation of a message, or the message itself if
+// it has none.
+func translate(lang, msg string) string {
+	if t := catalogs[lang][msg]; t != "" {
+		return t
+	}
+	return msg
+}
+
+// translator returns the function that templates translate their messages
+// with. Messages may hold HTML, so catalogs must be trusted, while the
+// arguments filling in their verbs are escaped.
+func translator(lang string) func(string, ...interface{}) template.HTML {
+	return func(msg string, args ...interface{}) template.HTML {
+		msg = translate(lang, msg)
+		if len(args) == 0 {
+			return template.HTML(msg)
+		}
+		escaped := make([]interface{}, len(args))
+		for i, arg := range args {
+			escaped[i] = template.HTMLEscapeString(fmt.Sprint(arg))
+		}
+		return template.HTML(fmt.Sprintf(msg, escaped...))
+	}
+}
+
+// htmlErrors wraps a handler so that the plain text errors it replies with
+// are shown as pages in the request's language to clients preferring HTML.
+func htmlErrors(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if negotiate(r, "text/plain", "text/html") != "text/html" {
+			h.ServeHTTP(w, r)
+			return
+		}
+		ew := &htmlErrorWriter{ResponseWriter: w}
+		h.ServeHTTP(ew, r)
+		ew.finish(r)
+	})
+}
+
+// htmlErrorWriter holds back the errors written by http.Error
+type htmlErrorWriter struct {
+	http.ResponseWriter
+	// status of the error held back, if any
+	status int
+	msg    bytes.Buffer
+}
+
+func (w *htmlErrorWriter) WriteHeader(status int) {
+	header := w.Header()
+	if status >= 400 && header.Get("Content-Type") == "text/plain; charset=utf-8" &&
+		header.Get("X-Content-Type-Options") == "nosniff" {
+		w.status = status
+		return
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *htmlErrorWriter) Write(p []byte) (int, error) {
+	if w.status != 0 {
+		return w.msg.Write(p)
+	}
+	return w.ResponseWriter.Write(p)
+}
+
+// ReadFrom holds back the body of an error like Write, passing through
+// anything else.
+func (w *htmlErrorWriter) ReadFrom(r io.Reader) (int64, error) {
+	if w.status != 0 {
+		return io.Copy(&w.msg, r)
+	}
+	return io.Copy(w.ResponseWriter, r)
+}
+
+func (w *htmlErrorWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// finish writes the page of the error held back, if any.
+func (w *htmlErrorWriter) finish(r *http.Request) {
+	if w.status == 0 {
+		return
+	}
+	lang := requestLang(r)
+	header := w.Header()
+	header.Set("Content-Type", "text/html; charset=utf-8")
+	header.Set("Content-Language", lang)
+	header.Add("Vary", "Accept-Language")
+	w.ResponseWriter.WriteHeader(w.status)
+	err := tmpl.ExecuteTemplate(w.ResponseWriter, "error", struct {
+		Lang    string
+		Status  int
+		Title   string
+		Message string
+	}{
+		Lang:    lang,
+		Status:  w.status,
+		Title:   translate(lang, http.StatusText(w.status)),
+		Message: translate(lang, strings.TrimSpace(w.msg.String())),
+	})
+	if err != nil {
+		log.Printf("Error executing template for %s: %v", r.URL.Path, err)
+	}
+}
@@ -0,0 +1,64 @@
+// Copyright (c) 2014-2015, Daniel Martí <mvdan@mvdan.cc>
+// See LICENSE for licensing information
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"html/template"
+	"image"
+	_ "image/gif"
+	_ "image/jpeg"
+	_ "image/png"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/mvdan/pastecat/storage"
+)
+
+// imageType returns the Content-Type of an image, given the start of its
+// content, or an empty string if it is not one.
+func imageType(start []byte) string {
+	ct := http.DetectContentType(start)
+	if !strings.HasPrefix(ct, "image/") {
+		return ""
+	}
+	return ct
+}
+
+// setContentType serves binary pastes that are images as such, if binary
+// pastes are allowed and not forced to be text, and the uploader did not
+// give the paste a Content-Type.
+func setContentType(header http.Header, paste storage.Paste, content io.ReaderAt) {
+	if !paste.Meta().Binary || *rejectBinary || *forceText || paste.Meta().ContentType != "" {
+		return
+	}
+	start := make([]byte, 512)
+	n, _ := content.ReadAt(start, 0)
+	if ct := imageType(start[:n]); ct != "" {
+		header.Set("Content-Type", ct)
+		header.Set("X-Content-Type-Options", "nosniff")
+	}
+}
+
+func isImage(start []byte) bool {
+	return !*rejectBinary && !*forceText && imageType(start) != ""
+}
+
+// renderImage renders a page showing an image along with its dimensions,
+// if they are known, and a link to download it.
+func renderImage(path string, content []byte) template.HTML {
+	var buf bytes.Buffer
+	src := template.HTMLEscapeString(path)
+	fmt.Fprintf(&buf, `<p style="text-align:center"><img src="%s" style="max-width:100%%"/></p>`, src)
+	buf.WriteString(`<p style="text-align:center">`)
+	buf.WriteString(template.HTMLEscapeString(imageType(content)))
+	if cfg, _, err := image.DecodeConfig(bytes.NewReader(content)); err == nil {
+		fmt.Fprintf(&buf, ", %dx%d pixels", cfg.Width, cfg.Height)
+	}
+	fmt.Fprintf(&buf, `, %s - <a href="%s" download>Download</a></p>`,
+		storage.ByteSize(len(content)), src)
+	return template.HTML(buf.String())
+}
@@ -0,0 +1,92 @@
+// Copyright (c) 2014-2015, Daniel Martí <mvdan@mvdan.cc>
+// See LICENSE for licensing information
+
+// Package dirwatch reports the files written to a directory once they are
+// complete, using inotify on Linux and polling elsewhere.
+package dirwatch
+
+import (
+	"io/ioutil"
+	"strings"
+	"sync"
+)
+
+// A Watcher sends the names of the files written to a directory, starting
+// with those already in it. A name may be sent more than once. Names
+// starting with a dot are skipped, as they are hidden or temporary files.
+type Watcher struct {
+	dir   string
+	files chan string
+	done  chan struct{}
+
+	mu  sync.Mutex
+	err error
+
+	watcher
+}
+
+// New starts watching a directory.
+func New(dir string) (*Watcher, error) {
+	w := &Watcher{
+		dir:   dir,
+		files: make(chan string),
+		done:  make(chan struct{}),
+	}
+	if err := w.start(); err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+// Files returns the channel the names are sent on, which is closed once the
+// watcher stops.
+func (w *Watcher) Files() <-chan string { return w.files }
+
+// Err returns why the watcher stopped, if it failed.
+func (w *Watcher) Err() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.err
+}
+
+// Close stops the watcher.
+func (w *Watcher) Close() error {
+	close(w.done)
+	return w.stop()
+}
+
+// fail stops the watcher because of an error.
+func (w *Watcher) fail(err error) {
+	w.mu.Lock()
+	w.err = err
+	w.mu.Unlock()
+	close(w.files)
+}
+
+// send reports a file, returning false if the watcher was closed.
+func (w *Watcher) send(name string) bool {
+	if strings.HasPrefix(name, ".") {
+		return true
+	}
+	select {
+	case w.files <- name:
+		return true
+	case <-w.done:
+		return false
+	}
+}
+
+// sendAll reports all the files in the directory, returning false if the
+// watcher was closed.
+func (w *Watcher) sendAll() (bool, error) {
+	infos, err := ioutil.ReadDir(w.dir)
+	if err != nil {
+		return true, err
+	}
+	for _, fi := range infos {
+		if fi.Mode().IsRegular() && !w.send(fi.Name()) {
+			return false, nil
+		}
+	}
+	return true, nil
+}
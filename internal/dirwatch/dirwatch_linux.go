@@ -0,0 +1,84 @@
+// Copyright (c) 2014-2015, Daniel Martí <mvdan@mvdan.cc>
+// See LICENSE for licensing information
+
+package dirwatch
+
+import (
+	"bytes"
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+// Files are complete once closed after being written, or once moved into
+// the directory
+const inotifyMask = syscall.IN_CLOSE_WRITE | syscall.IN_MOVED_TO
+
+type watcher struct {
+	f *os.File
+}
+
+func (w *Watcher) start() error {
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC | syscall.IN_NONBLOCK)
+	if err != nil {
+		return os.NewSyscallError("inotify_init1", err)
+	}
+	if _, err := syscall.InotifyAddWatch(fd, w.dir, inotifyMask); err != nil {
+		syscall.Close(fd)
+		return os.NewSyscallError("inotify_add_watch", err)
+	}
+	// Being non-blocking, reads go through the runtime's poller and are
+	// interrupted by Close
+	w.f = os.NewFile(uintptr(fd), w.dir)
+	go w.run()
+	return nil
+}
+
+func (w *Watcher) stop() error {
+	return w.f.Close()
+}
+
+func (w *Watcher) run() {
+	// Listed once watched, so that no file is missed
+	if ok, err := w.sendAll(); err != nil {
+		w.fail(err)
+		return
+	} else if !ok {
+		close(w.files)
+		return
+	}
+	buf := make([]byte, 64*(syscall.SizeofInotifyEvent+syscall.NAME_MAX+1))
+	for {
+		n, err := w.f.Read(buf)
+		if err != nil {
+			select {
+			case <-w.done:
+				close(w.files)
+			default:
+				w.fail(err)
+			}
+			return
+		}
+		for off := 0; off+syscall.SizeofInotifyEvent <= n; {
+			ev := (*syscall.InotifyEvent)(unsafe.Pointer(&buf[off]))
+			start := off + syscall.SizeofInotifyEvent
+			off = start + int(ev.Len)
+			ok := true
+			switch {
+			case ev.Mask&syscall.IN_Q_OVERFLOW != 0:
+				// Some events were dropped
+				if ok, err = w.sendAll(); err != nil {
+					w.fail(err)
+					return
+				}
+			case ev.Mask&syscall.IN_ISDIR == 0 && ev.Len > 0:
+				name := string(bytes.TrimRight(buf[start:off], "\x00"))
+				ok = w.send(name)
+			}
+			if !ok {
+				close(w.files)
+				return
+			}
+		}
+	}
+}
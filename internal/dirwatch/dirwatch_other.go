@@ -0,0 +1,88 @@
+// Copyright (c) 2014-2015, Daniel Martí <mvdan@mvdan.cc>
+// See LICENSE for licensing information
+
+//go:build !linux
+// +build !linux
+
+package dirwatch
+
+import (
+	"io/ioutil"
+	"os"
+	"time"
+)
+
+// How often the directory is listed
+const pollInterval = time.Second
+
+// fileState is what a file looked like when last listed
+type fileState struct {
+	size    int64
+	modTime time.Time
+	sent    bool
+}
+
+type watcher struct{}
+
+func (w *Watcher) start() error {
+	if _, err := ioutil.ReadDir(w.dir); err != nil {
+		return err
+	}
+	go w.run()
+	return nil
+}
+
+func (w *Watcher) stop() error { return nil }
+
+// run lists the directory periodically, reporting each file once it stops
+// changing between two listings.
+func (w *Watcher) run() {
+	seen := make(map[string]*fileState)
+	ticker := time.NewTicker(pollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-w.done:
+			close(w.files)
+			return
+		case <-ticker.C:
+		}
+		infos, err := ioutil.ReadDir(w.dir)
+		if err != nil {
+			w.fail(err)
+			return
+		}
+		listed := make(map[string]bool, len(infos))
+		for _, fi := range infos {
+			if !fi.Mode().IsRegular() {
+				continue
+			}
+			name := fi.Name()
+			listed[name] = true
+			if !w.update(seen, name, fi) {
+				close(w.files)
+				return
+			}
+		}
+		for name := range seen {
+			if !listed[name] {
+				delete(seen, name)
+			}
+		}
+	}
+}
+
+// update records what a file looks like, reporting it if it did not change
+// since the last listing. Returns false if the watcher was closed.
+func (w *Watcher) update(seen map[string]*fileState, name string, fi os.FileInfo) bool {
+	st, e := seen[name]
+	if !e || st.size != fi.Size() || !st.modTime.Equal(fi.ModTime()) {
+		seen[name] = &fileState{size: fi.Size(), modTime: fi.ModTime()}
+		return true
+	}
+	if st.sent {
+		return true
+	}
+	st.sent = true
+	return w.send(name)
+}
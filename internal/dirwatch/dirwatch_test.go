@@ -0,0 +1,57 @@
+package dirwatch
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestWatcher(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pastecat-dirwatch")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	write := func(name string) {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(name), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("before")
+	w, err := New(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	next := func(want string) {
+		select {
+		case name := <-w.Files():
+			if name != want {
+				t.Fatalf("Got %q, want %q", name, want)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Timed out waiting for %q", want)
+		}
+	}
+	next("before")
+	write(".hidden")
+	write("after")
+	next("after")
+	if err := os.Mkdir(filepath.Join(dir, "subdir"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(filepath.Join(dir, ".hidden"), filepath.Join(dir, "moved")); err != nil {
+		t.Fatal(err)
+	}
+	next("moved")
+
+	if err := w.Close(); err != nil {
+		t.Fatalf("Close() errored unexpectedly: %v", err)
+	}
+	for range w.Files() {
+	}
+	if err := w.Err(); err != nil {
+		t.Fatalf("Err() after Close() got %v, want nil", err)
+	}
+}
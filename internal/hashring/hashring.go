@@ -0,0 +1,67 @@
+// Copyright (c) 2014-2015, Daniel Martí <mvdan@mvdan.cc>
+// See LICENSE for licensing information
+
+// Package hashring maps keys to nodes by consistent hashing, so that adding
+// or removing a node only moves the keys that belong to it.
+package hashring
+
+import (
+	"hash/crc32"
+	"sort"
+	"strconv"
+)
+
+// Number of points each node has on the ring, which spreads the keys
+// evenly among the nodes
+const pointsPerNode = 160
+
+type point struct {
+	hash uint32
+	node string
+}
+
+// Ring is a consistent hash ring. The nodes a key maps to only depend on
+// the set of nodes, not on the order they were given in.
+type Ring struct {
+	points []point
+}
+
+// New returns a ring holding the given nodes.
+func New(nodes []string) *Ring {
+	r := &Ring{points: make([]point, 0, len(nodes)*pointsPerNode)}
+	for _, node := range nodes {
+		for i := 0; i < pointsPerNode; i++ {
+			key := node + "#" + strconv.Itoa(i)
+			r.points = append(r.points, point{crc32.ChecksumIEEE([]byte(key)), node})
+		}
+	}
+	sort.Sort(byHash(r.points))
+	return r
+}
+
+type byHash []point
+
+func (p byHash) Len() int      { return len(p) }
+func (p byHash) Swap(i, j int) { p[i], p[j] = p[j], p[i] }
+func (p byHash) Less(i, j int) bool {
+	if p[i].hash != p[j].hash {
+		return p[i].hash < p[j].hash
+	}
+	return p[i].node < p[j].node
+}
+
+// Get returns the node that a key maps to, or an empty string if the ring
+// is empty.
+func (r *Ring) Get(key []byte) string {
+	if len(r.points) == 0 {
+		return ""
+	}
+	h := crc32.ChecksumIEEE(key)
+	i := sort.Search(len(r.points), func(i int) bool {
+		return r.points[i].hash >= h
+	})
+	if i == len(r.points) {
+		i = 0
+	}
+	return r.points[i].node
+}
@@ -0,0 +1,66 @@
+package hashring
+
+import (
+	"encoding/binary"
+	"testing"
+)
+
+func keys(n int) [][]byte {
+	ks := make([][]byte, n)
+	for i := range ks {
+		ks[i] = make([]byte, 4)
+		binary.BigEndian.PutUint32(ks[i], uint32(i)*2654435761)
+	}
+	return ks
+}
+
+func TestSpread(t *testing.T) {
+	nodes := []string{"http://a:8080", "http://b:8080", "http://c:8080"}
+	r := New(nodes)
+	count := make(map[string]int)
+	ks := keys(30000)
+	for _, k := range ks {
+		count[r.Get(k)]++
+	}
+	for _, node := range nodes {
+		if c := count[node]; c < len(ks)/len(nodes)*2/3 {
+			t.Errorf("%s got %d of %d keys", node, c, len(ks))
+		}
+	}
+}
+
+func TestOrder(t *testing.T) {
+	r1 := New([]string{"a", "b", "c"})
+	r2 := New([]string{"c", "a", "b"})
+	for _, k := range keys(1000) {
+		if n1, n2 := r1.Get(k), r2.Get(k); n1 != n2 {
+			t.Fatalf("Key %x got %s and %s depending on the order", k, n1, n2)
+		}
+	}
+}
+
+func TestAddNode(t *testing.T) {
+	before := New([]string{"a", "b", "c"})
+	after := New([]string{"a", "b", "c", "d"})
+	moved := 0
+	ks := keys(10000)
+	for _, k := range ks {
+		n1, n2 := before.Get(k), after.Get(k)
+		if n1 == n2 {
+			continue
+		}
+		if n2 != "d" {
+			t.Fatalf("Key %x moved from %s to %s, not to the new node", k, n1, n2)
+		}
+		moved++
+	}
+	if moved > len(ks)/2 {
+		t.Errorf("Adding a node moved %d of %d keys", moved, len(ks))
+	}
+}
+
+func TestEmpty(t *testing.T) {
+	if got := New(nil).Get([]byte("foo")); got != "" {
+		t.Errorf("Empty ring got %q, want none", got)
+	}
+}
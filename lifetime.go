@@ -0,0 +1,160 @@
+// Copyright (c) 2014-2015, Daniel Martí <mvdan@mvdan.cc>
+// See LICENSE for licensing information
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/mvdan/pastecat/storage"
+)
+
+// Name of the HTTP form field to pick the lifetime of a paste with
+const lifeTimeField = "lifetime"
+
+type lifeTimePreset struct {
+	Name     string
+	LifeTime time.Duration
+}
+
+// Named lifetimes offered for pastes, in increasing order
+var lifeTimePresets = []lifeTimePreset{
+	{"10m", 10 * time.Minute},
+	{"1h", time.Hour},
+	{"1d", 24 * time.Hour},
+	{"1w", 7 * 24 * time.Hour},
+}
+
+// perPasteLifeTimes reports whether uploads may pick their own lifetime,
+// which is enabled by setting any bound.
+func perPasteLifeTimes() bool {
+	return *minLifeTime > 0 || *maxLifeTime > 0
+}
+
+// lifeTimeBounds returns the shortest and longest lifetimes that a paste
+// may pick. Zero means no bound.
+func lifeTimeBounds() (min, max time.Duration) {
+	max = *maxLifeTime
+	if *lifeTime > 0 && (max == 0 || *lifeTime < max) {
+		max = *lifeTime
+	}
+	return *minLifeTime, max
+}
+
+func checkLifeTime(lt time.Duration) error {
+	min, max := lifeTimeBounds()
+	if lt < min {
+		return fmt.Errorf("lifetime must be at least %s", min)
+	}
+	if max > 0 && lt > max {
+		return fmt.Errorf("lifetime must be at most %s", max)
+	}
+	return nil
+}
+
+// parseLifeTime parses either the name of a preset or a duration.
+func parseLifeTime(value string) (time.Duration, error) {
+	for _, p := range lifeTimePresets {
+		if p.Name == value {
+			return p.LifeTime, nil
+		}
+	}
+	lt, err := time.ParseDuration(value)
+	if err != nil || lt <= 0 {
+		return 0, fmt.Errorf("invalid lifetime '%s'", value)
+	}
+	return lt, nil
+}
+
+// formLifeTime returns the lifetime picked by an upload, if any. It is
+// ignored unless per-paste lifetimes are enabled.
+func formLifeTime(r *http.Request) (time.Duration, error) {
+	value := r.FormValue(lifeTimeField)
+	if !perPasteLifeTimes() || value == "" {
+		return 0, nil
+	}
+	lt, err := parseLifeTime(value)
+	if err != nil {
+		return 0, err
+	}
+	return lt, checkLifeTime(lt)
+}
+
+// lifeTimeOptions returns the presets that uploads may pick, if per-paste
+// lifetimes are enabled.
+func lifeTimeOptions() []lifeTimePreset {
+	if !perPasteLifeTimes() {
+		return nil
+	}
+	var options []lifeTimePreset
+	for _, p := range lifeTimePresets {
+		if checkLifeTime(p.LifeTime) == nil {
+			options = append(options, p)
+		}
+	}
+	return options
+}
+
+// sizeLifeTime caps the lifetime of the pastes of at least a size
+type sizeLifeTime struct {
+	Size     storage.ByteSize
+	LifeTime time.Duration
+}
+
+// sizeLifeTimes caps the lifetime of pastes by their size, sorted by size.
+// It is set like "10K=1d,1M=1h".
+type sizeLifeTimes []sizeLifeTime
+
+func (s *sizeLifeTimes) String() string {
+	var rules []string
+	for _, rule := range *s {
+		rules = append(rules, fmt.Sprintf("%s=%s", rule.Size, rule.LifeTime))
+	}
+	return strings.Join(rules, ",")
+}
+
+func (s *sizeLifeTimes) Set(value string) error {
+	*s = nil
+	for _, rule := range splitList(value) {
+		i := strings.IndexByte(rule, '=')
+		if i < 0 {
+			return fmt.Errorf("invalid rule '%s', want size=lifetime", rule)
+		}
+		var sl sizeLifeTime
+		if err := sl.Size.Set(rule[:i]); err != nil {
+			return err
+		}
+		lt, err := parseLifeTime(rule[i+1:])
+		if err != nil {
+			return err
+		}
+		sl.LifeTime = lt
+		*s = append(*s, sl)
+	}
+	sort.Slice(*s, func(i, j int) bool { return (*s)[i].Size < (*s)[j].Size })
+	return nil
+}
+
+// lifeTime returns the maximum lifetime of a paste of the given size, or
+// zero if no rule caps it.
+func (s sizeLifeTimes) lifeTime(size int64) time.Duration {
+	var max time.Duration
+	for _, rule := range s {
+		if size >= int64(rule.Size) {
+			max = rule.LifeTime
+		}
+	}
+	return max
+}
+
+// capLifeTime shortens the lifetime of a paste to max, if it is not zero
+// and the paste would otherwise live longer.
+func capLifeTime(meta *storage.Meta, max time.Duration) {
+	if lt := meta.EffectiveLifeTime(*lifeTime); max > 0 && (lt == 0 || max < lt) {
+		meta.LifeTime = max
+	}
+}
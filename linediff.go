@@ -0,0 +1,197 @@
+// Copyright (c) 2014-2015, Daniel Martí <mvdan@mvdan.cc>
+// See LICENSE for licensing information
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+)
+
+const (
+	// Lines of context around the changes of a hunk
+	diffContext = 3
+	// Maximum number of edits to look for before giving up on a minimal
+	// diff and replacing all the differing lines instead
+	maxDiffEdits = 1000
+)
+
+// diffOp is a line kept (' '), removed ('-') or added ('+') by a diff
+type diffOp struct {
+	kind byte
+	line []byte
+}
+
+// editScript returns the edits turning the lines of a into those of b.
+func editScript(a, b [][]byte) []diffOp {
+	pre := 0
+	for pre < len(a) && pre < len(b) && bytes.Equal(a[pre], b[pre]) {
+		pre++
+	}
+	suf := 0
+	for suf < len(a)-pre && suf < len(b)-pre &&
+		bytes.Equal(a[len(a)-1-suf], b[len(b)-1-suf]) {
+		suf++
+	}
+	var ops []diffOp
+	for _, line := range a[:pre] {
+		ops = append(ops, diffOp{' ', line})
+	}
+	ops = append(ops, myersDiff(a[pre:len(a)-suf], b[pre:len(b)-suf])...)
+	for _, line := range a[len(a)-suf:] {
+		ops = append(ops, diffOp{' ', line})
+	}
+	return ops
+}
+
+// myersDiff finds the shortest edit script between a and b with the
+// Myers algorithm, as long as it takes at most maxDiffEdits edits.
+func myersDiff(a, b [][]byte) []diffOp {
+	n, m := len(a), len(b)
+	limit := n + m
+	if limit > maxDiffEdits {
+		limit = maxDiffEdits
+	}
+	off := limit + 1
+	v := make([]int, 2*limit+3)
+	// trace holds the furthest x on each diagonal k in [-d, d] before
+	// each step d, to walk the path back once found
+	var trace [][]int
+	for d := 0; d <= limit; d++ {
+		trace = append(trace, append([]int(nil), v[off-d:off+d+1]...))
+		for k := -d; k <= d; k += 2 {
+			var x int
+			if k == -d || (k != d && v[off+k-1] < v[off+k+1]) {
+				x = v[off+k+1]
+			} else {
+				x = v[off+k-1] + 1
+			}
+			y := x - k
+			for x < n && y < m && bytes.Equal(a[x], b[y]) {
+				x++
+				y++
+			}
+			v[off+k] = x
+			if x >= n && y >= m {
+				return backtrackDiff(a, b, trace)
+			}
+		}
+	}
+	ops := make([]diffOp, 0, n+m)
+	for _, line := range a {
+		ops = append(ops, diffOp{'-', line})
+	}
+	for _, line := range b {
+		ops = append(ops, diffOp{'+', line})
+	}
+	return ops
+}
+
+func backtrackDiff(a, b [][]byte, trace [][]int) []diffOp {
+	x, y := len(a), len(b)
+	var rev []diffOp
+	for d := len(trace) - 1; d > 0; d-- {
+		v := trace[d]
+		k := x - y
+		prevK := k - 1
+		if k == -d || (k != d && v[k-1+d] < v[k+1+d]) {
+			prevK = k + 1
+		}
+		prevX := v[prevK+d]
+		prevY := prevX - prevK
+		for x > prevX && y > prevY {
+			rev = append(rev, diffOp{' ', a[x-1]})
+			x--
+			y--
+		}
+		if x == prevX {
+			rev = append(rev, diffOp{'+', b[prevY]})
+		} else {
+			rev = append(rev, diffOp{'-', a[prevX]})
+		}
+		x, y = prevX, prevY
+	}
+	for ; x > 0; x-- {
+		rev = append(rev, diffOp{' ', a[x-1]})
+	}
+	ops := make([]diffOp, len(rev))
+	for i, op := range rev {
+		ops[len(rev)-1-i] = op
+	}
+	return ops
+}
+
+// writeUnifiedDiff writes the differences between two contents as a
+// unified diff, writing nothing if they are equal.
+func writeUnifiedDiff(w io.Writer, fromName, toName string, from, to []byte) {
+	ops := editScript(diffLines(from), diffLines(to))
+	header := false
+	aPos, bPos := 0, 0
+	for i := 0; i < len(ops); {
+		if ops[i].kind == ' ' {
+			aPos++
+			bPos++
+			i++
+			continue
+		}
+		if !header {
+			fmt.Fprintf(w, "--- %s\n+++ %s\n", fromName, toName)
+			header = true
+		}
+		// Join the following changes into the hunk while they are
+		// close enough for their contexts to overlap
+		end := i
+		for end < len(ops) {
+			if ops[end].kind != ' ' {
+				end++
+				continue
+			}
+			j := end
+			for j < len(ops) && ops[j].kind == ' ' {
+				j++
+			}
+			if j == len(ops) || j-end > 2*diffContext {
+				break
+			}
+			end = j
+		}
+		start := i - diffContext
+		if start < 0 {
+			start = 0
+		}
+		stop := end + diffContext
+		if stop > len(ops) {
+			stop = len(ops)
+		}
+		aPos -= i - start
+		bPos -= i - start
+		aLen, bLen := 0, 0
+		for _, op := range ops[start:stop] {
+			if op.kind != '+' {
+				aLen++
+			}
+			if op.kind != '-' {
+				bLen++
+			}
+		}
+		aStart, bStart := aPos, bPos
+		if aLen > 0 {
+			aStart++
+		}
+		if bLen > 0 {
+			bStart++
+		}
+		fmt.Fprintf(w, "@@ -%d,%d +%d,%d @@\n", aStart, aLen, bStart, bLen)
+		for _, op := range ops[start:stop] {
+			w.Write([]byte{op.kind})
+			w.Write(op.line)
+			if !bytes.HasSuffix(op.line, []byte("\n")) {
+				io.WriteString(w, "\n\\ No newline at end of file\n")
+			}
+		}
+		aPos += aLen
+		bPos += bLen
+		i = stop
+	}
+}
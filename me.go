@@ -0,0 +1,132 @@
+// Copyright (c) 2014-2015, Daniel Martí <mvdan@mvdan.cc>
+// See LICENSE for licensing information
+
+package main
+
+import (
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/mvdan/pastecat/storage"
+)
+
+// Prefix of the routes letting users manage their own pastes
+const mePrefix = "/me/"
+
+// meHandler lets users list and delete the pastes they own, as identified
+// by any of the ways to authenticate uploads.
+type meHandler struct {
+	h *httpHandler
+}
+
+func (m meHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	owner, _, err := m.h.identify(r)
+	if err == nil && owner == "" {
+		err = errLoginRequired
+	}
+	if err != nil {
+		if r.URL.Path == mePrefix && m.h.oidc != nil {
+			http.Redirect(w, r, loginPath+"?next="+url.QueryEscape(mePrefix), http.StatusFound)
+			return
+		}
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	switch {
+	case r.URL.Path == mePrefix && r.Method == "GET":
+		m.servePage(w, r, owner)
+	case r.URL.Path == "/me/pastes" && r.Method == "GET":
+		opts, err := listOptionsFromForm(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		opts.Owner = owner
+		writeListing(w, m.h.store, opts)
+	case strings.HasPrefix(r.URL.Path, "/me/pastes/") && r.Method == "DELETE":
+		m.handleDelete(w, r, owner)
+	default:
+		http.Error(w, unknownAction, http.StatusBadRequest)
+	}
+}
+
+// servePage serves a page listing the user's newest pastes, from which they
+// can be deleted.
+func (m meHandler) servePage(w http.ResponseWriter, r *http.Request, owner string) {
+	entries, total, err := storage.List(m.h.store, storage.ListOptions{
+		Limit: maxPageSize,
+		Owner: owner,
+	})
+	if err != nil {
+		m.h.storeError(w, r, err)
+		return
+	}
+	type pasteRow struct {
+		ID      string
+		URL     string
+		Size    storage.ByteSize
+		Created time.Time
+		// Expires is zero if the paste never expires
+		Expires time.Time
+	}
+	rows := make([]pasteRow, len(entries))
+	for i, e := range entries {
+		rows[i] = pasteRow{
+			ID:      e.ID.String(),
+			URL:     pasteURL(e.ID, e.Meta),
+			Size:    storage.ByteSize(e.Size),
+			Created: e.Created(e.ModTime).UTC(),
+		}
+		if lt := e.EffectiveLifeTime(*lifeTime); lt > 0 {
+			rows[i].Expires = rows[i].Created.Add(lt)
+		}
+	}
+	user := owner
+	if m.h.oidc != nil {
+		if session, ok := m.h.oidc.session(r); ok && session.Subject == owner {
+			user = session.Name
+		}
+	}
+	err = tmpl.ExecuteTemplate(w, "me", struct {
+		SiteURL string
+		User    string
+		Total   int
+		Pastes  []pasteRow
+	}{*siteURL, user, total, rows})
+	if err != nil {
+		log.Printf("Error executing template for %s: %v", r.URL.Path, err)
+	}
+}
+
+func (m meHandler) handleDelete(w http.ResponseWriter, r *http.Request, owner string) {
+	id, err := storage.IDFromString(r.URL.Path[len("/me/pastes/"):])
+	if err != nil {
+		http.Error(w, invalidID, http.StatusBadRequest)
+		return
+	}
+	sp, done := m.h.storeSpan(r, "Stat"), timePhase(r, "store")
+	info, err := storage.Stat(m.h.store, id)
+	sp.endWith(err)
+	done()
+	if err != nil {
+		m.h.storeError(w, r, err)
+		return
+	}
+	if info.Owner != owner {
+		// Not telling apart the pastes of others from missing ones
+		http.Error(w, storage.ErrPasteNotFound.Error(), http.StatusNotFound)
+		return
+	}
+	sp, done = m.h.storeSpan(r, "Delete"), timePhase(r, "store")
+	err = m.h.deletePaste(id, reasonOwner, owner)
+	sp.endWith(err)
+	done()
+	if err != nil {
+		m.h.storeError(w, r, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,186 @@
+// Copyright (c) 2014-2015, Daniel Martí <mvdan@mvdan.cc>
+// See LICENSE for licensing information
+
+package main
+
+import (
+	"expvar"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/mvdan/pastecat/storage"
+)
+
+var (
+	uploadCount   = expvar.NewInt("uploads")
+	downloadCount = expvar.NewInt("downloads")
+	// Responses with a 5xx status code
+	errorCount = expvar.NewInt("errors")
+	// Store operation metrics, per backend type
+	storeVars = expvar.NewMap("store")
+)
+
+// Upper bounds of the store operation latency histogram buckets
+var latencyBuckets = []time.Duration{
+	time.Millisecond,
+	10 * time.Millisecond,
+	100 * time.Millisecond,
+	time.Second,
+}
+
+// metricsStore records the count, errors and latency of the operations of
+// the store it wraps.
+type metricsStore struct {
+	storage.Store
+	vars *expvar.Map
+}
+
+func newMetricsStore(s storage.Store, backend string) metricsStore {
+	vars := new(expvar.Map).Init()
+	storeVars.Set(backend, vars)
+	return metricsStore{Store: s, vars: vars}
+}
+
+func (s metricsStore) observe(op string, start time.Time, err error) {
+	took := time.Since(start)
+	s.vars.Add(op+"_count", 1)
+	if err != nil && err != storage.ErrPasteNotFound {
+		s.vars.Add(op+"_errors", 1)
+	}
+	s.vars.Add(op+"_latency_us", int64(took/time.Microsecond))
+	for _, le := range latencyBuckets {
+		if took <= le {
+			s.vars.Add(fmt.Sprintf("%s_le_%s", op, le), 1)
+		}
+	}
+}
+
+func (s metricsStore) Get(id storage.ID) (storage.Paste, error) {
+	start := time.Now()
+	paste, err := s.Store.Get(id)
+	s.observe("get", start, err)
+	return paste, err
+}
+
+func (s metricsStore) Stat(id storage.ID) (storage.Info, error) {
+	start := time.Now()
+	info, err := storage.Stat(s.Store, id)
+	s.observe("stat", start, err)
+	return info, err
+}
+
+func (s metricsStore) Put(content []byte, meta storage.Meta) (storage.ID, error) {
+	start := time.Now()
+	id, err := s.Store.Put(content, meta)
+	s.observe("put", start, err)
+	return id, err
+}
+
+func (s metricsStore) Delete(id storage.ID) error {
+	start := time.Now()
+	err := s.Store.Delete(id)
+	s.observe("delete", start, err)
+	return err
+}
+
+func (s metricsStore) DeleteBatch(ids []storage.ID) error {
+	start := time.Now()
+	err := storage.DeleteBatch(s.Store, ids)
+	s.observe("delete_batch", start, err)
+	return err
+}
+
+func (s metricsStore) Update(id storage.ID, content []byte, meta storage.Meta) error {
+	start := time.Now()
+	err := s.Store.Update(id, content, meta)
+	s.observe("update", start, err)
+	return err
+}
+
+func (s metricsStore) GetVersion(id storage.ID, version int) (storage.Paste, error) {
+	start := time.Now()
+	paste, err := s.Store.GetVersion(id, version)
+	s.observe("get_version", start, err)
+	return paste, err
+}
+
+func (s metricsStore) Copy(id storage.ID, content []byte, meta storage.Meta, modTime time.Time, versions [][]byte) error {
+	start := time.Now()
+	err := s.Store.Copy(id, content, meta, modTime, versions)
+	s.observe("copy", start, err)
+	return err
+}
+
+func publishStoreVars(stats *storage.Stats) {
+	expvar.Publish("pastes", expvar.Func(func() interface{} {
+		num, _ := stats.Report()
+		return num
+	}))
+	expvar.Publish("storage", expvar.Func(func() interface{} {
+		_, stg := stats.Report()
+		return stg
+	}))
+}
+
+func publishMirrorVars(mirror *storage.MirrorStore) {
+	expvar.Publish("mirror_pending", expvar.Func(func() interface{} {
+		return mirror.Pending()
+	}))
+}
+
+// statusWriter records the status of a response. Like the other writers
+// wrapping a response, it implements io.ReaderFrom so that io.Copy reaches
+// the server's own ReadFrom, which sends pastes kept in files with
+// sendfile instead of copying them through userspace. They also implement
+// Unwrap, so that a cluster's connections can take over the server's.
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *statusWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *statusWriter) Write(p []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	return w.ResponseWriter.Write(p)
+}
+
+// ReadFrom records an implicit 200, like Write.
+func (w *statusWriter) ReadFrom(r io.Reader) (int64, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	return io.Copy(w.ResponseWriter, r)
+}
+
+func (w *statusWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// countErrors wraps a handler so that its server errors are counted.
+func countErrors(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		sw := &statusWriter{ResponseWriter: w}
+		h.ServeHTTP(sw, r)
+		if sw.status >= 500 {
+			errorCount.Add(1)
+		}
+	})
+}
+
+// debugMux serves the debugging endpoints, to be kept off the public
+// listener.
+func debugMux() *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.Handle("/debug/vars", expvar.Handler())
+	return mux
+}
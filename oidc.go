@@ -0,0 +1,435 @@
+// Copyright (c) 2014-2015, Daniel Martí <mvdan@mvdan.cc>
+// See LICENSE for licensing information
+
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Paths of the routes logging users in and out of the web interface
+const (
+	authPrefix   = "/auth/"
+	loginPath    = authPrefix + "login"
+	callbackPath = authPrefix + "callback"
+	logoutPath   = authPrefix + "logout"
+)
+
+const (
+	// Cookie holding the logged in user
+	sessionCookie = "pastecat_session"
+	// Cookie holding the state of a login in progress
+	loginCookie = "pastecat_login"
+	// How long users stay logged in for
+	sessionLifeTime = 24 * time.Hour
+	// How long users have to log in with the provider
+	loginLifeTime = 10 * time.Minute
+	// Minimum time between fetching the provider's keys again, when an ID
+	// token is signed with an unknown key
+	oidcKeysInterval = 1 * time.Minute
+	// How far the clocks of the provider and ours may be apart
+	oidcLeeway = 1 * time.Minute
+)
+
+var errLoginRequired = errors.New("login required")
+
+// oidcSession is the user logged in to the web interface, as kept in a
+// signed cookie
+type oidcSession struct {
+	Subject string `json:"sub"`
+	// Name is what to show the user as
+	Name    string `json:"name,omitempty"`
+	Expires int64  `json:"exp"`
+}
+
+// oidcLogin is a login in progress, as kept in a signed cookie until the
+// provider sends the user back
+type oidcLogin struct {
+	State   string `json:"state"`
+	Nonce   string `json:"nonce"`
+	Next    string `json:"next"`
+	Expires int64  `json:"exp"`
+}
+
+// oidcProvider logs users in via an OpenID Connect provider, using the
+// authorization code flow.
+type oidcProvider struct {
+	client       *http.Client
+	issuer       string
+	clientID     string
+	clientSecret string
+	redirectURL  string
+	authURL      string
+	tokenURL     string
+	keysURL      string
+	// sessionKey signs the cookies, and is derived from the client secret
+	// so that sessions survive restarts
+	sessionKey []byte
+
+	mu      sync.Mutex
+	keys    map[string]crypto.PublicKey
+	fetched time.Time
+}
+
+// newOIDCProvider discovers the endpoints of the provider at issuer.
+func newOIDCProvider(issuer, clientID, clientSecret string) (*oidcProvider, error) {
+	o := &oidcProvider{
+		client:       &http.Client{Timeout: *timeout},
+		issuer:       issuer,
+		clientID:     clientID,
+		clientSecret: clientSecret,
+		redirectURL:  *siteURL + callbackPath,
+	}
+	mac := hmac.New(sha256.New, []byte(clientSecret))
+	mac.Write([]byte("pastecat session"))
+	o.sessionKey = mac.Sum(nil)
+	var doc struct {
+		Issuer   string `json:"issuer"`
+		AuthURL  string `json:"authorization_endpoint"`
+		TokenURL string `json:"token_endpoint"`
+		KeysURL  string `json:"jwks_uri"`
+	}
+	if err := o.getJSON(strings.TrimSuffix(issuer, "/")+"/.well-known/openid-configuration", &doc); err != nil {
+		return nil, err
+	}
+	if doc.Issuer != issuer {
+		return nil, fmt.Errorf("provider claims to be issuer %q", doc.Issuer)
+	}
+	if doc.AuthURL == "" || doc.TokenURL == "" || doc.KeysURL == "" {
+		return nil, fmt.Errorf("provider is missing endpoints")
+	}
+	o.authURL, o.tokenURL, o.keysURL = doc.AuthURL, doc.TokenURL, doc.KeysURL
+	return o, nil
+}
+
+func (o *oidcProvider) getJSON(u string, v interface{}) error {
+	resp, err := o.client.Get(u)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s: %s", u, resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// seal encodes v as a cookie value signed with the session key.
+func (o *oidcProvider) seal(v interface{}) string {
+	b, _ := json.Marshal(v)
+	payload := base64.RawURLEncoding.EncodeToString(b)
+	mac := hmac.New(sha256.New, o.sessionKey)
+	mac.Write([]byte(payload))
+	return payload + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// open decodes a cookie value made by seal into v, reporting whether its
+// signature was valid.
+func (o *oidcProvider) open(value string, v interface{}) bool {
+	i := strings.IndexByte(value, '.')
+	if i < 0 {
+		return false
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(value[i+1:])
+	if err != nil {
+		return false
+	}
+	mac := hmac.New(sha256.New, o.sessionKey)
+	mac.Write([]byte(value[:i]))
+	if !hmac.Equal(sig, mac.Sum(nil)) {
+		return false
+	}
+	b, err := base64.RawURLEncoding.DecodeString(value[:i])
+	return err == nil && json.Unmarshal(b, v) == nil
+}
+
+func (o *oidcProvider) setCookie(w http.ResponseWriter, name, path, value string, maxAge time.Duration) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     name,
+		Value:    value,
+		Path:     path,
+		MaxAge:   int(maxAge.Seconds()),
+		Secure:   strings.HasPrefix(*siteURL, "https:"),
+		HttpOnly: true,
+		// Not sent along with uploads from other sites
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// session returns the user logged in with the request, if any.
+func (o *oidcProvider) session(r *http.Request) (oidcSession, bool) {
+	var s oidcSession
+	c, err := r.Cookie(sessionCookie)
+	if err != nil || !o.open(c.Value, &s) {
+		return s, false
+	}
+	return s, s.Subject != "" && time.Now().Unix() < s.Expires
+}
+
+func (o *oidcProvider) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, unknownAction, http.StatusBadRequest)
+		return
+	}
+	switch r.URL.Path {
+	case loginPath:
+		o.handleLogin(w, r)
+	case callbackPath:
+		o.handleCallback(w, r)
+	case logoutPath:
+		o.setCookie(w, sessionCookie, "/", "", -1)
+		http.Redirect(w, r, "/", http.StatusFound)
+	default:
+		http.Error(w, unknownAction, http.StatusBadRequest)
+	}
+}
+
+func randomHex() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// handleLogin sends the user to the provider to log in, to come back to
+// the page given as "next".
+func (o *oidcProvider) handleLogin(w http.ResponseWriter, r *http.Request) {
+	next := r.FormValue("next")
+	// Only go back to pages of this site
+	if !strings.HasPrefix(next, "/") || strings.HasPrefix(next, "//") {
+		next = "/"
+	}
+	login := oidcLogin{
+		State:   randomHex(),
+		Nonce:   randomHex(),
+		Next:    next,
+		Expires: time.Now().Add(loginLifeTime).Unix(),
+	}
+	o.setCookie(w, loginCookie, authPrefix, o.seal(login), loginLifeTime)
+	q := url.Values{}
+	q.Set("response_type", "code")
+	q.Set("client_id", o.clientID)
+	q.Set("redirect_uri", o.redirectURL)
+	q.Set("scope", "openid profile email")
+	q.Set("state", login.State)
+	q.Set("nonce", login.Nonce)
+	sep := "?"
+	if strings.Contains(o.authURL, "?") {
+		sep = "&"
+	}
+	http.Redirect(w, r, o.authURL+sep+q.Encode(), http.StatusFound)
+}
+
+// handleCallback logs the user in once the provider sends them back with
+// an authorization code.
+func (o *oidcProvider) handleCallback(w http.ResponseWriter, r *http.Request) {
+	var login oidcLogin
+	c, err := r.Cookie(loginCookie)
+	if err != nil || !o.open(c.Value, &login) || time.Now().Unix() >= login.Expires ||
+		!secretsEqual(r.FormValue("state"), login.State) {
+		http.Error(w, "invalid or expired login", http.StatusBadRequest)
+		return
+	}
+	o.setCookie(w, loginCookie, authPrefix, "", -1)
+	if e := r.FormValue("error"); e != "" {
+		http.Error(w, "login failed: "+e, http.StatusForbidden)
+		return
+	}
+	claims, err := o.exchange(r.FormValue("code"), login.Nonce)
+	if err != nil {
+		log.Printf("Could not log in via OpenID Connect: %v", err)
+		http.Error(w, "login failed", http.StatusForbidden)
+		return
+	}
+	s := oidcSession{
+		Subject: claims.Subject,
+		Name:    claims.name(),
+		Expires: time.Now().Add(sessionLifeTime).Unix(),
+	}
+	o.setCookie(w, sessionCookie, "/", o.seal(s), sessionLifeTime)
+	http.Redirect(w, r, login.Next, http.StatusFound)
+}
+
+// idClaims are the claims of an ID token used by pastecat
+type idClaims struct {
+	Issuer   string          `json:"iss"`
+	Subject  string          `json:"sub"`
+	Audience json.RawMessage `json:"aud"`
+	Expires  int64           `json:"exp"`
+	Nonce    string          `json:"nonce"`
+
+	Username string `json:"preferred_username"`
+	Email    string `json:"email"`
+}
+
+func (c idClaims) name() string {
+	switch {
+	case c.Username != "":
+		return c.Username
+	case c.Email != "":
+		return c.Email
+	}
+	return c.Subject
+}
+
+// exchange gets the ID token for an authorization code, and returns its
+// claims once verified.
+func (o *oidcProvider) exchange(code, nonce string) (idClaims, error) {
+	form := url.Values{}
+	form.Set("grant_type", "authorization_code")
+	form.Set("code", code)
+	form.Set("redirect_uri", o.redirectURL)
+	req, err := http.NewRequest("POST", o.tokenURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return idClaims{}, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.SetBasicAuth(url.QueryEscape(o.clientID), url.QueryEscape(o.clientSecret))
+	resp, err := o.client.Do(req)
+	if err != nil {
+		return idClaims{}, err
+	}
+	defer resp.Body.Close()
+	var reply struct {
+		IDToken string `json:"id_token"`
+		Error   string `json:"error"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&reply); err != nil {
+		return idClaims{}, fmt.Errorf("token endpoint: %s", resp.Status)
+	}
+	if resp.StatusCode != http.StatusOK || reply.IDToken == "" {
+		return idClaims{}, fmt.Errorf("token endpoint: %s %s", resp.Status, reply.Error)
+	}
+	return o.verify(reply.IDToken, nonce, time.Now())
+}
+
+// verify checks the signature and claims of an ID token.
+func (o *oidcProvider) verify(token, nonce string, now time.Time) (idClaims, error) {
+	var claims idClaims
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return claims, fmt.Errorf("malformed id token")
+	}
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeJWTPart(parts[0], &header); err != nil {
+		return claims, err
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return claims, fmt.Errorf("malformed id token signature")
+	}
+	key, err := o.key(header.Kid)
+	if err != nil {
+		return claims, err
+	}
+	sum := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	valid := false
+	switch key := key.(type) {
+	case *rsa.PublicKey:
+		valid = header.Alg == "RS256" && rsa.VerifyPKCS1v15(key, crypto.SHA256, sum[:], sig) == nil
+	case *ecdsa.PublicKey:
+		valid = header.Alg == "ES256" && len(sig) == 64 && ecdsa.Verify(key, sum[:],
+			new(big.Int).SetBytes(sig[:32]), new(big.Int).SetBytes(sig[32:]))
+	}
+	if !valid {
+		return claims, fmt.Errorf("invalid id token signature")
+	}
+	if err := decodeJWTPart(parts[1], &claims); err != nil {
+		return claims, err
+	}
+	var audience []string
+	if json.Unmarshal(claims.Audience, &audience) != nil {
+		audience = make([]string, 1)
+		json.Unmarshal(claims.Audience, &audience[0])
+	}
+	forUs := false
+	for _, aud := range audience {
+		forUs = forUs || aud == o.clientID
+	}
+	switch {
+	case claims.Issuer != o.issuer:
+		return claims, fmt.Errorf("id token issued by %q", claims.Issuer)
+	case !forUs:
+		return claims, fmt.Errorf("id token not issued for us")
+	case now.Add(-oidcLeeway).Unix() >= claims.Expires:
+		return claims, fmt.Errorf("id token expired")
+	case claims.Nonce != nonce:
+		return claims, fmt.Errorf("id token has the wrong nonce")
+	case claims.Subject == "":
+		return claims, fmt.Errorf("id token has no subject")
+	}
+	return claims, nil
+}
+
+func decodeJWTPart(part string, v interface{}) error {
+	b, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil || json.Unmarshal(b, v) != nil {
+		return fmt.Errorf("malformed id token")
+	}
+	return nil
+}
+
+// key returns the provider's public key with the given id, fetching the
+// provider's keys again if it is unknown.
+func (o *oidcProvider) key(kid string) (crypto.PublicKey, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if key, e := o.keys[kid]; e {
+		return key, nil
+	}
+	if time.Since(o.fetched) < oidcKeysInterval {
+		return nil, fmt.Errorf("unknown key %q", kid)
+	}
+	o.fetched = time.Now()
+	var set struct {
+		Keys []struct {
+			Kty string `json:"kty"`
+			Kid string `json:"kid"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+			Crv string `json:"crv"`
+			X   string `json:"x"`
+			Y   string `json:"y"`
+		} `json:"keys"`
+	}
+	if err := o.getJSON(o.keysURL, &set); err != nil {
+		return nil, err
+	}
+	o.keys = make(map[string]crypto.PublicKey)
+	num := func(s string) *big.Int {
+		b, _ := base64.RawURLEncoding.DecodeString(s)
+		return new(big.Int).SetBytes(b)
+	}
+	for _, k := range set.Keys {
+		switch {
+		case k.Kty == "RSA":
+			o.keys[k.Kid] = &rsa.PublicKey{N: num(k.N), E: int(num(k.E).Int64())}
+		case k.Kty == "EC" && k.Crv == "P-256":
+			o.keys[k.Kid] = &ecdsa.PublicKey{Curve: elliptic.P256(), X: num(k.X), Y: num(k.Y)}
+		}
+	}
+	if key, e := o.keys[kid]; e {
+		return key, nil
+	}
+	return nil, fmt.Errorf("unknown key %q", kid)
+}
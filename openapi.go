@@ -0,0 +1,545 @@
+// Copyright (c) 2014-2015, Daniel Martí <mvdan@mvdan.cc>
+// See LICENSE for licensing information
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+
+	"github.com/mvdan/pastecat/storage"
+)
+
+type apiObject map[string]interface{}
+
+func apiText(desc string) apiObject {
+	return apiObject{
+		"description": desc,
+		"content": apiObject{
+			"text/plain": apiObject{"schema": apiObject{"type": "string"}},
+		},
+	}
+}
+
+func apiJSON(desc string) apiObject {
+	return apiObject{
+		"description": desc,
+		"content": apiObject{
+			"application/json": apiObject{"schema": apiObject{"type": "object"}},
+		},
+	}
+}
+
+func apiError(desc string) apiObject {
+	return apiObject{"description": desc}
+}
+
+func apiPathParam(name string, schema apiObject) apiObject {
+	return apiObject{
+		"name":     name,
+		"in":       "path",
+		"required": true,
+		"schema":   schema,
+	}
+}
+
+func apiIDParam() apiObject {
+	return apiPathParam("id", apiObject{
+		"type":    "string",
+		"pattern": fmt.Sprintf("^[0-9a-f]{%d}$", len(storage.ID{})*2),
+	})
+}
+
+// apiViewParam is the query parameter picking an HTML view of a paste
+func apiViewParam() apiObject {
+	var names []string
+	for name := range pasteViews {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return apiObject{
+		"name":        viewParam,
+		"in":          "query",
+		"description": "Serve the paste as an HTML view instead",
+		"schema":      apiObject{"type": "string", "enum": names},
+	}
+}
+
+// apiWriteParam is the query parameter holding a paste's write token
+func apiWriteParam(required bool) apiObject {
+	return apiObject{
+		"name":        writeParam,
+		"in":          "query",
+		"description": "The write token given on upload via X-Edit-Url",
+		"required":    required,
+		"schema":      apiObject{"type": "string"},
+	}
+}
+
+// apiIfMatchParam is the header holding the ETag of the content an edit
+// was based on
+func apiIfMatchParam() apiObject {
+	return apiObject{
+		"name":        "If-Match",
+		"in":          "header",
+		"description": "Only edit the paste if its ETag is still this one",
+		"schema":      apiObject{"type": "string"},
+	}
+}
+
+// apiRevisionParam is a query parameter picking a revision of a paste, as
+// numbered by its history
+func apiRevisionParam(name, description string) apiObject {
+	return apiObject{
+		"name":        name,
+		"in":          "query",
+		"description": description,
+		"schema":      apiObject{"type": "integer", "minimum": 1},
+	}
+}
+
+// apiPasteBody returns the request body of uploads taking the paste from
+// any of the given form fields.
+func apiPasteBody(fields []string) apiObject {
+	props := apiObject{}
+	for _, field := range fields {
+		props[field] = apiObject{
+			"type":      "string",
+			"maxLength": int64(routeMaxSize(apiMaxSize)),
+		}
+	}
+	if *encryptedMode {
+		props[encryptedField] = apiObject{
+			"type":        "boolean",
+			"description": "The paste was encrypted by the client, and is to be served as is",
+		}
+	}
+	props[titleField] = apiObject{
+		"type":        "string",
+		"maxLength":   maxTitleLength,
+		"description": "A short description of the paste",
+	}
+	props[contentTypeField] = apiObject{
+		"type":        "string",
+		"enum":        pasteTypeNames(),
+		"description": "The Content-Type to serve the paste with, instead of text/plain",
+	}
+	if *recentCount > 0 {
+		props[listedField] = apiObject{
+			"type":        "boolean",
+			"description": "Show the paste in the public listing of recent pastes",
+		}
+	}
+	schema := apiObject{"type": "object", "properties": props}
+	return apiObject{
+		"required": true,
+		"content": apiObject{
+			"multipart/form-data":               apiObject{"schema": schema},
+			"application/x-www-form-urlencoded": apiObject{"schema": schema},
+		},
+	}
+}
+
+func apiRawBody(mediaType string) apiObject {
+	return apiObject{
+		"required": true,
+		"content": apiObject{
+			mediaType: apiObject{"schema": apiObject{
+				"type":      "string",
+				"maxLength": int64(routeMaxSize(apiMaxSize)),
+			}},
+		},
+	}
+}
+
+// openAPI returns an OpenAPI document describing the routes enabled in
+// this instance and its limits.
+func (h *httpHandler) openAPI() apiObject {
+	fields := compat.fieldNames()
+	sort.Strings(fields)
+	uploadResponses := apiObject{
+		"200": apiText("The url of the new paste"),
+		"400": apiError("No paste was provided"),
+		"401": apiError("Unknown upload token, or logging in is required"),
+		"403": apiError("The storage quota of the upload token was exceeded"),
+		"413": apiError("The paste was larger than the maximum size"),
+		"503": apiError("The maximum number or storage of pastes was reached"),
+	}
+	editResponses := apiObject{
+		"200": apiText("The url of the edited paste"),
+		"400": apiError("No paste was provided"),
+		"403": apiError("Invalid write token"),
+		"404": apiError("The paste could not be found"),
+		"412": apiError("The paste no longer matches If-Match"),
+		"413": apiError("The paste was larger than the maximum size"),
+		"503": apiError("The maximum storage of pastes was reached"),
+	}
+	getResponses := apiObject{
+		"200": apiText("The paste"),
+		"400": apiError("Invalid paste id"),
+		"404": apiError("The paste could not be found"),
+		"410": apiError("The paste expired recently"),
+	}
+	// Forks may leave out the paste, to copy it as is
+	forkBody := apiPasteBody(fields)
+	forkBody["required"] = false
+	paths := apiObject{
+		"/": apiObject{
+			"get": apiObject{
+				"summary":   "Index page",
+				"responses": apiObject{"200": apiError("HTML page with an upload form")},
+			},
+			"post": apiObject{
+				"summary":     "Upload a paste",
+				"requestBody": apiPasteBody(fields),
+				"responses":   uploadResponses,
+			},
+		},
+		"/redirect": apiObject{
+			"post": apiObject{
+				"summary":     "Upload a paste and redirect to it",
+				"requestBody": apiPasteBody(fields),
+				"responses": apiObject{
+					"302": apiError("Redirect to the new paste"),
+				},
+			},
+		},
+		"/{id}": apiObject{
+			"get": apiObject{
+				"summary":    "Get a paste",
+				"parameters": []apiObject{apiIDParam(), apiViewParam()},
+				"responses":  getResponses,
+			},
+			"delete": apiObject{
+				"summary": "Delete a paste via the X-Delete-Url given on upload",
+				"parameters": []apiObject{apiIDParam(), {
+					"name":     deleteParam,
+					"in":       "query",
+					"required": true,
+					"schema":   apiObject{"type": "string"},
+				}},
+				"responses": apiObject{
+					"204": apiError("The paste was deleted"),
+					"403": apiError("Invalid delete token"),
+					"404": apiError("The paste could not be found"),
+				},
+			},
+			"put": apiObject{
+				"summary":     "Edit a paste via the X-Edit-Url given on upload",
+				"parameters":  []apiObject{apiIDParam(), apiWriteParam(true), apiIfMatchParam()},
+				"requestBody": apiRawBody("application/octet-stream"),
+				"responses":   editResponses,
+			},
+		},
+		"/{id}/{file}": apiObject{
+			"get": apiObject{
+				"summary": "Get a file of a paste",
+				"parameters": []apiObject{
+					apiIDParam(),
+					apiPathParam("file", apiObject{"type": "string"}),
+					apiViewParam(),
+				},
+				"responses": getResponses,
+			},
+		},
+		"/{id}/v/{version}": apiObject{
+			"get": apiObject{
+				"summary": "Get a previous version of an edited paste",
+				"parameters": []apiObject{
+					apiIDParam(),
+					apiPathParam("version", apiObject{"type": "integer", "minimum": 1}),
+					apiViewParam(),
+				},
+				"responses": getResponses,
+			},
+		},
+		"/{id}/history": apiObject{
+			"get": apiObject{
+				"summary":    "List the revisions of a paste with their time and size",
+				"parameters": []apiObject{apiIDParam()},
+				"responses": apiObject{
+					"200": apiObject{
+						"description": "One revision per line, or a JSON array",
+						"content": apiObject{
+							"text/plain":       apiObject{"schema": apiObject{"type": "string"}},
+							"application/json": apiObject{"schema": apiObject{"type": "array"}},
+						},
+					},
+					"404": apiError("The paste could not be found"),
+				},
+			},
+		},
+		"/{id}/diff": apiObject{
+			"get": apiObject{
+				"summary": "Get a unified diff between two revisions of a paste",
+				"parameters": []apiObject{
+					apiIDParam(),
+					apiRevisionParam("from", "The old revision, the one before to by default"),
+					apiRevisionParam("to", "The new revision, the current one by default"),
+					apiViewParam(),
+				},
+				"responses": apiObject{
+					"200": apiText("The unified diff"),
+					"400": apiError("Invalid revision"),
+					"404": apiError("The paste could not be found"),
+					"415": apiError("One of the revisions is binary"),
+				},
+			},
+		},
+		"/{id}/fork": apiObject{
+			"post": apiObject{
+				"summary":     "Create a copy of a paste, optionally with new content",
+				"parameters":  []apiObject{apiIDParam()},
+				"requestBody": forkBody,
+				"responses":   uploadResponses,
+			},
+		},
+		"/stats": apiObject{
+			"get": apiObject{
+				"summary": "Report the instance's health",
+				"responses": apiObject{
+					"200": apiJSON("Paste and storage usage, limits, uptime and activity, or a page showing them if HTML is preferred"),
+					"429": apiError("Too many requests"),
+				},
+			},
+		},
+		"/openapi.json": apiObject{
+			"get": apiObject{
+				"summary":   "This document",
+				"responses": apiObject{"200": apiJSON("OpenAPI document")},
+			},
+		},
+		versionPath: apiObject{
+			"get": apiObject{
+				"summary":   "Get the version of the instance and what it supports",
+				"responses": apiObject{"200": apiJSON("Version, backends, authentication, compatibility layers and features")},
+			},
+		},
+	}
+	if *recentCount > 0 {
+		paths[recentPath] = apiObject{
+			"get": apiObject{
+				"summary": "List the newest pastes whose uploaders asked for them to be listed",
+				"responses": apiObject{
+					"200": apiJSON("The pastes, newest first, or a page showing them if HTML is preferred"),
+				},
+			},
+		}
+	}
+	if h.signer != nil {
+		paths["/{id}/sig"] = apiObject{
+			"get": apiObject{
+				"summary":    "Get a minisign signature of the current content of a paste",
+				"parameters": []apiObject{apiIDParam()},
+				"responses": apiObject{
+					"200": apiText("The detached signature"),
+					"404": apiError("The paste could not be found"),
+				},
+			},
+		}
+		paths[publicKeyPath] = apiObject{
+			"get": apiObject{
+				"summary":   "Get the minisign public key verifying paste signatures",
+				"responses": apiObject{"200": apiText("The public key")},
+			},
+		}
+	}
+	if compat[compatTransfer] {
+		// Shares the path template with GET, as OpenAPI doesn't allow
+		// equivalent templates
+		paths["/{id}"].(apiObject)["put"] = apiObject{
+			"summary": "Upload a file as a paste, or edit a paste if a write token is given",
+			"parameters": []apiObject{apiPathParam("id", apiObject{
+				"type":        "string",
+				"description": "The file name, or the id of the paste to edit",
+			}), apiWriteParam(false)},
+			"requestBody": apiRawBody("application/octet-stream"),
+			"responses":   uploadResponses,
+		}
+	}
+	if compat[compatHastebin] {
+		paths["/documents"] = apiObject{
+			"post": apiObject{
+				"summary":     "Upload a paste, hastebin style",
+				"requestBody": apiRawBody("text/plain"),
+				"responses":   apiObject{"200": apiJSON("The key of the new paste")},
+			},
+		}
+		paths["/documents/{id}"] = apiObject{
+			"get": apiObject{
+				"summary":    "Get a paste as JSON, hastebin style",
+				"parameters": []apiObject{apiIDParam()},
+				"responses":  apiObject{"200": apiJSON("The key and data of the paste")},
+			},
+		}
+		paths["/raw/{id}"] = apiObject{
+			"get": apiObject{
+				"summary":    "Get a paste, hastebin style",
+				"parameters": []apiObject{apiIDParam()},
+				"responses":  getResponses,
+			},
+		}
+	}
+	if compat[compatPastebin] {
+		paths["/api/api_post.php"] = apiObject{
+			"post": apiObject{
+				"summary":     "Upload a paste, pastebin.com style",
+				"requestBody": apiPasteBody([]string{"api_option", "api_paste_code", "api_paste_expire_date", "api_paste_private"}),
+				"responses":   apiObject{"200": apiText("The url of the new paste")},
+			},
+		}
+	}
+	if compat[compatGist] {
+		paths["/gists"] = apiObject{
+			"post": apiObject{
+				"summary":     "Create a gist made of multiple files",
+				"requestBody": apiRawBody("application/json"),
+				"responses":   apiObject{"201": apiJSON("The new gist")},
+			},
+		}
+		paths["/gists/{id}"] = apiObject{
+			"get": apiObject{
+				"summary":    "Get a gist",
+				"parameters": []apiObject{apiIDParam()},
+				"responses":  apiObject{"200": apiJSON("The gist")},
+			},
+		}
+	}
+	if *adminToken != "" {
+		admin := func(op apiObject) apiObject {
+			op["security"] = []apiObject{{"bearer": []string{}}}
+			return op
+		}
+		paths["/admin/pastes"] = apiObject{
+			"get": admin(apiObject{
+				"summary":   "List the stored pastes",
+				"responses": apiObject{"200": apiJSON("A page of pastes")},
+			}),
+			"delete": admin(apiObject{
+				"summary": "Delete all the pastes uploaded by a token, user or address",
+				"responses": apiObject{
+					"200": apiJSON("The number of pastes deleted"),
+					"400": apiError("No token, owner or ip was given"),
+				},
+			}),
+		}
+		paths["/admin/pastes/{id}"] = apiObject{
+			"delete": admin(apiObject{
+				"summary":    "Delete a paste",
+				"parameters": []apiObject{apiIDParam()},
+				"responses":  apiObject{"204": apiError("The paste was deleted")},
+			}),
+		}
+		paths["/admin/deletions"] = apiObject{
+			"get": admin(apiObject{
+				"summary":   "List the recorded deletions",
+				"responses": apiObject{"200": apiJSON("The deletions")},
+			}),
+		}
+	}
+	if h.tokens != nil || h.oidc != nil || h.proxy != nil {
+		paths["/me/pastes"] = apiObject{
+			"get": apiObject{
+				"summary": "List the pastes uploaded by the user",
+				"responses": apiObject{
+					"200": apiJSON("A page of pastes"),
+					"401": apiError("The user is not authenticated"),
+				},
+			},
+		}
+		paths["/me/pastes/{id}"] = apiObject{
+			"delete": apiObject{
+				"summary":    "Delete a paste uploaded by the user",
+				"parameters": []apiObject{apiIDParam()},
+				"responses": apiObject{
+					"204": apiError("The paste was deleted"),
+					"401": apiError("The user is not authenticated"),
+					"404": apiError("The user has no such paste"),
+				},
+			},
+		}
+	}
+	if *syncToken != "" && *replicaOf == "" {
+		bearer := []apiObject{{"bearer": []string{}}}
+		paths["/sync/changes"] = apiObject{
+			"get": apiObject{
+				"summary":  "List the changes to pastes since the given one, for replicas",
+				"security": bearer,
+				"parameters": []apiObject{
+					{"name": "epoch", "in": "query", "schema": apiObject{"type": "string"}},
+					{"name": "since", "in": "query", "schema": apiObject{"type": "integer"}},
+				},
+				"responses": apiObject{"200": apiJSON("A page of changes, or of all pastes")},
+			},
+		}
+		paths["/sync/pastes/{id}"] = apiObject{
+			"get": apiObject{
+				"summary":    "Get a paste with its attributes and versions, for replicas",
+				"security":   bearer,
+				"parameters": []apiObject{apiIDParam()},
+				"responses":  apiObject{"200": apiJSON("The paste")},
+			},
+		}
+	}
+	if *tusDir != "" {
+		uploadParam := apiPathParam("upload", apiObject{"type": "string"})
+		paths["/files/"] = apiObject{
+			"post": apiObject{
+				"summary": "Create a resumable tus upload",
+				"responses": apiObject{
+					"201": apiError("The upload was created, see Location"),
+					"429": apiError("The client has too many unfinished uploads"),
+					"503": apiError("The upload would go over the maximum storage"),
+				},
+			},
+		}
+		paths["/files/{upload}"] = apiObject{
+			"head": apiObject{
+				"summary":    "Get the offset of a tus upload",
+				"parameters": []apiObject{uploadParam},
+				"responses":  apiObject{"200": apiError("The offset, in Upload-Offset")},
+			},
+			"patch": apiObject{
+				"summary":     "Append a chunk to a tus upload",
+				"parameters":  []apiObject{uploadParam},
+				"requestBody": apiRawBody("application/offset+octet-stream"),
+				"responses":   apiObject{"204": apiError("The chunk was appended")},
+			},
+			"delete": apiObject{
+				"summary":    "Terminate a tus upload",
+				"parameters": []apiObject{uploadParam},
+				"responses":  apiObject{"204": apiError("The upload was terminated")},
+			},
+		}
+	}
+	desc := fmt.Sprintf("Pastes may be up to %s in size", routeMaxSize(apiMaxSize))
+	if *lifeTime > 0 {
+		desc += fmt.Sprintf(" and are deleted after %s", *lifeTime)
+	}
+	return apiObject{
+		"openapi": "3.0.3",
+		"info": apiObject{
+			"title":       "pastecat",
+			"version":     "1",
+			"description": desc + ".",
+		},
+		"servers": []apiObject{{"url": *siteURL}},
+		"paths":   paths,
+		"components": apiObject{
+			"securitySchemes": apiObject{
+				"bearer": apiObject{"type": "http", "scheme": "bearer"},
+			},
+		},
+		"x-limits": apiObject{
+			"maxSize":    int64(routeMaxSize(apiMaxSize)),
+			"lifeTime":   lifeTime.Seconds(),
+			"maxNumber":  h.stats.MaxNumber,
+			"maxStorage": h.stats.MaxStorage,
+		},
+	}
+}
+
+func (h *httpHandler) handleOpenAPI(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, h.openAPI())
+}
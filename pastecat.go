@@ -4,30 +4,54 @@
 package main
 
 import (
+	"crypto/tls"
+	"encoding/json"
 	"errors"
 	"flag"
 	"fmt"
+	"html/template"
+	"io"
 	"io/ioutil"
 	"log"
+	"mime"
+	"mime/multipart"
+	"net"
 	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
 	"time"
 
+	"github.com/mvdan/pastecat/internal/dirwatch"
+	"github.com/mvdan/pastecat/internal/hashring"
 	"github.com/mvdan/pastecat/storage"
 )
 
 const (
 	// Name of the HTTP form field when uploading a paste
 	fieldName = "paste"
-	// Content-Type when serving pastes
-	contentType = "text/plain; charset=utf-8"
-	// Report usage stats how often
-	reportInterval = 1 * time.Minute
+	// Content-Type when serving pastes, which are stored as UTF-8 unless
+	// they are binary
+	contentType       = "text/plain; charset=utf-8"
+	binaryContentType = "text/plain"
+	// Maximum size of uploaded form files to keep in memory
+	multipartMemory = 32 << 20
+	// Save the activity counters how often
+	saveInterval = 1 * time.Minute
 
 	// HTTP response strings
 	invalidID     = "invalid paste id"
 	unknownAction = "unsupported action"
+	pasteExpired  = "paste expired at %s"
+	fileNotFound  = "file could not be found in paste"
 )
 
+var errNoPaste = errors.New("no paste provided")
+
 var (
 	siteURL   = flag.String("u", "http://localhost:8080", "URL of the site")
 	listen    = flag.String("l", ":8080", "Host and port to listen to")
@@ -35,160 +59,1053 @@ var (
 	timeout   = flag.Duration("T", 5*time.Second, "Timeout of HTTP requests")
 	maxNumber = flag.Int("m", 0, "Maximum number of pastes to store at once")
 
+	showVersion = flag.Bool("version", false, "Print the version and exit")
+
+	warnPercent = flag.Int("storage-warn", 80, "Percentage of -M in use from which uploads are warned about it, or 0 to never")
+	anonPercent = flag.Int("storage-anonymous", 95, "Percentage of -M in use from which anonymous uploads are refused, or 0 to never")
+
+	rejectBinary  = flag.Bool("reject-binary", false, "Reject uploads that don't look like text")
+	forceText     = flag.Bool("force-text", false, "Serve all pastes as text/plain, even images")
+	disposition   = flag.String("disposition", "inline", "How browsers get pastes by default: inline, to show them, or attachment, to download them")
+	encryptedMode = flag.Bool("encrypted", false, "Accept pastes encrypted in the browser, and offer a web form doing so")
+
+	minLifeTime = flag.Duration("min-lifetime", 0, "Minimum lifetime that a paste may pick, enabling per-paste lifetimes")
+	maxLifeTime = flag.Duration("max-lifetime", 0, "Maximum lifetime that a paste may pick, enabling per-paste lifetimes")
+
+	debugListen  = flag.String("debug-listen", "", "Host and port to serve debugging endpoints on")
+	tcpListen    = flag.String("tcp-listen", "", "Host and port to accept raw pastes over TCP on")
+	otlpEndpoint = flag.String("otlp-endpoint", "", "URL of an OTLP/HTTP collector to send traces to")
+	slowRequest  = flag.Duration("slow-request", 0, "Log requests taking longer than this")
+
+	statsdAddr     = flag.String("statsd", "", "Host and port of a StatsD server to send metrics to")
+	statsdPrefix   = flag.String("statsd-prefix", "pastecat.", "Prefix of the metrics sent to StatsD")
+	statsdInterval = flag.Duration("statsd-interval", 10*time.Second, "How often to send metrics to StatsD")
+
+	maxTombstones = flag.Int("tombstones", 10000, "Number of expired pastes to remember")
+	expiryEvery   = flag.Duration("expiry-interval", 0, "How often to delete expired pastes, together, instead of as soon as they expire")
+	expiryBatch   = flag.Int("expiry-batch", 100, "Most expired pastes to delete from the store at once")
+	statsRate     = flag.Int("stats-rate", 60, "Requests per minute to /stats allowed per client")
+	statsFile     = flag.String("stats-file", "", "File to keep the upload and download counters in across restarts")
+	statsReport   = flag.String("stats-report", "log", "Where to report the usage stats: log, json to log them as JSON, a file to append JSON lines to, or none")
+	reportEvery   = flag.Duration("stats-report-interval", time.Minute, "How often to report the usage stats, or 0 to never")
+	recentCount   = flag.Int("recent", 0, "Number of listed pastes to show at /recent, enabling the public listing")
+
+	theme       = flag.String("theme", "auto", "Theme of the web pages: light, dark, or auto to follow the browser's preference")
+	forceLang   = flag.String("lang", "", "Language to show the web pages in, instead of the one preferred by each client")
+	messagesDir = flag.String("messages", "", "Directory with message catalogs like es.json to translate the web pages with")
+
+	tokensPath   = flag.String("tokens", "", "File with the upload tokens to accept")
+	oidcIssuer   = flag.String("oidc-issuer", "", "URL of an OpenID Connect provider that web interface users must log in with to upload")
+	oidcClientID = flag.String("oidc-client-id", "", "Client id registered with the OpenID Connect provider")
+	oidcSecret   = flag.String("oidc-client-secret", "", "Client secret registered with the OpenID Connect provider")
+	authHeader   = flag.String("auth-header", "", "Header naming the user, set by a reverse proxy logging users in")
+	authProxies  = flag.String("auth-proxies", "127.0.0.1,::1", "Comma-separated addresses or networks of the proxies trusted to set -auth-header")
+	tlsCert      = flag.String("tls-cert", "", "File with the TLS certificate to serve HTTPS with")
+	tlsKey       = flag.String("tls-key", "", "File with the TLS key to serve HTTPS with")
+	clientCA     = flag.String("client-ca", "", "File with the CA certificates that client certificates must be signed by")
+	clientAuth   = flag.Bool("require-client-cert", false, "Refuse clients without a certificate from -client-ca")
+	adminToken   = flag.String("admin-token", "", "Secret token enabling the admin API")
+	adminListen  = flag.String("admin-listen", "", "Host and port to serve the admin API on, to clients with a certificate from -admin-ca")
+	adminCert    = flag.String("admin-cert", "", "File with the TLS certificate of the admin listener")
+	adminKey     = flag.String("admin-key", "", "File with the TLS key of the admin listener")
+	adminCA      = flag.String("admin-ca", "", "File with the CA certificates that admin clients must be signed by")
+	auditPath    = flag.String("audit-log", "", "File to append a log of deletions to")
+	privacyMode  = flag.Bool("privacy", false, "Never log nor store the addresses of clients")
+	anonymizeIPs = flag.String("anonymize-ips", "", "Log the addresses of clients anonymized: truncate or hmac")
+	hashIPs      = flag.Bool("hash-ips", false, "Record a hash of the address each paste is uploaded from, to delete pastes by address")
+	signKey      = flag.String("sign-key", "", "File with the key to sign pastes with, created if missing")
+	tusDir       = flag.String("tus-dir", "", "Directory to stage resumable tus uploads in")
+	mirrorDir    = flag.String("mirror-dir", "", "Directory to copy pastes to in the background")
+	fsDepth      = flag.Int("fs-depth", storage.DefaultLayout.Depth, "Levels of subdirectories to spread pastes among in fs stores")
+	fsWidth      = flag.Int("fs-width", storage.DefaultLayout.Width, "Hex digits of the ids naming each subdirectory in fs stores")
+	storeRetries = flag.Int("store-retries", 0, "Times to try store operations failing with transient errors, instead of the backend's default")
+	storeBackoff = flag.Duration("store-retry-backoff", 0, "How long to wait before retrying a store operation, doubling each time, instead of the backend's default")
+	dedup        = flag.Bool("dedup", false, "Reply to uploads of the same content as an existing paste with that paste")
+	compressAge  = flag.Duration("compress-after", 0, "Compress the pastes not read for this long, to fit more of them in -M")
+	idFilter     = flag.Bool("id-filter", false, "Turn down lookups of unknown ids without asking the store, which no one else may add pastes to, like fs:shared=false")
+	fsync        = flag.String("fsync", "interval", "When to flush the pastes written to disk: always, interval or never")
+	watch        = flag.Bool("watch", false, "Turn the files dropped into the fs store's directory into pastes")
+	syncToken    = flag.String("sync-token", "", "Secret token enabling the sync API for replicas, or used to pull from the primary")
+	replicaOf    = flag.String("replica-of", "", "URL of the primary to serve pastes from as a read-only replica")
+
+	clusterSelf  = flag.String("cluster-self", "", "URL of this node, enabling the cluster mode")
+	clusterPeers = flag.String("cluster-peers", "", "Comma-separated URLs of the other nodes in the cluster")
+	clusterDir   = flag.String("cluster-dir", "raft", "Directory to keep the cluster's log and snapshots in")
+	clusterToken = flag.String("cluster-token", "", "Secret token shared by the nodes in the cluster")
+
+	peers = flag.String("peers", "", "Comma-separated URLs of peer instances to try for pastes not found locally")
+
+	shards    = flag.String("shards", "", "Comma-separated URLs of the shards to route requests to by paste id")
+	shardSelf = flag.String("shard-self", "", "URL of this node among -shards, making it a shard rather than a router")
+
+	torControl  = flag.String("tor-control", "", "Host and port of Tor's control port, to publish an onion service")
+	torPassword = flag.String("tor-password", "", "Password of Tor's control port, if any")
+	torKey      = flag.String("tor-key", "", "File to keep the onion service's private key in")
+
 	maxSize    = 1 * storage.MB
 	maxStorage = 1 * storage.GB
+
+	// Maximum sizes of pastes on some routes, overriding maxSize if not zero
+	formMaxSize storage.ByteSize
+	apiMaxSize  storage.ByteSize
+
+	compat = make(compatSet)
+
+	// Lifetimes capped by the size of pastes
+	sizeLimits sizeLifeTimes
 )
 
 func init() {
 	flag.Var(&maxSize, "s", "Maximum size of pastes")
 	flag.Var(&maxStorage, "M", "Maximum storage size to use at once")
+	flag.Var(&formMaxSize, "form-max-size", "Maximum size of pastes uploaded via the web form, instead of -s")
+	flag.Var(&apiMaxSize, "api-max-size", "Maximum size of pastes uploaded via the API, instead of -s")
+	flag.Var(compat, "compat", "Comma-separated compatibility layers to enable")
+	flag.Var(&sizeLimits, "size-lifetimes", "Comma-separated maximum lifetimes of the pastes of at least a size, like 1M=1h")
+}
+
+// upload is a paste uploaded via a form, along with the name of the file it
+// was uploaded from, if any
+type upload struct {
+	content  []byte
+	filename string
 }
 
-func getContentFromForm(r *http.Request) ([]byte, error) {
-	if value := r.FormValue(fieldName); len(value) > 0 {
-		return []byte(value), nil
+// getContentFromForm returns the uploaded pastes, which may be many if the
+// form holds multiple parts with the same field name.
+func getContentFromForm(r *http.Request) ([]upload, error) {
+	// Parsing a multipart form hides the errors from reading any other
+	// form, like those from going over the maximum size
+	if err := r.ParseForm(); err != nil {
+		return nil, err
 	}
-	if f, _, err := r.FormFile(fieldName); err == nil {
-		defer f.Close()
-		content, err := ioutil.ReadAll(f)
-		if err == nil && len(content) > 0 {
-			return content, nil
+	if err := r.ParseMultipartForm(multipartMemory); err != nil && err != http.ErrNotMultipart {
+		return nil, err
+	}
+	for _, name := range compat.fieldNames() {
+		var uploads []upload
+		for _, value := range r.Form[name] {
+			if len(value) > 0 {
+				uploads = append(uploads, upload{content: []byte(value)})
+			}
+		}
+		if r.MultipartForm != nil {
+			for _, header := range r.MultipartForm.File[name] {
+				content, err := readFormFile(header)
+				if err != nil {
+					return nil, err
+				}
+				if len(content) > 0 {
+					uploads = append(uploads, upload{content, header.Filename})
+				}
+			}
+		}
+		if len(uploads) > 0 {
+			return uploads, nil
 		}
 	}
-	return nil, errors.New("no paste provided")
+	return nil, errNoPaste
+}
+
+// tooLarge is the JSON reply to an upload over its maximum size.
+type tooLarge struct {
+	Error   string `json:"error"`
+	MaxSize int64  `json:"max_size"`
+}
+
+// isTooLarge returns whether err comes from reading a request body past the
+// limit set with http.MaxBytesReader.
+func isTooLarge(err error) bool {
+	var maxErr *http.MaxBytesError
+	return errors.As(err, &maxErr)
+}
+
+// replyTooLarge replies that an upload went over its maximum size of
+// maxSize bytes, in the format preferred by the client.
+func replyTooLarge(w http.ResponseWriter, r *http.Request, maxSize int64) {
+	msg := fmt.Sprintf("paste too large, maximum is %s", storage.ByteSize(maxSize))
+	if negotiate(r, "text/plain", "application/json") != "application/json" {
+		http.Error(w, msg, http.StatusRequestEntityTooLarge)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusRequestEntityTooLarge)
+	if err := json.NewEncoder(w).Encode(tooLarge{msg, maxSize}); err != nil {
+		log.Printf("Error encoding JSON response: %v", err)
+	}
+}
+
+func readFormFile(header *multipart.FileHeader) ([]byte, error) {
+	f, err := header.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ioutil.ReadAll(f)
 }
 
 func setHeaders(header http.Header, id storage.ID, paste storage.Paste) {
-	modTime := paste.ModTime()
-	header.Set("Etag", fmt.Sprintf(`"%d-%s"`, modTime.Unix(), id))
-	if *lifeTime > 0 {
-		deathTime := modTime.Add(*lifeTime)
+	setMetaHeaders(header, id, paste.Meta(), paste.ModTime())
+}
+
+// setMetaHeaders sets the headers of a paste that only depend on its
+// attributes.
+func setMetaHeaders(header http.Header, id storage.ID, meta storage.Meta, modTime time.Time) {
+	header.Set("Etag", metaETag(id, meta, modTime))
+	if lt := meta.EffectiveLifeTime(*lifeTime); lt > 0 {
+		deathTime := meta.Created(modTime).Add(lt)
 		lifeLeft := deathTime.Sub(time.Now())
 		header.Set("Expires", deathTime.UTC().Format(http.TimeFormat))
 		header.Set("Cache-Control", fmt.Sprintf(
 			"max-age=%.f, must-revalidate", lifeLeft.Seconds()))
 	}
-	header.Set("Content-Type", contentType)
+	switch {
+	case meta.Encrypted:
+		header.Set("Content-Type", encryptedContentType)
+		header.Set("X-Paste-Encrypted", "true")
+		// Browsers get a page decrypting it instead
+		header.Set("Vary", "Accept")
+	// Checked again, as pastes may have been stored with types that are
+	// no longer allowed
+	case meta.ContentType != "" && !*forceText && pasteTypes[meta.ContentType]:
+		ct := meta.ContentType
+		if !meta.Binary {
+			ct += "; charset=utf-8"
+		}
+		header.Set("Content-Type", ct)
+		header.Set("X-Content-Type-Options", "nosniff")
+	case meta.Binary:
+		header.Set("Content-Type", binaryContentType)
+	default:
+		header.Set("Content-Type", contentType)
+	}
+}
+
+// setDisposition sets whether browsers show the content of a paste or
+// download it, named name if not empty, as per -disposition.
+func setDisposition(header http.Header, name string) {
+	if *disposition == "inline" {
+		return
+	}
+	var params map[string]string
+	if name != "" {
+		params = map[string]string{"filename": name}
+	}
+	header.Set("Content-Disposition", mime.FormatMediaType(*disposition, params))
 }
 
 type httpHandler struct {
-	store storage.Store
-	stats *storage.Stats
+	store     storage.Store
+	storeType string
+	stats     *storage.Stats
+	tokens    tokenSet
+	usage     *storage.Usage
+	tombs     *storage.Tombstones
+	audit     *auditLog
+	mirror    *storage.MirrorStore
+	changes   *changeLog
+	cluster   *cluster
+	shard     *shardStore
+	dups      *dupIndex
+	peers     *federation
+	disk      *diskGuard
+	signer    *pasteSigner
+	oidc      *oidcProvider
+	proxy     *authProxy
+	activity  *activityLog
+}
+
+// deletePaste deletes a paste before its expiry, recording the reason and
+// actor in the audit log.
+func (h *httpHandler) deletePaste(id storage.ID, reason, actor string) error {
+	var err error
+	if h.cluster != nil {
+		err = h.cluster.propose(clusterCommand{Op: opDelete, ID: id.String()})
+	} else {
+		err = h.dropPaste(id)
+	}
+	if err != nil {
+		return err
+	}
+	err = h.audit.record(deletion{
+		Time:   time.Now(),
+		ID:     id.String(),
+		Reason: reason,
+		Actor:  actor,
+	})
+	if err != nil {
+		log.Printf("Could not record the deletion of %s: %v", id, err)
+	}
+	return nil
+}
+
+// storeSpan starts a span tracing a store operation made by a request.
+func (h *httpHandler) storeSpan(r *http.Request, op string) *span {
+	sp := childSpan(r, "store."+op)
+	if sp != nil {
+		sp.attrs["store.type"] = h.storeType
+	}
+	return sp
+}
+
+func (h *httpHandler) expired(id storage.ID, at time.Time) {
+	h.tombs.Add(id, at)
+	h.usage.Forget(id)
+	if h.mirror != nil {
+		// Expired pastes are deleted from the store underneath
+		h.mirror.Forget(id)
+	}
+	if h.changes != nil {
+		h.changes.add(id, true)
+	}
+	err := h.audit.record(deletion{
+		Time:   at,
+		ID:     id.String(),
+		Reason: reasonExpiry,
+	})
+	if err != nil {
+		log.Printf("Could not record the expiry of %s: %v", id, err)
+	}
+}
+
+// outlived returns when a paste expired if it outlived its lifetime, which
+// happens when its deletion was lost, like when the process stopped before
+// removing the expired pastes it found. Its deletion is then scheduled.
+func (h *httpHandler) outlived(id storage.ID, meta storage.Meta, modTime time.Time) (time.Time, bool) {
+	lifeTime := meta.EffectiveLifeTime(*lifeTime)
+	if lifeTime == 0 {
+		return time.Time{}, false
+	}
+	at := meta.Created(modTime).Add(lifeTime)
+	if at.After(time.Now()) {
+		return time.Time{}, false
+	}
+	storage.ExpirePaste(h.store, h.stats, h.expired, id)
+	return at, true
+}
+
+// replyExpired replies that a paste expired at a time.
+func replyExpired(w http.ResponseWriter, at time.Time) {
+	expires := at.UTC().Format(http.TimeFormat)
+	w.Header().Set("Expires", expires)
+	http.Error(w, fmt.Sprintf(pasteExpired, expires), http.StatusGone)
 }
 
 func (h httpHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	switch r.Method {
 	case "GET":
 		h.handleGet(w, r)
+	case "HEAD":
+		h.handleHead(w, r)
 	case "POST":
+		if _, file := compat.splitPath(r.URL.Path); file == forkAction {
+			h.handleFork(w, r)
+			return
+		}
 		h.handlePost(w, r)
+	case "PUT":
+		if r.URL.Query().Get(writeParam) != "" {
+			h.handleEdit(w, r)
+			return
+		}
+		if !compat[compatTransfer] {
+			http.Error(w, unknownAction, http.StatusBadRequest)
+			return
+		}
+		h.handlePut(w, r)
+	case "DELETE":
+		h.handleDelete(w, r)
 	default:
 		http.Error(w, unknownAction, http.StatusBadRequest)
 	}
 }
 
 func (h *httpHandler) handleGet(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == "/" {
+		if wantsUsage(r) {
+			h.serveUsage(w, r)
+			return
+		}
+		w.Header().Add("Vary", "Accept, User-Agent")
+	}
 	if _, e := templates[r.URL.Path]; e {
+		var user string
+		if h.oidc != nil && h.proxy.user(r) == "" {
+			session, ok := h.oidc.session(r)
+			if !ok && r.URL.Path != "/" {
+				// The forms are of no use without logging in
+				http.Redirect(w, r, loginPath+"?next="+url.QueryEscape(r.URL.Path), http.StatusFound)
+				return
+			}
+			user = session.Name
+		}
+		lang := requestLang(r)
+		w.Header().Set("Content-Language", lang)
+		w.Header().Add("Vary", "Accept-Language")
 		err := tmpl.ExecuteTemplate(w, r.URL.Path,
 			struct {
-				SiteURL   string
-				MaxSize   storage.ByteSize
-				LifeTime  time.Duration
-				FieldName string
+				SiteURL    string
+				MaxSize    storage.ByteSize
+				LifeTime   time.Duration
+				LifeTimes  []lifeTimePreset
+				SizeLimits sizeLifeTimes
+				Listing    bool
+				Lang       string
+				T          func(string, ...interface{}) template.HTML
+				FieldName  string
+				Stats      instanceStats
+				Encrypted  bool
+				Login      bool
+				User       string
 			}{
-				SiteURL:   *siteURL,
-				MaxSize:   maxSize,
-				LifeTime:  *lifeTime,
-				FieldName: fieldName,
+				SiteURL:    *siteURL,
+				MaxSize:    routeMaxSize(formMaxSize),
+				LifeTime:   *lifeTime,
+				LifeTimes:  lifeTimeOptions(),
+				SizeLimits: sizeLimits,
+				Listing:    *recentCount > 0,
+				Lang:       lang,
+				T:          translator(lang),
+				FieldName:  fieldName,
+				Stats:      h.instanceStats(),
+				Encrypted:  *encryptedMode,
+				Login:      h.oidc != nil,
+				User:       user,
 			})
 		if err != nil {
 			log.Printf("Error executing template for %s: %v", r.URL.Path, err)
 		}
 		return
 	}
-	id, err := storage.IDFromString(r.URL.Path[1:])
+	hexID, file := compat.splitPath(r.URL.Path)
+	id, err := storage.IDFromString(hexID)
 	if err != nil {
 		http.Error(w, invalidID, http.StatusBadRequest)
 		return
 	}
-	paste, err := h.store.Get(id)
+	version, isVersion := versionFromFile(file)
+	if isVersion {
+		file = ""
+	}
+	paste, ok := h.getPasteVersion(w, r, id, version)
+	if !ok {
+		return
+	}
+	defer h.donePaste(id, paste)
+	switch file {
+	case historyAction:
+		serveHistory(w, r, id, paste)
+		return
+	case diffAction:
+		h.serveDiff(w, r, id, paste)
+		return
+	case signAction:
+		if h.signer != nil {
+			h.signer.serveSignature(w, r, id, paste)
+			return
+		}
+	}
+	var content io.ReadSeeker = paste
+	if file != "" {
+		if off, size, ok := paste.Meta().FileSection(file); ok {
+			content = io.NewSectionReader(paste, off, size)
+		} else if len(paste.Meta().Files) > 0 || !compat.ignoresFile() {
+			http.Error(w, fileNotFound, http.StatusNotFound)
+			return
+		}
+	}
+	if paste.Meta().Encrypted {
+		if r.URL.Query().Get(viewParam) != "" {
+			http.Error(w, "encrypted pastes have no views", http.StatusBadRequest)
+			return
+		}
+		if file == "" && wantsDecryptPage(r) {
+			serveDecryptPage(w, r, id, paste)
+			return
+		}
+	}
+	if view := r.URL.Query().Get(viewParam); view != "" {
+		serveView(w, r, view, id, paste, content)
+		return
+	}
+	setHeaders(w.Header(), id, paste)
+	setContentType(w.Header(), paste, content.(io.ReaderAt))
+	if file == "" {
+		file = paste.Meta().Filename
+	}
+	setDisposition(w.Header(), file)
+	setViewLinks(w.Header(), r.URL.EscapedPath(), paste, content.(io.ReaderAt))
+	if f, ok := content.(interface{ File() *os.File }); ok {
+		// Lets the kernel send the file with sendfile
+		content = f.File()
+	}
+	http.ServeContent(w, r, "", paste.ModTime(), content)
+}
+
+// getPaste fetches a paste to be served, replying with an error if it
+// cannot be.
+func (h *httpHandler) getPaste(w http.ResponseWriter, r *http.Request, id storage.ID) (storage.Paste, bool) {
+	return h.getPasteVersion(w, r, id, 0)
+}
+
+// getPasteVersion is like getPaste, but fetches a previous version of the
+// paste if version is not zero.
+func (h *httpHandler) getPasteVersion(w http.ResponseWriter, r *http.Request, id storage.ID, version int) (storage.Paste, bool) {
+	var paste storage.Paste
+	var err error
+	sp, done := h.storeSpan(r, "Get"), timePhase(r, "store")
+	if version > 0 {
+		paste, err = h.store.GetVersion(id, version)
+	} else {
+		paste, err = h.store.Get(id)
+	}
+	sp.endWith(err)
+	done()
+	if err != nil {
+		h.getError(w, r, id, err)
+		return nil, false
+	}
+	if at, ok := h.outlived(id, paste.Meta(), paste.ModTime()); ok {
+		paste.Close()
+		replyExpired(w, at)
+		return nil, false
+	}
+	// Reads made at the same time may have used up its last read, which
+	// donePaste deletes it after
+	if max := paste.Meta().MaxReads; max > 0 && paste.Views() > int64(max) {
+		paste.Close()
+		http.Error(w, storage.ErrPasteNotFound.Error(), http.StatusNotFound)
+		return nil, false
+	}
+	downloadCount.Add(1)
+	return paste, true
+}
+
+// getError replies with the error from getting a paste, which may have
+// expired or be held by a peer.
+func (h *httpHandler) getError(w http.ResponseWriter, r *http.Request, id storage.ID, err error) {
 	if err == storage.ErrPasteNotFound {
+		if at, e := h.tombs.Get(id); e {
+			replyExpired(w, at)
+			return
+		}
+		if h.peers != nil && (r.Method == "GET" || r.Method == "HEAD") && h.peers.serve(w, r) {
+			return
+		}
 		http.Error(w, err.Error(), http.StatusNotFound)
 		return
-	} else if err != nil {
-		log.Printf("Unknown error on GET: %v", err)
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+	h.storeError(w, r, err)
+}
+
+// storeError replies with an error from the store by its kind, so that the
+// details of the backend are only logged and not shown to clients.
+func (h *httpHandler) storeError(w http.ResponseWriter, r *http.Request, err error) {
+	if storage.IsDiskFull(err) {
+		h.disk.refuse(w)
 		return
 	}
-	defer paste.Close()
-	setHeaders(w.Header(), id, paste)
-	http.ServeContent(w, r, "", paste.ModTime(), paste)
+	replyStoreError(w, r, err)
+}
+
+// replyStoreError is like storeError, for errors that cannot mean that the
+// disk is full, like those from reading a paste.
+func replyStoreError(w http.ResponseWriter, r *http.Request, err error) {
+	switch kind := storage.Kind(err); kind {
+	case storage.ErrPasteNotFound:
+		http.Error(w, kind.Error(), http.StatusNotFound)
+	case storage.ErrPasteExpired:
+		http.Error(w, kind.Error(), http.StatusGone)
+	case storage.ErrPasteTooLarge:
+		http.Error(w, kind.Error(), http.StatusRequestEntityTooLarge)
+	case storage.ErrQuotaExceeded:
+		msg := kind.Error()
+		if err == storage.ErrReachedMaxNumber || err == storage.ErrReachedMaxStorage {
+			msg = err.Error()
+		}
+		http.Error(w, msg, http.StatusServiceUnavailable)
+	case storage.ErrUnavailable:
+		log.Printf("Store unavailable on %s: %v", r.Method, err)
+		http.Error(w, kind.Error(), http.StatusServiceUnavailable)
+	case storage.ErrCorrupted:
+		log.Printf("Corrupted paste on %s %s: %v", r.Method, r.URL.Path, err)
+		http.Error(w, kind.Error(), http.StatusInternalServerError)
+	default:
+		log.Printf("Unknown error on %s: %v", r.Method, err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+	}
+}
+
+// handleHead replies to HEAD requests for pastes from their attributes
+// alone, without opening their content nor counting as a view. The Link
+// headers pointing to views are left out, as they depend on the content,
+// and so is the type of binary pastes, which may be images. Other requests,
+// like those for files or views, are replied to like a GET.
+func (h *httpHandler) handleHead(w http.ResponseWriter, r *http.Request) {
+	hexID, file := compat.splitPath(r.URL.Path)
+	id, err := storage.IDFromString(hexID)
+	if err != nil || file != "" || r.URL.RawQuery != "" {
+		h.handleGet(w, r)
+		return
+	}
+	sp, done := h.storeSpan(r, "Stat"), timePhase(r, "store")
+	info, err := storage.Stat(h.store, id)
+	sp.endWith(err)
+	done()
+	if err != nil {
+		h.getError(w, r, id, err)
+		return
+	}
+	if at, ok := h.outlived(id, info.Meta, info.ModTime); ok {
+		replyExpired(w, at)
+		return
+	}
+	header := w.Header()
+	setMetaHeaders(header, id, info.Meta, info.ModTime)
+	switch {
+	case info.Encrypted && wantsDecryptPage(r):
+		// Like serveDecryptPage, whose length is only known once
+		// rendered
+		header.Del("Etag")
+		header.Set("Content-Type", "text/html; charset=utf-8")
+		return
+	case !info.Encrypted && info.Binary && !*rejectBinary && !*forceText && info.ContentType == "":
+		// Like setContentType, which needs the start of the content
+		header.Del("Content-Type")
+	}
+	setDisposition(header, info.Filename)
+	header.Set("Last-Modified", info.ModTime.UTC().Format(http.TimeFormat))
+	header.Set("Accept-Ranges", "bytes")
+	if notModified(r, header.Get("Etag"), info.ModTime) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	header.Set("Content-Length", strconv.FormatInt(info.Size, 10))
+}
+
+// donePaste closes a paste once it has been served, deleting it if it was
+// its last allowed read.
+func (h *httpHandler) donePaste(id storage.ID, paste storage.Paste) {
+	paste.Close()
+	if max := paste.Meta().MaxReads; max > 0 && paste.Views() >= int64(max) {
+		err := h.deletePaste(id, reasonReads, "")
+		if err != nil && err != storage.ErrPasteNotFound {
+			log.Printf("Could not delete %s after its last read: %v", id, err)
+		}
+	}
+}
+
+// uploadMeta returns the attributes common to all uploads, replying with an
+// error if the request is not allowed to upload.
+func (h *httpHandler) uploadMeta(w http.ResponseWriter, r *http.Request) (storage.Meta, bool) {
+	var meta storage.Meta
+	owner, token, err := h.identify(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return meta, false
+	}
+	if !h.admitUpload(w, owner) {
+		return meta, false
+	}
+	meta.Token = token.name
+	meta.Owner = owner
+	meta.IPHash = uploaderHash(clientHost(r))
+	return meta, true
+}
+
+// identify returns who is making a request, to attribute their pastes to,
+// along with the upload token used, if any. Anonymous clients have no
+// owner, unless logging in is required.
+func (h *httpHandler) identify(r *http.Request) (string, uploadToken, error) {
+	token, err := h.tokens.get(r)
+	if err != nil {
+		return "", token, err
+	}
+	if user := h.proxy.user(r); user != "" {
+		return user, token, nil
+	}
+	if token.name != "" {
+		return token.name, token, nil
+	}
+	if h.oidc != nil {
+		session, ok := h.oidc.session(r)
+		if !ok {
+			return "", token, errLoginRequired
+		}
+		return session.Subject, token, nil
+	}
+	return "", token, nil
+}
+
+// unbufferedReads serves GET and HEAD requests with reads, and any others
+// with h.
+func unbufferedReads(reads, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "GET" || r.Method == "HEAD" {
+			reads.ServeHTTP(w, r)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// fsLayout returns how the directories of fs stores and mirrors are split
+// into subdirectories.
+func fsLayout() storage.Layout {
+	return storage.Layout{Depth: *fsDepth, Width: *fsWidth}
+}
+
+// routeMaxSize returns the maximum size of pastes on a route, given its
+// override of maxSize.
+func routeMaxSize(override storage.ByteSize) storage.ByteSize {
+	if override > 0 {
+		return override
+	}
+	return maxSize
+}
+
+// sizeLimit returns the maximum size of the pastes that a request may
+// upload on a route, which the request's token may override.
+func (h *httpHandler) sizeLimit(r *http.Request, override storage.ByteSize) int64 {
+	if token, err := h.tokens.get(r); err == nil && token.maxSize > 0 {
+		return int64(token.maxSize)
+	}
+	return int64(routeMaxSize(override))
+}
+
+// largestMaxSize returns the maximum size of pastes on any route or with
+// any token.
+func (h *httpHandler) largestMaxSize() int64 {
+	max := maxSize
+	for _, size := range []storage.ByteSize{formMaxSize, apiMaxSize, h.tokens.maxSize()} {
+		if size > max {
+			max = size
+		}
+	}
+	return int64(max)
 }
 
 func (h *httpHandler) handlePost(w http.ResponseWriter, r *http.Request) {
-	r.Body = http.MaxBytesReader(w, r.Body, int64(maxSize))
-	content, err := getContentFromForm(r)
-	size := int64(len(content))
+	meta, ok := h.uploadMeta(w, r)
+	if !ok {
+		return
+	}
+	override := apiMaxSize
+	if r.URL.Path == "/redirect" || r.URL.Path == encryptPage {
+		// Where the web forms post to
+		override = formMaxSize
+	}
+	limit := h.sizeLimit(r, override)
+	r.Body = http.MaxBytesReader(w, r.Body, limit)
+	done := timePhase(r, "read body")
+	uploads, err := getContentFromForm(r)
+	done()
+	if isTooLarge(err) {
+		replyTooLarge(w, r, limit)
+		return
+	}
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
-	if err := h.stats.MakeSpaceFor(size); err != nil {
+	if meta.MaxReads, err = compat.maxReads(r); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if meta.LifeTime, err = formLifeTime(r); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if meta.Encrypted, err = formEncrypted(r); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if meta.Listed, err = formListed(r); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if meta.Title, err = formTitle(r); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if meta.ContentType, err = formContentType(r); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var created []createdPaste
+	for _, upload := range uploads {
+		meta.Filename = compat.filename(upload.filename)
+		id, ok := h.newPaste(w, r, upload.content, meta)
+		if !ok {
+			return
+		}
+		created = append(created, createdPaste{id.String(), pasteURL(id, meta), meta.Encrypted})
+	}
+	if r.URL.Path == "/redirect" {
+		http.Redirect(w, r, created[0].URL, 302)
+		return
+	}
+	writeCreated(w, r, created)
+}
+
+// writeCreated replies with the urls of the created pastes, in the format
+// preferred by the client.
+func writeCreated(w http.ResponseWriter, r *http.Request, created []createdPaste) {
+	if len(created) > 1 {
+		// Location can only point to one of the pastes
+		w.Header().Del("Location")
+	}
+	switch negotiate(r, "text/plain", "application/json", "text/html") {
+	case "application/json":
+		if len(created) == 1 {
+			writeJSON(w, created[0])
+		} else {
+			writeJSON(w, created)
+		}
+	case "text/html":
+		err := tmpl.ExecuteTemplate(w, "created", created)
+		if err != nil {
+			log.Printf("Error executing template for %s: %v", r.URL.Path, err)
+		}
+	default:
+		for _, c := range created {
+			fmt.Fprintln(w, c.URL)
+		}
+	}
+}
+
+type createdPaste struct {
+	ID  string `json:"id"`
+	URL string `json:"url"`
+	// Encrypted pastes are only readable with the key the client kept
+	Encrypted bool `json:"encrypted,omitempty"`
+}
+
+// pasteURL returns the url of a paste, including its file name if it has
+// one.
+func pasteURL(id storage.ID, meta storage.Meta) string {
+	if meta.Filename != "" {
+		return fmt.Sprintf("%s/%s/%s", *siteURL, id, url.PathEscape(meta.Filename))
+	}
+	return fmt.Sprintf("%s/%s", *siteURL, id)
+}
+
+// newPaste stores a new paste, replying with an error if it cannot be.
+func (h *httpHandler) newPaste(w http.ResponseWriter, r *http.Request, content []byte, meta storage.Meta) (storage.ID, bool) {
+	deleteToken, err := newPasteToken()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return storage.ID{}, false
+	}
+	writeToken, err := newPasteToken()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return storage.ID{}, false
+	}
+	meta.DeleteHash = hashPasteToken(deleteToken)
+	meta.WriteHash = hashPasteToken(writeToken)
+	token, _ := h.tokens.get(r)
+	capLifeTime(&meta, token.lifeTime)
+	// Also done by put, but needed for the headers
+	capLifeTime(&meta, sizeLimits.lifeTime(int64(len(content))))
+	release, err := h.reserveQuota(token, int64(len(content)))
+	if err != nil {
+		// Not 413, as the paste itself is not too large
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return storage.ID{}, false
+	}
+	defer release()
+	sp, done := h.storeSpan(r, "Put"), timePhase(r, "store")
+	id, dup, err := h.putOrReuse(content, meta)
+	sp.endWith(err)
+	done()
+	switch err {
+	case nil:
+		if dup != nil {
+			setDupHeaders(w.Header(), id, *dup)
+		} else {
+			setUploadHeaders(w.Header(), id, meta, deleteToken, writeToken)
+		}
+		return id, true
+	case errClusterUnavailable:
 		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+	case errBinary:
+		http.Error(w, err.Error(), http.StatusUnsupportedMediaType)
+	default:
+		h.storeError(w, r, err)
 	}
-	id, err := h.store.Put(content)
+	return id, false
+}
+
+// put stores a new paste once there is space for it, and sets up its
+// deletion. Text is transcoded to UTF-8 first.
+func (h *httpHandler) put(content []byte, meta storage.Meta) (storage.ID, error) {
+	id, _, err := h.putOrReuse(content, meta)
+	return id, err
+}
+
+// putOrReuse is like put, but with -dedup it may return an existing paste
+// with the same content instead, along with its attributes.
+func (h *httpHandler) putOrReuse(content []byte, meta storage.Meta) (storage.ID, *storage.Info, error) {
+	capLifeTime(&meta, sizeLimits.lifeTime(int64(len(content))))
+	content, err := prepareContent(content, &meta)
 	if err != nil {
+		return storage.ID{}, nil, err
+	}
+	if h.cluster != nil {
+		id, err := h.cluster.put(content, meta)
+		if err == nil {
+			uploadCount.Add(1)
+		} else if err == storage.ErrDiskFull {
+			h.disk.full()
+		}
+		return id, nil, err
+	}
+	if id, info, ok := h.dups.find(h.store, meta); ok {
+		dedupCount.Add(1)
+		return id, &info, nil
+	}
+	size := int64(len(content))
+	if err := h.stats.MakeSpaceFor(size); err != nil {
+		return storage.ID{}, nil, err
+	}
+	id, err := h.store.Put(content, meta)
+	if err == storage.ErrDiskFull {
+		h.disk.full()
+		h.stats.FreeSpace(size)
+		return id, nil, err
+	} else if err != nil {
 		log.Printf("Unknown error on POST: %v", err)
 		h.stats.FreeSpace(size)
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
+		return id, nil, err
 	}
-	storage.SetupPasteDeletion(h.store, h.stats, id, size, *lifeTime)
-	url := fmt.Sprintf("%s/%s", *siteURL, id)
-	switch r.URL.Path {
-	case "/redirect":
-		http.Redirect(w, r, url, 302)
-	default:
-		fmt.Fprintln(w, url)
+	uploadCount.Add(1)
+	h.dups.add(meta.Hash, id)
+	h.usage.Track(id, meta, time.Now(), size)
+	storage.SetupPasteDeletion(h.store, h.stats, h.expired, id, meta.EffectiveLifeTime(*lifeTime))
+	return id, nil, nil
+}
+
+// parseStoreArgs returns the storage backend and parameters described by
+// args, either as a single "name:key=value,..." argument or, as in older
+// versions, as the name followed by the value of its only parameter.
+func parseStoreArgs(args []string) (string, map[string]string, error) {
+	storageType, params, err := storage.ParseSpec(args[0])
+	if err != nil {
+		return "", nil, err
+	}
+	all, err := storage.Params(storageType)
+	if err != nil {
+		return "", nil, err
+	}
+	if args = args[1:]; len(args) > 0 {
+		if len(params) > 0 || len(all) != 1 || len(args) > 1 {
+			return "", nil, fmt.Errorf("too many arguments given for %s", storageType)
+		}
+		for k := range all {
+			params[k] = args[0]
+		}
+	}
+	return storageType, params, nil
+}
+
+// setupStore starts the storage backend described by args, as given to
+// parseStoreArgs.
+func (h *httpHandler) setupStore(lifeTime time.Duration, args []string) error {
+	storageType, params, err := parseStoreArgs(args)
+	if err != nil {
+		return err
+	}
+	all, _ := storage.Params(storageType)
+	for k, v := range params {
+		all[k] = redactParam(k, v)
+	}
+	h.storeType = storageType
+	log.Printf("Starting up the store %s", storage.FormatSpec(storageType, all))
+	h.store, err = storage.Open(storageType, params, storage.Config{
+		Stats:    h.stats,
+		OnExpire: h.expired,
+		LifeTime: lifeTime,
+		Layout:   fsLayout(),
+	})
+	if err != nil {
+		return err
+	}
+	if c, ok := h.store.(io.Closer); ok {
+		go closeOnSignal(c)
 	}
+	h.store = withRetries(h.store, storageType)
+	if *compressAge > 0 {
+		h.store = storage.NewCompressStore(h.store, h.stats, *compressAge, lifeTime)
+	}
+	if *idFilter {
+		// Directories are shared unless told otherwise
+		shared := params["shared"]
+		if shared == "" {
+			defaults, _ := storage.Params(storageType)
+			shared = defaults["shared"]
+		}
+		if s, _ := strconv.ParseBool(shared); s || storageType == "fs-nfs" {
+			return fmt.Errorf("the ids of a shared directory cannot be filtered, use fs:shared=false")
+		}
+		fs, err := storage.NewFilterStore(h.store)
+		if err != nil {
+			return err
+		}
+		log.Printf("Filtering lookups by the %d known ids", fs.Len())
+		h.store = fs
+	}
+	if *shardSelf != "" {
+		h.shard = &shardStore{
+			Store: h.store,
+			ring:  hashring.New(splitList(*shards)),
+			self:  *shardSelf,
+		}
+		h.store = h.shard
+	}
+	if h.mirror != nil {
+		h.mirror.Store = h.store
+		h.store = h.mirror
+	}
+	if h.changes != nil {
+		h.store = loggedStore{h.store, h.changes}
+	}
+	h.store = newMetricsStore(h.store, storageType)
+	return nil
 }
 
-func (h *httpHandler) setupStore(lifeTime time.Duration, storageType string, args []string) error {
-	params, e := map[string]map[string]string{
-		"fs": {
-			"dir": "pastes",
-		},
-		"fs-mmap": {
-			"dir": "pastes",
-		},
-		"mem": {},
-	}[storageType]
-	if !e {
-		return fmt.Errorf("unknown storage type '%s'", storageType)
+// closeOnSignal closes a store before exiting on an interrupt or
+// termination signal, so that it can save what it holds in memory.
+func closeOnSignal(c io.Closer) {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+	sig := <-sigs
+	log.Printf("Closing the store on %v", sig)
+	if err := c.Close(); err != nil {
+		log.Fatalf("Could not close the store: %v", err)
 	}
-	if len(args) > len(params) {
-		return fmt.Errorf("too many arguments given for %s", storageType)
+	os.Exit(0)
+}
+
+// redactParam hides the secrets in the parameters of storage backends, so
+// that they are not logged.
+func redactParam(k, v string) string {
+	if (k == "sas" || k == "password") && v != "" {
+		return "xxxxx"
 	}
-	for k := range params {
-		if len(args) == 0 {
-			break
+	if k == "small" || k == "large" {
+		// The stores within a hybrid one
+		if name, params, err := storage.ParseSubSpec(v); err == nil {
+			for pk, pv := range params {
+				params[pk] = redactParam(pk, pv)
+			}
+			return storage.FormatSubSpec(name, params)
 		}
-		params[k] = args[0]
-		args = args[1:]
 	}
-	var err error
-	switch storageType {
-	case "fs":
-		log.Printf("Starting up file store in the directory '%s'", params["dir"])
-		h.store, err = storage.NewFileStore(h.stats, lifeTime, params["dir"])
-	case "fs-mmap":
-		log.Printf("Starting up mmapped file store in the directory '%s'", params["dir"])
-		h.store, err = storage.NewMmapStore(h.stats, lifeTime, params["dir"])
-	case "mem":
-		log.Printf("Starting up in-memory store")
-		h.store, err = storage.NewMemStore()
+	if u, err := url.Parse(v); err == nil && u.User != nil {
+		return u.Redacted()
 	}
-	return err
+	return v
 }
 
 func logStats(stats *storage.Stats) {
@@ -209,13 +1126,104 @@ func logStats(stats *storage.Stats) {
 	log.Printf("Have a total of %s pastes using %s", numStats, stgStats)
 }
 
+// checkFlags returns an error if the flags given are invalid or cannot be
+// used together.
+func checkFlags() error {
+	if maxStorage > 1*storage.EB {
+		return errors.New("specified a maximum storage size that would overflow int64")
+	}
+	for _, percent := range []int{*warnPercent, *anonPercent} {
+		if percent < 0 || percent > 100 {
+			return errors.New("storage percentages must be between 0 and 100")
+		}
+	}
+	for _, size := range []storage.ByteSize{maxSize, formMaxSize, apiMaxSize} {
+		if size > 1*storage.EB {
+			return errors.New("specified a maximum paste size that would overflow int64")
+		}
+	}
+	if *disposition != "inline" && *disposition != "attachment" {
+		return fmt.Errorf("unknown disposition %q, want inline or attachment", *disposition)
+	}
+	if _, e := themes[*theme]; !e {
+		return fmt.Errorf("unknown theme %q, want light, dark or auto", *theme)
+	}
+	if *recentCount < 0 {
+		return errors.New("the number of recent pastes to list cannot be negative")
+	}
+	if *maxLifeTime > 0 && *minLifeTime > *maxLifeTime {
+		return errors.New("specified a minimum lifetime longer than the maximum")
+	}
+	if _, err := storage.ParseSyncPolicy(*fsync); err != nil {
+		return fmt.Errorf("invalid -fsync: %v", err)
+	}
+	if *expiryBatch < 1 {
+		return errors.New("specified an expiry batch smaller than one")
+	}
+	if *privacyMode && *hashIPs {
+		return errors.New("privacy mode cannot record hashes of addresses")
+	}
+	switch *anonymizeIPs {
+	case "", anonymizeTruncate, anonymizeHMAC:
+	default:
+		return fmt.Errorf("unknown way to anonymize addresses: %s", *anonymizeIPs)
+	}
+	if *oidcIssuer != "" && (*oidcClientID == "" || *oidcSecret == "") {
+		return errors.New("logging in needs -oidc-client-id and -oidc-client-secret")
+	}
+	if *oidcIssuer != "" && *tcpListen != "" {
+		return errors.New("pastes over TCP cannot require logging in")
+	}
+	if (*tlsCert == "") != (*tlsKey == "") {
+		return errors.New("HTTPS needs both -tls-cert and -tls-key")
+	}
+	if *tlsCert == "" && (*clientCA != "" || *clientAuth) {
+		return errors.New("client certificates need HTTPS via -tls-cert")
+	}
+	if *clientAuth && *clientCA == "" {
+		return errors.New("requiring client certificates needs a -client-ca")
+	}
+	if *replicaOf != "" && *syncToken == "" {
+		return errors.New("a replica needs the primary's -sync-token")
+	}
+	if *replicaOf != "" && *tcpListen != "" {
+		return errors.New("a replica cannot accept pastes over TCP")
+	}
+	if *replicaOf != "" && *watch {
+		return errors.New("a replica cannot turn files into pastes")
+	}
+	return nil
+}
+
 func main() {
+	if len(os.Args) > 1 {
+		if cmd, ok := findSubcommand(os.Args[1]); ok {
+			cmd.run(os.Args[2:])
+			return
+		}
+	}
 	flag.Parse()
-	if maxStorage > 1*storage.EB {
-		log.Fatalf("Specified a maximum storage size that would overflow int64!")
+	if *showVersion {
+		printVersion()
+		return
 	}
-	if maxSize > 1*storage.EB {
-		log.Fatalf("Specified a maximum paste size that would overflow int64!")
+	if err := checkFlags(); err != nil {
+		log.Fatalf("Invalid flags: %v", err)
+	}
+	// Already checked by checkFlags
+	syncPolicy, _ := storage.ParseSyncPolicy(*fsync)
+	storage.SetSyncPolicy(syncPolicy)
+	storage.SetDeletionBatching(*expiryEvery, *expiryBatch)
+	if *shards != "" && *shardSelf == "" {
+		rt, err := newRouter(splitList(*shards))
+		if err != nil {
+			log.Fatalf("Could not set up the router: %v", err)
+		}
+		log.Printf("Routing to %d shards on %s", len(rt.shards), *listen)
+		log.Fatal(http.ListenAndServe(*listen, rt))
+	}
+	if !*encryptedMode {
+		delete(templates, encryptPage)
 	}
 	loadTemplates()
 	var handler httpHandler
@@ -223,33 +1231,359 @@ func main() {
 		MaxNumber:  *maxNumber,
 		MaxStorage: int64(maxStorage),
 	}
+	handler.disk = newDiskGuard()
+	if *torControl != "" {
+		target, err := onionTarget(*listen)
+		if err != nil {
+			log.Fatalf("Invalid listen address for an onion service: %v", err)
+		}
+		onion, err := publishOnion(*torControl, *torPassword, *torKey, target)
+		if err != nil {
+			log.Fatalf("Could not publish onion service: %v", err)
+		}
+		defer onion.Close()
+		siteSet := false
+		flag.Visit(func(f *flag.Flag) {
+			siteSet = siteSet || f.Name == "u"
+		})
+		if !siteSet {
+			*siteURL = onion.URL()
+		}
+		log.Printf("onion      = %s", onion.URL())
+	}
 	log.Printf("siteURL    = %s", *siteURL)
 	log.Printf("listen     = %s", *listen)
 	log.Printf("lifeTime   = %s", *lifeTime)
+	if len(sizeLimits) > 0 {
+		log.Printf("sizeLimits = %s", &sizeLimits)
+	}
 	log.Printf("maxSize    = %s", maxSize)
+	if formMaxSize > 0 {
+		log.Printf("formSize   = %s", formMaxSize)
+	}
+	if apiMaxSize > 0 {
+		log.Printf("apiSize    = %s", apiMaxSize)
+	}
 	log.Printf("maxNumber  = %d", *maxNumber)
 	log.Printf("maxStorage = %s", maxStorage)
+	handler.tombs = storage.NewTombstones(*maxTombstones)
+
+	if *messagesDir != "" {
+		if err := loadCatalogs(*messagesDir); err != nil {
+			log.Fatalf("Could not load message catalogs: %v", err)
+		}
+	}
+	if *forceLang = strings.ToLower(*forceLang); *forceLang != "" && !hasLang(*forceLang) {
+		log.Fatalf("No message catalog for the language %q", *forceLang)
+	}
+
+	if *tokensPath != "" {
+		tokens, err := loadTokens(*tokensPath)
+		if err != nil {
+			log.Fatalf("Could not load upload tokens: %v", err)
+		}
+		handler.tokens = tokens
+	}
+	if *auditPath != "" {
+		audit, err := openAuditLog(*auditPath)
+		if err != nil {
+			log.Fatalf("Could not open audit log: %v", err)
+		}
+		handler.audit = audit
+	}
+	if *oidcIssuer != "" {
+		o, err := newOIDCProvider(*oidcIssuer, *oidcClientID, *oidcSecret)
+		if err != nil {
+			log.Fatalf("Could not set up OpenID Connect: %v", err)
+		}
+		handler.oidc = o
+		log.Printf("Uploads require logging in via %s", *oidcIssuer)
+	}
+	if *authHeader != "" {
+		proxy, err := newAuthProxy(*authHeader, splitList(*authProxies))
+		if err != nil {
+			log.Fatalf("Could not set up the auth proxy: %v", err)
+		}
+		handler.proxy = proxy
+		log.Printf("Attributing pastes to the users in %s", *authHeader)
+	}
+	if *signKey != "" {
+		signer, err := loadSigner(*signKey)
+		if err != nil {
+			log.Fatalf("Could not load the signing key: %v", err)
+		}
+		handler.signer = signer
+		log.Printf("Signing pastes with key %s", signer.KeyID())
+	}
+
+	var tus *tusHandler
+	if *tusDir != "" {
+		var err error
+		if tus, err = newTusHandler(&handler, *tusDir); err != nil {
+			log.Fatalf("Could not set up tus uploads: %v", err)
+		}
+	}
+
+	if *mirrorDir != "" {
+		replica, err := storage.NewDirReplica(*mirrorDir, fsLayout())
+		if err != nil {
+			log.Fatalf("Could not set up the mirror: %v", err)
+		}
+		handler.mirror = storage.NewMirrorStore(replica)
+		publishMirrorVars(handler.mirror)
+	}
+
+	if *syncToken != "" && *replicaOf == "" {
+		changes, err := newChangeLog()
+		if err != nil {
+			log.Fatalf("Could not set up the sync API: %v", err)
+		}
+		handler.changes = changes
+	}
+
+	if *shardSelf != "" {
+		found := false
+		for _, shard := range splitList(*shards) {
+			found = found || shard == *shardSelf
+		}
+		if !found {
+			log.Fatalf("-shard-self must be one of -shards")
+		}
+	}
+	if *peers != "" {
+		handler.peers = newFederation(splitList(*peers))
+		log.Printf("Trying %d peers for pastes not found locally", len(handler.peers.peers))
+	}
+	if *clusterSelf != "" {
+		if *replicaOf != "" {
+			log.Fatalf("A replica cannot be part of a cluster")
+		}
+		if *shardSelf != "" {
+			log.Fatalf("A shard cannot be part of a cluster")
+		}
+		if *clusterToken == "" {
+			log.Fatalf("A cluster needs a -cluster-token")
+		}
+		if *dedup {
+			log.Fatalf("Uploads to a cluster cannot be deduplicated")
+		}
+	}
+	// Stores chdir into their directory
+	raftDir, err := filepath.Abs(*clusterDir)
+	if err != nil {
+		log.Fatalf("Invalid cluster directory: %v", err)
+	}
+	activityPath := *statsFile
+	if activityPath != "" {
+		if activityPath, err = filepath.Abs(activityPath); err != nil {
+			log.Fatalf("Invalid stats file: %v", err)
+		}
+	}
+	if handler.activity, err = loadActivity(activityPath); err != nil {
+		log.Fatalf("Could not load the stats file: %v", err)
+	}
+	go handler.activity.run(saveInterval)
+	var report func()
+	if *statsReport != "none" && *reportEvery > 0 {
+		if report, err = handler.statsReporter(*statsReport); err != nil {
+			log.Fatalf("Could not set up the stats report: %v", err)
+		}
+	}
 
 	args := flag.Args()
 	if len(args) == 0 {
 		args = []string{"fs"}
 	}
-	if err := handler.setupStore(*lifeTime, args[0], args[1:]); err != nil {
+	if err := handler.setupStore(*lifeTime, args); err != nil {
 		log.Fatalf("Could not setup paste store: %v", err)
 	}
+	if *dedup {
+		if handler.dups, err = newDupIndex(handler.store); err != nil {
+			log.Fatalf("Could not index the pastes by content: %v", err)
+		}
+	}
+	if handler.tokens.hasQuota() {
+		if handler.usage, err = storage.NewUsage(handler.store, *lifeTime); err != nil {
+			log.Fatalf("Could not count the usage of the tokens: %v", err)
+		}
+	}
 
-	ticker := time.NewTicker(reportInterval)
-	go func() {
-		logStats(handler.stats)
-		for range ticker.C {
-			logStats(handler.stats)
+	if *clusterSelf != "" {
+		peers := splitList(*clusterPeers)
+		log.Printf("Joining a cluster of %d nodes as %s", len(peers)+1, *clusterSelf)
+		c, err := newCluster(&handler, *clusterSelf, peers, raftDir, *clusterToken)
+		if err != nil {
+			log.Fatalf("Could not set up the cluster: %v", err)
 		}
-	}()
-	var finalHandler http.Handler = handler
-	if *timeout > 0 {
-		finalHandler = http.TimeoutHandler(finalHandler, *timeout, "")
+		handler.cluster = c
+	}
+	if *watch {
+		switch handler.storeType {
+		case "fs", "fs-mmap", "fs-nfs":
+		default:
+			log.Fatalf("Only fs stores can watch their directory")
+		}
+		// Stores chdir into their directory
+		w, err := dirwatch.New(".")
+		if err != nil {
+			log.Fatalf("Could not watch the store directory: %v", err)
+		}
+		go newImporter(&handler).run(w)
+	}
+
+	if report != nil {
+		go func() {
+			report()
+			for range time.Tick(*reportEvery) {
+				report()
+			}
+		}()
+	}
+	withTimeout := func(h http.Handler) http.Handler {
+		if *timeout > 0 {
+			return http.TimeoutHandler(h, *timeout, "")
+		}
+		return h
+	}
+	// Routes that store pastes are refused while the disk is full
+	guard := handler.disk.guard
+	mux := http.NewServeMux()
+	pastes := withTimeout(guard(handler))
+	if handler.storeType == "fs" {
+		// The timeout would buffer the pastes being downloaded, which
+		// can instead be sent straight from their files
+		pastes = unbufferedReads(guard(handler), pastes)
+	}
+	mux.Handle("/", pastes)
+	statsLimiter := newRateLimiter(*statsRate)
+	mux.Handle("/stats", withTimeout(statsLimiter.limit(http.HandlerFunc(handler.handleStats))))
+	mux.Handle("/openapi.json", withTimeout(http.HandlerFunc(handler.handleOpenAPI)))
+	mux.Handle(versionPath, withTimeout(versionHandler{h: &handler, tus: tus != nil}))
+	mux.Handle(staticPrefix, newStaticHandler(*theme))
+	if *recentCount > 0 {
+		mux.Handle(recentPath, withTimeout(http.HandlerFunc(handler.handleRecent)))
+	}
+	if handler.tokens != nil || handler.oidc != nil || handler.proxy != nil {
+		mux.Handle(mePrefix, withTimeout(meHandler{h: &handler}))
+	}
+	if handler.oidc != nil {
+		mux.Handle(authPrefix, withTimeout(handler.oidc))
+	}
+	if handler.signer != nil {
+		mux.Handle(publicKeyPath, withTimeout(http.HandlerFunc(handler.signer.servePublicKey)))
+	}
+	if compat[compatHastebin] {
+		hb := withTimeout(guard(hastebinHandler{h: &handler}))
+		mux.Handle("/documents", hb)
+		mux.Handle("/documents/", hb)
+		mux.Handle("/raw/", hb)
+	}
+	if compat[compatPastebin] {
+		mux.Handle("/api/api_post.php", withTimeout(guard(pastebinHandler{h: &handler})))
+	}
+	if compat[compatGist] {
+		gh := withTimeout(guard(gistHandler{h: &handler}))
+		mux.Handle("/gists", gh)
+		mux.Handle("/gists/", gh)
+	}
+	if tus != nil {
+		// Not timed out, as uploading each chunk may take long
+		mux.Handle(tusPrefix, guard(tus))
+	}
+	if *adminToken != "" {
+		mux.Handle("/admin/", withTimeout(adminHandler{
+			h:      &handler,
+			secret: *adminToken,
+		}))
+	}
+	if handler.changes != nil {
+		mux.Handle(syncPrefix, withTimeout(syncHandler{
+			h:      &handler,
+			secret: *syncToken,
+		}))
+	}
+	if handler.cluster != nil {
+		// Not timed out, as snapshots may take long to send
+		mux.Handle(clusterPrefix, handler.cluster)
+	}
+	var root http.Handler = mux
+	if *replicaOf != "" {
+		log.Printf("Serving pastes as a replica of %s", *replicaOf)
+		root = readOnly(mux)
+		go newReplicator(&handler, *replicaOf, *syncToken).run()
+	}
+	if *tcpListen != "" {
+		l, err := net.Listen("tcp", *tcpListen)
+		if err != nil {
+			log.Fatalf("Could not listen for TCP pastes: %v", err)
+		}
+		go func() {
+			log.Fatal(handler.serveTCP(l))
+		}()
+	}
+	if *adminListen != "" {
+		if *adminCert == "" || *adminKey == "" || *adminCA == "" {
+			log.Fatalf("The admin listener needs -admin-cert, -admin-key and -admin-ca")
+		}
+		config, err := serverTLSConfig(*adminCert, *adminKey, *adminCA, tls.RequireAndVerifyClientCert)
+		if err != nil {
+			log.Fatalf("Could not set up the admin listener: %v", err)
+		}
+		var admin http.Handler = withTimeout(adminHandler{h: &handler})
+		if *replicaOf != "" {
+			admin = readOnly(admin)
+		}
+		adminMux := http.NewServeMux()
+		adminMux.Handle("/admin/", admin)
+		srv := &http.Server{
+			Addr:      *adminListen,
+			Handler:   adminMux,
+			TLSConfig: config,
+			ErrorLog:  serverErrorLog(),
+		}
+		log.Printf("Serving the admin API on %s", *adminListen)
+		go func() {
+			log.Fatal(srv.ListenAndServeTLS("", ""))
+		}()
+	}
+	if *debugListen != "" {
+		publishStoreVars(handler.stats)
+		go func() {
+			srv := &http.Server{
+				Addr:     *debugListen,
+				Handler:  debugMux(),
+				ErrorLog: serverErrorLog(),
+			}
+			log.Fatal(srv.ListenAndServe())
+		}()
+	}
+	if *statsdAddr != "" {
+		emitter, err := newStatsdEmitter(*statsdAddr, *statsdPrefix, handler.stats)
+		if err != nil {
+			log.Fatalf("Could not set up StatsD: %v", err)
+		}
+		go emitter.run(*statsdInterval)
+	}
+	var tr *tracer
+	if *otlpEndpoint != "" {
+		tr = newTracer(*otlpEndpoint)
+	}
+	srv := &http.Server{
+		Addr:     *listen,
+		Handler:  countErrors(tr.wrap(logSlow(decompressBody(htmlErrors(root), handler.largestMaxSize()), *slowRequest))),
+		ErrorLog: serverErrorLog(),
+	}
+	if *tlsCert == "" {
+		log.Println("Up and running!")
+		log.Fatal(srv.ListenAndServe())
+	}
+	auth := tls.VerifyClientCertIfGiven
+	if *clientAuth {
+		auth = tls.RequireAndVerifyClientCert
+	}
+	if srv.TLSConfig, err = serverTLSConfig(*tlsCert, *tlsKey, *clientCA, auth); err != nil {
+		log.Fatalf("Could not set up TLS: %v", err)
 	}
-	http.Handle("/", finalHandler)
 	log.Println("Up and running!")
-	log.Fatal(http.ListenAndServe(*listen, nil))
+	log.Fatal(srv.ListenAndServeTLS("", ""))
 }
@@ -0,0 +1,127 @@
+// Copyright (c) 2014-2015, Daniel Martí <mvdan@mvdan.cc>
+// See LICENSE for licensing information
+
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// clientSalt is the secret mixing the addresses of clients into hashes in
+// privacy mode. It is only kept in memory and replaced daily, so that the
+// hashes cannot be linked across days.
+var clientSalt struct {
+	sync.Mutex
+	day  int64
+	salt []byte
+}
+
+// anonymousHost returns a salted hash of a client's address, which only
+// stays the same for the current day.
+func anonymousHost(host string) string {
+	day := time.Now().Unix() / int64(24*time.Hour/time.Second)
+	clientSalt.Lock()
+	if clientSalt.salt == nil || clientSalt.day != day {
+		clientSalt.salt = make([]byte, 32)
+		rand.Read(clientSalt.salt)
+		clientSalt.day = day
+	}
+	mac := hmac.New(sha256.New, clientSalt.salt)
+	clientSalt.Unlock()
+	mac.Write([]byte(host))
+	return hex.EncodeToString(mac.Sum(nil)[:16])
+}
+
+// clientKey returns what tells clients apart when tracking their requests,
+// which is their address unless in privacy mode.
+func clientKey(r *http.Request) string {
+	if *privacyMode {
+		return anonymousHost(clientHost(r))
+	}
+	return clientHost(r)
+}
+
+// Ways to anonymize the addresses of clients that are logged
+const (
+	anonymizeTruncate = "truncate"
+	anonymizeHMAC     = "hmac"
+)
+
+// logKey is the secret mixing the addresses of clients into the hashes that
+// are logged instead. It is only kept in memory, so the hashes can only be
+// linked while the server is running.
+var logKey = make([]byte, 32)
+
+func init() {
+	rand.Read(logKey)
+}
+
+// logHost returns how the address of a client is logged, which is not at
+// all in privacy mode.
+func logHost(host string) string {
+	switch {
+	case *privacyMode:
+		return ""
+	case *anonymizeIPs == anonymizeTruncate:
+		ip := net.ParseIP(host)
+		if ip == nil {
+			return host
+		}
+		if ip4 := ip.To4(); ip4 != nil {
+			return ip4.Mask(net.CIDRMask(24, 32)).String() + "/24"
+		}
+		return ip.Mask(net.CIDRMask(48, 128)).String() + "/48"
+	case *anonymizeIPs == anonymizeHMAC:
+		mac := hmac.New(sha256.New, logKey)
+		mac.Write([]byte(host))
+		return hex.EncodeToString(mac.Sum(nil)[:8])
+	}
+	return host
+}
+
+// clientActor returns the client to record in the audit log, if any.
+func clientActor(r *http.Request) string {
+	return logHost(clientHost(r))
+}
+
+// Addresses of clients in the errors logged by net/http, like "http: TLS
+// handshake error from 192.0.2.1:51234: EOF"
+var clientAddrRe = regexp.MustCompile(`(from|serving) (\S+):\d+`)
+
+type redactWriter struct{}
+
+func (redactWriter) Write(p []byte) (int, error) {
+	redacted := clientAddrRe.ReplaceAllFunc(p, func(match []byte) []byte {
+		m := clientAddrRe.FindSubmatch(match)
+		host := logHost(strings.Trim(string(m[2]), "[]"))
+		if host == "" {
+			host = "client"
+		}
+		return []byte(string(m[1]) + " " + host)
+	})
+	if _, err := os.Stderr.Write(redacted); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// serverErrorLog returns the logger of the HTTP servers, which leaves out
+// or anonymizes the addresses of clients if asked to.
+func serverErrorLog() *log.Logger {
+	if !*privacyMode && *anonymizeIPs == "" {
+		// The default logger
+		return nil
+	}
+	return log.New(redactWriter{}, "", log.LstdFlags)
+}
@@ -0,0 +1,94 @@
+// Copyright (c) 2014-2015, Daniel Martí <mvdan@mvdan.cc>
+// See LICENSE for licensing information
+
+package main
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// How often to forget about clients that have not made requests in a while
+const rateLimitPrune = 10 * time.Minute
+
+// rateLimiter allows each client a number of requests per minute, with
+// bursts of up to the same amount.
+type rateLimiter struct {
+	sync.Mutex
+	perMinute float64
+	clients   map[string]*bucket
+	lastPrune time.Time
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+func newRateLimiter(perMinute int) *rateLimiter {
+	return &rateLimiter{
+		perMinute: float64(perMinute),
+		clients:   make(map[string]*bucket),
+		lastPrune: time.Now(),
+	}
+}
+
+func clientHost(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// wait returns how long the client must wait before making the request,
+// which is zero if it is allowed right away.
+func (l *rateLimiter) wait(r *http.Request) time.Duration {
+	if l.perMinute <= 0 {
+		return 0
+	}
+	now := time.Now()
+	l.Lock()
+	defer l.Unlock()
+	if now.Sub(l.lastPrune) > rateLimitPrune {
+		for client, b := range l.clients {
+			if now.Sub(b.last) > time.Minute {
+				delete(l.clients, client)
+			}
+		}
+		l.lastPrune = now
+	}
+	client := clientKey(r)
+	b, e := l.clients[client]
+	if !e {
+		b = &bucket{tokens: l.perMinute, last: now}
+		l.clients[client] = b
+	}
+	b.tokens += now.Sub(b.last).Minutes() * l.perMinute
+	if b.tokens > l.perMinute {
+		b.tokens = l.perMinute
+	}
+	b.last = now
+	if b.tokens < 1 {
+		return time.Duration((1 - b.tokens) / l.perMinute * float64(time.Minute))
+	}
+	b.tokens--
+	return 0
+}
+
+// limit wraps a handler so that clients going over the limit get a
+// "429 Too Many Requests" error instead.
+func (l *rateLimiter) limit(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if wait := l.wait(r); wait > 0 {
+			w.Header().Set("Retry-After", fmt.Sprintf("%.f", math.Ceil(wait.Seconds())))
+			http.Error(w, "too many requests", http.StatusTooManyRequests)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,104 @@
+// Copyright (c) 2014-2015, Daniel Martí <mvdan@mvdan.cc>
+// See LICENSE for licensing information
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/mvdan/pastecat/storage"
+)
+
+const (
+	// Name of the HTTP form field asking for a paste to be listed publicly
+	listedField = "listed"
+	// Name of the HTTP form field giving a paste a title
+	titleField = "title"
+	// Path of the public listing of recent pastes
+	recentPath = "/recent"
+	// Maximum length of the titles of pastes, in characters
+	maxTitleLength = 100
+)
+
+var errListingDisabled = errors.New("the public listing is not enabled")
+
+// formListed returns whether an upload asked to be listed publicly, which
+// is only accepted if the listing is enabled.
+func formListed(r *http.Request) (bool, error) {
+	value := r.FormValue(listedField)
+	if value == "" {
+		return false, nil
+	}
+	listed, err := strconv.ParseBool(value)
+	if err != nil {
+		return false, fmt.Errorf("invalid %s value '%s'", listedField, value)
+	}
+	if listed && *recentCount <= 0 {
+		return false, errListingDisabled
+	}
+	return listed, nil
+}
+
+// formTitle returns the title given to an upload, if any.
+func formTitle(r *http.Request) (string, error) {
+	title := strings.TrimSpace(r.FormValue(titleField))
+	if utf8.RuneCountInString(title) > maxTitleLength {
+		return "", fmt.Errorf("title must be at most %d characters long", maxTitleLength)
+	}
+	return title, nil
+}
+
+// recentEntry is a paste as shown in the public listing, which must not
+// reveal who uploaded it
+type recentEntry struct {
+	ID      string           `json:"id"`
+	URL     string           `json:"url"`
+	Title   string           `json:"title,omitempty"`
+	Size    storage.ByteSize `json:"size"`
+	Created time.Time        `json:"created"`
+}
+
+// handleRecent lists the newest pastes whose uploaders asked for them to be
+// listed.
+func (h *httpHandler) handleRecent(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, unknownAction, http.StatusBadRequest)
+		return
+	}
+	entries, _, err := storage.List(h.store, storage.ListOptions{
+		Limit:  *recentCount,
+		Listed: true,
+	})
+	if err != nil {
+		h.storeError(w, r, err)
+		return
+	}
+	recent := make([]recentEntry, len(entries))
+	for i, e := range entries {
+		title := e.Title
+		if title == "" {
+			title = e.Filename
+		}
+		recent[i] = recentEntry{
+			ID:      e.ID.String(),
+			URL:     pasteURL(e.ID, e.Meta),
+			Title:   title,
+			Size:    storage.ByteSize(e.Size),
+			Created: e.Created(e.ModTime),
+		}
+	}
+	if negotiate(r, "application/json", "text/html") == "application/json" {
+		writeJSON(w, recent)
+		return
+	}
+	if err := tmpl.ExecuteTemplate(w, "recent", recent); err != nil {
+		log.Printf("Error executing template for %s: %v", r.URL.Path, err)
+	}
+}
@@ -0,0 +1,162 @@
+// Copyright (c) 2014-2015, Daniel Martí <mvdan@mvdan.cc>
+// See LICENSE for licensing information
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/mvdan/pastecat/storage"
+)
+
+// How often replicas ask their primary for changes
+const replicaPollInterval = 1 * time.Second
+
+// replicator keeps the store of a replica in sync with its primary's
+type replicator struct {
+	h       *httpHandler
+	primary string
+	secret  string
+	client  *http.Client
+
+	epoch string
+	next  uint64
+}
+
+func newReplicator(h *httpHandler, primary, secret string) *replicator {
+	return &replicator{
+		h:       h,
+		primary: strings.TrimSuffix(primary, "/"),
+		secret:  secret,
+		client:  &http.Client{Timeout: 30 * time.Second},
+	}
+}
+
+func (rp *replicator) run() {
+	for {
+		if err := rp.sync(); err != nil {
+			log.Printf("Could not sync with the primary: %v", err)
+		}
+		time.Sleep(replicaPollInterval)
+	}
+}
+
+func (rp *replicator) get(path string, v interface{}) error {
+	req, err := http.NewRequest("GET", rp.primary+path, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+rp.secret)
+	resp, err := rp.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		return storage.ErrPasteNotFound
+	default:
+		return fmt.Errorf("%s: %s", path, resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// sync applies the changes made on the primary since the last sync. Only
+// the last change to each paste is applied, as the current paste is
+// copied anyway.
+func (rp *replicator) sync() error {
+	var page changesPage
+	err := rp.get(fmt.Sprintf("%schanges?epoch=%s&since=%d", syncPrefix,
+		url.QueryEscape(rp.epoch), rp.next), &page)
+	if err != nil {
+		return err
+	}
+	last := make(map[string]int, len(page.Changes))
+	for i, c := range page.Changes {
+		last[c.ID] = i
+	}
+	local := make(map[storage.ID]storage.Info)
+	if page.Full {
+		rp.h.store.Iterate(func(id storage.ID, info storage.Info) bool {
+			local[id] = info
+			return true
+		})
+		for id := range local {
+			if _, e := last[id.String()]; !e {
+				if err := rp.remove(id); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	for i, c := range page.Changes {
+		if last[c.ID] != i {
+			continue
+		}
+		id, err := storage.IDFromString(c.ID)
+		if err != nil {
+			return err
+		}
+		if c.Deleted {
+			err = rp.remove(id)
+		} else if info, e := local[id]; e && c.Hash != "" &&
+			info.Hash == c.Hash && len(info.Versions) == c.Versions {
+			// Already up to date
+			continue
+		} else {
+			err = rp.copy(id)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	rp.epoch, rp.next = page.Epoch, page.Next
+	return nil
+}
+
+func (rp *replicator) remove(id storage.ID) error {
+	if err := rp.h.dropPaste(id); err != storage.ErrPasteNotFound {
+		return err
+	}
+	return nil
+}
+
+func (rp *replicator) copy(id storage.ID) error {
+	var p syncedPaste
+	err := rp.get(syncPrefix+"pastes/"+id.String(), &p)
+	if err == storage.ErrPasteNotFound {
+		// Deleted or not replicated since
+		return rp.remove(id)
+	} else if err != nil {
+		return err
+	}
+	switch err := rp.h.copyPaste(id, p); err {
+	case storage.ErrReachedMaxNumber, storage.ErrReachedMaxStorage:
+		// Skipped rather than retried, as it may never fit
+		log.Printf("Could not copy %s from the primary: %v", id, err)
+		return nil
+	default:
+		return err
+	}
+}
+
+// readOnly refuses the requests that would change pastes, as replicas
+// only serve the pastes stored by their primary.
+func readOnly(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case "GET", "HEAD", "OPTIONS":
+			h.ServeHTTP(w, r)
+		default:
+			w.Header().Set("Allow", "GET, HEAD")
+			http.Error(w, "read-only replica", http.StatusMethodNotAllowed)
+		}
+	})
+}
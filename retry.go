@@ -0,0 +1,47 @@
+// Copyright (c) 2014-2015, Daniel Martí <mvdan@mvdan.cc>
+// See LICENSE for licensing information
+
+package main
+
+import (
+	"expvar"
+	"log"
+	"time"
+
+	"github.com/mvdan/pastecat/storage"
+)
+
+// retryPolicies are how the operations failing with transient errors are
+// retried on each backend, unless overridden. Local disks rarely fail that
+// way, while network filesystems may take a while to recover.
+var retryPolicies = map[string]storage.RetryPolicy{
+	"fs":      {Attempts: 3, Backoff: 10 * time.Millisecond},
+	"fs-mmap": {Attempts: 3, Backoff: 10 * time.Millisecond},
+	"fs-nfs":  {Attempts: 5, Backoff: 50 * time.Millisecond},
+	"mem":     {Attempts: 1},
+}
+
+// withRetries wraps a backend's store so that its operations failing with
+// transient errors are retried, counting each retry along with the
+// backend's metrics.
+func withRetries(s storage.Store, storageType string) storage.Store {
+	policy := retryPolicies[storageType]
+	if *storeRetries > 0 {
+		policy.Attempts = *storeRetries
+	}
+	if *storeBackoff > 0 {
+		policy.Backoff = *storeBackoff
+	}
+	if policy.Attempts < 2 {
+		return s
+	}
+	policy.MaxBackoff = 16 * policy.Backoff
+	rs := storage.NewRetryStore(s, policy)
+	rs.OnRetry = func(op string, err error) {
+		log.Printf("Retrying a %s after a transient error: %v", op, err)
+		if vars, ok := storeVars.Get(storageType).(*expvar.Map); ok {
+			vars.Add(op+"_retries", 1)
+		}
+	}
+	return rs
+}
@@ -0,0 +1,134 @@
+// Copyright (c) 2014-2015, Daniel Martí <mvdan@mvdan.cc>
+// See LICENSE for licensing information
+
+package main
+
+import (
+	"crypto/rand"
+	"fmt"
+	mathrand "math/rand"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mvdan/pastecat/internal/hashring"
+	"github.com/mvdan/pastecat/storage"
+)
+
+// How many random ids a shard tries for a new paste, as only some of them
+// map to it
+const shardIDTries = 1000
+
+// splitList splits a comma-separated list, dropping empty elements.
+func splitList(s string) []string {
+	var list []string
+	for _, elem := range strings.Split(s, ",") {
+		if elem = strings.TrimSpace(elem); elem != "" {
+			list = append(list, elem)
+		}
+	}
+	return list
+}
+
+// shardStore only assigns the ids that map to this shard on the ring, so
+// that routers know which shard holds each paste
+type shardStore struct {
+	storage.Store
+	ring *hashring.Ring
+	self string
+	// mu keeps two uploads from picking the same id
+	mu sync.Mutex
+}
+
+// owns reports whether a key, like a paste id, maps to this shard.
+func (s *shardStore) owns(key []byte) bool {
+	return s.ring.Get(key) == s.self
+}
+
+func (s *shardStore) Stat(id storage.ID) (storage.Info, error) {
+	return storage.Stat(s.Store, id)
+}
+
+func (s *shardStore) DeleteBatch(ids []storage.ID) error {
+	return storage.DeleteBatch(s.Store, ids)
+}
+
+func (s *shardStore) Put(content []byte, meta storage.Meta) (storage.ID, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for try := 0; try < shardIDTries; try++ {
+		var id storage.ID
+		if _, err := rand.Read(id[:]); err != nil {
+			continue
+		}
+		if !s.owns(id[:]) {
+			continue
+		}
+		paste, err := s.Store.Get(id)
+		if err == nil {
+			paste.Close()
+			continue
+		} else if err != storage.ErrPasteNotFound {
+			return id, err
+		}
+		return id, s.Store.Copy(id, content, meta, time.Now(), nil)
+	}
+	return storage.ID{}, storage.ErrNoUnusedIDFound
+}
+
+// router forwards each request to the shard holding the paste it is about,
+// or to any shard if it is not about an existing paste
+type router struct {
+	ring    *hashring.Ring
+	shards  []string
+	proxies map[string]*httputil.ReverseProxy
+}
+
+func newRouter(shards []string) (*router, error) {
+	rt := &router{
+		ring:    hashring.New(shards),
+		shards:  shards,
+		proxies: make(map[string]*httputil.ReverseProxy, len(shards)),
+	}
+	for _, shard := range shards {
+		u, err := url.Parse(shard)
+		if err != nil {
+			return nil, err
+		}
+		if u.Scheme == "" || u.Host == "" {
+			return nil, fmt.Errorf("invalid shard URL: %s", shard)
+		}
+		rt.proxies[shard] = httputil.NewSingleHostReverseProxy(u)
+	}
+	return rt, nil
+}
+
+// shardFor returns the shard holding the paste whose id is in the path,
+// like "/a63d03b9/file" or "/raw/a63d03b9", or the tus upload in it, if
+// any.
+func (rt *router) shardFor(path string) (string, bool) {
+	if strings.HasPrefix(path, tusPrefix) && len(path) > len(tusPrefix) {
+		return rt.ring.Get([]byte(path[len(tusPrefix):])), true
+	}
+	for _, elem := range strings.Split(path, "/") {
+		if compat[compatIxio] {
+			elem = strings.TrimSuffix(elem, "+")
+		}
+		if id, err := storage.IDFromString(elem); err == nil {
+			return rt.ring.Get(id[:]), true
+		}
+	}
+	return "", false
+}
+
+func (rt *router) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	shard, ok := rt.shardFor(r.URL.Path)
+	if !ok {
+		// New pastes get an id that maps to the shard storing them
+		shard = rt.shards[mathrand.Intn(len(rt.shards))]
+	}
+	rt.proxies[shard].ServeHTTP(w, r)
+}
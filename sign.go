@@ -0,0 +1,139 @@
+// Copyright (c) 2014-2015, Daniel Martí <mvdan@mvdan.cc>
+// See LICENSE for licensing information
+
+package main
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/mvdan/pastecat/storage"
+)
+
+const (
+	// Name of the action after a paste's id to get its signature
+	signAction = "sig"
+	// Path the public key verifying signatures is served at
+	publicKeyPath = "/.well-known/minisign.pub"
+
+	// Signature algorithm of minisign signing the content itself, rather
+	// than its BLAKE2b hash
+	minisignAlg = "Ed"
+	// Comment heading the secret key files written by pastecat
+	secretKeyComment = "untrusted comment: pastecat secret key"
+)
+
+// pasteSigner signs the content of pastes with an Ed25519 key, producing
+// signatures that minisign can verify.
+type pasteSigner struct {
+	keyID [8]byte
+	key   ed25519.PrivateKey
+}
+
+// loadSigner reads the signing key from keyPath if it exists, and writes a
+// new one to it otherwise, so that signatures stay verifiable.
+func loadSigner(keyPath string) (*pasteSigner, error) {
+	s := &pasteSigner{}
+	data, err := ioutil.ReadFile(keyPath)
+	if err == nil {
+		return s, s.parse(data)
+	}
+	if !os.IsNotExist(err) {
+		return nil, err
+	}
+	if _, err := rand.Read(s.keyID[:]); err != nil {
+		return nil, err
+	}
+	if _, s.key, err = ed25519.GenerateKey(rand.Reader); err != nil {
+		return nil, err
+	}
+	raw := append(s.keyID[:], s.key.Seed()...)
+	data = []byte(secretKeyComment + "\n" + base64.StdEncoding.EncodeToString(raw) + "\n")
+	if err := ioutil.WriteFile(keyPath, data, 0600); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *pasteSigner) parse(data []byte) error {
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	if len(lines) != 2 || lines[0] != secretKeyComment {
+		return fmt.Errorf("not a pastecat secret key")
+	}
+	raw, err := base64.StdEncoding.DecodeString(lines[1])
+	if err != nil || len(raw) != len(s.keyID)+ed25519.SeedSize {
+		return fmt.Errorf("invalid secret key")
+	}
+	copy(s.keyID[:], raw)
+	s.key = ed25519.NewKeyFromSeed(raw[len(s.keyID):])
+	return nil
+}
+
+// KeyID returns the id of the key as minisign shows it, which is its
+// little-endian number in hexadecimal.
+func (s *pasteSigner) KeyID() string {
+	var id [8]byte
+	for i, b := range s.keyID {
+		id[len(id)-1-i] = b
+	}
+	return strings.ToUpper(hex.EncodeToString(id[:]))
+}
+
+// PublicKey returns the public key in the format of minisign's key files
+func (s *pasteSigner) PublicKey() string {
+	raw := append([]byte(minisignAlg), s.keyID[:]...)
+	raw = append(raw, s.key.Public().(ed25519.PublicKey)...)
+	return fmt.Sprintf("untrusted comment: minisign public key %s\n%s\n",
+		s.KeyID(), base64.StdEncoding.EncodeToString(raw))
+}
+
+// Sign returns a detached signature of content in the format of minisign,
+// whose trusted comment names the paste and the time of its content.
+func (s *pasteSigner) Sign(id storage.ID, paste storage.Paste, content []byte) string {
+	signature := ed25519.Sign(s.key, content)
+	sig := append([]byte(minisignAlg), s.keyID[:]...)
+	sig = append(sig, signature...)
+	trusted := fmt.Sprintf("timestamp:%d\tfile:%s", paste.ModTime().Unix(), id)
+	// The trusted comment is signed along with the signature
+	global := ed25519.Sign(s.key, append(signature, trusted...))
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "untrusted comment: signature from pastecat key %s\n", s.KeyID())
+	fmt.Fprintf(&buf, "%s\n", base64.StdEncoding.EncodeToString(sig))
+	fmt.Fprintf(&buf, "trusted comment: %s\n", trusted)
+	fmt.Fprintf(&buf, "%s\n", base64.StdEncoding.EncodeToString(global))
+	return buf.String()
+}
+
+// serveSignature serves the detached signature of the paste's content.
+func (s *pasteSigner) serveSignature(w http.ResponseWriter, r *http.Request, id storage.ID, paste storage.Paste) {
+	done := timePhase(r, "read paste")
+	content, err := ioutil.ReadAll(io.NewSectionReader(paste, 0, paste.Size()))
+	done()
+	if err != nil {
+		replyStoreError(w, r, err)
+		return
+	}
+	setHeaders(w.Header(), id, paste)
+	// The signature is not a representation of the paste
+	w.Header().Del("Etag")
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	io.WriteString(w, s.Sign(id, paste, content))
+}
+
+func (s *pasteSigner) servePublicKey(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, unknownAction, http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	io.WriteString(w, s.PublicKey())
+}
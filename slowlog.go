@@ -0,0 +1,98 @@
+// Copyright (c) 2014-2015, Daniel Martí <mvdan@mvdan.cc>
+// See LICENSE for licensing information
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+type timingsKey struct{}
+
+// requestTimings holds how long each phase of a request took.
+type requestTimings struct {
+	sync.Mutex
+	names []string
+	took  map[string]time.Duration
+}
+
+func (t *requestTimings) add(name string, d time.Duration) {
+	t.Lock()
+	defer t.Unlock()
+	if _, e := t.took[name]; !e {
+		t.names = append(t.names, name)
+	}
+	t.took[name] += d
+}
+
+func (t *requestTimings) String() string {
+	t.Lock()
+	defer t.Unlock()
+	var buf bytes.Buffer
+	for i, name := range t.names {
+		if i > 0 {
+			buf.WriteString(", ")
+		}
+		fmt.Fprintf(&buf, "%s %s", name, t.took[name])
+	}
+	return buf.String()
+}
+
+// timePhase starts timing a phase of a request, returning the function
+// that stops it. Does nothing unless slow requests are being logged.
+func timePhase(r *http.Request, name string) func() {
+	t, _ := r.Context().Value(timingsKey{}).(*requestTimings)
+	if t == nil {
+		return func() {}
+	}
+	start := time.Now()
+	return func() { t.add(name, time.Since(start)) }
+}
+
+type timedWriter struct {
+	http.ResponseWriter
+	timings *requestTimings
+}
+
+func (w timedWriter) Write(p []byte) (int, error) {
+	start := time.Now()
+	n, err := w.ResponseWriter.Write(p)
+	w.timings.add("write response", time.Since(start))
+	return n, err
+}
+
+// ReadFrom times the whole copy of a paste as writing the response.
+func (w timedWriter) ReadFrom(r io.Reader) (int64, error) {
+	start := time.Now()
+	n, err := io.Copy(w.ResponseWriter, r)
+	w.timings.add("write response", time.Since(start))
+	return n, err
+}
+
+func (w timedWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// logSlow wraps a handler so that requests taking longer than threshold
+// are logged along with how long each of their phases took.
+func logSlow(h http.Handler, threshold time.Duration) http.Handler {
+	if threshold <= 0 {
+		return h
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t := &requestTimings{took: make(map[string]time.Duration)}
+		start := time.Now()
+		r = r.WithContext(context.WithValue(r.Context(), timingsKey{}, t))
+		h.ServeHTTP(timedWriter{ResponseWriter: w, timings: t}, r)
+		if took := time.Since(start); took > threshold {
+			log.Printf("Slow request: %s %s took %s (%s)", r.Method, r.URL.Path, took, t)
+		}
+	})
+}
@@ -0,0 +1,262 @@
+// Copyright (c) 2014-2015, Daniel Martí <mvdan@mvdan.cc>
+// See LICENSE for licensing information
+
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mvdan/pastecat/storage"
+)
+
+var startTime = time.Now()
+
+// Number of hours of activity shown on the stats page
+const activityHours = 24
+
+// instanceStats is the health report served at /stats. Zero limits mean
+// that there is no limit.
+type instanceStats struct {
+	Pastes     int              `json:"pastes"`
+	MaxPastes  int              `json:"max_pastes"`
+	Storage    storage.ByteSize `json:"storage"`
+	MaxStorage storage.ByteSize `json:"max_storage"`
+	MaxSize    storage.ByteSize `json:"max_size"`
+	// Durations, in seconds
+	LifeTime float64 `json:"lifetime"`
+	Uptime   float64 `json:"uptime"`
+	// Total uploads and downloads, kept across restarts with -stats-file
+	Uploads   int64 `json:"uploads"`
+	Downloads int64 `json:"downloads"`
+}
+
+func (h *httpHandler) instanceStats() instanceStats {
+	num, stg := h.stats.Report()
+	activity := h.activity.sample()
+	return instanceStats{
+		Pastes:     num,
+		MaxPastes:  h.stats.MaxNumber,
+		Storage:    storage.ByteSize(stg),
+		MaxStorage: storage.ByteSize(h.stats.MaxStorage),
+		MaxSize:    routeMaxSize(apiMaxSize),
+		LifeTime:   lifeTime.Seconds(),
+		Uptime:     time.Since(startTime).Seconds(),
+		Uploads:    activity.Uploads,
+		Downloads:  activity.Downloads,
+	}
+}
+
+func (h *httpHandler) handleStats(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, unknownAction, http.StatusBadRequest)
+		return
+	}
+	stats := h.instanceStats()
+	if negotiate(r, "application/json", "text/html") == "application/json" {
+		writeJSON(w, stats)
+		return
+	}
+	activity := h.activity.sample()
+	page := statsPage{
+		instanceStats: stats,
+		UptimeText:    time.Since(startTime).Round(time.Second),
+		LifeTimeText:  *lifeTime,
+		Hours:         activityHours,
+	}
+	var uploads, downloads []int64
+	for _, c := range activity.Hourly {
+		uploads = append(uploads, c.Uploads)
+		downloads = append(downloads, c.Downloads)
+	}
+	page.UploadsLine = sparkline(uploads)
+	page.DownloadsLine = sparkline(downloads)
+	if stats.MaxPastes > 0 {
+		page.PastesUsed = float64(stats.Pastes*100) / float64(stats.MaxPastes)
+	}
+	if stats.MaxStorage > 0 {
+		page.StorageUsed = float64(stats.Storage*100) / float64(stats.MaxStorage)
+	}
+	if err := tmpl.ExecuteTemplate(w, "stats", page); err != nil {
+		log.Printf("Error executing template for %s: %v", r.URL.Path, err)
+	}
+}
+
+// statsPage is what the stats page shows, for browsers
+type statsPage struct {
+	instanceStats
+	UptimeText   time.Duration
+	LifeTimeText time.Duration
+	// Percentage of the limits in use, if any
+	PastesUsed, StorageUsed float64
+	// Uploads and downloads per hour, oldest first
+	Hours                      int
+	UploadsLine, DownloadsLine string
+}
+
+// Characters drawing a sparkline, from lowest to highest
+var sparkBlocks = []rune("▁▂▃▄▅▆▇█")
+
+// sparkline draws values as a line of block characters, scaled to the
+// largest value.
+func sparkline(values []int64) string {
+	var max int64
+	for _, v := range values {
+		if v > max {
+			max = v
+		}
+	}
+	var sb strings.Builder
+	for _, v := range values {
+		i := 0
+		if max > 0 {
+			i = int(v * int64(len(sparkBlocks)-1) / max)
+		}
+		sb.WriteRune(sparkBlocks[i])
+	}
+	return sb.String()
+}
+
+// activityCount is a number of uploads and downloads
+type activityCount struct {
+	Uploads   int64 `json:"uploads"`
+	Downloads int64 `json:"downloads"`
+}
+
+// activityRecord holds the total uploads and downloads, and those of each
+// of the last hours.
+type activityRecord struct {
+	activityCount
+	// Hour of the last entry of Hourly, in hours since the Unix epoch
+	Hour int64 `json:"hour"`
+	// Counts of the last activityHours hours, oldest first
+	Hourly []activityCount `json:"hourly"`
+}
+
+// activityLog records the uploads and downloads of the instance, persisting
+// them to a file if it has one.
+type activityLog struct {
+	path string
+
+	mu     sync.Mutex
+	record activityRecord
+	// Counter values as of the last sample
+	last activityCount
+}
+
+// loadActivity starts an activity log, continuing the one in path if it
+// exists. An empty path keeps it in memory only.
+func loadActivity(path string) (*activityLog, error) {
+	a := &activityLog{path: path}
+	if path != "" {
+		data, err := ioutil.ReadFile(path)
+		if err == nil {
+			err = json.Unmarshal(data, &a.record)
+		} else if os.IsNotExist(err) {
+			err = nil
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	a.sample()
+	return a, nil
+}
+
+// sample adds the uploads and downloads since the last sample, and returns
+// a copy of the record.
+func (a *activityLog) sample() activityRecord {
+	if a == nil {
+		return activityRecord{}
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	rec := &a.record
+	hour := time.Now().Unix() / 3600
+	if len(rec.Hourly) != activityHours {
+		rec.Hourly = make([]activityCount, activityHours)
+	}
+	if shift := hour - rec.Hour; shift >= activityHours || shift < 0 {
+		rec.Hourly = make([]activityCount, activityHours)
+	} else if shift > 0 {
+		rec.Hourly = append(rec.Hourly[shift:], make([]activityCount, shift)...)
+	}
+	rec.Hour = hour
+	now := activityCount{Uploads: uploadCount.Value(), Downloads: downloadCount.Value()}
+	cur := &rec.Hourly[activityHours-1]
+	cur.Uploads += now.Uploads - a.last.Uploads
+	cur.Downloads += now.Downloads - a.last.Downloads
+	rec.Uploads += now.Uploads - a.last.Uploads
+	rec.Downloads += now.Downloads - a.last.Downloads
+	a.last = now
+	copied := *rec
+	copied.Hourly = append([]activityCount(nil), rec.Hourly...)
+	return copied
+}
+
+// save writes the record to the file, if any, replacing it at once.
+func (a *activityLog) save() error {
+	if a.path == "" {
+		return nil
+	}
+	data, err := json.Marshal(a.sample())
+	if err != nil {
+		return err
+	}
+	tmp := a.path + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, a.path)
+}
+
+// usageReport is a periodic report of the usage stats in JSON
+type usageReport struct {
+	Time time.Time `json:"time"`
+	instanceStats
+}
+
+// statsReporter returns a func reporting the usage stats to a target: the
+// log as a line of text with "log", the log as JSON with "json", or a file
+// to append JSON lines to otherwise.
+func (h *httpHandler) statsReporter(target string) (func(), error) {
+	switch target {
+	case "log":
+		return func() { logStats(h.stats) }, nil
+	case "json":
+		return func() {
+			data, err := json.Marshal(usageReport{time.Now(), h.instanceStats()})
+			if err != nil {
+				log.Printf("Could not encode the stats report: %v", err)
+				return
+			}
+			log.Printf("%s", data)
+		}, nil
+	}
+	// Opened before the store changes directories
+	f, err := os.OpenFile(target, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	enc := json.NewEncoder(f)
+	return func() {
+		if err := enc.Encode(usageReport{time.Now(), h.instanceStats()}); err != nil {
+			log.Printf("Could not write the stats report: %v", err)
+		}
+	}, nil
+}
+
+// run saves the record every interval.
+func (a *activityLog) run(interval time.Duration) {
+	for range time.Tick(interval) {
+		if err := a.save(); err != nil {
+			log.Printf("Could not save the activity counters: %v", err)
+		}
+	}
+}
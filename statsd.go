@@ -0,0 +1,70 @@
+// Copyright (c) 2014-2015, Daniel Martí <mvdan@mvdan.cc>
+// See LICENSE for licensing information
+
+package main
+
+import (
+	"bytes"
+	"expvar"
+	"fmt"
+	"log"
+	"net"
+	"time"
+
+	"github.com/mvdan/pastecat/storage"
+)
+
+// statsdEmitter periodically sends the same metrics published via expvar
+// to a StatsD server over UDP.
+type statsdEmitter struct {
+	conn   net.Conn
+	prefix string
+	stats  *storage.Stats
+	// Counter values as of the last emission
+	last map[string]int64
+}
+
+func newStatsdEmitter(addr, prefix string, stats *storage.Stats) (*statsdEmitter, error) {
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return &statsdEmitter{
+		conn:   conn,
+		prefix: prefix,
+		stats:  stats,
+		last:   make(map[string]int64),
+	}, nil
+}
+
+func (e *statsdEmitter) counter(buf *bytes.Buffer, name string, value int64) {
+	fmt.Fprintf(buf, "%s%s:%d|c\n", e.prefix, name, value-e.last[name])
+	e.last[name] = value
+}
+
+func (e *statsdEmitter) emit() error {
+	var buf bytes.Buffer
+	e.counter(&buf, "uploads", uploadCount.Value())
+	e.counter(&buf, "downloads", downloadCount.Value())
+	e.counter(&buf, "errors", errorCount.Value())
+	e.counter(&buf, "disk_full", diskFullCount.Value())
+	storeVars.Do(func(backend expvar.KeyValue) {
+		backend.Value.(*expvar.Map).Do(func(kv expvar.KeyValue) {
+			name := "store." + backend.Key + "." + kv.Key
+			e.counter(&buf, name, kv.Value.(*expvar.Int).Value())
+		})
+	})
+	num, stg := e.stats.Report()
+	fmt.Fprintf(&buf, "%spastes:%d|g\n", e.prefix, num)
+	fmt.Fprintf(&buf, "%sstorage:%d|g\n", e.prefix, stg)
+	_, err := e.conn.Write(buf.Bytes())
+	return err
+}
+
+func (e *statsdEmitter) run(interval time.Duration) {
+	for range time.Tick(interval) {
+		if err := e.emit(); err != nil {
+			log.Printf("Could not send metrics to StatsD: %v", err)
+		}
+	}
+}
@@ -0,0 +1,106 @@
+// Copyright (c) 2014-2015, Daniel Martí <mvdan@mvdan.cc>
+// See LICENSE for licensing information
+
+package storage
+
+import (
+	"bufio"
+	"errors"
+	"net"
+	"sync"
+	"time"
+)
+
+// How long to wait for a cache server to answer each command
+const cacheTimeout = 5 * time.Second
+
+// How many idle connections to a cache server to keep
+const cacheMaxIdle = 8
+
+// errCacheExists means that a key was not added as it is already set
+var errCacheExists = errors.New("key already exists in the cache")
+
+// cacheReplyError is an error replied by a cache server, after which the
+// connection can still be used
+type cacheReplyError string
+
+func (e cacheReplyError) Error() string { return "cache server: " + string(e) }
+
+// replied reports whether an error was a full reply from the server, rather
+// than a failure to send a command or to read its reply.
+func replied(err error) bool {
+	switch err.(type) {
+	case cacheReplyError:
+		return true
+	}
+	return err == ErrPasteNotFound || err == errCacheExists || err == ErrDiskFull
+}
+
+// cacheConn is a connection to a cache server
+type cacheConn struct {
+	net.Conn
+	r *bufio.Reader
+	w *bufio.Writer
+}
+
+// cachePool keeps idle connections to a cache server, so that each command
+// doesn't need a new one.
+type cachePool struct {
+	addr string
+	// setup, if set, is run on each new connection, like to log in
+	setup func(c *cacheConn) error
+
+	mu   sync.Mutex
+	idle []*cacheConn
+}
+
+// do runs fn on a connection, which is kept for later unless fn fails
+// without a full reply, since that may leave it halfway through one.
+func (p *cachePool) do(fn func(c *cacheConn) error) error {
+	c, err := p.get()
+	if err != nil {
+		return err
+	}
+	c.SetDeadline(time.Now().Add(cacheTimeout))
+	err = fn(c)
+	if err != nil && !replied(err) {
+		c.Close()
+		return err
+	}
+	p.put(c)
+	return err
+}
+
+func (p *cachePool) get() (*cacheConn, error) {
+	p.mu.Lock()
+	if n := len(p.idle); n > 0 {
+		c := p.idle[n-1]
+		p.idle = p.idle[:n-1]
+		p.mu.Unlock()
+		return c, nil
+	}
+	p.mu.Unlock()
+	conn, err := net.DialTimeout("tcp", p.addr, cacheTimeout)
+	if err != nil {
+		return nil, err
+	}
+	c := &cacheConn{Conn: conn, r: bufio.NewReader(conn), w: bufio.NewWriter(conn)}
+	if p.setup != nil {
+		c.SetDeadline(time.Now().Add(cacheTimeout))
+		if err := p.setup(c); err != nil {
+			c.Close()
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+func (p *cachePool) put(c *cacheConn) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if len(p.idle) >= cacheMaxIdle {
+		c.Close()
+		return
+	}
+	p.idle = append(p.idle, c)
+}
@@ -0,0 +1,141 @@
+// Copyright (c) 2014-2015, Daniel Martí <mvdan@mvdan.cc>
+// See LICENSE for licensing information
+
+package storage
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Expiry times longer than this are taken by memcached as unix times
+const memcachedMaxRelative = 30 * 24 * time.Hour
+
+// memcachedClient talks to a memcached server with its text protocol
+type memcachedClient struct {
+	pool *cachePool
+}
+
+func newMemcachedClient(addr string) *memcachedClient {
+	return &memcachedClient{pool: &cachePool{addr: addr}}
+}
+
+// memcachedExpiry returns how a ttl is sent to memcached, rounded up to
+// whole seconds.
+func memcachedExpiry(ttl time.Duration) int64 {
+	if ttl > memcachedMaxRelative {
+		return time.Now().Add(ttl).Unix() + 1
+	}
+	return int64((ttl + time.Second - 1) / time.Second)
+}
+
+// memcachedLine reads a reply line without its trailing CRLF, turning the
+// error replies into errors.
+func memcachedLine(c *cacheConn) (string, error) {
+	line, err := c.r.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	line = strings.TrimSuffix(line, "\r\n")
+	switch {
+	case line == "ERROR":
+		return "", cacheReplyError("unknown command")
+	case strings.HasPrefix(line, "SERVER_ERROR out of memory"):
+		return "", ErrDiskFull
+	case strings.HasPrefix(line, "CLIENT_ERROR "), strings.HasPrefix(line, "SERVER_ERROR "):
+		return "", cacheReplyError(line)
+	}
+	return line, nil
+}
+
+func (m *memcachedClient) get(key string) ([]byte, error) {
+	var value []byte
+	err := m.pool.do(func(c *cacheConn) error {
+		fmt.Fprintf(c.w, "get %s\r\n", key)
+		if err := c.w.Flush(); err != nil {
+			return err
+		}
+		line, err := memcachedLine(c)
+		if err != nil {
+			return err
+		}
+		if line == "END" {
+			return ErrPasteNotFound
+		}
+		// VALUE <key> <flags> <bytes>
+		fields := strings.Fields(line)
+		if len(fields) != 4 || fields[0] != "VALUE" {
+			return fmt.Errorf("unexpected memcached reply %q", line)
+		}
+		size, err := strconv.Atoi(fields[3])
+		if err != nil {
+			return fmt.Errorf("unexpected memcached reply %q", line)
+		}
+		value = make([]byte, size+2)
+		if _, err := io.ReadFull(c.r, value); err != nil {
+			return err
+		}
+		value = value[:size]
+		if line, err = memcachedLine(c); err != nil {
+			return err
+		}
+		if line != "END" {
+			return fmt.Errorf("unexpected memcached reply %q", line)
+		}
+		return nil
+	})
+	return value, err
+}
+
+func (m *memcachedClient) store(cmd, key string, value []byte, ttl time.Duration) error {
+	return m.pool.do(func(c *cacheConn) error {
+		fmt.Fprintf(c.w, "%s %s 0 %d %d\r\n", cmd, key, memcachedExpiry(ttl), len(value))
+		c.w.Write(value)
+		c.w.WriteString("\r\n")
+		if err := c.w.Flush(); err != nil {
+			return err
+		}
+		line, err := memcachedLine(c)
+		if err != nil {
+			return err
+		}
+		switch line {
+		case "STORED":
+			return nil
+		case "NOT_STORED":
+			return errCacheExists
+		}
+		return fmt.Errorf("unexpected memcached reply %q", line)
+	})
+}
+
+func (m *memcachedClient) set(key string, value []byte, ttl time.Duration) error {
+	return m.store("set", key, value, ttl)
+}
+
+func (m *memcachedClient) add(key string, value []byte, ttl time.Duration) error {
+	return m.store("add", key, value, ttl)
+}
+
+func (m *memcachedClient) delete(key string) error {
+	return m.pool.do(func(c *cacheConn) error {
+		fmt.Fprintf(c.w, "delete %s\r\n", key)
+		if err := c.w.Flush(); err != nil {
+			return err
+		}
+		line, err := memcachedLine(c)
+		if err != nil {
+			return err
+		}
+		switch line {
+		case "DELETED":
+			return nil
+		case "NOT_FOUND":
+			return ErrPasteNotFound
+		}
+		return fmt.Errorf("unexpected memcached reply %q", line)
+	})
+}
@@ -0,0 +1,136 @@
+// Copyright (c) 2014-2015, Daniel Martí <mvdan@mvdan.cc>
+// See LICENSE for licensing information
+
+package storage
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// respClient talks to a Valkey or Redis server with the RESP protocol
+type respClient struct {
+	pool *cachePool
+}
+
+// newRESPClient logs in with password, if any, and selects the database
+// numbered db on each connection.
+func newRESPClient(addr, password string, db int) *respClient {
+	r := &respClient{pool: &cachePool{addr: addr}}
+	r.pool.setup = func(c *cacheConn) error {
+		if password != "" {
+			if _, err := respCommand(c, "AUTH", []byte(password)); err != nil {
+				return err
+			}
+		}
+		if db != 0 {
+			if _, err := respCommand(c, "SELECT", []byte(strconv.Itoa(db))); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	return r
+}
+
+// respCommand sends a command and reads its reply, which is nil for a null
+// bulk string.
+func respCommand(c *cacheConn, name string, args ...[]byte) ([]byte, error) {
+	fmt.Fprintf(c.w, "*%d\r\n$%d\r\n%s\r\n", len(args)+1, len(name), name)
+	for _, arg := range args {
+		fmt.Fprintf(c.w, "$%d\r\n", len(arg))
+		c.w.Write(arg)
+		c.w.WriteString("\r\n")
+	}
+	if err := c.w.Flush(); err != nil {
+		return nil, err
+	}
+	line, err := c.r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	line = strings.TrimSuffix(line, "\r\n")
+	if line == "" {
+		return nil, fmt.Errorf("empty reply to %s", name)
+	}
+	switch line[0] {
+	case '+', ':':
+		return []byte(line[1:]), nil
+	case '-':
+		if strings.HasPrefix(line, "-OOM ") {
+			return nil, ErrDiskFull
+		}
+		return nil, cacheReplyError(line[1:])
+	case '$':
+		size, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, fmt.Errorf("invalid reply to %s: %q", name, line)
+		}
+		if size < 0 {
+			return nil, nil
+		}
+		value := make([]byte, size+2)
+		if _, err := io.ReadFull(c.r, value); err != nil {
+			return nil, err
+		}
+		return value[:size], nil
+	}
+	return nil, fmt.Errorf("unexpected reply to %s: %q", name, line)
+}
+
+func (r *respClient) get(key string) ([]byte, error) {
+	var value []byte
+	err := r.pool.do(func(c *cacheConn) error {
+		var err error
+		if value, err = respCommand(c, "GET", []byte(key)); err != nil {
+			return err
+		}
+		if value == nil {
+			return ErrPasteNotFound
+		}
+		return nil
+	})
+	return value, err
+}
+
+// respMillis returns a ttl in milliseconds, rounded up.
+func respMillis(ttl time.Duration) []byte {
+	ms := (ttl + time.Millisecond - 1) / time.Millisecond
+	return []byte(strconv.FormatInt(int64(ms), 10))
+}
+
+func (r *respClient) set(key string, value []byte, ttl time.Duration) error {
+	return r.pool.do(func(c *cacheConn) error {
+		_, err := respCommand(c, "SET", []byte(key), value, []byte("PX"), respMillis(ttl))
+		return err
+	})
+}
+
+func (r *respClient) add(key string, value []byte, ttl time.Duration) error {
+	return r.pool.do(func(c *cacheConn) error {
+		reply, err := respCommand(c, "SET", []byte(key), value, []byte("PX"), respMillis(ttl), []byte("NX"))
+		if err != nil {
+			return err
+		}
+		if reply == nil {
+			return errCacheExists
+		}
+		return nil
+	})
+}
+
+func (r *respClient) delete(key string) error {
+	return r.pool.do(func(c *cacheConn) error {
+		reply, err := respCommand(c, "DEL", []byte(key))
+		if err != nil {
+			return err
+		}
+		if string(reply) == "0" {
+			return ErrPasteNotFound
+		}
+		return nil
+	})
+}
@@ -0,0 +1,49 @@
+// Copyright (c) 2014-2015, Daniel Martí <mvdan@mvdan.cc>
+// See LICENSE for licensing information
+
+package storage
+
+import "time"
+
+// Clock tells the time and sets timers for the stores and the deletion of
+// expired pastes, so that they can run on a time other than the system's,
+// like in tests or when replaying what a store would do at some point.
+type Clock interface {
+	Now() time.Time
+	NewTimer(d time.Duration) Timer
+}
+
+// Timer is a timer set by a Clock, like a time.Timer.
+type Timer interface {
+	// C returns the channel the time is sent on when the timer fires.
+	C() <-chan time.Time
+	Reset(d time.Duration) bool
+	Stop() bool
+}
+
+// SystemClock is the Clock of the system, which stores run on by default.
+type SystemClock struct{}
+
+func (SystemClock) Now() time.Time { return time.Now() }
+
+func (SystemClock) NewTimer(d time.Duration) Timer {
+	return systemTimer{time.NewTimer(d)}
+}
+
+type systemTimer struct {
+	*time.Timer
+}
+
+func (t systemTimer) C() <-chan time.Time { return t.Timer.C }
+
+// clock is the Clock the stores run on
+var clock Clock = SystemClock{}
+
+// SetClock sets the Clock the stores and the deletion of expired pastes run
+// on. It must be called before any store is created.
+func SetClock(c Clock) {
+	clock = c
+	deletions.mu.Lock()
+	deletions.clock = c
+	deletions.mu.Unlock()
+}
@@ -0,0 +1,330 @@
+// Copyright (c) 2014-2015, Daniel Martí <mvdan@mvdan.cc>
+// See LICENSE for licensing information
+
+package storage
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"log"
+	"sync"
+	"time"
+)
+
+const (
+	// The one compression used by a CompressStore
+	compressionGzip = "gzip"
+	// Smaller pastes are not worth compressing
+	minCompressSize = 1 << 10
+)
+
+// CompressStore is a Store that compresses the pastes in another store once
+// they have not been read for a while, so that more pastes fit in the same
+// storage. Compressed pastes are decompressed in memory when read, and look
+// as if they never were to the users of the CompressStore. Only the current
+// content of a paste is compressed, not its previous versions.
+//
+// Compressing a paste frees the space it saved from the stats, and deleting
+// it takes that space back, as whoever frees its space when deleting it
+// only knows of its size before being compressed.
+type CompressStore struct {
+	Store
+	stats    *Stats
+	after    time.Duration
+	lifeTime time.Duration
+
+	// mu is held while changing pastes, so that a paste being compressed
+	// is not changed before the compressed one replaces it
+	mu sync.Mutex
+
+	readMu sync.Mutex
+	// lastRead is when each paste was last read since the store started
+	lastRead map[ID]time.Time
+}
+
+// NewCompressStore sets up a CompressStore, compressing the pastes in s not
+// read for the given duration. lifeTime is the lifetime of all pastes, if
+// any, as pastes about to expire are left alone.
+func NewCompressStore(s Store, stats *Stats, after, lifeTime time.Duration) *CompressStore {
+	cs := &CompressStore{
+		Store:    s,
+		stats:    stats,
+		after:    after,
+		lifeTime: lifeTime,
+		lastRead: make(map[ID]time.Time),
+	}
+	go func() {
+		for range time.Tick(after / 4) {
+			if err := cs.compressCold(clock.Now().Add(-after)); err != nil {
+				log.Printf("Could not compress cold pastes: %v", err)
+			}
+		}
+	}()
+	return cs
+}
+
+// rawInfo returns the attributes of a paste as they were before it was
+// compressed.
+func rawInfo(info Info) Info {
+	if info.Compression != "" {
+		info.Size = info.RawSize
+		info.Compression, info.RawSize = "", 0
+	}
+	return info
+}
+
+// compressedPaste is a compressed paste read into memory
+type compressedPaste struct {
+	*bytes.Reader
+	info Info
+}
+
+func (p compressedPaste) Close() error       { return nil }
+func (p compressedPaste) ModTime() time.Time { return p.info.ModTime }
+func (p compressedPaste) Size() int64        { return p.info.Size }
+func (p compressedPaste) Meta() Meta         { return p.info.Meta }
+func (p compressedPaste) Views() int64       { return p.info.Views }
+
+func (s *CompressStore) Get(id ID) (Paste, error) {
+	paste, err := s.Store.Get(id)
+	if err != nil {
+		return nil, err
+	}
+	s.readMu.Lock()
+	s.lastRead[id] = clock.Now()
+	s.readMu.Unlock()
+	meta := paste.Meta()
+	if meta.Compression == "" {
+		return paste, nil
+	}
+	defer paste.Close()
+	content, err := decompress(paste)
+	if err != nil {
+		return nil, err
+	}
+	return compressedPaste{
+		Reader: bytes.NewReader(content),
+		info: rawInfo(Info{
+			Meta:    meta,
+			ModTime: paste.ModTime(),
+			Size:    paste.Size(),
+			Views:   paste.Views(),
+		}),
+	}, nil
+}
+
+func decompress(r io.Reader) ([]byte, error) {
+	zr, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, corrupted(err)
+	}
+	content, err := ioutil.ReadAll(zr)
+	if err != nil {
+		return nil, corrupted(err)
+	}
+	return content, nil
+}
+
+func (s *CompressStore) Stat(id ID) (Info, error) {
+	info, err := Stat(s.Store, id)
+	return rawInfo(info), err
+}
+
+func (s *CompressStore) Iterate(fn func(id ID, info Info) bool) error {
+	return s.Store.Iterate(func(id ID, info Info) bool {
+		return fn(id, rawInfo(info))
+	})
+}
+
+// saved returns the space that compressing a paste saved, if it was.
+func (s *CompressStore) saved(id ID) int64 {
+	info, err := Stat(s.Store, id)
+	if err != nil || info.Compression == "" {
+		return 0
+	}
+	return info.RawSize - info.Size
+}
+
+func (s *CompressStore) Delete(id ID) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	saved := s.saved(id)
+	if err := s.Store.Delete(id); err != nil {
+		return err
+	}
+	s.stats.Shrink(-saved)
+	s.readMu.Lock()
+	delete(s.lastRead, id)
+	s.readMu.Unlock()
+	return nil
+}
+
+func (s *CompressStore) DeleteBatch(ids []ID) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var saved int64
+	for _, id := range ids {
+		saved += s.saved(id)
+	}
+	if err := DeleteBatch(s.Store, ids); err != nil {
+		return err
+	}
+	s.stats.Shrink(-saved)
+	s.readMu.Lock()
+	for _, id := range ids {
+		delete(s.lastRead, id)
+	}
+	s.readMu.Unlock()
+	return nil
+}
+
+// Update decompresses the paste first, so that its previous content is
+// kept as a version as it was.
+func (s *CompressStore) Update(id ID, content []byte, meta Meta) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.decompressPaste(id); err != nil {
+		return err
+	}
+	return s.Store.Update(id, content, meta)
+}
+
+func (s *CompressStore) Copy(id ID, content []byte, meta Meta, modTime time.Time, versions [][]byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	saved := s.saved(id)
+	if err := s.Store.Copy(id, content, meta, modTime, versions); err != nil {
+		return err
+	}
+	s.stats.Shrink(-saved)
+	return nil
+}
+
+// versions reads the content of all previous versions of a paste.
+func (s *CompressStore) versions(id ID, meta Meta) ([][]byte, error) {
+	versions := make([][]byte, len(meta.Versions))
+	for i := range versions {
+		p, err := s.Store.GetVersion(id, i+1)
+		if err != nil {
+			return nil, err
+		}
+		versions[i], err = ioutil.ReadAll(p)
+		p.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+	return versions, nil
+}
+
+// readPaste reads the current content of a paste along with its attributes,
+// closing it before the paste is replaced as some stores wait for pastes
+// being read to be closed.
+func (s *CompressStore) readPaste(id ID) ([]byte, Info, error) {
+	paste, err := s.Store.Get(id)
+	if err != nil {
+		return nil, Info{}, err
+	}
+	defer paste.Close()
+	info := Info{Meta: paste.Meta(), ModTime: paste.ModTime(), Size: paste.Size()}
+	content, err := ioutil.ReadAll(paste)
+	return content, info, err
+}
+
+// replace puts a paste back with new content, keeping its versions. s.mu
+// must be held.
+func (s *CompressStore) replace(id ID, info Info, content []byte) error {
+	versions, err := s.versions(id, info.Meta)
+	if err != nil {
+		return err
+	}
+	return s.Store.Copy(id, content, info.Meta, info.ModTime, versions)
+}
+
+// decompressPaste puts a paste back as it was before being compressed, if
+// it was. s.mu must be held.
+func (s *CompressStore) decompressPaste(id ID) error {
+	compressed, info, err := s.readPaste(id)
+	if err != nil || info.Compression == "" {
+		return err
+	}
+	content, err := decompress(bytes.NewReader(compressed))
+	if err != nil {
+		return err
+	}
+	saved := info.RawSize - info.Size
+	info.Compression, info.RawSize = "", 0
+	if err := s.replace(id, info, content); err != nil {
+		return err
+	}
+	s.stats.Shrink(-saved)
+	return nil
+}
+
+// compressPaste compresses a paste if that makes it smaller. s.mu must be
+// held.
+func (s *CompressStore) compressPaste(id ID) error {
+	content, info, err := s.readPaste(id)
+	if err != nil || info.Compression != "" {
+		return err
+	}
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	if _, err := zw.Write(content); err != nil {
+		return err
+	}
+	if err := zw.Close(); err != nil {
+		return err
+	}
+	saved := int64(len(content) - buf.Len())
+	// Not worth the cost of decompressing it
+	if saved < int64(len(content))/10 {
+		return nil
+	}
+	info.Compression, info.RawSize = compressionGzip, int64(len(content))
+	if err := s.replace(id, info, buf.Bytes()); err != nil {
+		return err
+	}
+	s.stats.Shrink(saved)
+	return nil
+}
+
+// compressCold compresses the pastes not read since a time. Pastes that
+// may expire before the next run are left alone, so that they are not put
+// back after being deleted from underneath the CompressStore. So are those
+// limited to a number of reads, as reading them here would count.
+func (s *CompressStore) compressCold(since time.Time) error {
+	var cold []ID
+	expiring := clock.Now().Add(s.after / 2)
+	s.readMu.Lock()
+	err := s.Store.Iterate(func(id ID, info Info) bool {
+		lastRead, e := s.lastRead[id]
+		if !e {
+			lastRead = info.ModTime
+		}
+		if info.Compression != "" || info.Encrypted || info.MaxReads > 0 ||
+			info.Size < minCompressSize || lastRead.After(since) {
+			return true
+		}
+		if lt := info.EffectiveLifeTime(s.lifeTime); lt > 0 && info.Created(info.ModTime).Add(lt).Before(expiring) {
+			return true
+		}
+		cold = append(cold, id)
+		return true
+	})
+	s.readMu.Unlock()
+	if err != nil {
+		return err
+	}
+	for _, id := range cold {
+		s.mu.Lock()
+		err := s.compressPaste(id)
+		s.mu.Unlock()
+		if err != nil && err != ErrPasteNotFound {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,83 @@
+package storage
+
+import (
+	"io/ioutil"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCompressStore(t *testing.T) {
+	mem, _ := NewMemStore()
+	stats := &Stats{}
+	s := NewCompressStore(mem, stats, time.Hour, 0)
+	large := strings.Repeat("foo bar ", 1000)
+	put := func(content string) ID {
+		t.Helper()
+		if err := stats.MakeSpaceFor(int64(len(content))); err != nil {
+			t.Fatal(err)
+		}
+		id, err := s.Put([]byte(content), Meta{})
+		if err != nil {
+			t.Fatalf("Put() errored unexpectedly: %v", err)
+		}
+		return id
+	}
+	mustRead := func(id ID, version int, want string) {
+		t.Helper()
+		var p Paste
+		var err error
+		if version > 0 {
+			p, err = s.GetVersion(id, version)
+		} else {
+			p, err = s.Get(id)
+		}
+		if err != nil {
+			t.Fatalf("Could not get %s version %d: %v", id, version, err)
+		}
+		defer p.Close()
+		got, _ := ioutil.ReadAll(p)
+		if string(got) != want {
+			t.Errorf("Got %d bytes for %s version %d, want %d", len(got), id, version, len(want))
+		}
+		if p.Size() != int64(len(want)) || p.Meta().Compression != "" {
+			t.Errorf("Got size %d and compression %q for %s version %d", p.Size(), p.Meta().Compression, id, version)
+		}
+	}
+	small := put("foo")
+	cold := put(large)
+	hot := put(large)
+	_, before := stats.Report()
+
+	time.Sleep(time.Millisecond)
+	since := time.Now()
+	mustRead(hot, 0, large)
+	if err := s.compressCold(since); err != nil {
+		t.Fatalf("compressCold() errored unexpectedly: %v", err)
+	}
+	for id, want := range map[ID]bool{small: false, cold: true, hot: false} {
+		info, _ := mem.Stat(id)
+		if got := info.Compression != ""; got != want {
+			t.Errorf("Paste %s compressed: %t, want %t", id, got, want)
+		}
+	}
+	_, after := stats.Report()
+	raw, _ := mem.Stat(cold)
+	if saved := before - after; saved != int64(len(large))-raw.Size {
+		t.Errorf("Compressing freed %d bytes, want %d", saved, int64(len(large))-raw.Size)
+	}
+	mustRead(cold, 0, large)
+	if info, err := s.Stat(cold); err != nil || info.Size != int64(len(large)) {
+		t.Errorf("Stat() of a compressed paste got size %d and %v", info.Size, err)
+	}
+
+	// Editing keeps the previous content as it was
+	if err := s.Update(cold, []byte("baz"), Meta{}); err != nil {
+		t.Fatalf("Update() errored unexpectedly: %v", err)
+	}
+	mustRead(cold, 0, "baz")
+	mustRead(cold, 1, large)
+	if _, got := stats.Report(); got != before {
+		t.Errorf("Got %d bytes stored after decompressing, want %d", got, before)
+	}
+}
@@ -0,0 +1,130 @@
+// Copyright (c) 2014-2015, Daniel Martí <mvdan@mvdan.cc>
+// See LICENSE for licensing information
+
+package storage
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"runtime"
+	"sync"
+	"time"
+)
+
+// How often the files written are flushed to disk with SyncInterval
+const syncInterval = 1 * time.Second
+
+// SyncPolicy is when the files written by the fs stores and mirrors are
+// flushed to disk. Files are always written in full before they replace
+// any others, so a crash may lose recent pastes but never truncate them.
+type SyncPolicy int
+
+const (
+	// SyncNever leaves flushing to the operating system
+	SyncNever SyncPolicy = iota
+	// SyncInterval flushes the files written in the background, losing at
+	// most the last second of changes on a crash
+	SyncInterval
+	// SyncAlways flushes each file and its directory before the change
+	// is done
+	SyncAlways
+)
+
+var syncPolicyNames = map[SyncPolicy]string{
+	SyncNever:    "never",
+	SyncInterval: "interval",
+	SyncAlways:   "always",
+}
+
+func (p SyncPolicy) String() string {
+	return syncPolicyNames[p]
+}
+
+// ParseSyncPolicy parses a policy by its name, like "always".
+func ParseSyncPolicy(s string) (SyncPolicy, error) {
+	for p, name := range syncPolicyNames {
+		if s == name {
+			return p, nil
+		}
+	}
+	return SyncNever, fmt.Errorf("unknown fsync policy: %q", s)
+}
+
+var (
+	syncPolicy = SyncNever
+
+	// syncMu guards the files to flush with SyncInterval, mapped to
+	// whether they are directories
+	syncMu      sync.Mutex
+	syncPending map[string]bool
+)
+
+// SetSyncPolicy sets when files are flushed to disk. It must be called
+// before any store is created.
+func SetSyncPolicy(p SyncPolicy) {
+	if p == SyncInterval && syncPolicy != SyncInterval {
+		syncPending = make(map[string]bool)
+		go syncPeriodically()
+	}
+	syncPolicy = p
+}
+
+// synced flushes a file written to disk per the policy.
+func synced(f *os.File) error {
+	if syncPolicy == SyncAlways {
+		return f.Sync()
+	}
+	return nil
+}
+
+// syncedDir flushes a directory whose entries changed to disk per the
+// policy, along with the file that was written in it with SyncInterval.
+func syncedDir(dir, written string) error {
+	switch syncPolicy {
+	case SyncAlways:
+		return syncPath(dir, true)
+	case SyncInterval:
+		syncMu.Lock()
+		syncPending[written] = false
+		syncPending[dir] = true
+		syncMu.Unlock()
+	}
+	return nil
+}
+
+func syncPeriodically() {
+	for range time.Tick(syncInterval) {
+		syncMu.Lock()
+		pending := syncPending
+		syncPending = make(map[string]bool)
+		syncMu.Unlock()
+		for path, isDir := range pending {
+			err := syncPath(path, isDir)
+			if err != nil && !os.IsNotExist(err) {
+				log.Printf("Could not flush %s to disk: %v", path, err)
+			}
+		}
+	}
+}
+
+func syncPath(path string, isDir bool) error {
+	if isDir && runtime.GOOS == "windows" {
+		// Directories cannot be flushed
+		return nil
+	}
+	flag := os.O_RDONLY
+	if !isDir {
+		// Windows needs write access to flush a file
+		flag = os.O_RDWR
+	}
+	f, err := os.OpenFile(path, flag, 0)
+	if err != nil {
+		return err
+	}
+	err = f.Sync()
+	if err1 := f.Close(); err == nil {
+		err = err1
+	}
+	return err
+}
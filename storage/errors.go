@@ -0,0 +1,91 @@
+// Copyright (c) 2014-2015, Daniel Martí <mvdan@mvdan.cc>
+// See LICENSE for licensing information
+
+package storage
+
+import (
+	"errors"
+	"net/http"
+)
+
+// Kinds of errors other than ErrPasteNotFound that stores may fail with,
+// either as they are or as the Kind of an Error
+var (
+	// ErrPasteExpired means that the paste was deleted at the end of its
+	// lifetime. Stores report expired pastes as not found, as they do not
+	// remember them, so this is for those who do.
+	ErrPasteExpired = errors.New("paste expired")
+	// ErrPasteTooLarge means that the backend refused a paste for its
+	// size
+	ErrPasteTooLarge = errors.New("paste is too large")
+	// ErrQuotaExceeded means that there is no room left for the paste,
+	// like ErrReachedMaxNumber, ErrReachedMaxStorage and ErrDiskFull
+	ErrQuotaExceeded = errors.New("no room left for more pastes")
+	// ErrCorrupted means that a paste could not be read back as it was
+	// stored
+	ErrCorrupted = errors.New("paste is corrupted")
+	// ErrUnavailable means that the backend could not be reached or was
+	// failing, which may only last for a while
+	ErrUnavailable = errors.New("storage backend is unavailable")
+)
+
+// Error is an error from a backend along with its kind, so that it can be
+// handled by kind while keeping the backend's error to log it.
+type Error struct {
+	// Kind is one of the kinds of errors, like ErrCorrupted
+	Kind error
+	Err  error
+}
+
+func (e *Error) Error() string {
+	return e.Kind.Error() + ": " + e.Err.Error()
+}
+
+// Kind returns the kind of an error from a store: ErrPasteNotFound,
+// ErrPasteExpired, ErrPasteTooLarge, ErrQuotaExceeded, ErrCorrupted or
+// ErrUnavailable, or nil if its kind is unknown.
+func Kind(err error) error {
+	switch err {
+	case ErrPasteNotFound, ErrPasteExpired, ErrPasteTooLarge,
+		ErrQuotaExceeded, ErrCorrupted, ErrUnavailable:
+		return err
+	case ErrReachedMaxNumber, ErrReachedMaxStorage:
+		return ErrQuotaExceeded
+	}
+	if e, ok := err.(*Error); ok {
+		return e.Kind
+	}
+	if IsDiskFull(err) {
+		return ErrQuotaExceeded
+	}
+	if IsTransient(err) {
+		return ErrUnavailable
+	}
+	return nil
+}
+
+// corrupted marks an error as meaning that a paste is corrupted.
+func corrupted(err error) error {
+	return &Error{Kind: ErrCorrupted, Err: err}
+}
+
+// statusKind returns the kind of error of a failed reply from a backend
+// spoken to over HTTP, or nil if it has none.
+func statusKind(code int) error {
+	switch {
+	case code == http.StatusRequestEntityTooLarge:
+		return ErrPasteTooLarge
+	case code == http.StatusTooManyRequests || code >= 500:
+		return ErrUnavailable
+	}
+	return nil
+}
+
+// withStatusKind gives an error from a backend spoken to over HTTP the kind
+// of its reply's status, if it has one.
+func withStatusKind(code int, err error) error {
+	if kind := statusKind(code); kind != nil {
+		return &Error{Kind: kind, Err: err}
+	}
+	return err
+}
@@ -0,0 +1,38 @@
+package storage
+
+import (
+	"errors"
+	"net/http"
+	"os"
+	"syscall"
+	"testing"
+)
+
+func TestKind(t *testing.T) {
+	backend := errors.New("backend failed")
+	for _, tc := range []struct {
+		err  error
+		want error
+	}{
+		{ErrPasteNotFound, ErrPasteNotFound},
+		{ErrPasteExpired, ErrPasteExpired},
+		{ErrReachedMaxNumber, ErrQuotaExceeded},
+		{ErrReachedMaxStorage, ErrQuotaExceeded},
+		{ErrDiskFull, ErrQuotaExceeded},
+		{&os.PathError{Op: "write", Path: "foo", Err: syscall.ENOSPC}, ErrQuotaExceeded},
+		{&os.PathError{Op: "open", Path: "foo", Err: syscall.EBUSY}, ErrUnavailable},
+		{corrupted(backend), ErrCorrupted},
+		{withStatusKind(http.StatusRequestEntityTooLarge, backend), ErrPasteTooLarge},
+		{withStatusKind(http.StatusServiceUnavailable, backend), ErrUnavailable},
+		{withStatusKind(http.StatusTooManyRequests, backend), ErrUnavailable},
+		{withStatusKind(http.StatusForbidden, backend), nil},
+		{backend, nil},
+	} {
+		if got := Kind(tc.err); got != tc.want {
+			t.Errorf("Kind(%v) got %v, want %v", tc.err, got, tc.want)
+		}
+	}
+	if got, want := corrupted(backend).Error(), "paste is corrupted: backend failed"; got != want {
+		t.Errorf("Error() got %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,239 @@
+// Copyright (c) 2014-2015, Daniel Martí <mvdan@mvdan.cc>
+// See LICENSE for licensing information
+
+package storage
+
+import (
+	"container/heap"
+	"log"
+	"sync"
+	"time"
+)
+
+// deletion is a paste to be deleted at the end of its lifetime
+type deletion struct {
+	at       time.Time
+	s        Store
+	stats    *Stats
+	onExpire ExpireFunc
+	id       ID
+	// tries is how many times deleting the paste failed
+	tries int
+}
+
+// deletionHeap is a min-heap of deletions by the time they are due
+type deletionHeap []*deletion
+
+func (h deletionHeap) Len() int            { return len(h) }
+func (h deletionHeap) Less(i, j int) bool  { return h[i].at.Before(h[j].at) }
+func (h deletionHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *deletionHeap) Push(x interface{}) { *h = append(*h, x.(*deletion)) }
+
+func (h *deletionHeap) Pop() interface{} {
+	old := *h
+	d := old[len(old)-1]
+	old[len(old)-1] = nil
+	*h = old[:len(old)-1]
+	return d
+}
+
+// Default number of expired pastes deleted from a store at once
+const defaultDeleteBatch = 100
+
+// deletionScheduler deletes pastes as they expire from a single goroutine,
+// started along with the first deletion scheduled. The deletions due at
+// once are grouped by store, so that stores able to delete many pastes at
+// once do so.
+type deletionScheduler struct {
+	once sync.Once
+	// wake tells the goroutine that the next deletion may be due earlier
+	wake chan struct{}
+	// interval is the least time between sweeps of the due deletions
+	interval time.Duration
+	// batch is the most pastes deleted from a store at once
+	batch int
+	clock Clock
+
+	mu   sync.Mutex
+	heap deletionHeap
+}
+
+var deletions = &deletionScheduler{
+	wake:  make(chan struct{}, 1),
+	batch: defaultDeleteBatch,
+	clock: clock,
+}
+
+// SetDeletionBatching sets how often expired pastes are deleted, so that
+// those expiring within the interval are deleted together, and how many of
+// them may be deleted from a store at once. An interval of zero deletes
+// pastes as soon as they expire, and a batch of zero uses the default. It
+// must be called before any store is created.
+func SetDeletionBatching(interval time.Duration, batch int) {
+	if batch <= 0 {
+		batch = defaultDeleteBatch
+	}
+	deletions.mu.Lock()
+	deletions.interval, deletions.batch = interval, batch
+	deletions.mu.Unlock()
+}
+
+func (d *deletionScheduler) schedule(del *deletion) {
+	d.once.Do(func() { go d.run() })
+	d.mu.Lock()
+	heap.Push(&d.heap, del)
+	first := d.heap[0] == del
+	d.mu.Unlock()
+	if first {
+		select {
+		case d.wake <- struct{}{}:
+		default:
+		}
+	}
+}
+
+func (d *deletionScheduler) run() {
+	timer := d.clock.NewTimer(0)
+	if !timer.Stop() {
+		<-timer.C()
+	}
+	lastSweep := d.clock.Now()
+	for {
+		d.mu.Lock()
+		if len(d.heap) == 0 {
+			d.mu.Unlock()
+			<-d.wake
+			continue
+		}
+		now := d.clock.Now()
+		next := d.heap[0].at
+		if earliest := lastSweep.Add(d.interval); next.Before(earliest) {
+			next = earliest
+		}
+		if next.After(now) {
+			d.mu.Unlock()
+			timer.Reset(next.Sub(now))
+			select {
+			case <-timer.C():
+			case <-d.wake:
+				if !timer.Stop() {
+					<-timer.C()
+				}
+			}
+			continue
+		}
+		var due []*deletion
+		for len(d.heap) > 0 && !d.heap[0].at.After(now) {
+			due = append(due, heap.Pop(&d.heap).(*deletion))
+		}
+		batch := d.batch
+		d.mu.Unlock()
+		lastSweep = now
+		d.sweep(due, batch)
+	}
+}
+
+// sweep deletes the pastes due, in batches per store.
+func (d *deletionScheduler) sweep(due []*deletion, batch int) {
+	var stores []Store
+	byStore := make(map[Store][]*deletion)
+	for _, del := range due {
+		if _, e := byStore[del.s]; !e {
+			stores = append(stores, del.s)
+		}
+		byStore[del.s] = append(byStore[del.s], del)
+	}
+	for _, s := range stores {
+		dels := byStore[s]
+		for len(dels) > 0 {
+			n := batch
+			if n > len(dels) {
+				n = len(dels)
+			}
+			d.expire(s, dels[:n])
+			dels = dels[n:]
+		}
+	}
+}
+
+// expire deletes pastes from a store at once, scheduling again those that
+// could not be deleted.
+func (d *deletionScheduler) expire(s Store, dels []*deletion) {
+	var live []*deletion
+	var ids []ID
+	var sizes []int64
+	for _, del := range dels {
+		// The paste may have grown via new versions since
+		info, err := Stat(s, del.id)
+		if err == ErrPasteNotFound {
+			// Already deleted by other means
+			continue
+		}
+		if err != nil {
+			d.retry(del)
+			continue
+		}
+		live = append(live, del)
+		ids = append(ids, del.id)
+		sizes = append(sizes, info.Size+info.VersionsSize())
+	}
+	if len(live) == 0 {
+		return
+	}
+	failed := DeleteBatch(s, ids) != nil
+	for i, del := range live {
+		if failed {
+			// Some of them may have been deleted before failing
+			if _, err := Stat(s, del.id); err != ErrPasteNotFound {
+				d.retry(del)
+				continue
+			}
+		}
+		del.stats.FreeSpace(sizes[i])
+		if del.onExpire != nil {
+			del.onExpire(del.id, d.clock.Now())
+		}
+	}
+}
+
+// retry schedules a deletion that failed again, unless it failed too many
+// times already.
+func (d *deletionScheduler) retry(del *deletion) {
+	del.tries++
+	if del.tries > deleteRetries {
+		log.Printf("Giving up on deleting %s", del.id)
+		return
+	}
+	log.Printf("Could not delete %s, trying again in %s", del.id, deleteRetryTimeout)
+	del.at = d.clock.Now().Add(deleteRetryTimeout)
+	d.schedule(del)
+}
+
+// SetupPasteDeletion deletes a paste from s once the given duration passes,
+// freeing its space from stats and calling onExpire if not nil. A duration
+// of zero means that the paste never expires.
+//
+// All pastes are deleted by a single goroutine, which keeps them in a heap
+// by when they expire.
+func SetupPasteDeletion(s Store, stats *Stats, onExpire ExpireFunc, id ID, after time.Duration) {
+	if after == 0 {
+		return
+	}
+	scheduleDeletion(s, stats, onExpire, id, clock.Now().Add(after))
+}
+
+// ExpirePaste is like SetupPasteDeletion, but for a paste that outlived its
+// lifetime, which is deleted as soon as possible.
+func ExpirePaste(s Store, stats *Stats, onExpire ExpireFunc, id ID) {
+	scheduleDeletion(s, stats, onExpire, id, clock.Now())
+}
+
+func scheduleDeletion(s Store, stats *Stats, onExpire ExpireFunc, id ID, at time.Time) {
+	deletions.schedule(&deletion{
+		at:       at,
+		s:        s,
+		stats:    stats,
+		onExpire: onExpire,
+		id:       id,
+	})
+}
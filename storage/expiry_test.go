@@ -0,0 +1,121 @@
+package storage
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSetupPasteDeletion(t *testing.T) {
+	s, _ := NewMemStore()
+	stats := &Stats{}
+	expired := make(chan ID, 3)
+	onExpire := func(id ID, at time.Time) { expired <- id }
+	var want []ID
+	for _, content := range []string{"foo", "bar", "baz"} {
+		stats.MakeSpaceFor(int64(len(content)))
+		id, err := s.Put([]byte(content), Meta{})
+		if err != nil {
+			t.Fatalf("Put() errored unexpectedly: %v", err)
+		}
+		want = append(want, id)
+	}
+	// Scheduled out of order, and one never expiring
+	SetupPasteDeletion(s, stats, onExpire, want[2], 60*time.Millisecond)
+	SetupPasteDeletion(s, stats, onExpire, want[0], 20*time.Millisecond)
+	SetupPasteDeletion(s, stats, onExpire, want[1], 40*time.Millisecond)
+	SetupPasteDeletion(s, stats, onExpire, want[1], 0)
+	for i, id := range want {
+		select {
+		case got := <-expired:
+			if got != id {
+				t.Fatalf("Paste %d to expire was %s, want %s", i, got, id)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("Paste %s did not expire", id)
+		}
+		if _, err := s.Get(id); err != ErrPasteNotFound {
+			t.Errorf("Expired paste %s is still there: %v", id, err)
+		}
+	}
+	if n, size := stats.Report(); n != 0 || size != 0 {
+		t.Errorf("Got %d pastes using %d bytes after expiring them all", n, size)
+	}
+}
+
+// batchStore records the batches of pastes deleted from a store
+type batchStore struct {
+	Store
+	batches chan []ID
+}
+
+func (s batchStore) DeleteBatch(ids []ID) error {
+	s.batches <- ids
+	return DeleteBatch(s.Store, ids)
+}
+
+func TestDeletionBatching(t *testing.T) {
+	SetDeletionBatching(0, 2)
+	defer SetDeletionBatching(0, 0)
+	mem, _ := NewMemStore()
+	s := batchStore{Store: mem, batches: make(chan []ID, 5)}
+	stats := &Stats{}
+	expired := make(chan ID, 5)
+	onExpire := func(id ID, at time.Time) { expired <- id }
+	at := time.Now().Add(20 * time.Millisecond)
+	for _, content := range []string{"foo", "bar", "baz", "qux", "quux"} {
+		stats.MakeSpaceFor(int64(len(content)))
+		id, err := s.Put([]byte(content), Meta{})
+		if err != nil {
+			t.Fatalf("Put() errored unexpectedly: %v", err)
+		}
+		scheduleDeletion(s, stats, onExpire, id, at)
+	}
+	for i := 0; i < 5; i++ {
+		select {
+		case <-expired:
+		case <-time.After(time.Second):
+			t.Fatalf("Only %d pastes expired, want 5", i)
+		}
+	}
+	var sizes []int
+	for len(s.batches) > 0 {
+		sizes = append(sizes, len(<-s.batches))
+	}
+	if len(sizes) != 3 || sizes[0] != 2 || sizes[1] != 2 || sizes[2] != 1 {
+		t.Errorf("Pastes were deleted in batches of %v, want [2 2 1]", sizes)
+	}
+	if n, size := stats.Report(); n != 0 || size != 0 {
+		t.Errorf("Got %d pastes using %d bytes after expiring them all", n, size)
+	}
+}
+
+func TestDeletionClock(t *testing.T) {
+	c := newFakeClock()
+	d := &deletionScheduler{wake: make(chan struct{}, 1), batch: 1, clock: c}
+	s, _ := NewMemStore()
+	stats := &Stats{}
+	expired := make(chan time.Time, 1)
+	onExpire := func(id ID, at time.Time) { expired <- at }
+	stats.MakeSpaceFor(3)
+	id, err := s.Put([]byte("foo"), Meta{})
+	if err != nil {
+		t.Fatalf("Put() errored unexpectedly: %v", err)
+	}
+	d.schedule(&deletion{at: c.Now().Add(time.Hour), s: s, stats: stats, onExpire: onExpire, id: id})
+
+	c.Advance(time.Hour - time.Second)
+	select {
+	case <-expired:
+		t.Fatalf("Paste expired a second early")
+	case <-time.After(50 * time.Millisecond):
+	}
+	c.Advance(time.Second)
+	select {
+	case at := <-expired:
+		if want := c.Now(); !at.Equal(want) {
+			t.Errorf("Paste expired at %s, want %s", at, want)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Paste did not expire")
+	}
+}
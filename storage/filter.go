@@ -0,0 +1,197 @@
+// Copyright (c) 2014-2015, Daniel Martí <mvdan@mvdan.cc>
+// See LICENSE for licensing information
+
+package storage
+
+import (
+	"hash/fnv"
+	"sync"
+	"time"
+)
+
+const (
+	// Bits and hashes per id for a false positive rate of about 1%
+	filterBitsPerID = 10
+	filterHashes    = 7
+	// Ids that the first filter has room for
+	minFilterIDs = 1024
+)
+
+// bloomFilter is a Bloom filter over ids with room for a number of them
+type bloomFilter struct {
+	bits []uint64
+	ids  int
+	room int
+}
+
+func newBloomFilter(room int) *bloomFilter {
+	return &bloomFilter{
+		bits: make([]uint64, (room*filterBitsPerID+63)/64),
+		room: room,
+	}
+}
+
+// positions calls fn with each of the bits that id sets, derived from two
+// hashes as they are as good as independent ones for a Bloom filter.
+func (f *bloomFilter) positions(id ID, fn func(i uint64)) {
+	h := fnv.New64a()
+	h.Write(id[:])
+	sum := h.Sum64()
+	h1, h2 := sum&0xffffffff, sum>>32
+	n := uint64(len(f.bits) * 64)
+	for i := uint64(0); i < filterHashes; i++ {
+		fn((h1 + i*h2) % n)
+	}
+}
+
+func (f *bloomFilter) add(id ID) {
+	f.positions(id, func(i uint64) {
+		f.bits[i/64] |= 1 << (i % 64)
+	})
+	f.ids++
+}
+
+func (f *bloomFilter) mayHave(id ID) bool {
+	has := true
+	f.positions(id, func(i uint64) {
+		if f.bits[i/64]&(1<<(i%64)) == 0 {
+			has = false
+		}
+	})
+	return has
+}
+
+// FilterStore is a Store that turns down the operations on ids it has
+// certainly never seen without asking another store, which is where most
+// of the requests guessing ids end up. It knows of the pastes in the other
+// store when it is set up and of those added through it since, so no one
+// else may add pastes to the other store.
+//
+// Ids are kept in Bloom filters, so deleted pastes are still looked up in
+// the other store. Once a filter is full, another one twice as large is
+// added.
+type FilterStore struct {
+	Store
+
+	mu      sync.RWMutex
+	filters []*bloomFilter
+}
+
+// NewFilterStore sets up a FilterStore over the pastes in s.
+func NewFilterStore(s Store) (*FilterStore, error) {
+	var ids []ID
+	err := s.Iterate(func(id ID, info Info) bool {
+		ids = append(ids, id)
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	room := 2 * len(ids)
+	if room < minFilterIDs {
+		room = minFilterIDs
+	}
+	fs := &FilterStore{
+		Store:   s,
+		filters: []*bloomFilter{newBloomFilter(room)},
+	}
+	for _, id := range ids {
+		fs.add(id)
+	}
+	return fs, nil
+}
+
+func (s *FilterStore) add(id ID) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	last := s.filters[len(s.filters)-1]
+	if last.ids >= last.room {
+		last = newBloomFilter(2 * last.room)
+		s.filters = append(s.filters, last)
+	}
+	last.add(id)
+}
+
+// mayHave reports whether a paste may be in the other store.
+func (s *FilterStore) mayHave(id ID) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for _, f := range s.filters {
+		if f.mayHave(id) {
+			return true
+		}
+	}
+	return false
+}
+
+// Len returns the number of ids added to the filters, including those of
+// pastes deleted since.
+func (s *FilterStore) Len() int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	n := 0
+	for _, f := range s.filters {
+		n += f.ids
+	}
+	return n
+}
+
+func (s *FilterStore) Get(id ID) (Paste, error) {
+	if !s.mayHave(id) {
+		return nil, ErrPasteNotFound
+	}
+	return s.Store.Get(id)
+}
+
+func (s *FilterStore) Stat(id ID) (Info, error) {
+	if !s.mayHave(id) {
+		return Info{}, ErrPasteNotFound
+	}
+	return Stat(s.Store, id)
+}
+
+func (s *FilterStore) GetVersion(id ID, version int) (Paste, error) {
+	if !s.mayHave(id) {
+		return nil, ErrPasteNotFound
+	}
+	return s.Store.GetVersion(id, version)
+}
+
+func (s *FilterStore) Put(content []byte, meta Meta) (ID, error) {
+	id, err := s.Store.Put(content, meta)
+	if err == nil {
+		s.add(id)
+	}
+	return id, err
+}
+
+func (s *FilterStore) Delete(id ID) error {
+	if !s.mayHave(id) {
+		return ErrPasteNotFound
+	}
+	return s.Store.Delete(id)
+}
+
+func (s *FilterStore) DeleteBatch(ids []ID) error {
+	var known []ID
+	for _, id := range ids {
+		if s.mayHave(id) {
+			known = append(known, id)
+		}
+	}
+	return DeleteBatch(s.Store, known)
+}
+
+func (s *FilterStore) Update(id ID, content []byte, meta Meta) error {
+	if !s.mayHave(id) {
+		return ErrPasteNotFound
+	}
+	return s.Store.Update(id, content, meta)
+}
+
+// Copy adds the id before copying, so that the paste can be found as soon
+// as it is in the other store.
+func (s *FilterStore) Copy(id ID, content []byte, meta Meta, modTime time.Time, versions [][]byte) error {
+	s.add(id)
+	return s.Store.Copy(id, content, meta, modTime, versions)
+}
@@ -0,0 +1,74 @@
+package storage
+
+import (
+	"testing"
+	"time"
+)
+
+// countingStore counts the lookups that reach it
+type countingStore struct {
+	Store
+	gets int
+}
+
+func (s *countingStore) Get(id ID) (Paste, error) {
+	s.gets++
+	return s.Store.Get(id)
+}
+
+func TestFilterStore(t *testing.T) {
+	mem, _ := NewMemStore()
+	before, err := mem.Put([]byte("foo"), Meta{})
+	if err != nil {
+		t.Fatalf("Put() errored unexpectedly: %v", err)
+	}
+	cs := &countingStore{Store: mem}
+	s, err := NewFilterStore(cs)
+	if err != nil {
+		t.Fatalf("NewFilterStore() errored unexpectedly: %v", err)
+	}
+	mustGet := func(id ID) {
+		t.Helper()
+		p, err := s.Get(id)
+		if err != nil {
+			t.Fatalf("Get(%s) errored unexpectedly: %v", id, err)
+		}
+		p.Close()
+	}
+	mustGet(before)
+	after, err := s.Put([]byte("bar"), Meta{})
+	if err != nil {
+		t.Fatalf("Put() errored unexpectedly: %v", err)
+	}
+	mustGet(after)
+	copied := ID{1, 2, 3, 4}
+	if err := s.Copy(copied, []byte("baz"), Meta{}, time.Now(), nil); err != nil {
+		t.Fatalf("Copy() errored unexpectedly: %v", err)
+	}
+	mustGet(copied)
+
+	// Guessed ids are almost all turned down without a lookup
+	cs.gets = 0
+	guesses := 10000
+	for i := 0; i < guesses; i++ {
+		id, _ := randomID(func(ID) bool { return true })
+		if _, err := s.Get(id); err != ErrPasteNotFound {
+			t.Fatalf("Get(%s) got %v, want %v", id, err, ErrPasteNotFound)
+		}
+	}
+	if cs.gets > guesses/20 {
+		t.Errorf("%d out of %d guessed ids were looked up", cs.gets, guesses)
+	}
+
+	// Further filters are added as ids keep coming
+	for i := 0; i < 3*minFilterIDs; i++ {
+		if _, err := s.Put([]byte("x"), Meta{}); err != nil {
+			t.Fatalf("Put() errored unexpectedly: %v", err)
+		}
+	}
+	if len(s.filters) < 2 {
+		t.Errorf("Got %d filters after %d ids, want more", len(s.filters), s.Len())
+	}
+	mustGet(before)
+	mustGet(copied)
+}
@@ -0,0 +1,173 @@
+// Copyright (c) 2014-2015, Daniel Martí <mvdan@mvdan.cc>
+// See LICENSE for licensing information
+
+package storage
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// OAuth scopes of the Cloud Storage API
+const (
+	gcsReadWrite   = "https://www.googleapis.com/auth/devstorage.read_write"
+	gcsFullControl = "https://www.googleapis.com/auth/devstorage.full_control"
+)
+
+// Where instances on Google Cloud get the tokens of their service account
+const gcsMetadataToken = "http://metadata.google.internal/computeMetadata/v1/instance/service-accounts/default/token"
+
+// How long before a token expires to get a new one
+const gcsTokenMargin = 1 * time.Minute
+
+// gcsKey is the JSON key of a service account, as downloaded from the
+// Google Cloud console
+type gcsKey struct {
+	ClientEmail string `json:"client_email"`
+	PrivateKey  string `json:"private_key"`
+	TokenURI    string `json:"token_uri"`
+}
+
+// gcsAuth gets OAuth access tokens for a service account, either by
+// signing a JWT with its key or from the metadata server, and caches them
+// until they are about to expire.
+type gcsAuth struct {
+	client *http.Client
+	scope  string
+	email  string
+	key    *rsa.PrivateKey
+	uri    string
+
+	mu      sync.Mutex
+	cached  string
+	expires time.Time
+}
+
+// newGCSAuth loads the key at path, or uses the metadata server if path is
+// empty.
+func newGCSAuth(client *http.Client, path, scope string) (*gcsAuth, error) {
+	a := &gcsAuth{client: client, scope: scope, uri: gcsMetadataToken}
+	if path == "" {
+		return a, nil
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var k gcsKey
+	if err := json.Unmarshal(data, &k); err != nil {
+		return nil, fmt.Errorf("invalid service account key %s: %v", path, err)
+	}
+	block, _ := pem.Decode([]byte(k.PrivateKey))
+	if block == nil || k.ClientEmail == "" || k.TokenURI == "" {
+		return nil, fmt.Errorf("service account key %s is incomplete", path)
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("invalid private key in %s: %v", path, err)
+	}
+	rsaKey, ok := parsed.(*rsa.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("private key in %s is not RSA", path)
+	}
+	a.email, a.key, a.uri = k.ClientEmail, rsaKey, k.TokenURI
+	return a, nil
+}
+
+// token returns an access token, getting a new one if needed.
+func (a *gcsAuth) token() (string, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.cached != "" && time.Now().Add(gcsTokenMargin).Before(a.expires) {
+		return a.cached, nil
+	}
+	var req *http.Request
+	var err error
+	if a.key == nil {
+		req, err = http.NewRequest("GET", a.uri+"?scopes="+url.QueryEscape(a.scope), nil)
+		if err == nil {
+			req.Header.Set("Metadata-Flavor", "Google")
+		}
+	} else {
+		var jwt string
+		if jwt, err = a.signJWT(time.Now()); err != nil {
+			return "", err
+		}
+		form := url.Values{}
+		form.Set("grant_type", "urn:ietf:params:oauth:grant-type:jwt-bearer")
+		form.Set("assertion", jwt)
+		req, err = http.NewRequest("POST", a.uri, strings.NewReader(form.Encode()))
+		if err == nil {
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		}
+	}
+	if err != nil {
+		return "", err
+	}
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("cannot get a gcs token: %v", err)
+	}
+	defer resp.Body.Close()
+	var reply struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int    `json:"expires_in"`
+		Error       string `json:"error_description"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&reply); err != nil {
+		return "", fmt.Errorf("cannot get a gcs token: %s", resp.Status)
+	}
+	if resp.StatusCode != http.StatusOK || reply.AccessToken == "" {
+		return "", fmt.Errorf("cannot get a gcs token: %s %s", resp.Status, reply.Error)
+	}
+	a.cached = reply.AccessToken
+	a.expires = time.Now().Add(time.Duration(reply.ExpiresIn) * time.Second)
+	return a.cached, nil
+}
+
+// expire forgets the cached token, so that a new one is used next.
+func (a *gcsAuth) expire() {
+	a.mu.Lock()
+	a.cached = ""
+	a.mu.Unlock()
+}
+
+// signJWT returns the assertion exchanged for an access token, valid for an
+// hour from now.
+func (a *gcsAuth) signJWT(now time.Time) (string, error) {
+	enc := base64.RawURLEncoding
+	header, err := json.Marshal(map[string]string{"alg": "RS256", "typ": "JWT"})
+	if err != nil {
+		return "", err
+	}
+	claims, err := json.Marshal(map[string]interface{}{
+		"iss":   a.email,
+		"scope": a.scope,
+		"aud":   a.uri,
+		"iat":   now.Unix(),
+		"exp":   now.Add(time.Hour).Unix(),
+	})
+	if err != nil {
+		return "", err
+	}
+	signed := enc.EncodeToString(header) + "." + enc.EncodeToString(claims)
+	sum := sha256.Sum256([]byte(signed))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, a.key, crypto.SHA256, sum[:])
+	if err != nil {
+		return "", fmt.Errorf("cannot sign gcs token request: %v", err)
+	}
+	return signed + "." + enc.EncodeToString(sig), nil
+}
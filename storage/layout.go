@@ -0,0 +1,193 @@
+// Copyright (c) 2014-2015, Daniel Martí <mvdan@mvdan.cc>
+// See LICENSE for licensing information
+
+package storage
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Layout is how a directory of pastes is split into nested subdirectories,
+// each named after the next hex digits of the ids of the pastes in it. Tiny
+// instances do fine with the default, while millions of pastes call for
+// more levels so that no directory grows too large.
+type Layout struct {
+	// Depth is how many levels of subdirectories there are
+	Depth int
+	// Width is how many hex digits name each subdirectory
+	Width int
+}
+
+// DefaultLayout stores a paste like "a63d03b9" at "a6/3d03b9"
+var DefaultLayout = Layout{Depth: 1, Width: 2}
+
+// Check returns an error if the layout does not leave some of the digits of
+// each id to name the paste's file.
+func (l Layout) Check() error {
+	if l.Depth < 1 || l.Width < 1 || l.Depth*l.Width >= idSize {
+		return fmt.Errorf("%d levels of %d digits must use between 1 and %d of the %d digits of an id",
+			l.Depth, l.Width, idSize-1, idSize)
+	}
+	return nil
+}
+
+func (l Layout) String() string {
+	return fmt.Sprintf("%d levels of %d digits", l.Depth, l.Width)
+}
+
+// path returns where a paste is stored, relative to the directory.
+func (l Layout) path(id ID) string {
+	hexID := id.String()
+	elems := make([]string, 0, l.Depth+1)
+	for i := 0; i < l.Depth; i++ {
+		elems = append(elems, hexID[i*l.Width:(i+1)*l.Width])
+	}
+	return filepath.Join(append(elems, hexID[l.Depth*l.Width:])...)
+}
+
+// uses reports whether the layout has a subdirectory, relative to the
+// directory.
+func (l Layout) uses(dir string) bool {
+	elems := strings.Split(dir, string(filepath.Separator))
+	if len(elems) > l.Depth {
+		return false
+	}
+	for _, elem := range elems {
+		if len(elem) != l.Width {
+			return false
+		}
+	}
+	return true
+}
+
+// idFromPath returns the id of the paste stored at a path relative to the
+// directory, in any layout.
+func idFromPath(path string) (ID, error) {
+	if !strings.Contains(path, string(filepath.Separator)) {
+		return ID{}, fmt.Errorf("paste not in a subdirectory at %s", path)
+	}
+	return IDFromString(strings.Replace(path, string(filepath.Separator), "", -1))
+}
+
+// isLayoutDir reports whether a directory's name could be part of a layout.
+func isLayoutDir(name string) bool {
+	if len(name) == 0 || len(name) >= idSize {
+		return false
+	}
+	for _, r := range name {
+		if !strings.ContainsRune("0123456789abcdef", r) {
+			return false
+		}
+	}
+	return true
+}
+
+// walkLayout walks the current directory like filepath.Walk, but only the
+// subdirectories that could be part of a layout and the files in them.
+// Files at the top, like lock files, are skipped.
+func walkLayout(fn filepath.WalkFunc) error {
+	return filepath.Walk(".", func(path string, fi os.FileInfo, err error) error {
+		if path == "." {
+			return err
+		}
+		if err == nil {
+			if fi.IsDir() && !isLayoutDir(fi.Name()) {
+				return filepath.SkipDir
+			}
+			if !fi.IsDir() && !strings.Contains(path, string(filepath.Separator)) {
+				return nil
+			}
+		}
+		return fn(path, fi, err)
+	})
+}
+
+// isPasteFile reports whether a file holds the content of a paste, rather
+// than its attributes or one of its previous versions.
+func isPasteFile(path string) bool {
+	if _, isVersion := versionOf(path); isVersion {
+		return false
+	}
+	return !strings.HasSuffix(path, metaSuffix) && !strings.HasSuffix(path, tmpSuffix)
+}
+
+// migrate moves the pastes stored in any other layout to where this one
+// stores them, removing the subdirectories left empty. A paste's file is
+// moved after its attributes and versions, so that it is never found
+// without them. Returns how many pastes were moved.
+func (l Layout) migrate() (int, error) {
+	var moves, dirs []string
+	err := walkLayout(func(path string, fi os.FileInfo, err error) error {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if fi.IsDir() {
+			dirs = append(dirs, path)
+			return nil
+		}
+		if !isPasteFile(path) {
+			return nil
+		}
+		if id, err := idFromPath(path); err == nil && path != l.path(id) {
+			moves = append(moves, path)
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	for _, from := range moves {
+		id, _ := idFromPath(from)
+		if err := movePaste(from, l.path(id)); err != nil {
+			return 0, err
+		}
+	}
+	// Children come after their parents
+	for i := len(dirs) - 1; i >= 0; i-- {
+		if !l.uses(dirs[i]) {
+			// Fails if it still holds any files
+			os.Remove(dirs[i])
+		}
+	}
+	return len(moves), nil
+}
+
+func movePaste(from, to string) error {
+	if err := makeParent(to); err != nil {
+		return err
+	}
+	others, err := filepath.Glob(from + versionSuffix + "*")
+	if err != nil {
+		return err
+	}
+	for _, path := range append(others, from+metaSuffix) {
+		err := os.Rename(path, to+strings.TrimPrefix(path, from))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return os.Rename(from, to)
+}
+
+// recoverDir moves the pastes in the current directory to the layout, and
+// then walks all of its files with rec.
+func recoverDir(topdir string, l Layout, rec filepath.WalkFunc) error {
+	moved, err := l.migrate()
+	if err != nil {
+		return fmt.Errorf("cannot move the pastes in %s to %s: %v", topdir, l, err)
+	}
+	if moved > 0 {
+		log.Printf("Moved %d pastes in %s to %s", moved, topdir, l)
+	}
+	if err := walkLayout(rec); err != nil {
+		return fmt.Errorf("cannot recover data directory %s: %v", topdir, err)
+	}
+	return nil
+}
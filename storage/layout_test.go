@@ -0,0 +1,111 @@
+package storage
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLayoutPath(t *testing.T) {
+	id, err := IDFromString("a63d03b9")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		layout Layout
+		want   string
+	}{
+		{DefaultLayout, "a6/3d03b9"},
+		{Layout{Depth: 2, Width: 2}, "a6/3d/03b9"},
+		{Layout{Depth: 3, Width: 1}, "a/6/3/d03b9"},
+		{Layout{Depth: 1, Width: 7}, "a63d03b/9"},
+	}
+	for _, tc := range tests {
+		if err := tc.layout.Check(); err != nil {
+			t.Errorf("Check() of %s errored unexpectedly: %v", tc.layout, err)
+		}
+		want := filepath.FromSlash(tc.want)
+		got := tc.layout.path(id)
+		if got != want {
+			t.Errorf("path() in %s got %q, want %q", tc.layout, got, want)
+		}
+		if back, err := idFromPath(got); err != nil || back != id {
+			t.Errorf("idFromPath(%q) got %s, %v", got, back, err)
+		}
+	}
+	for _, l := range []Layout{{0, 2}, {1, 0}, {2, 4}, {4, 2}} {
+		if err := l.Check(); err == nil {
+			t.Errorf("Check() of %s did not error", l)
+		}
+	}
+}
+
+func TestLayoutMigrate(t *testing.T) {
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// File stores work from within their directory
+	defer os.Chdir(wd)
+	dir, err := ioutil.TempDir("", "pastecat-layout")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	s, err := NewFileStore(&Stats{}, nil, 0, dir, DefaultLayout)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, err := s.Put([]byte("foo"), Meta{Title: "title"})
+	if err != nil {
+		t.Fatalf("Put() errored unexpectedly: %v", err)
+	}
+	if err := s.Update(id, []byte("bar"), Meta{Title: "title"}); err != nil {
+		t.Fatalf("Update() errored unexpectedly: %v", err)
+	}
+
+	for _, l := range []Layout{{Depth: 2, Width: 2}, {Depth: 1, Width: 3}} {
+		stats := &Stats{}
+		s, err := NewFileStore(stats, nil, 0, dir, l)
+		if err != nil {
+			t.Fatalf("Moving to %s errored: %v", l, err)
+		}
+		if _, err := os.Stat(filepath.Join(dir, l.path(id))); err != nil {
+			t.Fatalf("Paste not moved to %s: %v", l, err)
+		}
+		if number, _ := stats.Report(); number != 1 {
+			t.Fatalf("Got %d pastes after moving to %s, want 1", number, l)
+		}
+		for version, want := range []string{"bar", "foo"} {
+			var p Paste
+			if version == 0 {
+				p, err = s.Get(id)
+			} else {
+				p, err = s.GetVersion(id, version)
+			}
+			if err != nil {
+				t.Fatalf("Could not get version %d in %s: %v", version, l, err)
+			}
+			got, _ := ioutil.ReadAll(p)
+			p.Close()
+			if string(got) != want {
+				t.Errorf("Got %q for version %d in %s, want %q", got, version, l, want)
+			}
+			if title := p.Meta().Title; title != "title" {
+				t.Errorf("Got title %q in %s, want %q", title, l, "title")
+			}
+		}
+		// Only the subdirectories of the layout are left
+		err = filepath.Walk(dir, func(path string, fi os.FileInfo, err error) error {
+			rel, _ := filepath.Rel(dir, path)
+			if err == nil && fi.IsDir() && rel != "." && !l.uses(rel) {
+				t.Errorf("Directory %s left behind after moving to %s", rel, l)
+			}
+			return err
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
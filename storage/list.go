@@ -0,0 +1,141 @@
+// Copyright (c) 2014-2015, Daniel Martí <mvdan@mvdan.cc>
+// See LICENSE for licensing information
+
+package storage
+
+import (
+	"fmt"
+	"sort"
+	"time"
+)
+
+// Keys by which a listing of pastes can be sorted
+const (
+	SortAge   = "age"
+	SortSize  = "size"
+	SortViews = "views"
+)
+
+// ListOptions selects which pastes are listed and in what order
+type ListOptions struct {
+	// Number of pastes to skip and maximum number of pastes to return,
+	// with zero meaning no limit
+	Offset, Limit int
+	// Key to sort by, youngest, smallest or least viewed first. Defaults
+	// to SortAge.
+	SortBy string
+	// Reverse the sorting order
+	Reverse bool
+
+	// Only list pastes of at least this size
+	MinSize int64
+	// Only list pastes created after or before these times, if not zero
+	CreatedAfter, CreatedBefore time.Time
+	// Only list pastes uploaded with the token of this name, if not empty
+	Token string
+	// Only list pastes owned by this user, if not empty
+	Owner string
+	// Only list pastes uploaded from the address with this hash, if not
+	// empty
+	IPHash string
+	// Only list pastes whose uploader asked for them to be listed
+	Listed bool
+}
+
+// Entry is a paste as returned by List
+type Entry struct {
+	ID ID
+	Info
+}
+
+func (o *ListOptions) match(info Info) bool {
+	if info.Size < o.MinSize {
+		return false
+	}
+	if !o.CreatedAfter.IsZero() && !info.Created(info.ModTime).After(o.CreatedAfter) {
+		return false
+	}
+	if !o.CreatedBefore.IsZero() && !info.Created(info.ModTime).Before(o.CreatedBefore) {
+		return false
+	}
+	if o.Token != "" && info.Token != o.Token {
+		return false
+	}
+	if o.Owner != "" && info.Owner != o.Owner {
+		return false
+	}
+	if o.IPHash != "" && info.IPHash != o.IPHash {
+		return false
+	}
+	if o.Listed && !info.Listed {
+		return false
+	}
+	return true
+}
+
+func entryLess(sortBy string) (func(a, b *Entry) bool, error) {
+	switch sortBy {
+	case "", SortAge:
+		return func(a, b *Entry) bool {
+			return a.Created(a.ModTime).After(b.Created(b.ModTime))
+		}, nil
+	case SortSize:
+		return func(a, b *Entry) bool { return a.Size < b.Size }, nil
+	case SortViews:
+		return func(a, b *Entry) bool { return a.Views < b.Views }, nil
+	}
+	return nil, fmt.Errorf("unknown sorting key '%s'", sortBy)
+}
+
+type entrySorter struct {
+	entries []Entry
+	less    func(a, b *Entry) bool
+	reverse bool
+}
+
+func (s entrySorter) Len() int      { return len(s.entries) }
+func (s entrySorter) Swap(i, j int) { s.entries[i], s.entries[j] = s.entries[j], s.entries[i] }
+
+func (s entrySorter) Less(i, j int) bool {
+	a, b := &s.entries[i], &s.entries[j]
+	if s.reverse {
+		a, b = b, a
+	}
+	if s.less(a, b) {
+		return true
+	}
+	if s.less(b, a) {
+		return false
+	}
+	// Keep the order stable between pages
+	return a.ID.String() < b.ID.String()
+}
+
+// List returns the page of pastes in the store matching the options, along
+// with the total number of matching pastes, and an error, if any.
+func List(s Store, opts ListOptions) ([]Entry, int, error) {
+	less, err := entryLess(opts.SortBy)
+	if err != nil {
+		return nil, 0, err
+	}
+	var entries []Entry
+	err = s.Iterate(func(id ID, info Info) bool {
+		if opts.match(info) {
+			entries = append(entries, Entry{ID: id, Info: info})
+		}
+		return true
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+	sort.Sort(entrySorter{entries: entries, less: less, reverse: opts.Reverse})
+	total := len(entries)
+	if opts.Offset >= total {
+		return nil, total, nil
+	}
+	entries = entries[opts.Offset:]
+	if opts.Limit > 0 && opts.Limit < len(entries) {
+		entries = entries[:opts.Limit]
+	}
+	return entries, total, nil
+}
@@ -0,0 +1,97 @@
+package storage
+
+import (
+	"testing"
+	"time"
+)
+
+func TestList(t *testing.T) {
+	s, _ := NewMemStore()
+	var ids []ID
+	for _, c := range []struct {
+		content string
+		token   string
+		owner   string
+		ipHash  string
+		listed  bool
+		views   int
+	}{
+		{"a", "", "alice", "", true, 2},
+		{"bbb", "ci", "", "a1b2", false, 0},
+		{"cc", "ci", "alice", "a1b2", true, 1},
+	} {
+		id, err := s.Put([]byte(c.content), Meta{Token: c.token, Owner: c.owner, IPHash: c.ipHash, Listed: c.listed})
+		if err != nil {
+			t.Fatalf("Put() errored unexpectedly: %v", err)
+		}
+		for i := 0; i < c.views; i++ {
+			s.Get(id)
+		}
+		// Distinct creation times
+		s.cache[id].modTime = time.Unix(int64(len(ids)), 0)
+		ids = append(ids, id)
+	}
+	for _, c := range []struct {
+		opts      ListOptions
+		want      []ID
+		wantTotal int
+		wantErr   bool
+	}{
+		{ListOptions{}, []ID{ids[2], ids[1], ids[0]}, 3, false},
+		{ListOptions{Reverse: true}, []ID{ids[0], ids[1], ids[2]}, 3, false},
+		{ListOptions{SortBy: SortSize}, []ID{ids[0], ids[2], ids[1]}, 3, false},
+		{ListOptions{SortBy: SortViews, Reverse: true}, []ID{ids[0], ids[2], ids[1]}, 3, false},
+		{ListOptions{Offset: 1, Limit: 1}, []ID{ids[1]}, 3, false},
+		{ListOptions{Offset: 5}, nil, 3, false},
+		{ListOptions{MinSize: 2}, []ID{ids[2], ids[1]}, 2, false},
+		{ListOptions{CreatedAfter: time.Unix(0, 0)}, []ID{ids[2], ids[1]}, 2, false},
+		{ListOptions{CreatedBefore: time.Unix(2, 0)}, []ID{ids[1], ids[0]}, 2, false},
+		{ListOptions{CreatedAfter: time.Unix(0, 0), CreatedBefore: time.Unix(2, 0)}, []ID{ids[1]}, 1, false},
+		{ListOptions{Token: "ci", Limit: 1}, []ID{ids[2]}, 2, false},
+		{ListOptions{Owner: "alice"}, []ID{ids[2], ids[0]}, 2, false},
+		{ListOptions{Owner: "alice", Token: "ci"}, []ID{ids[2]}, 1, false},
+		{ListOptions{IPHash: "a1b2", Owner: "alice"}, []ID{ids[2]}, 1, false},
+		{ListOptions{Listed: true}, []ID{ids[2], ids[0]}, 2, false},
+		{ListOptions{Listed: true, Limit: 1}, []ID{ids[2]}, 2, false},
+		{ListOptions{SortBy: "foo"}, nil, 0, true},
+	} {
+		got, total, err := List(s, c.opts)
+		if c.wantErr {
+			if err == nil {
+				t.Errorf(`List(%+v) didn't error as expected`, c.opts)
+			}
+			continue
+		} else if err != nil {
+			t.Errorf(`List(%+v) errored unexpectedly: %v`, c.opts, err)
+			continue
+		}
+		if total != c.wantTotal {
+			t.Errorf(`List(%+v) got total %d, want %d`, c.opts, total, c.wantTotal)
+		}
+		if len(got) != len(c.want) {
+			t.Errorf(`List(%+v) got %d entries, want %d`, c.opts, len(got), len(c.want))
+			continue
+		}
+		for i, e := range got {
+			if e.ID != c.want[i] {
+				t.Errorf(`List(%+v) got %s at %d, want %s`, c.opts, e.ID, i, c.want[i])
+			}
+		}
+	}
+	u, err := NewUsage(s, 0)
+	if err != nil {
+		t.Fatalf(`NewUsage() errored unexpectedly: %v`, err)
+	}
+	for _, c := range []struct {
+		token string
+		want  int64
+	}{
+		{"", 1},
+		{"ci", 5},
+		{"other", 0},
+	} {
+		if got := u.used[c.token]; got != c.want {
+			t.Errorf(`NewUsage() counted %d for %q, want %d`, got, c.token, c.want)
+		}
+	}
+}
@@ -0,0 +1,103 @@
+// Copyright (c) 2014-2015, Daniel Martí <mvdan@mvdan.cc>
+// See LICENSE for licensing information
+
+package storage
+
+import (
+	"crypto/rand"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"time"
+)
+
+const (
+	// How long to wait before trying to take a lock file again
+	linkLockRetry = 20 * time.Millisecond
+	// How often the holder of a lock file touches it, so that it isn't
+	// taken for one left behind
+	linkLockRefresh = 10 * time.Second
+	// How long a lock file is kept after it was last touched
+	linkLockStale = time.Minute
+)
+
+// linkLock is a lock file created by hard-linking a unique file to it,
+// which is atomic even on network filesystems where advisory locks and
+// O_EXCL may not be reliable
+type linkLock struct {
+	path string
+	// token is written to the lock file to tell which process holds it
+	token string
+	done  chan struct{}
+}
+
+func newLinkLock(path string) (*linkLock, error) {
+	host, err := os.Hostname()
+	if err != nil {
+		return nil, err
+	}
+	var b [8]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return nil, err
+	}
+	return &linkLock{
+		path:  path,
+		token: fmt.Sprintf("%s.%d.%x", host, os.Getpid(), b),
+	}, nil
+}
+
+func (l *linkLock) lock() error {
+	tmpPath := l.path + "." + l.token + tmpSuffix
+	os.Remove(tmpPath)
+	if err := createFile(tmpPath, []byte(l.token), false); err != nil {
+		return err
+	}
+	defer os.Remove(tmpPath)
+	for {
+		err := os.Link(tmpPath, l.path)
+		// The link may have been made even if the server's reply was
+		// lost
+		if err == nil || l.held() {
+			break
+		}
+		if !os.IsExist(err) {
+			return err
+		}
+		if fi, err := os.Stat(l.path); err == nil && time.Since(fi.ModTime()) > linkLockStale {
+			// Left behind by a process that stopped
+			os.Remove(l.path)
+			continue
+		}
+		time.Sleep(linkLockRetry)
+	}
+	l.done = make(chan struct{})
+	go l.refresh(l.done)
+	return nil
+}
+
+// refresh touches the lock file until it is unlocked.
+func (l *linkLock) refresh(done chan struct{}) {
+	ticker := time.NewTicker(linkLockRefresh)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case now := <-ticker.C:
+			os.Chtimes(l.path, now, now)
+		}
+	}
+}
+
+// held reports whether the lock file was created by this process.
+func (l *linkLock) held() bool {
+	data, err := ioutil.ReadFile(l.path)
+	return err == nil && string(data) == l.token
+}
+
+func (l *linkLock) unlock() {
+	close(l.done)
+	if l.held() {
+		os.Remove(l.path)
+	}
+}
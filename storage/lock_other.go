@@ -0,0 +1,20 @@
+// Copyright (c) 2014-2015, Daniel Martí <mvdan@mvdan.cc>
+// See LICENSE for licensing information
+
+//go:build !darwin && !dragonfly && !freebsd && !linux && !netbsd && !openbsd
+// +build !darwin,!dragonfly,!freebsd,!linux,!netbsd,!openbsd
+
+package storage
+
+// dirLock does nothing where advisory locks are not supported, so the
+// directory must not be shared by multiple processes
+type dirLock struct{}
+
+func openDirLock(path string) (*dirLock, error) { return &dirLock{}, nil }
+
+func (l *dirLock) lock() error { return nil }
+
+func (l *dirLock) unlock() {}
+
+// holdDir does nothing where advisory locks are not supported
+func holdDir(path string, exclusive bool) error { return nil }
@@ -0,0 +1,70 @@
+// Copyright (c) 2014-2015, Daniel Martí <mvdan@mvdan.cc>
+// See LICENSE for licensing information
+
+//go:build darwin || dragonfly || freebsd || linux || netbsd || openbsd
+// +build darwin dragonfly freebsd linux netbsd openbsd
+
+package storage
+
+import (
+	"os"
+	"syscall"
+)
+
+// dirLock is an advisory lock on a directory, held while changing the
+// pastes in it so that processes sharing the directory don't race
+type dirLock struct {
+	f *os.File
+}
+
+func openDirLock(path string) (*dirLock, error) {
+	f, err := os.OpenFile(path, os.O_RDONLY|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return &dirLock{f: f}, nil
+}
+
+func (l *dirLock) lock() error {
+	for {
+		err := syscall.Flock(int(l.f.Fd()), syscall.LOCK_EX)
+		if err != syscall.EINTR {
+			return err
+		}
+	}
+}
+
+func (l *dirLock) unlock() {
+	syscall.Flock(int(l.f.Fd()), syscall.LOCK_UN)
+}
+
+// holdDir locks a directory for as long as the process runs, along with
+// the other processes sharing it unless exclusive.
+func holdDir(path string, exclusive bool) error {
+	f, err := os.OpenFile(path, os.O_RDONLY|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	how := syscall.LOCK_SH
+	if exclusive {
+		how = syscall.LOCK_EX
+	}
+	for {
+		err = syscall.Flock(int(f.Fd()), how|syscall.LOCK_NB)
+		if err != syscall.EINTR {
+			break
+		}
+	}
+	if err == nil {
+		// The lock goes away when the file is closed
+		return nil
+	}
+	f.Close()
+	if err != syscall.EWOULDBLOCK {
+		return err
+	}
+	if exclusive {
+		return ErrDirInUse
+	}
+	return ErrDirHeld
+}
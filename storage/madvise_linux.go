@@ -0,0 +1,34 @@
+// Copyright (c) 2014-2015, Daniel Martí <mvdan@mvdan.cc>
+// See LICENSE for licensing information
+
+package storage
+
+import "syscall"
+
+// adviseRandom stops the kernel from reading ahead of the pages of a mapping
+// that are touched, as most reads only need its first pages or a range.
+func adviseRandom(b []byte) error {
+	if len(b) == 0 {
+		return nil
+	}
+	return syscall.Madvise(b, syscall.MADV_RANDOM)
+}
+
+// adviseCold releases the pages of a mapping from memory. They are read back
+// from the file when touched again.
+func adviseCold(b []byte) error {
+	if len(b) == 0 {
+		return nil
+	}
+	return syscall.Madvise(b, syscall.MADV_DONTNEED)
+}
+
+// adviseHuge asks for a mapping to be backed by transparent huge pages, to
+// take fewer TLB entries. File mappings only get them if the kernel supports
+// huge pages in the page cache.
+func adviseHuge(b []byte) error {
+	if len(b) == 0 {
+		return nil
+	}
+	return syscall.Madvise(b, syscall.MADV_HUGEPAGE)
+}
@@ -0,0 +1,17 @@
+// Copyright (c) 2014-2015, Daniel Martí <mvdan@mvdan.cc>
+// See LICENSE for licensing information
+
+//go:build !linux
+// +build !linux
+
+package storage
+
+// adviseRandom does nothing where madvise is not available
+func adviseRandom(b []byte) error { return nil }
+
+// adviseCold does nothing where madvise is not available, so the kernel alone
+// decides when to release the pages of a mapping
+func adviseCold(b []byte) error { return nil }
+
+// adviseHuge does nothing where madvise is not available
+func adviseHuge(b []byte) error { return nil }
@@ -0,0 +1,233 @@
+// Copyright (c) 2014-2015, Daniel Martí <mvdan@mvdan.cc>
+// See LICENSE for licensing information
+
+package storage
+
+import (
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const (
+	// How long to wait before retrying a change that could not be
+	// mirrored, doubling after each failure up to the maximum
+	mirrorRetryTimeout    = 1 * time.Second
+	mirrorMaxRetryTimeout = 1 * time.Minute
+)
+
+// A Replica receives copies of the changes made to a store, keeping the
+// pastes' ids. Stores are replicas too.
+type Replica interface {
+	// Copy a paste, like Store's Copy.
+	Copy(id ID, content []byte, meta Meta, modTime time.Time, versions [][]byte) error
+
+	// Update replaces the content and attributes of a paste, like
+	// Store's Update.
+	Update(id ID, content []byte, meta Meta) error
+
+	// Delete a paste and its previous versions.
+	Delete(id ID) error
+}
+
+type mirrorChange struct {
+	id       ID
+	content  []byte
+	meta     Meta
+	modTime  time.Time
+	versions [][]byte
+	// update or deletion, a new paste otherwise
+	update, delete bool
+}
+
+// MirrorStore is a Store that writes to a primary store and copies each
+// change to a replica in the background. Changes that fail are retried
+// until they succeed, keeping their order.
+type MirrorStore struct {
+	Store
+	replica Replica
+
+	mu      sync.Mutex
+	changed *sync.Cond
+	queue   []mirrorChange
+}
+
+// NewMirrorStore returns a MirrorStore copying changes to replica. Its
+// primary store must be set via its Store field before it is used.
+func NewMirrorStore(replica Replica) *MirrorStore {
+	s := &MirrorStore{replica: replica}
+	s.changed = sync.NewCond(&s.mu)
+	go s.mirror()
+	return s
+}
+
+func (s *MirrorStore) Stat(id ID) (Info, error) {
+	return Stat(s.Store, id)
+}
+
+func (s *MirrorStore) Put(content []byte, meta Meta) (ID, error) {
+	id, err := s.Store.Put(content, meta)
+	if err == nil {
+		s.push(mirrorChange{id: id, content: content, meta: meta, modTime: clock.Now()})
+	}
+	return id, err
+}
+
+func (s *MirrorStore) Update(id ID, content []byte, meta Meta) error {
+	err := s.Store.Update(id, content, meta)
+	if err == nil {
+		s.push(mirrorChange{id: id, content: content, meta: meta, modTime: clock.Now(), update: true})
+	}
+	return err
+}
+
+func (s *MirrorStore) Copy(id ID, content []byte, meta Meta, modTime time.Time, versions [][]byte) error {
+	err := s.Store.Copy(id, content, meta, modTime, versions)
+	if err == nil {
+		s.push(mirrorChange{id: id, content: content, meta: meta, modTime: modTime, versions: versions})
+	}
+	return err
+}
+
+func (s *MirrorStore) Delete(id ID) error {
+	err := s.Store.Delete(id)
+	if err == nil {
+		s.Forget(id)
+	}
+	return err
+}
+
+func (s *MirrorStore) DeleteBatch(ids []ID) error {
+	err := DeleteBatch(s.Store, ids)
+	if err == nil {
+		for _, id := range ids {
+			s.Forget(id)
+		}
+	}
+	return err
+}
+
+// Forget mirrors the deletion of a paste made directly on the primary
+// store, like when it expires.
+func (s *MirrorStore) Forget(id ID) {
+	s.push(mirrorChange{id: id, delete: true})
+}
+
+// Pending returns how many changes are yet to be mirrored.
+func (s *MirrorStore) Pending() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.queue)
+}
+
+func (s *MirrorStore) push(c mirrorChange) {
+	s.mu.Lock()
+	s.queue = append(s.queue, c)
+	s.mu.Unlock()
+	s.changed.Signal()
+}
+
+func (s *MirrorStore) mirror() {
+	retry := mirrorRetryTimeout
+	for {
+		s.mu.Lock()
+		for len(s.queue) == 0 {
+			s.changed.Wait()
+		}
+		c := s.queue[0]
+		s.mu.Unlock()
+		if err := s.apply(c); err != nil {
+			log.Printf("Could not mirror %s, trying again in %s: %v", c.id, retry, err)
+			time.Sleep(retry)
+			if retry *= 2; retry > mirrorMaxRetryTimeout {
+				retry = mirrorMaxRetryTimeout
+			}
+			continue
+		}
+		retry = mirrorRetryTimeout
+		s.mu.Lock()
+		s.queue[0] = mirrorChange{}
+		s.queue = s.queue[1:]
+		s.mu.Unlock()
+	}
+}
+
+func (s *MirrorStore) apply(c mirrorChange) error {
+	switch {
+	case c.delete:
+		if err := s.replica.Delete(c.id); err != nil && err != ErrPasteNotFound {
+			return err
+		}
+		return nil
+	case c.update:
+		err := s.replica.Update(c.id, c.content, c.meta)
+		if err != ErrPasteNotFound {
+			return err
+		}
+		// Missed by the replica, so keep at least its current content
+	}
+	return s.replica.Copy(c.id, c.content, c.meta, c.modTime, c.versions)
+}
+
+// DirReplica keeps copies of pastes in a directory, laid out like a
+// FileStore's so that it can be used as one if the primary store is lost.
+// It is not safe for concurrent use.
+type DirReplica struct {
+	dir    string
+	layout Layout
+}
+
+func NewDirReplica(dir string, layout Layout) (*DirReplica, error) {
+	if err := layout.Check(); err != nil {
+		return nil, err
+	}
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	return &DirReplica{dir: dir, layout: layout}, nil
+}
+
+func (r *DirReplica) path(id ID) string {
+	return filepath.Join(r.dir, r.layout.path(id))
+}
+
+func (r *DirReplica) Copy(id ID, content []byte, meta Meta, modTime time.Time, versions [][]byte) error {
+	pastePath := r.path(id)
+	if err := removePaste(pastePath); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err := makeParent(pastePath); err != nil {
+		return err
+	}
+	return writeCopy(pastePath, content, meta, modTime, versions)
+}
+
+func (r *DirReplica) Update(id ID, content []byte, meta Meta) error {
+	pastePath := r.path(id)
+	info, err := os.Stat(pastePath)
+	if os.IsNotExist(err) {
+		return ErrPasteNotFound
+	} else if err != nil {
+		return err
+	}
+	old, err := readMeta(pastePath)
+	if err != nil {
+		return err
+	}
+	_, err = keepVersion(pastePath, content, meta, old, info.ModTime(), info.Size())
+	return err
+}
+
+func (r *DirReplica) Delete(id ID) error {
+	err := removePaste(r.path(id))
+	if os.IsNotExist(err) {
+		return ErrPasteNotFound
+	}
+	return err
+}
@@ -0,0 +1,64 @@
+package storage
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestMirrorStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pastecat-mirror")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	replica, err := NewDirReplica(dir, DefaultLayout)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := NewMirrorStore(replica)
+	s.Store, _ = NewMemStore()
+	wait := func() {
+		for i := 0; s.Pending() > 0; i++ {
+			if i == 100 {
+				t.Fatalf("Changes were not mirrored in time")
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	mustRead := func(id ID, suffix, want string) {
+		got, err := ioutil.ReadFile(filepath.Join(dir, DefaultLayout.path(id)) + suffix)
+		if err != nil {
+			t.Errorf("Mirror of %s%s could not be read: %v", id, suffix, err)
+		} else if string(got) != want {
+			t.Errorf("Mirror of %s%s got %q, want %q", id, suffix, got, want)
+		}
+	}
+	kept, err := s.Put([]byte("foo"), Meta{})
+	if err != nil {
+		t.Fatalf("Put() errored unexpectedly: %v", err)
+	}
+	deleted, err := s.Put([]byte("bar"), Meta{})
+	if err != nil {
+		t.Fatalf("Put() errored unexpectedly: %v", err)
+	}
+	if err := s.Update(kept, []byte("foo2"), Meta{}); err != nil {
+		t.Fatalf("Update() errored unexpectedly: %v", err)
+	}
+	if err := s.Delete(deleted); err != nil {
+		t.Fatalf("Delete() errored unexpectedly: %v", err)
+	}
+	wait()
+	mustRead(kept, "", "foo2")
+	mustRead(kept, versionSuffix+"1", "foo")
+	if _, err := os.Stat(filepath.Join(dir, DefaultLayout.path(deleted))); !os.IsNotExist(err) {
+		t.Errorf("Mirror of deleted paste %s was kept", deleted)
+	}
+	s.Forget(kept)
+	wait()
+	if _, err := os.Stat(filepath.Join(dir, DefaultLayout.path(kept))); !os.IsNotExist(err) {
+		t.Errorf("Mirror of forgotten paste %s was kept", kept)
+	}
+}
@@ -0,0 +1,153 @@
+// Copyright (c) 2014-2015, Daniel Martí <mvdan@mvdan.cc>
+// See LICENSE for licensing information
+
+package storage
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Config is what a backend sets up a store with
+type Config struct {
+	Stats    *Stats
+	OnExpire ExpireFunc
+	LifeTime time.Duration
+	Layout   Layout
+	// Params holds the backend's own parameters, with their defaults
+	// filled in for those that were not given.
+	Params map[string]string
+}
+
+// A Factory sets up a new store.
+type Factory func(c Config) (Store, error)
+
+type backend struct {
+	defaults map[string]string
+	factory  Factory
+}
+
+var (
+	backendsMu sync.Mutex
+	backends   = make(map[string]backend)
+)
+
+// Register makes a storage backend available under a name, along with the
+// parameters it takes and their default values. Meant to be called from the
+// init function of the package implementing the backend, like
+// database/sql drivers. Panics if the name is already taken.
+func Register(name string, defaults map[string]string, factory Factory) {
+	backendsMu.Lock()
+	defer backendsMu.Unlock()
+	if factory == nil {
+		panic("storage: Register factory is nil")
+	}
+	if _, dup := backends[name]; dup {
+		panic("storage: Register called twice for backend " + name)
+	}
+	backends[name] = backend{defaults: defaults, factory: factory}
+}
+
+// Backends returns the sorted names of the registered backends.
+func Backends() []string {
+	backendsMu.Lock()
+	defer backendsMu.Unlock()
+	names := make([]string, 0, len(backends))
+	for name := range backends {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Params returns the parameters a backend takes, with their default values.
+func Params(name string) (map[string]string, error) {
+	b, err := lookup(name)
+	if err != nil {
+		return nil, err
+	}
+	params := make(map[string]string, len(b.defaults))
+	for k, v := range b.defaults {
+		params[k] = v
+	}
+	return params, nil
+}
+
+func lookup(name string) (backend, error) {
+	backendsMu.Lock()
+	defer backendsMu.Unlock()
+	b, e := backends[name]
+	if !e {
+		return backend{}, fmt.Errorf("unknown storage type '%s'", name)
+	}
+	return b, nil
+}
+
+// ParseSpec splits a backend description like "fs:dir=pastes,foo=bar" into
+// the backend's name and its parameters. Values cannot hold commas.
+func ParseSpec(spec string) (string, map[string]string, error) {
+	params := make(map[string]string)
+	name, rest := spec, ""
+	if i := strings.IndexByte(spec, ':'); i >= 0 {
+		name, rest = spec[:i], spec[i+1:]
+	}
+	if name == "" {
+		return "", nil, fmt.Errorf("no storage type in '%s'", spec)
+	}
+	if rest == "" {
+		return name, params, nil
+	}
+	for _, kv := range strings.Split(rest, ",") {
+		i := strings.IndexByte(kv, '=')
+		if i <= 0 {
+			return "", nil, fmt.Errorf("parameter '%s' of %s is not key=value", kv, name)
+		}
+		k := kv[:i]
+		if _, dup := params[k]; dup {
+			return "", nil, fmt.Errorf("parameter '%s' of %s given twice", k, name)
+		}
+		params[k] = kv[i+1:]
+	}
+	return name, params, nil
+}
+
+// FormatSpec is the inverse of ParseSpec, with the parameters sorted by
+// name.
+func FormatSpec(name string, params map[string]string) string {
+	keys := make([]string, 0, len(params))
+	for k := range params {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	kvs := make([]string, len(keys))
+	for i, k := range keys {
+		kvs[i] = k + "=" + params[k]
+	}
+	if len(kvs) == 0 {
+		return name
+	}
+	return name + ":" + strings.Join(kvs, ",")
+}
+
+// Open sets up a store with a registered backend, checking that it takes
+// all of the parameters given and filling in the defaults of the rest.
+func Open(name string, params map[string]string, c Config) (Store, error) {
+	b, err := lookup(name)
+	if err != nil {
+		return nil, err
+	}
+	c.Params = make(map[string]string, len(b.defaults))
+	for k, v := range b.defaults {
+		c.Params[k] = v
+	}
+	for k, v := range params {
+		if _, e := b.defaults[k]; !e {
+			return nil, fmt.Errorf("unknown parameter '%s' for %s", k, name)
+		}
+		c.Params[k] = v
+	}
+	return b.factory(c)
+}
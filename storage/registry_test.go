@@ -0,0 +1,84 @@
+package storage
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseSpec(t *testing.T) {
+	tests := []struct {
+		spec       string
+		wantName   string
+		wantParams map[string]string
+		wantErr    bool
+	}{
+		{"fs", "fs", map[string]string{}, false},
+		{"fs:", "fs", map[string]string{}, false},
+		{"fs:dir=pastes", "fs", map[string]string{"dir": "pastes"}, false},
+		{"fs:dir=/a=b", "fs", map[string]string{"dir": "/a=b"}, false},
+		{"s3:bucket=b,region=", "s3", map[string]string{"bucket": "b", "region": ""}, false},
+		{"", "", nil, true},
+		{":dir=pastes", "", nil, true},
+		{"fs:pastes", "", nil, true},
+		{"fs:=pastes", "", nil, true},
+		{"fs:dir=a,dir=b", "", nil, true},
+	}
+	for _, tc := range tests {
+		name, params, err := ParseSpec(tc.spec)
+		if (err != nil) != tc.wantErr {
+			t.Errorf("ParseSpec(%q) got error %v", tc.spec, err)
+			continue
+		}
+		if name != tc.wantName || !reflect.DeepEqual(params, tc.wantParams) {
+			t.Errorf("ParseSpec(%q) got %q %v, want %q %v",
+				tc.spec, name, params, tc.wantName, tc.wantParams)
+		}
+		if err == nil && tc.spec != "fs:" {
+			if got := FormatSpec(name, params); got != tc.spec {
+				t.Errorf("FormatSpec(%q, %v) got %q", name, params, got)
+			}
+		}
+	}
+}
+
+func TestRegistry(t *testing.T) {
+	var got Config
+	Register("test", map[string]string{"a": "1", "b": "2"}, func(c Config) (Store, error) {
+		got = c
+		return NewMemStore()
+	})
+	defer func() {
+		backendsMu.Lock()
+		delete(backends, "test")
+		backendsMu.Unlock()
+	}()
+	found := false
+	for _, name := range Backends() {
+		found = found || name == "test"
+	}
+	if !found {
+		t.Fatalf("Backends() does not list test: %v", Backends())
+	}
+	stats := &Stats{}
+	if _, err := Open("test", map[string]string{"b": "3"}, Config{Stats: stats}); err != nil {
+		t.Fatal(err)
+	}
+	if want := map[string]string{"a": "1", "b": "3"}; !reflect.DeepEqual(got.Params, want) {
+		t.Errorf("Open() got params %v, want %v", got.Params, want)
+	}
+	if got.Stats != stats {
+		t.Errorf("Open() did not pass the config along")
+	}
+	if _, err := Open("test", map[string]string{"c": "4"}, Config{}); err == nil {
+		t.Errorf("Open() with an unknown parameter did not fail")
+	}
+	if _, err := Open("missing", nil, Config{}); err == nil {
+		t.Errorf("Open() with an unknown backend did not fail")
+	}
+	defer func() {
+		if recover() == nil {
+			t.Errorf("Register() twice did not panic")
+		}
+	}()
+	Register("test", nil, func(c Config) (Store, error) { return nil, nil })
+}
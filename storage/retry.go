@@ -0,0 +1,139 @@
+// Copyright (c) 2014-2015, Daniel Martí <mvdan@mvdan.cc>
+// See LICENSE for licensing information
+
+package storage
+
+import (
+	"math/rand"
+	"net"
+	"os"
+	"syscall"
+	"time"
+)
+
+// RetryPolicy is how a RetryStore retries the operations failing with
+// transient errors
+type RetryPolicy struct {
+	// Attempts is how many times each operation is tried at most
+	Attempts int
+	// Backoff is how long to wait before the first retry, doubling after
+	// each one up to MaxBackoff. Up to half as much again is added at
+	// random, so that clients don't retry in lockstep.
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+}
+
+// IsTransient reports whether an error may go away if the operation is
+// tried again, like an interrupted system call or a network timeout.
+func IsTransient(err error) bool {
+	if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		return true
+	}
+	switch pe := err.(type) {
+	case *os.PathError:
+		err = pe.Err
+	case *os.LinkError:
+		err = pe.Err
+	case *os.SyscallError:
+		err = pe.Err
+	}
+	switch err {
+	case syscall.EINTR, syscall.EAGAIN, syscall.EBUSY, syscall.ETIMEDOUT,
+		syscall.ECONNRESET, syscall.ECONNREFUSED:
+		return true
+	}
+	return false
+}
+
+// RetryStore is a Store that tries its operations on another store again
+// when they fail with transient errors, waiting longer after each try. The
+// other store must not change anything when an operation fails, so that
+// trying it again is safe.
+type RetryStore struct {
+	Store
+	policy RetryPolicy
+	// OnRetry, if set, is called before each retry with the operation's
+	// name and the error it failed with.
+	OnRetry func(op string, err error)
+}
+
+func NewRetryStore(s Store, policy RetryPolicy) *RetryStore {
+	return &RetryStore{Store: s, policy: policy}
+}
+
+func (s *RetryStore) retry(op string, fn func() error) error {
+	backoff := s.policy.Backoff
+	for try := 1; ; try++ {
+		err := fn()
+		if err == nil || try >= s.policy.Attempts || !IsTransient(err) {
+			return err
+		}
+		if s.OnRetry != nil {
+			s.OnRetry(op, err)
+		}
+		wait := backoff
+		if backoff > 1 {
+			wait += time.Duration(rand.Int63n(int64(backoff / 2)))
+		}
+		time.Sleep(wait)
+		if backoff *= 2; backoff > s.policy.MaxBackoff {
+			backoff = s.policy.MaxBackoff
+		}
+	}
+}
+
+func (s *RetryStore) Get(id ID) (paste Paste, err error) {
+	err = s.retry("get", func() error {
+		paste, err = s.Store.Get(id)
+		return err
+	})
+	return paste, err
+}
+
+func (s *RetryStore) Stat(id ID) (info Info, err error) {
+	err = s.retry("stat", func() error {
+		info, err = Stat(s.Store, id)
+		return err
+	})
+	return info, err
+}
+
+func (s *RetryStore) Put(content []byte, meta Meta) (id ID, err error) {
+	err = s.retry("put", func() error {
+		id, err = s.Store.Put(content, meta)
+		return err
+	})
+	return id, err
+}
+
+func (s *RetryStore) Delete(id ID) error {
+	return s.retry("delete", func() error {
+		return s.Store.Delete(id)
+	})
+}
+
+func (s *RetryStore) DeleteBatch(ids []ID) error {
+	return s.retry("delete_batch", func() error {
+		return DeleteBatch(s.Store, ids)
+	})
+}
+
+func (s *RetryStore) Update(id ID, content []byte, meta Meta) error {
+	return s.retry("update", func() error {
+		return s.Store.Update(id, content, meta)
+	})
+}
+
+func (s *RetryStore) GetVersion(id ID, version int) (paste Paste, err error) {
+	err = s.retry("get_version", func() error {
+		paste, err = s.Store.GetVersion(id, version)
+		return err
+	})
+	return paste, err
+}
+
+func (s *RetryStore) Copy(id ID, content []byte, meta Meta, modTime time.Time, versions [][]byte) error {
+	return s.retry("copy", func() error {
+		return s.Store.Copy(id, content, meta, modTime, versions)
+	})
+}
@@ -0,0 +1,63 @@
+package storage
+
+import (
+	"os"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// flakyStore fails each Put a number of times before storing the paste
+type flakyStore struct {
+	Store
+	failures int
+	err      error
+	tries    int
+}
+
+func (s *flakyStore) Put(content []byte, meta Meta) (ID, error) {
+	if s.tries++; s.tries <= s.failures {
+		return ID{}, s.err
+	}
+	return s.Store.Put(content, meta)
+}
+
+func TestRetryStore(t *testing.T) {
+	policy := RetryPolicy{Attempts: 3, Backoff: time.Millisecond, MaxBackoff: 2 * time.Millisecond}
+	interrupted := &os.PathError{Op: "open", Path: "paste", Err: syscall.EINTR}
+	tests := []struct {
+		failures  int
+		err       error
+		wantTries int
+		wantErr   error
+	}{
+		{0, nil, 1, nil},
+		{2, interrupted, 3, nil},
+		{3, interrupted, 3, interrupted},
+		{1, ErrReachedMaxStorage, 1, ErrReachedMaxStorage},
+	}
+	for _, tc := range tests {
+		mem, err := NewMemStore()
+		if err != nil {
+			t.Fatal(err)
+		}
+		flaky := &flakyStore{Store: mem, failures: tc.failures, err: tc.err}
+		s := NewRetryStore(flaky, policy)
+		retries := 0
+		s.OnRetry = func(op string, err error) {
+			if op != "put" || err != tc.err {
+				t.Errorf("OnRetry() got %s, %v", op, err)
+			}
+			retries++
+		}
+		_, err = s.Put([]byte("foo"), Meta{})
+		if err != tc.wantErr {
+			t.Errorf("Put() failing %d times with %v got %v, want %v",
+				tc.failures, tc.err, err, tc.wantErr)
+		}
+		if flaky.tries != tc.wantTries || retries != tc.wantTries-1 {
+			t.Errorf("Put() failing %d times with %v was tried %d times and retried %d, want %d",
+				tc.failures, tc.err, flaky.tries, retries, tc.wantTries)
+		}
+	}
+}
@@ -6,6 +6,7 @@ package storage
 import (
 	"errors"
 	"sync"
+	"time"
 )
 
 var (
@@ -36,6 +37,34 @@ func (s *Stats) MakeSpaceFor(size int64) error {
 	return nil
 }
 
+// Track counts a paste that is already stored, such as one stored by
+// another process sharing the same directory, without checking the limits.
+func (s *Stats) Track(size int64) {
+	s.Lock()
+	s.number++
+	s.storage += size
+	s.Unlock()
+}
+
+// Grow makes space for a paste to grow by size, such as when it gets a new
+// version.
+func (s *Stats) Grow(size int64) error {
+	s.Lock()
+	defer s.Unlock()
+	if s.MaxStorage > 0 && s.storage+size > s.MaxStorage {
+		return ErrReachedMaxStorage
+	}
+	s.storage += size
+	return nil
+}
+
+// Shrink frees the space that a paste grew by.
+func (s *Stats) Shrink(size int64) {
+	s.Lock()
+	s.storage -= size
+	s.Unlock()
+}
+
 func (s *Stats) FreeSpace(size int64) {
 	s.Lock()
 	s.number--
@@ -50,3 +79,109 @@ func (s *Stats) Report() (int, int64) {
 	s.RUnlock()
 	return number, storage
 }
+
+// usedPaste is a paste counted towards the usage of its token
+type usedPaste struct {
+	token string
+	size  int64
+	// expires is when the paste is deleted, if ever
+	expires time.Time
+}
+
+// Usage counts the size of the pastes uploaded with each token, so that
+// quotas are checked without listing the store. Pastes are forgotten once
+// deleted, or once their lifetime is over, as some stores expire them by
+// themselves.
+type Usage struct {
+	mu       sync.Mutex
+	lifeTime time.Duration
+	used     map[string]int64
+	pastes   map[string]map[ID]usedPaste
+	tokens   map[ID]string
+}
+
+// NewUsage counts the pastes in the store, which expire after lifeTime if
+// they have no shorter one.
+func NewUsage(s Store, lifeTime time.Duration) (*Usage, error) {
+	u := &Usage{
+		lifeTime: lifeTime,
+		used:     make(map[string]int64),
+		pastes:   make(map[string]map[ID]usedPaste),
+		tokens:   make(map[ID]string),
+	}
+	err := s.Iterate(func(id ID, info Info) bool {
+		u.Track(id, info.Meta, info.ModTime, info.Size)
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	return u, nil
+}
+
+// Track counts a paste that was stored or changed, replacing what was
+// counted for it before.
+func (u *Usage) Track(id ID, meta Meta, modTime time.Time, size int64) {
+	if u == nil {
+		return
+	}
+	p := usedPaste{token: meta.Token, size: size}
+	if lt := meta.EffectiveLifeTime(u.lifeTime); lt > 0 {
+		p.expires = meta.Created(modTime).Add(lt)
+	}
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.forget(id)
+	if u.pastes[p.token] == nil {
+		u.pastes[p.token] = make(map[ID]usedPaste)
+	}
+	u.pastes[p.token][id] = p
+	u.tokens[id] = p.token
+	u.used[p.token] += size
+}
+
+// Forget stops counting a paste that was deleted.
+func (u *Usage) Forget(id ID) {
+	if u == nil {
+		return
+	}
+	u.mu.Lock()
+	u.forget(id)
+	u.mu.Unlock()
+}
+
+func (u *Usage) forget(id ID) {
+	token, ok := u.tokens[id]
+	if !ok {
+		return
+	}
+	u.used[token] -= u.pastes[token][id].size
+	delete(u.pastes[token], id)
+	delete(u.tokens, id)
+}
+
+// Reserve counts size more bytes towards the usage of a token, unless that
+// would take it over quota. Once the paste is stored and tracked, or it
+// failed to be, the size must be released.
+func (u *Usage) Reserve(token string, size, quota int64) bool {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	now := clock.Now()
+	for id, p := range u.pastes[token] {
+		if !p.expires.IsZero() && !p.expires.After(now) {
+			u.forget(id)
+		}
+	}
+	if u.used[token]+size > quota {
+		return false
+	}
+	u.used[token] += size
+	return true
+}
+
+// Release stops counting the size reserved for a paste.
+func (u *Usage) Release(token string, size int64) {
+	u.mu.Lock()
+	u.used[token] -= size
+	u.mu.Unlock()
+}
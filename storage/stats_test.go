@@ -2,6 +2,7 @@ package storage
 
 import (
 	"testing"
+	"time"
 )
 
 func TestMakeSpaceFor(t *testing.T) {
@@ -55,4 +56,53 @@ func TestSpaceChanges(t *testing.T) {
 	stats.FreeSpace(1)
 	mustSucceed(stats.MakeSpaceFor(15))
 	mustError(stats.MakeSpaceFor(15))
+	mustError(stats.Grow(6))
+	mustSucceed(stats.Grow(3))
+	mustError(stats.MakeSpaceFor(3))
+	stats.Shrink(3)
+	mustSucceed(stats.MakeSpaceFor(3))
+	stats.Track(10)
+	mustError(stats.Grow(1))
+	stats.FreeSpace(10)
+	mustSucceed(stats.Grow(1))
+}
+
+func TestUsage(t *testing.T) {
+	u := &Usage{
+		used:   make(map[string]int64),
+		pastes: make(map[string]map[ID]usedPaste),
+		tokens: make(map[ID]string),
+	}
+	ids := []ID{{1}, {2}, {3}}
+	now := clock.Now()
+	u.Track(ids[0], Meta{Token: "ci"}, now, 4)
+	if u.Reserve("ci", 7, 10) {
+		t.Errorf("Reserve() went over the quota")
+	}
+	if !u.Reserve("ci", 6, 10) {
+		t.Errorf("Reserve() did not fit in the quota")
+	}
+	// Reserved, but not stored yet
+	if !u.Reserve("other", 10, 10) {
+		t.Errorf("Reserve() did not count by token")
+	}
+	u.Track(ids[1], Meta{Token: "ci"}, now, 6)
+	u.Release("ci", 6)
+	if u.Reserve("ci", 1, 10) {
+		t.Errorf("Reserve() did not count a tracked paste")
+	}
+	u.Forget(ids[1])
+	if !u.Reserve("ci", 1, 10) {
+		t.Errorf("Reserve() counted a forgotten paste")
+	}
+	u.Release("ci", 1)
+	// Edited to be larger
+	u.Track(ids[0], Meta{Token: "ci"}, now, 9)
+	if u.Reserve("ci", 2, 10) {
+		t.Errorf("Reserve() did not count the new size of a paste")
+	}
+	u.Track(ids[2], Meta{Token: "old", LifeTime: time.Hour}, now.Add(-2*time.Hour), 10)
+	if !u.Reserve("old", 10, 10) {
+		t.Errorf("Reserve() counted an expired paste")
+	}
 }
@@ -9,7 +9,7 @@ import (
 	"errors"
 	"fmt"
 	"io"
-	"log"
+	"reflect"
 	"time"
 )
 
@@ -30,6 +30,9 @@ var (
 	// ErrNoUnusedIDFound means that we could not find an unused ID to
 	// allocate to a new paste
 	ErrNoUnusedIDFound = errors.New("gave up trying to find an unused random id")
+	// ErrDiskFull means that the disk or the user's quota ran out of space
+	// while writing a paste
+	ErrDiskFull = errors.New("no space left on the disk")
 )
 
 // A Paste represents the paste's content and information
@@ -40,6 +43,142 @@ type Paste interface {
 	io.Closer
 	ModTime() time.Time
 	Size() int64
+	Meta() Meta
+	// Views returns how many times the paste had been fetched when this
+	// handle was obtained, including this time
+	Views() int64
+}
+
+// Meta holds the attributes given to a paste when it is created
+type Meta struct {
+	// Token is the name of the upload token used, if any
+	Token string `json:"token,omitempty"`
+	// Owner is the name of the user or upload token that uploaded the
+	// paste, if any
+	Owner string `json:"owner,omitempty"`
+	// IPHash is the hex-encoded SHA-256 hash of the address the paste was
+	// uploaded from, if recorded
+	IPHash string `json:"ip_hash,omitempty"`
+	// MaxReads is how many times the paste can be fetched before it is
+	// deleted, if not zero
+	MaxReads int `json:"max_reads,omitempty"`
+	// LifeTime is how long the paste lives for, if shorter than the
+	// lifetime of all pastes
+	LifeTime time.Duration `json:"lifetime,omitempty"`
+	// Filename is the name of the file the paste was uploaded from, if
+	// it is to be kept
+	Filename string `json:"filename,omitempty"`
+	// Title is a short description of the paste, if any
+	Title string `json:"title,omitempty"`
+	// ContentType is the Content-Type the paste is to be served with
+	// instead of plain text, if any
+	ContentType string `json:"content_type,omitempty"`
+	// Files lists the files the paste is made of, in order, if it holds
+	// more than one. The content of the paste is their concatenation.
+	Files []File `json:"files,omitempty"`
+	// DeleteHash is the hex-encoded SHA-256 hash of the secret allowing
+	// the uploader to delete the paste, if any
+	DeleteHash string `json:"delete_hash,omitempty"`
+	// Binary is whether the content did not look like text, meaning that
+	// it is not necessarily UTF-8
+	Binary bool `json:"binary,omitempty"`
+	// WriteHash is the hex-encoded SHA-256 hash of the secret allowing
+	// the uploader to edit the paste, if any
+	WriteHash string `json:"write_hash,omitempty"`
+	// Versions lists the previous versions of the paste, oldest first, if
+	// it was edited
+	Versions []Version `json:"versions,omitempty"`
+	// Hash is the hex-encoded SHA-256 hash of the content, if known
+	Hash string `json:"hash,omitempty"`
+	// Encrypted is whether the content was encrypted by the uploader,
+	// with a key that was never sent, so it can only be served as is
+	Encrypted bool `json:"encrypted,omitempty"`
+	// Listed is whether the uploader asked for the paste to appear in the
+	// public listing of recent pastes
+	Listed bool `json:"listed,omitempty"`
+	// Compression is how the content was compressed by a CompressStore,
+	// if it was
+	Compression string `json:"compression,omitempty"`
+	// RawSize is the size of the content before it was compressed, if it
+	// was
+	RawSize int64 `json:"raw_size,omitempty"`
+}
+
+// Version describes a previous version of a paste
+type Version struct {
+	ModTime time.Time `json:"mod_time"`
+	Size    int64     `json:"size"`
+	Binary  bool      `json:"binary,omitempty"`
+	Hash    string    `json:"hash,omitempty"`
+}
+
+// File is one of the files of a multi-file paste
+type File struct {
+	Name string `json:"name"`
+	Size int64  `json:"size"`
+}
+
+// FileSection returns the offset and size within the paste's content of
+// the file with the given name, if there is such a file.
+func (m Meta) FileSection(name string) (off, size int64, ok bool) {
+	for _, f := range m.Files {
+		if f.Name == name {
+			return off, f.Size, true
+		}
+		off += f.Size
+	}
+	return 0, 0, false
+}
+
+func (m Meta) isZero() bool {
+	return reflect.DeepEqual(m, Meta{})
+}
+
+// Created returns when the paste was created, given when its current
+// version was.
+func (m Meta) Created(modTime time.Time) time.Time {
+	if len(m.Versions) > 0 {
+		return m.Versions[0].ModTime
+	}
+	return modTime
+}
+
+// VersionsSize returns the combined size of the previous versions of the
+// paste.
+func (m Meta) VersionsSize() int64 {
+	var size int64
+	for _, v := range m.Versions {
+		size += v.Size
+	}
+	return size
+}
+
+// versionMeta returns the attributes of a previous version of the paste.
+// The versions are kept, as they tell when the paste was created.
+func (m Meta) versionMeta(v Version) Meta {
+	m.Binary = v.Binary
+	m.Hash = v.Hash
+	m.Files = nil
+	return m
+}
+
+// EffectiveLifeTime returns how long the paste lives for, given the
+// lifetime of all pastes. Zero means forever.
+func (m Meta) EffectiveLifeTime(max time.Duration) time.Duration {
+	if m.LifeTime > 0 && (max == 0 || m.LifeTime < max) {
+		return m.LifeTime
+	}
+	return max
+}
+
+// Info holds everything a Store knows about a paste other than its content
+type Info struct {
+	Meta
+	ModTime time.Time
+	Size    int64
+	// Views is the number of times the paste was fetched since the store
+	// was started
+	Views int64
 }
 
 // ID is the binary representation of the identifier for a paste
@@ -69,12 +208,82 @@ type Store interface {
 	// Get the paste known by the given ID and an error, if any.
 	Get(id ID) (Paste, error)
 
-	// Put a new paste given its content. Will return the ID assigned to
-	// the new paste and an error, if any.
-	Put(content []byte) (ID, error)
+	// Put a new paste given its content and attributes. Will return the
+	// ID assigned to the new paste and an error, if any.
+	Put(content []byte, meta Meta) (ID, error)
 
-	// Delete an existing paste by its ID. Will return an error, if any.
+	// Delete an existing paste by its ID, along with its previous
+	// versions. Will return an error, if any.
 	Delete(id ID) error
+
+	// Update replaces the content and attributes of an existing paste,
+	// keeping its previous content as a version, which is appended to
+	// the attributes' versions. Will return an error, if any.
+	Update(id ID, content []byte, meta Meta) error
+
+	// GetVersion gets a previous version of the paste known by the given
+	// ID, numbered from 1, and an error, if any.
+	GetVersion(id ID, version int) (Paste, error)
+
+	// Copy stores a copy of a paste from elsewhere under the same ID,
+	// replacing any paste with it. versions holds the content of the
+	// attributes' versions. Will return an error, if any.
+	Copy(id ID, content []byte, meta Meta, modTime time.Time, versions [][]byte) error
+
+	// Iterate calls fn for each paste in the store, in no particular
+	// order, until fn returns false. fn must not modify the store. Will
+	// return an error, if any.
+	Iterate(fn func(id ID, info Info) bool) error
+}
+
+// Stater is implemented by the stores able to get the attributes of a paste
+// without opening its content.
+type Stater interface {
+	// Stat gets the attributes of the paste known by the given ID, without
+	// counting it as a view, and an error, if any.
+	Stat(id ID) (Info, error)
+}
+
+// BatchDeleter is implemented by the stores able to delete many pastes for
+// less than deleting them one by one, like databases.
+type BatchDeleter interface {
+	// DeleteBatch deletes the pastes known by the given IDs, skipping
+	// those not found, and returns an error, if any. Some of the pastes
+	// may have been deleted when it fails.
+	DeleteBatch(ids []ID) error
+}
+
+// DeleteBatch deletes many pastes at once if the store is a BatchDeleter.
+// Otherwise they are deleted one by one. Pastes not found are skipped.
+func DeleteBatch(s Store, ids []ID) error {
+	if bd, ok := s.(BatchDeleter); ok {
+		return bd.DeleteBatch(ids)
+	}
+	for _, id := range ids {
+		if err := s.Delete(id); err != nil && err != ErrPasteNotFound {
+			return err
+		}
+	}
+	return nil
+}
+
+// Stat gets the attributes of a paste, without opening its content if the
+// store is a Stater. Otherwise the paste is opened, counting as a view.
+func Stat(s Store, id ID) (Info, error) {
+	if st, ok := s.(Stater); ok {
+		return st.Stat(id)
+	}
+	paste, err := s.Get(id)
+	if err != nil {
+		return Info{}, err
+	}
+	defer paste.Close()
+	return Info{
+		Meta:    paste.Meta(),
+		ModTime: paste.ModTime(),
+		Size:    paste.Size(),
+		Views:   paste.Views(),
+	}, nil
 }
 
 func randomID(available func(ID) bool) (ID, error) {
@@ -90,31 +299,6 @@ func randomID(available func(ID) bool) (ID, error) {
 	return id, ErrNoUnusedIDFound
 }
 
-func SetupPasteDeletion(s Store, stats *Stats, id ID, size int64, after time.Duration) {
-	if after == 0 {
-		return
-	}
-	f := func() {
-		del := func() error {
-			if err := s.Delete(id); err != nil {
-				return err
-			}
-			stats.FreeSpace(size)
-			return nil
-		}
-		if err := del(); err == nil {
-			return
-		}
-		timer := time.NewTimer(deleteRetryTimeout)
-		for i := 0; i < deleteRetries; i++ {
-			log.Printf("Could not delete %s, trying again in %s", id, deleteRetryTimeout)
-			<-timer.C
-			if err := del(); err == nil {
-				break
-			}
-			timer.Reset(deleteRetryTimeout)
-		}
-		log.Printf("Giving up on deleting %s", id)
-	}
-	time.AfterFunc(after, f)
-}
+// An ExpireFunc is called after a paste is deleted at the end of its
+// lifetime, with the time at which it expired.
+type ExpireFunc func(id ID, at time.Time)
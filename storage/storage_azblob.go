@@ -0,0 +1,322 @@
+// Copyright (c) 2014-2015, Daniel Martí <mvdan@mvdan.cc>
+// See LICENSE for licensing information
+
+package storage
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// How long to wait for each request to Azure Blob Storage
+const azTimeout = 1 * time.Minute
+
+// Version of the Blob Storage REST API used, which must be at least
+// 2017-11-09 for managed identities
+const azVersion = "2020-10-02"
+
+// Where virtual machines on Azure get the tokens of their managed identity
+const azIdentityToken = "http://169.254.169.254/metadata/identity/oauth2/token"
+
+// How long before a token expires to get a new one
+const azTokenMargin = 1 * time.Minute
+
+// azBlobs keeps each value in a blob in an Azure Blob Storage container,
+// named after its key with a prefix.
+type azBlobs struct {
+	container string
+	prefix    string
+	// sas is the query string of a shared access signature, if used
+	sas      string
+	identity *azIdentity
+	client   *http.Client
+}
+
+func init() {
+	Register("azblob", map[string]string{
+		"account":   "",
+		"container": "",
+		"prefix":    "",
+		"sas":       "",
+		"identity":  "",
+		"endpoint":  "",
+	}, func(c Config) (Store, error) {
+		s, err := NewAzureStore(c.Stats, c.OnExpire, c.LifeTime, AzureConfig{
+			Account:   c.Params["account"],
+			Container: c.Params["container"],
+			Prefix:    c.Params["prefix"],
+			SAS:       c.Params["sas"],
+			Identity:  c.Params["identity"],
+			Endpoint:  c.Params["endpoint"],
+		})
+		if err != nil {
+			return nil, err
+		}
+		return s, nil
+	})
+}
+
+// AzureConfig is where an Azure store keeps its pastes and how it
+// authenticates
+type AzureConfig struct {
+	Account   string
+	Container string
+	// Prefix is prepended to the names of all blobs, like "pastes/"
+	Prefix string
+	// SAS is a shared access signature allowing to read, write, delete
+	// and list blobs in the container. If empty, AZURE_STORAGE_SAS_TOKEN
+	// is used, and if that is not set either, the managed identity of the
+	// virtual machine pastecat runs on.
+	SAS string
+	// Identity is the client id of the managed identity to use, if the
+	// virtual machine has more than one
+	Identity string
+	// Endpoint is the url of the storage account, if not the default of
+	// https://<account>.blob.core.windows.net, like when using Azurite
+	Endpoint string
+
+	identityURI string
+}
+
+// NewAzureStore keeps pastes in an Azure Blob Storage container, using its
+// REST API.
+func NewAzureStore(stats *Stats, onExpire ExpireFunc, lifeTime time.Duration, c AzureConfig) (*BlobStore, error) {
+	if c.Container == "" || (c.Account == "" && c.Endpoint == "") {
+		return nil, errors.New("azblob store needs an account and a container")
+	}
+	if c.Endpoint == "" {
+		c.Endpoint = "https://" + c.Account + ".blob.core.windows.net"
+	}
+	if c.SAS == "" {
+		c.SAS = os.Getenv("AZURE_STORAGE_SAS_TOKEN")
+	}
+	if c.identityURI == "" {
+		c.identityURI = azIdentityToken
+	}
+	client := &http.Client{Timeout: azTimeout}
+	a := &azBlobs{
+		container: strings.TrimSuffix(c.Endpoint, "/") + "/" + url.PathEscape(c.Container),
+		prefix:    c.Prefix,
+		sas:       strings.TrimPrefix(c.SAS, "?"),
+		client:    client,
+	}
+	if a.sas == "" {
+		a.identity = &azIdentity{client: client, uri: c.identityURI, clientID: c.Identity}
+	}
+	s, err := newBlobStore(a, stats, onExpire, lifeTime)
+	if err != nil {
+		return nil, fmt.Errorf("cannot recover pastes from container %s: %v", c.Container, err)
+	}
+	return s, nil
+}
+
+// blobURL returns the url of the blob holding a key, with query appended.
+func (a *azBlobs) blobURL(key, query string) string {
+	elems := strings.Split(a.prefix+key, "/")
+	for i, elem := range elems {
+		elems[i] = url.PathEscape(elem)
+	}
+	return a.container + "/" + strings.Join(elems, "/") + "?" + query
+}
+
+func (a *azBlobs) do(method, rawurl string, body []byte) (*http.Response, error) {
+	if a.sas != "" {
+		if strings.HasSuffix(rawurl, "?") {
+			rawurl += a.sas
+		} else {
+			rawurl += "&" + a.sas
+		}
+	}
+	req, err := http.NewRequest(method, rawurl, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("x-ms-version", azVersion)
+	if method == "PUT" {
+		req.Header.Set("x-ms-blob-type", "BlockBlob")
+	}
+	if a.identity != nil {
+		token, err := a.identity.token()
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := a.client.Do(req)
+	if err == nil && resp.StatusCode == http.StatusUnauthorized && a.identity != nil {
+		// Get a new token on the next request
+		a.identity.expire()
+	}
+	return resp, err
+}
+
+// azStatusError turns a reply that was not a success into an error,
+// closing its body.
+func azStatusError(resp *http.Response, op, name string) error {
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return ErrPasteNotFound
+	}
+	var reply struct {
+		Code    string `xml:"Code"`
+		Message string `xml:"Message"`
+	}
+	msg := resp.Status
+	if err := xml.NewDecoder(resp.Body).Decode(&reply); err == nil && reply.Code != "" {
+		// The message spans lines, ending with a request id and a time
+		msg = reply.Code + ": " + strings.SplitN(reply.Message, "\n", 2)[0]
+	}
+	return withStatusKind(resp.StatusCode, fmt.Errorf("azblob %s of %s failed: %s", op, name, msg))
+}
+
+func (a *azBlobs) get(key string) ([]byte, error) {
+	resp, err := a.do("GET", a.blobURL(key, ""), nil)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, azStatusError(resp, "get", key)
+	}
+	defer resp.Body.Close()
+	return ioutil.ReadAll(resp.Body)
+}
+
+func (a *azBlobs) put(key string, value []byte) error {
+	resp, err := a.do("PUT", a.blobURL(key, ""), value)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusCreated {
+		return azStatusError(resp, "put", key)
+	}
+	io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+	return nil
+}
+
+func (a *azBlobs) delete(key string) error {
+	resp, err := a.do("DELETE", a.blobURL(key, ""), nil)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode == http.StatusAccepted {
+		resp.Body.Close()
+		return nil
+	}
+	if err := azStatusError(resp, "delete", key); err != ErrPasteNotFound {
+		return err
+	}
+	return nil
+}
+
+func (a *azBlobs) list() ([]string, error) {
+	var keys []string
+	marker := ""
+	for {
+		q := url.Values{}
+		q.Set("restype", "container")
+		q.Set("comp", "list")
+		q.Set("prefix", a.prefix)
+		if marker != "" {
+			q.Set("marker", marker)
+		}
+		resp, err := a.do("GET", a.container+"?"+q.Encode(), nil)
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode != http.StatusOK {
+			return nil, azStatusError(resp, "list", "the container")
+		}
+		var page struct {
+			Names      []string `xml:"Blobs>Blob>Name"`
+			NextMarker string   `xml:"NextMarker"`
+		}
+		err = xml.NewDecoder(resp.Body).Decode(&page)
+		resp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		for _, name := range page.Names {
+			keys = append(keys, name[len(a.prefix):])
+		}
+		if marker = page.NextMarker; marker == "" {
+			return keys, nil
+		}
+	}
+}
+
+// azIdentity gets OAuth access tokens for the managed identity of a virtual
+// machine from its metadata service, and caches them until they are about
+// to expire.
+type azIdentity struct {
+	client   *http.Client
+	uri      string
+	clientID string
+
+	mu      sync.Mutex
+	cached  string
+	expires time.Time
+}
+
+// token returns an access token, getting a new one if needed.
+func (i *azIdentity) token() (string, error) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	if i.cached != "" && time.Now().Add(azTokenMargin).Before(i.expires) {
+		return i.cached, nil
+	}
+	q := url.Values{}
+	q.Set("api-version", "2018-02-01")
+	q.Set("resource", "https://storage.azure.com/")
+	if i.clientID != "" {
+		q.Set("client_id", i.clientID)
+	}
+	req, err := http.NewRequest("GET", i.uri+"?"+q.Encode(), nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Metadata", "true")
+	resp, err := i.client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("cannot get an azure token: %v", err)
+	}
+	defer resp.Body.Close()
+	var reply struct {
+		AccessToken string `json:"access_token"`
+		// A number, but sent as a string
+		ExpiresIn string `json:"expires_in"`
+		Error     string `json:"error_description"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&reply); err != nil {
+		return "", fmt.Errorf("cannot get an azure token: %s", resp.Status)
+	}
+	if resp.StatusCode != http.StatusOK || reply.AccessToken == "" {
+		return "", fmt.Errorf("cannot get an azure token: %s %s", resp.Status, reply.Error)
+	}
+	secs, err := strconv.Atoi(reply.ExpiresIn)
+	if err != nil {
+		return "", fmt.Errorf("invalid azure token expiry %q", reply.ExpiresIn)
+	}
+	i.cached = reply.AccessToken
+	i.expires = time.Now().Add(time.Duration(secs) * time.Second)
+	return i.cached, nil
+}
+
+// expire forgets the cached token, so that a new one is used next.
+func (i *azIdentity) expire() {
+	i.mu.Lock()
+	i.cached = ""
+	i.mu.Unlock()
+}
@@ -0,0 +1,180 @@
+package storage
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeAzure serves the parts of the Blob Storage REST API and the instance
+// metadata service that an Azure store uses, for a single container.
+type fakeAzure struct {
+	sync.Mutex
+	t         *testing.T
+	container string
+	sas       string
+	tokens    int
+	blobs     map[string][]byte
+}
+
+func (f *fakeAzure) authorized(r *http.Request) bool {
+	if r.Header.Get("Authorization") == "Bearer secret" {
+		return true
+	}
+	return strings.HasSuffix(r.URL.RawQuery, f.sas)
+}
+
+func (f *fakeAzure) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.Lock()
+	defer f.Unlock()
+	if r.URL.Path == "/identity" {
+		if r.Header.Get("Metadata") != "true" || r.FormValue("resource") != "https://storage.azure.com/" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		f.tokens++
+		fmt.Fprint(w, `{"access_token":"secret","expires_in":"3600"}`)
+		return
+	}
+	if r.Header.Get("x-ms-version") == "" || !f.authorized(r) {
+		w.WriteHeader(http.StatusForbidden)
+		fmt.Fprint(w, `<?xml version="1.0" encoding="utf-8"?><Error>`+
+			`<Code>AuthenticationFailed</Code><Message>Server failed to authenticate the request.
+RequestId:1</Message></Error>`)
+		return
+	}
+	if r.URL.Path == "/"+f.container && r.FormValue("comp") == "list" {
+		var names []string
+		for name := range f.blobs {
+			if strings.HasPrefix(name, r.FormValue("prefix")) {
+				names = append(names, name)
+			}
+		}
+		sort.Strings(names)
+		// Two per page, to test paging
+		start := 0
+		if marker := r.FormValue("marker"); marker != "" {
+			start = sort.SearchStrings(names, marker)
+		}
+		end, next := start+2, ""
+		if end < len(names) {
+			next = names[end]
+		} else {
+			end = len(names)
+		}
+		type blob struct {
+			Name string
+		}
+		page := struct {
+			XMLName    xml.Name `xml:"EnumerationResults"`
+			Blobs      []blob   `xml:"Blobs>Blob"`
+			NextMarker string
+		}{NextMarker: next}
+		for _, name := range names[start:end] {
+			page.Blobs = append(page.Blobs, blob{name})
+		}
+		xml.NewEncoder(w).Encode(page)
+		return
+	}
+	name := strings.TrimPrefix(r.URL.Path, "/"+f.container+"/")
+	switch r.Method {
+	case "PUT":
+		if r.Header.Get("x-ms-blob-type") != "BlockBlob" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		f.blobs[name], _ = ioutil.ReadAll(r.Body)
+		w.WriteHeader(http.StatusCreated)
+		return
+	case "GET", "DELETE":
+		content, e := f.blobs[name]
+		if !e {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if r.Method == "GET" {
+			w.Write(content)
+		} else {
+			delete(f.blobs, name)
+			w.WriteHeader(http.StatusAccepted)
+		}
+		return
+	}
+	f.t.Errorf("unexpected request %s %s", r.Method, r.URL)
+	w.WriteHeader(http.StatusBadRequest)
+}
+
+func TestAzureStore(t *testing.T) {
+	az := &fakeAzure{
+		t:         t,
+		container: "pastes",
+		sas:       "sv=2020-08-04&sp=rwdl&sig=abc%2Bdef",
+		blobs:     make(map[string][]byte),
+	}
+	srv := httptest.NewServer(az)
+	defer srv.Close()
+	config := AzureConfig{
+		Container:   "pastes",
+		Prefix:      "p/",
+		SAS:         "?" + az.sas,
+		Endpoint:    srv.URL,
+		identityURI: srv.URL + "/identity",
+	}
+
+	s, err := NewAzureStore(&Stats{}, nil, 0, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ids []ID
+	for _, content := range []string{"foo", "bar", "baz"} {
+		id, err := s.Put([]byte(content), Meta{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, id)
+	}
+	if err := s.Update(ids[0], []byte("foofoo"), Meta{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Delete(ids[2]); err != nil {
+		t.Fatal(err)
+	}
+	if got := string(az.blobs["p/"+ids[1].String()]); got != "bar" {
+		t.Errorf("blob of %s holds %q, want %q", ids[1], got, "bar")
+	}
+
+	// A new store using the managed identity finds the pastes already in
+	// the container, going through the pages of blobs
+	config.SAS = ""
+	stats := &Stats{}
+	s2, err := NewAzureStore(stats, nil, 0, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if num, stg := stats.Report(); num != 2 || stg != 12 {
+		t.Errorf("recovered %d pastes taking %d bytes, want 2 and 12", num, stg)
+	}
+	p, err := s2.GetVersion(ids[0], 1)
+	if got := readPaste(t, p, err); got != "foo" {
+		t.Errorf("GetVersion() got %q, want %q", got, "foo")
+	}
+	if _, err := s2.Get(ids[2]); err != ErrPasteNotFound {
+		t.Errorf("Get() of a deleted paste got %v, want %v", err, ErrPasteNotFound)
+	}
+	if az.tokens != 1 {
+		t.Errorf("got %d tokens, want 1", az.tokens)
+	}
+
+	// Failing to authenticate
+	config.SAS = "sig=wrong"
+	_, err = NewAzureStore(&Stats{}, nil, 0, config)
+	if want := "AuthenticationFailed: Server failed to authenticate the request."; err == nil || !strings.HasSuffix(err.Error(), want) {
+		t.Errorf("NewAzureStore() with a wrong signature got %v, want %q", err, want)
+	}
+}
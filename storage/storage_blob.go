@@ -0,0 +1,288 @@
+// Copyright (c) 2014-2015, Daniel Martí <mvdan@mvdan.cc>
+// See LICENSE for licensing information
+
+package storage
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Suffixes of the keys a paste's attributes and previous versions are
+// stored under, after the paste's id
+const (
+	blobMetaSuffix    = ".meta"
+	blobVersionSuffix = ".v"
+)
+
+// blobs holds values under keys, like a plugin or a WebDAV server. Keys are
+// made of lowercase hex digits, dots and letters, so they are safe to use
+// as file names. Missing keys are reported as ErrPasteNotFound, except by
+// delete, which ignores them.
+type blobs interface {
+	get(key string) ([]byte, error)
+	put(key string, value []byte) error
+	delete(key string) error
+	list() ([]string, error)
+}
+
+// blobRecord is what is stored under a paste's meta key
+type blobRecord struct {
+	ModTime time.Time `json:"mod_time"`
+	Size    int64     `json:"size"`
+	Meta    Meta      `json:"meta"`
+}
+
+// BlobStore keeps pastes in somewhere that can only hold values under keys,
+// like the plugin of an exec store or a WebDAV server. A paste's content is
+// stored under its id, its attributes under its id with a ".meta" suffix,
+// and its previous versions with ".v1", ".v2" and so on. The attributes
+// are kept in memory, so that only the contents are fetched.
+type BlobStore struct {
+	sync.RWMutex
+	blobs blobs
+	cache map[ID]*memCache
+}
+
+// newBlobStore loads the attributes of the pastes already in blobs.
+func newBlobStore(b blobs, stats *Stats, onExpire ExpireFunc, lifeTime time.Duration) (*BlobStore, error) {
+	s := &BlobStore{
+		blobs: b,
+		cache: make(map[ID]*memCache),
+	}
+	if err := s.recover(stats, onExpire, lifeTime); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func blobVersionKey(id ID, version int) string {
+	return id.String() + blobVersionSuffix + strconv.Itoa(version)
+}
+
+func (s *BlobStore) recover(stats *Stats, onExpire ExpireFunc, lifeTime time.Duration) error {
+	keys, err := s.blobs.list()
+	if err != nil {
+		return err
+	}
+	startTime := clock.Now()
+	for _, key := range keys {
+		if !strings.HasSuffix(key, blobMetaSuffix) {
+			continue
+		}
+		id, err := IDFromString(strings.TrimSuffix(key, blobMetaSuffix))
+		if err != nil {
+			return err
+		}
+		value, err := s.blobs.get(key)
+		if err == ErrPasteNotFound {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		var rec blobRecord
+		if err := json.Unmarshal(value, &rec); err != nil {
+			return fmt.Errorf("invalid attributes at %s: %v", key, err)
+		}
+		var lifeLeft time.Duration
+		if lt := rec.Meta.EffectiveLifeTime(lifeTime); lt > 0 {
+			deathTime := rec.Meta.Created(rec.ModTime).Add(lt)
+			if lifeLeft = deathTime.Sub(startTime); lifeLeft <= 0 {
+				if err := s.remove(id, len(rec.Meta.Versions)); err != nil {
+					return err
+				}
+				if onExpire != nil {
+					onExpire(id, deathTime)
+				}
+				continue
+			}
+		}
+		if err := stats.MakeSpaceFor(rec.Size + rec.Meta.VersionsSize()); err != nil {
+			return err
+		}
+		s.cache[id] = &memCache{modTime: rec.ModTime, size: rec.Size, meta: rec.Meta}
+		SetupPasteDeletion(s, stats, onExpire, id, lifeLeft)
+	}
+	return nil
+}
+
+// write stores a paste's content and then its attributes, so that a paste
+// is never found without its content.
+func (s *BlobStore) write(id ID, content []byte, meta Meta, modTime time.Time) (*memCache, error) {
+	rec := blobRecord{ModTime: modTime, Size: int64(len(content)), Meta: meta}
+	value, err := json.Marshal(rec)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.blobs.put(id.String(), content); err != nil {
+		return nil, err
+	}
+	if err := s.blobs.put(id.String()+blobMetaSuffix, value); err != nil {
+		return nil, err
+	}
+	return &memCache{modTime: modTime, size: rec.Size, meta: meta}, nil
+}
+
+// remove deletes a paste's attributes first, so that it is never found
+// without its content.
+func (s *BlobStore) remove(id ID, versions int) error {
+	if err := s.blobs.delete(id.String() + blobMetaSuffix); err != nil {
+		return err
+	}
+	if err := s.blobs.delete(id.String()); err != nil {
+		return err
+	}
+	for v := 1; v <= versions; v++ {
+		if err := s.blobs.delete(blobVersionKey(id, v)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *BlobStore) Get(id ID) (Paste, error) {
+	s.RLock()
+	cached, e := s.cache[id]
+	s.RUnlock()
+	if !e {
+		return nil, ErrPasteNotFound
+	}
+	content, err := s.blobs.get(id.String())
+	if err != nil {
+		return nil, err
+	}
+	views := atomic.AddInt64(&cached.views, 1)
+	return MemPaste{content: bytes.NewReader(content), cache: cached, views: views}, nil
+}
+
+func (s *BlobStore) Put(content []byte, meta Meta) (ID, error) {
+	available := func(id ID) bool {
+		_, e := s.cache[id]
+		return !e
+	}
+	s.Lock()
+	defer s.Unlock()
+	id, err := randomID(available)
+	if err != nil {
+		return id, err
+	}
+	cached, err := s.write(id, content, meta, clock.Now())
+	if err != nil {
+		return id, err
+	}
+	s.cache[id] = cached
+	return id, nil
+}
+
+func (s *BlobStore) Delete(id ID) error {
+	s.Lock()
+	defer s.Unlock()
+	cached, e := s.cache[id]
+	if !e {
+		return ErrPasteNotFound
+	}
+	delete(s.cache, id)
+	return s.remove(id, len(cached.meta.Versions))
+}
+
+func (s *BlobStore) Update(id ID, content []byte, meta Meta) error {
+	s.Lock()
+	defer s.Unlock()
+	cached, e := s.cache[id]
+	if !e {
+		return ErrPasteNotFound
+	}
+	old, err := s.blobs.get(id.String())
+	if err != nil {
+		return err
+	}
+	version := len(cached.meta.Versions) + 1
+	if err := s.blobs.put(blobVersionKey(id, version), old); err != nil {
+		return err
+	}
+	meta.Versions = append(append([]Version(nil), cached.meta.Versions...), Version{
+		ModTime: cached.modTime,
+		Size:    cached.size,
+		Binary:  cached.meta.Binary,
+		Hash:    cached.meta.Hash,
+	})
+	updated, err := s.write(id, content, meta, clock.Now())
+	if err != nil {
+		return err
+	}
+	updated.views = atomic.LoadInt64(&cached.views)
+	s.cache[id] = updated
+	return nil
+}
+
+func (s *BlobStore) Copy(id ID, content []byte, meta Meta, modTime time.Time, versions [][]byte) error {
+	if len(versions) != len(meta.Versions) {
+		return fmt.Errorf("got %d versions, want %d", len(versions), len(meta.Versions))
+	}
+	s.Lock()
+	defer s.Unlock()
+	for i, version := range versions {
+		if err := s.blobs.put(blobVersionKey(id, i+1), version); err != nil {
+			return err
+		}
+	}
+	cached, err := s.write(id, content, meta, modTime)
+	if err != nil {
+		return err
+	}
+	if old, e := s.cache[id]; e {
+		for v := len(versions) + 1; v <= len(old.meta.Versions); v++ {
+			if err := s.blobs.delete(blobVersionKey(id, v)); err != nil {
+				log.Printf("Could not delete version %d of %s: %v", v, id, err)
+			}
+		}
+	}
+	s.cache[id] = cached
+	return nil
+}
+
+func (s *BlobStore) GetVersion(id ID, version int) (Paste, error) {
+	s.RLock()
+	cached, e := s.cache[id]
+	s.RUnlock()
+	if !e || version < 1 || version > len(cached.meta.Versions) {
+		return nil, ErrPasteNotFound
+	}
+	content, err := s.blobs.get(blobVersionKey(id, version))
+	if err != nil {
+		return nil, err
+	}
+	v := cached.meta.Versions[version-1]
+	views := atomic.AddInt64(&cached.views, 1)
+	return MemPaste{content: bytes.NewReader(content), cache: &memCache{
+		content: memContent{buffer: content},
+		modTime: v.ModTime,
+		size:    v.Size,
+		meta:    cached.meta.versionMeta(v),
+	}, views: views}, nil
+}
+
+func (s *BlobStore) Iterate(fn func(id ID, info Info) bool) error {
+	s.RLock()
+	defer s.RUnlock()
+	for id, cached := range s.cache {
+		info := Info{
+			Meta:    cached.meta,
+			ModTime: cached.modTime,
+			Size:    cached.size,
+			Views:   atomic.LoadInt64(&cached.views),
+		}
+		if !fn(id, info) {
+			break
+		}
+	}
+	return nil
+}
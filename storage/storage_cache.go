@@ -0,0 +1,396 @@
+// Copyright (c) 2014-2015, Daniel Martí <mvdan@mvdan.cc>
+// See LICENSE for licensing information
+
+package storage
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// cacheClient talks to a cache server, which deletes each key once its
+// ttl has passed, or earlier if it runs out of memory. Missing keys are
+// reported as ErrPasteNotFound.
+type cacheClient interface {
+	get(key string) ([]byte, error)
+	set(key string, value []byte, ttl time.Duration) error
+	// add is like set, but fails with errCacheExists if the key is set
+	add(key string, value []byte, ttl time.Duration) error
+	delete(key string) error
+}
+
+// cacheEntry is what a CacheStore knows about a paste in the cache
+type cacheEntry struct {
+	memCache
+	death time.Time
+}
+
+// CacheStore keeps pastes in a cache server like memcached or Valkey, for
+// instances whose pastes only live for minutes or hours. The server deletes
+// each paste once its lifetime has passed, and may lose them earlier if it
+// runs out of memory or is restarted.
+//
+// Each paste is a single key holding its attributes and content, named
+// after its id with a prefix, and its previous versions are kept under its
+// id with ".v1", ".v2" and so on. The pastes added since the store was set
+// up are listed from memory, while older ones are only found when fetched.
+type CacheStore struct {
+	sync.RWMutex
+	client   cacheClient
+	prefix   string
+	stats    *Stats
+	onExpire ExpireFunc
+	lifeTime time.Duration
+	cache    map[ID]*cacheEntry
+}
+
+func init() {
+	Register("memcached", map[string]string{
+		"addr":   "localhost:11211",
+		"prefix": "pastecat:",
+	}, func(c Config) (Store, error) {
+		return newCacheStore(c, newMemcachedClient(c.Params["addr"]))
+	})
+	Register("valkey", map[string]string{
+		"addr":     "localhost:6379",
+		"prefix":   "pastecat:",
+		"password": "",
+		"db":       "0",
+	}, func(c Config) (Store, error) {
+		db, err := strconv.Atoi(c.Params["db"])
+		if err != nil {
+			return nil, fmt.Errorf("invalid db: %v", err)
+		}
+		return newCacheStore(c, newRESPClient(c.Params["addr"], c.Params["password"], db))
+	})
+}
+
+func newCacheStore(c Config, client cacheClient) (Store, error) {
+	s, err := NewCacheStore(c.Stats, c.OnExpire, c.LifeTime, client, c.Params["prefix"])
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// NewCacheStore checks that the cache server can be reached. Pastes must
+// have a lifetime, as the cache may only keep them for so long.
+func NewCacheStore(stats *Stats, onExpire ExpireFunc, lifeTime time.Duration, client cacheClient, prefix string) (*CacheStore, error) {
+	if lifeTime == 0 {
+		return nil, errors.New("cache stores need pastes to have a lifetime")
+	}
+	s := &CacheStore{
+		client:   client,
+		prefix:   prefix,
+		stats:    stats,
+		onExpire: onExpire,
+		lifeTime: lifeTime,
+		cache:    make(map[ID]*cacheEntry),
+	}
+	if _, err := client.get(prefix + "ping"); err != nil && err != ErrPasteNotFound {
+		return nil, fmt.Errorf("cannot reach the cache server: %v", err)
+	}
+	return s, nil
+}
+
+func (s *CacheStore) key(id ID) string {
+	return s.prefix + id.String()
+}
+
+func (s *CacheStore) versionKey(id ID, version int) string {
+	return s.key(id) + blobVersionSuffix + strconv.Itoa(version)
+}
+
+// encodeCached puts a paste's attributes before its content, on a line of
+// their own.
+func encodeCached(rec blobRecord, content []byte) ([]byte, error) {
+	header, err := json.Marshal(rec)
+	if err != nil {
+		return nil, err
+	}
+	return append(append(header, '\n'), content...), nil
+}
+
+func decodeCached(value []byte) (blobRecord, []byte, error) {
+	var rec blobRecord
+	i := bytes.IndexByte(value, '\n')
+	if i < 0 {
+		return rec, nil, corrupted(errors.New("cached paste has no attributes"))
+	}
+	if err := json.Unmarshal(value[:i], &rec); err != nil {
+		return rec, nil, corrupted(fmt.Errorf("invalid attributes of cached paste: %v", err))
+	}
+	return rec, value[i+1:], nil
+}
+
+// deathOf returns when a paste expires.
+func (s *CacheStore) deathOf(meta Meta, modTime time.Time) time.Time {
+	return meta.Created(modTime).Add(meta.EffectiveLifeTime(s.lifeTime))
+}
+
+// lost forgets a paste that the cache no longer holds, either because it
+// expired or because it was evicted, so that it is not counted anymore.
+func (s *CacheStore) lost(id ID) {
+	s.Lock()
+	entry, e := s.cache[id]
+	delete(s.cache, id)
+	s.Unlock()
+	if !e {
+		return
+	}
+	s.stats.FreeSpace(entry.size + entry.meta.VersionsSize())
+	if !clock.Now().Before(entry.death) && s.onExpire != nil {
+		s.onExpire(id, entry.death)
+	}
+}
+
+// found starts tracking a paste added to the cache before this store was
+// set up, deleting it once it expires like the ones added since.
+func (s *CacheStore) found(id ID, rec blobRecord) *cacheEntry {
+	s.Lock()
+	defer s.Unlock()
+	if entry, e := s.cache[id]; e {
+		return entry
+	}
+	entry := &cacheEntry{
+		memCache: memCache{modTime: rec.ModTime, size: rec.Size, meta: rec.Meta},
+		death:    s.deathOf(rec.Meta, rec.ModTime),
+	}
+	if err := s.stats.MakeSpaceFor(rec.Size + rec.Meta.VersionsSize()); err != nil {
+		// Still served, but not counted
+		return entry
+	}
+	s.cache[id] = entry
+	SetupPasteDeletion(s, s.stats, s.onExpire, id, entry.death.Sub(clock.Now()))
+	return entry
+}
+
+func (s *CacheStore) Get(id ID) (Paste, error) {
+	value, err := s.client.get(s.key(id))
+	if err == ErrPasteNotFound {
+		s.lost(id)
+	}
+	if err != nil {
+		return nil, err
+	}
+	rec, content, err := decodeCached(value)
+	if err != nil {
+		return nil, err
+	}
+	s.RLock()
+	entry, e := s.cache[id]
+	s.RUnlock()
+	if !e {
+		entry = s.found(id, rec)
+	}
+	views := atomic.AddInt64(&entry.views, 1)
+	return MemPaste{content: bytes.NewReader(content), cache: &memCache{
+		modTime: rec.ModTime,
+		size:    rec.Size,
+		meta:    rec.Meta,
+	}, views: views}, nil
+}
+
+func (s *CacheStore) Put(content []byte, meta Meta) (ID, error) {
+	now := clock.Now()
+	rec := blobRecord{ModTime: now, Size: int64(len(content)), Meta: meta}
+	value, err := encodeCached(rec, content)
+	if err != nil {
+		return ID{}, err
+	}
+	death := s.deathOf(meta, now)
+	available := func(id ID) bool {
+		_, e := s.cache[id]
+		return !e
+	}
+	s.Lock()
+	defer s.Unlock()
+	for try := 0; try < randTries; try++ {
+		id, err := randomID(available)
+		if err != nil {
+			return id, err
+		}
+		// Fails if the paste was added before this store was set up
+		err = s.client.add(s.key(id), value, death.Sub(now))
+		if err == errCacheExists {
+			continue
+		}
+		if err != nil {
+			return id, err
+		}
+		s.cache[id] = &cacheEntry{
+			memCache: memCache{modTime: now, size: rec.Size, meta: meta},
+			death:    death,
+		}
+		return id, nil
+	}
+	return ID{}, ErrNoUnusedIDFound
+}
+
+func (s *CacheStore) Delete(id ID) error {
+	value, err := s.client.get(s.key(id))
+	if err == ErrPasteNotFound {
+		s.lost(id)
+	}
+	if err != nil {
+		return err
+	}
+	rec, _, err := decodeCached(value)
+	if err != nil {
+		return err
+	}
+	s.RLock()
+	_, e := s.cache[id]
+	s.RUnlock()
+	if !e {
+		// Counted, as the caller frees its space
+		s.found(id, rec)
+	}
+	if err := s.client.delete(s.key(id)); err != nil && err != ErrPasteNotFound {
+		return err
+	}
+	for v := 1; v <= len(rec.Meta.Versions); v++ {
+		if err := s.client.delete(s.versionKey(id, v)); err != nil && err != ErrPasteNotFound {
+			return err
+		}
+	}
+	s.Lock()
+	delete(s.cache, id)
+	s.Unlock()
+	return nil
+}
+
+func (s *CacheStore) Update(id ID, content []byte, meta Meta) error {
+	s.Lock()
+	defer s.Unlock()
+	value, err := s.client.get(s.key(id))
+	if err != nil {
+		return err
+	}
+	old, oldContent, err := decodeCached(value)
+	if err != nil {
+		return err
+	}
+	meta.Versions = append(append([]Version(nil), old.Meta.Versions...), Version{
+		ModTime: old.ModTime,
+		Size:    old.Size,
+		Binary:  old.Meta.Binary,
+		Hash:    old.Meta.Hash,
+	})
+	now := clock.Now()
+	ttl := s.deathOf(meta, now).Sub(now)
+	if ttl <= 0 {
+		return ErrPasteNotFound
+	}
+	if err := s.client.set(s.versionKey(id, len(meta.Versions)), oldContent, ttl); err != nil {
+		return err
+	}
+	rec := blobRecord{ModTime: now, Size: int64(len(content)), Meta: meta}
+	if value, err = encodeCached(rec, content); err != nil {
+		return err
+	}
+	if err := s.client.set(s.key(id), value, ttl); err != nil {
+		return err
+	}
+	entry := &cacheEntry{
+		memCache: memCache{modTime: now, size: rec.Size, meta: meta},
+		death:    now.Add(ttl),
+	}
+	if cached, e := s.cache[id]; e {
+		entry.views = atomic.LoadInt64(&cached.views)
+	}
+	s.cache[id] = entry
+	return nil
+}
+
+func (s *CacheStore) Copy(id ID, content []byte, meta Meta, modTime time.Time, versions [][]byte) error {
+	if len(versions) != len(meta.Versions) {
+		return fmt.Errorf("got %d versions, want %d", len(versions), len(meta.Versions))
+	}
+	death := s.deathOf(meta, modTime)
+	ttl := death.Sub(clock.Now())
+	if ttl <= 0 {
+		// Expired already
+		return nil
+	}
+	s.Lock()
+	defer s.Unlock()
+	for i, version := range versions {
+		if err := s.client.set(s.versionKey(id, i+1), version, ttl); err != nil {
+			return err
+		}
+	}
+	rec := blobRecord{ModTime: modTime, Size: int64(len(content)), Meta: meta}
+	value, err := encodeCached(rec, content)
+	if err != nil {
+		return err
+	}
+	if err := s.client.set(s.key(id), value, ttl); err != nil {
+		return err
+	}
+	s.cache[id] = &cacheEntry{
+		memCache: memCache{modTime: modTime, size: rec.Size, meta: meta},
+		death:    death,
+	}
+	return nil
+}
+
+func (s *CacheStore) GetVersion(id ID, version int) (Paste, error) {
+	value, err := s.client.get(s.key(id))
+	if err == ErrPasteNotFound {
+		s.lost(id)
+	}
+	if err != nil {
+		return nil, err
+	}
+	rec, _, err := decodeCached(value)
+	if err != nil {
+		return nil, err
+	}
+	if version < 1 || version > len(rec.Meta.Versions) {
+		return nil, ErrPasteNotFound
+	}
+	content, err := s.client.get(s.versionKey(id, version))
+	if err != nil {
+		return nil, err
+	}
+	var views int64
+	s.RLock()
+	if entry, e := s.cache[id]; e {
+		views = atomic.AddInt64(&entry.views, 1)
+	}
+	s.RUnlock()
+	v := rec.Meta.Versions[version-1]
+	return MemPaste{content: bytes.NewReader(content), cache: &memCache{
+		modTime: v.ModTime,
+		size:    v.Size,
+		meta:    rec.Meta.versionMeta(v),
+	}, views: views}, nil
+}
+
+func (s *CacheStore) Iterate(fn func(id ID, info Info) bool) error {
+	s.RLock()
+	defer s.RUnlock()
+	now := clock.Now()
+	for id, entry := range s.cache {
+		if !now.Before(entry.death) {
+			continue
+		}
+		info := Info{
+			Meta:    entry.meta,
+			ModTime: entry.modTime,
+			Size:    entry.size,
+			Views:   atomic.LoadInt64(&entry.views),
+		}
+		if !fn(id, info) {
+			break
+		}
+	}
+	return nil
+}
@@ -0,0 +1,261 @@
+package storage
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeCache holds the keys of a fake cache server, along with the ttl each
+// was last set with. Keys never expire on their own.
+type fakeCache struct {
+	sync.Mutex
+	values map[string][]byte
+	ttls   map[string]time.Duration
+}
+
+func (f *fakeCache) set(key string, value []byte, ttl time.Duration, onlyNew bool) bool {
+	f.Lock()
+	defer f.Unlock()
+	if _, e := f.values[key]; e && onlyNew {
+		return false
+	}
+	f.values[key], f.ttls[key] = value, ttl
+	return true
+}
+
+func (f *fakeCache) get(key string) ([]byte, bool) {
+	f.Lock()
+	defer f.Unlock()
+	value, e := f.values[key]
+	return value, e
+}
+
+func (f *fakeCache) ttl(key string) time.Duration {
+	f.Lock()
+	defer f.Unlock()
+	return f.ttls[key]
+}
+
+func (f *fakeCache) delete(key string) bool {
+	f.Lock()
+	defer f.Unlock()
+	_, e := f.values[key]
+	delete(f.values, key)
+	return e
+}
+
+// serve accepts connections, handling each with handle until it fails.
+func (f *fakeCache) serve(t *testing.T, handle func(r *bufio.Reader, w io.Writer) error) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				r := bufio.NewReader(c)
+				for handle(r, c) == nil {
+				}
+			}()
+		}
+	}()
+	return l.Addr().String()
+}
+
+// handleMemcached answers a command of the memcached text protocol.
+func (f *fakeCache) handleMemcached(r *bufio.Reader, w io.Writer) error {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return err
+	}
+	fields := strings.Fields(line)
+	switch {
+	case len(fields) == 2 && fields[0] == "get":
+		if value, e := f.get(fields[1]); e {
+			fmt.Fprintf(w, "VALUE %s 0 %d\r\n%s\r\n", fields[1], len(value), value)
+		}
+		fmt.Fprint(w, "END\r\n")
+	case len(fields) == 2 && fields[0] == "delete":
+		if f.delete(fields[1]) {
+			fmt.Fprint(w, "DELETED\r\n")
+		} else {
+			fmt.Fprint(w, "NOT_FOUND\r\n")
+		}
+	case len(fields) == 5 && (fields[0] == "set" || fields[0] == "add"):
+		exptime, _ := strconv.Atoi(fields[3])
+		size, _ := strconv.Atoi(fields[4])
+		value := make([]byte, size+2)
+		if _, err := io.ReadFull(r, value); err != nil {
+			return err
+		}
+		if size > 1000 {
+			fmt.Fprint(w, "SERVER_ERROR out of memory storing object\r\n")
+		} else if f.set(fields[1], value[:size], time.Duration(exptime)*time.Second, fields[0] == "add") {
+			fmt.Fprint(w, "STORED\r\n")
+		} else {
+			fmt.Fprint(w, "NOT_STORED\r\n")
+		}
+	default:
+		fmt.Fprint(w, "ERROR\r\n")
+	}
+	return nil
+}
+
+// handleRESP answers a command of the RESP protocol, requiring a password.
+func (f *fakeCache) handleRESP(r *bufio.Reader, w io.Writer) error {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return err
+	}
+	n, _ := strconv.Atoi(strings.TrimSpace(line[1:]))
+	args := make([]string, n)
+	for i := range args {
+		if line, err = r.ReadString('\n'); err != nil {
+			return err
+		}
+		size, _ := strconv.Atoi(strings.TrimSpace(line[1:]))
+		arg := make([]byte, size+2)
+		if _, err := io.ReadFull(r, arg); err != nil {
+			return err
+		}
+		args[i] = string(arg[:size])
+	}
+	switch {
+	case args[0] == "AUTH":
+		if args[1] != "hunter2" {
+			fmt.Fprint(w, "-WRONGPASS invalid password\r\n")
+			return io.EOF
+		}
+		fmt.Fprint(w, "+OK\r\n")
+	case args[0] == "SELECT":
+		fmt.Fprint(w, "+OK\r\n")
+	case args[0] == "GET":
+		if value, e := f.get(args[1]); e {
+			fmt.Fprintf(w, "$%d\r\n%s\r\n", len(value), value)
+		} else {
+			fmt.Fprint(w, "$-1\r\n")
+		}
+	case args[0] == "DEL":
+		if f.delete(args[1]) {
+			fmt.Fprint(w, ":1\r\n")
+		} else {
+			fmt.Fprint(w, ":0\r\n")
+		}
+	case args[0] == "SET" && len(args) >= 5 && args[3] == "PX":
+		ms, _ := strconv.Atoi(args[4])
+		if len(args[2]) > 1000 {
+			fmt.Fprint(w, "-OOM command not allowed when used memory > 'maxmemory'.\r\n")
+		} else if f.set(args[1], []byte(args[2]), time.Duration(ms)*time.Millisecond, len(args) == 6) {
+			fmt.Fprint(w, "+OK\r\n")
+		} else {
+			fmt.Fprint(w, "$-1\r\n")
+		}
+	default:
+		fmt.Fprint(w, "-ERR unknown command\r\n")
+	}
+	return nil
+}
+
+func TestCacheStore(t *testing.T) {
+	t.Run("memcached", func(t *testing.T) {
+		f := &fakeCache{values: make(map[string][]byte), ttls: make(map[string]time.Duration)}
+		addr := f.serve(t, f.handleMemcached)
+		testCacheStore(t, f, func() cacheClient { return newMemcachedClient(addr) })
+	})
+	t.Run("valkey", func(t *testing.T) {
+		f := &fakeCache{values: make(map[string][]byte), ttls: make(map[string]time.Duration)}
+		addr := f.serve(t, f.handleRESP)
+		if _, err := NewCacheStore(&Stats{}, nil, time.Hour, newRESPClient(addr, "wrong", 0), ""); err == nil {
+			t.Errorf("NewCacheStore() with a wrong password did not fail")
+		}
+		testCacheStore(t, f, func() cacheClient { return newRESPClient(addr, "hunter2", 1) })
+	})
+}
+
+func testCacheStore(t *testing.T, f *fakeCache, client func() cacheClient) {
+	s, err := NewCacheStore(&Stats{}, nil, time.Hour, client(), "p:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, err := s.Put([]byte("foo"), Meta{LifeTime: 10 * time.Minute})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ttl := f.ttl("p:" + id.String()); ttl != 10*time.Minute {
+		t.Errorf("Put() set a ttl of %s, want 10m", ttl)
+	}
+	if err := s.Update(id, []byte("barbar"), Meta{LifeTime: 10 * time.Minute}); err != nil {
+		t.Fatal(err)
+	}
+	if ttl := f.ttl("p:" + id.String() + ".v1"); ttl <= 9*time.Minute || ttl > 10*time.Minute {
+		t.Errorf("Update() set a ttl of %s, want the rest of 10m", ttl)
+	}
+	if _, err := s.Put(make([]byte, 2000), Meta{}); err != ErrDiskFull {
+		t.Errorf("Put() of a paste too large got %v, want %v", err, ErrDiskFull)
+	}
+
+	// A new store finds the pastes added before it once they are fetched
+	var expired []ID
+	stats := &Stats{}
+	s2, err := NewCacheStore(stats, func(id ID, at time.Time) {
+		expired = append(expired, id)
+	}, time.Hour, client(), "p:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err := s2.Get(id)
+	if got := readPaste(t, p, err); got != "barbar" {
+		t.Errorf("Get() got %q, want %q", got, "barbar")
+	}
+	p, err = s2.GetVersion(id, 1)
+	if got := readPaste(t, p, err); got != "foo" {
+		t.Errorf("GetVersion() got %q, want %q", got, "foo")
+	}
+	if num, stg := stats.Report(); num != 1 || stg != 9 {
+		t.Errorf("found %d pastes taking %d bytes, want 1 and 9", num, stg)
+	}
+	listed := 0
+	s2.Iterate(func(ID, Info) bool {
+		listed++
+		return true
+	})
+	if listed != 1 {
+		t.Errorf("Iterate() listed %d pastes, want 1", listed)
+	}
+
+	// Pastes evicted by the cache stop being counted
+	f.delete("p:" + id.String())
+	if _, err := s2.Get(id); err != ErrPasteNotFound {
+		t.Errorf("Get() of an evicted paste got %v, want %v", err, ErrPasteNotFound)
+	}
+	if num, _ := stats.Report(); num != 0 || len(expired) != 0 {
+		t.Errorf("evicted paste is still counted, or counted as expired")
+	}
+
+	other, err := s2.Put([]byte("other"), Meta{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ttl := f.ttl("p:" + other.String()); ttl != time.Hour {
+		t.Errorf("Put() set a ttl of %s, want 1h", ttl)
+	}
+	if err := s2.Delete(other); err != nil {
+		t.Fatal(err)
+	}
+	if _, e := f.get("p:" + other.String()); e {
+		t.Errorf("Delete() left the paste in the cache")
+	}
+}
@@ -0,0 +1,524 @@
+// Copyright (c) 2014-2015, Daniel Martí <mvdan@mvdan.cc>
+// See LICENSE for licensing information
+
+package storage
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gocql/gocql"
+)
+
+// Cassandra refuses ttls longer than 20 years
+const cassandraMaxTTL = 20 * 365 * 24 * 60 * 60
+
+// Number of pastes fetched at a time when iterating
+const cassandraPageSize = 1000
+
+var keyspaceRegex = regexp.MustCompile(`^[a-zA-Z][a-zA-Z0-9_]{0,47}$`)
+
+// cqlSession runs statements on a cluster, as done by gocqlSession. The
+// routing key is the serialized partition key, or nil if the statement
+// does not touch a single partition.
+type cqlSession interface {
+	Exec(stmt string, routingKey []byte, args ...interface{}) error
+	// Query returns the few rows of a statement, which come in a single
+	// page
+	Query(stmt string, routingKey []byte, args ...interface{}) ([]cqlRow, error)
+	// Iter runs a statement page by page, calling fn on each row until it
+	// returns false
+	Iter(stmt string, pageSize int, fn func(row cqlRow) bool, args ...interface{}) error
+}
+
+// cqlRow holds the values of the columns of a row as sent by the cluster,
+// nil being null
+type cqlRow [][]byte
+
+// Bytes returns a blob or text column.
+func (r cqlRow) Bytes(i int) []byte {
+	return r[i]
+}
+
+// Bool returns a boolean column, or false if null.
+func (r cqlRow) Bool(i int) bool {
+	return len(r[i]) == 1 && r[i][0] != 0
+}
+
+// cqlValue takes the value of a column as sent by the cluster, whatever its
+// type.
+type cqlValue []byte
+
+func (v *cqlValue) UnmarshalCQL(info gocql.TypeInfo, data []byte) error {
+	if data == nil {
+		*v = nil
+	} else {
+		*v = append([]byte{}, data...)
+	}
+	return nil
+}
+
+// gocqlSession runs the statements of a CassandraStore with gocql.
+type gocqlSession struct {
+	*gocql.Session
+}
+
+func (s gocqlSession) query(stmt string, routingKey []byte, args []interface{}) *gocql.Query {
+	q := s.Session.Query(stmt, args...)
+	if routingKey != nil {
+		q = q.RoutingKey(routingKey)
+	}
+	return q
+}
+
+// scan returns the next row of iter, if there is one.
+func scan(iter *gocql.Iter) (cqlRow, bool) {
+	values := make([]cqlValue, len(iter.Columns()))
+	dest := make([]interface{}, len(values))
+	for i := range values {
+		dest[i] = &values[i]
+	}
+	if !iter.Scan(dest...) {
+		return nil, false
+	}
+	row := make(cqlRow, len(values))
+	for i, value := range values {
+		row[i] = value
+	}
+	return row, true
+}
+
+func (s gocqlSession) Exec(stmt string, routingKey []byte, args ...interface{}) error {
+	return s.query(stmt, routingKey, args).Exec()
+}
+
+func (s gocqlSession) Query(stmt string, routingKey []byte, args ...interface{}) ([]cqlRow, error) {
+	iter := s.query(stmt, routingKey, args).Iter()
+	var rows []cqlRow
+	for {
+		row, ok := scan(iter)
+		if !ok {
+			break
+		}
+		rows = append(rows, row)
+	}
+	return rows, iter.Close()
+}
+
+func (s gocqlSession) Iter(stmt string, pageSize int, fn func(row cqlRow) bool, args ...interface{}) error {
+	iter := s.query(stmt, nil, args).PageSize(pageSize).Iter()
+	for {
+		row, ok := scan(iter)
+		if !ok || !fn(row) {
+			break
+		}
+	}
+	return iter.Close()
+}
+
+// CassandraStore keeps pastes in a Cassandra or Scylla cluster, for
+// instances with more pastes than fit in the memory of a single machine.
+//
+// Each paste is a partition of the pastes table, keyed by its id, so
+// that the cluster spreads them among its nodes and each statement is sent
+// straight to a node holding the paste. Its content is the row with version
+// 0, its previous versions are the rows numbered from 1, and its
+// attributes are a static column shared by all of them. Every cell is
+// written with a ttl, so the cluster deletes pastes once they expire even
+// if pastecat is not running.
+//
+// Pastes already in the cluster are not loaded at startup, as there may be
+// too many, so they are neither counted in the stats nor deleted by
+// pastecat, which leaves their expiry to their ttl.
+type CassandraStore struct {
+	session  cqlSession
+	lifeTime time.Duration
+
+	getStmt    string
+	putStmt    string
+	setStmt    string
+	rowStmt    string
+	updateStmt string
+	deleteStmt string
+	batchStmt  string
+	trimStmt   string
+	listStmt   string
+
+	// writing is held while updating pastes, which reads them first
+	writing sync.Mutex
+
+	mu    sync.Mutex
+	views map[ID]int64
+}
+
+// CassandraConfig holds how to connect to a cluster and lay out the data
+type CassandraConfig struct {
+	// Hosts are some of the nodes of the cluster, with port 9042 if
+	// none is given
+	Hosts    []string
+	Keyspace string
+	// Replication is the replication factor of the keyspace if it has to
+	// be created, like "3", or the factor in each datacenter separated by
+	// semicolons, like "dc1:3;dc2:3"
+	Replication string
+	Consistency gocql.Consistency
+	Username    string
+	Password    string
+}
+
+func init() {
+	Register("cassandra", map[string]string{
+		"hosts":       "localhost:9042",
+		"keyspace":    "pastecat",
+		"replication": "1",
+		"consistency": "local_quorum",
+		"user":        "",
+		"password":    "",
+	}, func(c Config) (Store, error) {
+		cons, err := gocql.ParseConsistencyWrapper(c.Params["consistency"])
+		if err != nil {
+			return nil, err
+		}
+		s, err := NewCassandraStore(c.LifeTime, CassandraConfig{
+			Hosts:       strings.FieldsFunc(c.Params["hosts"], func(r rune) bool { return r == ';' || r == ' ' }),
+			Keyspace:    c.Params["keyspace"],
+			Replication: c.Params["replication"],
+			Consistency: cons,
+			Username:    c.Params["user"],
+			Password:    c.Params["password"],
+		})
+		if err != nil {
+			return nil, err
+		}
+		return s, nil
+	})
+}
+
+// replicationMap returns the CQL map of the replication of a keyspace.
+func replicationMap(replication string) (string, error) {
+	if n, err := strconv.Atoi(replication); err == nil && n > 0 {
+		return fmt.Sprintf("{'class': 'SimpleStrategy', 'replication_factor': %d}", n), nil
+	}
+	m := "{'class': 'NetworkTopologyStrategy'"
+	for _, dc := range strings.Split(replication, ";") {
+		i := strings.LastIndexByte(dc, ':')
+		if i < 0 {
+			return "", fmt.Errorf("invalid replication: %s", replication)
+		}
+		n, err := strconv.Atoi(dc[i+1:])
+		if err != nil || n < 1 || strings.ContainsAny(dc[:i], "'") {
+			return "", fmt.Errorf("invalid replication: %s", replication)
+		}
+		m += fmt.Sprintf(", '%s': %d", dc[:i], n)
+	}
+	return m + "}", nil
+}
+
+// NewCassandraStore connects to a cluster, creating the keyspace and the
+// table if they do not exist yet.
+func NewCassandraStore(lifeTime time.Duration, c CassandraConfig) (*CassandraStore, error) {
+	if len(c.Hosts) == 0 {
+		return nil, errors.New("cassandra store needs hosts")
+	}
+	hosts := make([]string, len(c.Hosts))
+	for i, host := range c.Hosts {
+		if _, _, err := net.SplitHostPort(host); err != nil {
+			host = net.JoinHostPort(host, "9042")
+		}
+		hosts[i] = host
+	}
+	cluster := gocql.NewCluster(hosts...)
+	cluster.Consistency = c.Consistency
+	// Send each statement straight to a node holding its paste
+	cluster.PoolConfig.HostSelectionPolicy = gocql.TokenAwareHostPolicy(gocql.RoundRobinHostPolicy())
+	if c.Username != "" {
+		cluster.Authenticator = gocql.PasswordAuthenticator{
+			Username: c.Username,
+			Password: c.Password,
+		}
+	}
+	session, err := cluster.CreateSession()
+	if err != nil {
+		return nil, err
+	}
+	s, err := newCassandraStore(gocqlSession{session}, lifeTime, c.Keyspace, c.Replication)
+	if err != nil {
+		session.Close()
+		return nil, err
+	}
+	// The table may have just been created by another statement
+	if err := session.AwaitSchemaAgreement(context.Background()); err != nil {
+		session.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+func newCassandraStore(session cqlSession, lifeTime time.Duration, keyspace, replication string) (*CassandraStore, error) {
+	if !keyspaceRegex.MatchString(keyspace) {
+		return nil, fmt.Errorf("invalid keyspace: %s", keyspace)
+	}
+	repl, err := replicationMap(replication)
+	if err != nil {
+		return nil, err
+	}
+	table := keyspace + ".pastes"
+	setStmt := "INSERT INTO " + table + " (id, version, content, meta) VALUES (?, 0, ?, ?)"
+	rowStmt := "INSERT INTO " + table + " (id, version, content) VALUES (?, ?, ?)"
+	s := &CassandraStore{
+		session:  session,
+		lifeTime: lifeTime,
+		getStmt:  "SELECT content, meta FROM " + table + " WHERE id = ? AND version = ?",
+		putStmt:  setStmt + " IF NOT EXISTS USING TTL ?",
+		setStmt:  setStmt + " USING TTL ?",
+		rowStmt:  rowStmt + " USING TTL ?",
+		updateStmt: "BEGIN UNLOGGED BATCH " +
+			rowStmt + " USING TTL ?; " +
+			setStmt + " USING TTL ?; " +
+			"APPLY BATCH",
+		deleteStmt: "DELETE FROM " + table + " WHERE id = ?",
+		batchStmt:  "DELETE FROM " + table + " WHERE id IN ",
+		trimStmt:   "DELETE FROM " + table + " WHERE id = ? AND version > ?",
+		listStmt:   "SELECT DISTINCT id, meta FROM " + table,
+		views:      make(map[ID]int64),
+	}
+	if err := session.Exec("CREATE KEYSPACE IF NOT EXISTS "+keyspace+
+		" WITH replication = "+repl, nil); err != nil {
+		return nil, fmt.Errorf("cannot create keyspace: %v", err)
+	}
+	if err := session.Exec("CREATE TABLE IF NOT EXISTS "+table+" ("+
+		"id blob, version int, content blob, meta text static, "+
+		"PRIMARY KEY (id, version))", nil); err != nil {
+		return nil, fmt.Errorf("cannot create table: %v", err)
+	}
+	return s, nil
+}
+
+// ttl returns the seconds a paste written now has left, zero if it never
+// expires, or false if it expired already. It is a second longer than
+// the paste's lifetime, so that the paste can still be deleted by
+// pastecat when it expires, freeing its space in the stats.
+func (s *CassandraStore) ttl(meta Meta, modTime time.Time) (int, bool) {
+	lifeTime := meta.EffectiveLifeTime(s.lifeTime)
+	if lifeTime == 0 {
+		return 0, true
+	}
+	left := meta.Created(modTime).Add(lifeTime).Sub(clock.Now())
+	if left <= 0 {
+		return 0, false
+	}
+	secs := int(math.Ceil(left.Seconds())) + 1
+	if secs > cassandraMaxTTL {
+		secs = cassandraMaxTTL
+	}
+	return secs, true
+}
+
+// get returns a row of a paste, along with the paste's attributes.
+func (s *CassandraStore) get(id ID, version int) (blobRecord, []byte, error) {
+	var rec blobRecord
+	rows, err := s.session.Query(s.getStmt, id[:], id[:], version)
+	if err != nil {
+		return rec, nil, err
+	}
+	if len(rows) == 0 || rows[0].Bytes(0) == nil || rows[0].Bytes(1) == nil {
+		return rec, nil, ErrPasteNotFound
+	}
+	if err := json.Unmarshal(rows[0].Bytes(1), &rec); err != nil {
+		return rec, nil, corrupted(fmt.Errorf("invalid attributes of paste %s: %v", id, err))
+	}
+	return rec, rows[0].Bytes(0), nil
+}
+
+func (s *CassandraStore) view(id ID) int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.views[id]++
+	return s.views[id]
+}
+
+func (s *CassandraStore) Get(id ID) (Paste, error) {
+	rec, content, err := s.get(id, 0)
+	if err != nil {
+		return nil, err
+	}
+	return MemPaste{content: bytes.NewReader(content), cache: &memCache{
+		modTime: rec.ModTime,
+		size:    rec.Size,
+		meta:    rec.Meta,
+	}, views: s.view(id)}, nil
+}
+
+func (s *CassandraStore) Put(content []byte, meta Meta) (ID, error) {
+	now := clock.Now()
+	rec, err := json.Marshal(blobRecord{ModTime: now, Size: int64(len(content)), Meta: meta})
+	if err != nil {
+		return ID{}, err
+	}
+	ttl, _ := s.ttl(meta, now)
+	for try := 0; try < randTries; try++ {
+		id, err := randomID(func(ID) bool { return true })
+		if err != nil {
+			return id, err
+		}
+		rows, err := s.session.Query(s.putStmt, id[:], id[:], content, string(rec), ttl)
+		if err != nil {
+			return id, err
+		}
+		if len(rows) > 0 && !rows[0].Bool(0) {
+			// The id was taken
+			continue
+		}
+		return id, nil
+	}
+	return ID{}, ErrNoUnusedIDFound
+}
+
+func (s *CassandraStore) Delete(id ID) error {
+	if _, _, err := s.get(id, 0); err != nil {
+		return err
+	}
+	if err := s.session.Exec(s.deleteStmt, id[:], id[:]); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	delete(s.views, id)
+	s.mu.Unlock()
+	return nil
+}
+
+// DeleteBatch deletes many pastes with a single statement, which cannot be
+// sent straight to a node holding them as they are spread among the cluster.
+func (s *CassandraStore) DeleteBatch(ids []ID) error {
+	if len(ids) == 0 {
+		return nil
+	}
+	args := make([]interface{}, len(ids))
+	for i := range ids {
+		args[i] = ids[i][:]
+	}
+	stmt := s.batchStmt + "(?" + strings.Repeat(", ?", len(ids)-1) + ")"
+	if err := s.session.Exec(stmt, nil, args...); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	for _, id := range ids {
+		delete(s.views, id)
+	}
+	s.mu.Unlock()
+	return nil
+}
+
+func (s *CassandraStore) Update(id ID, content []byte, meta Meta) error {
+	s.writing.Lock()
+	defer s.writing.Unlock()
+	old, oldContent, err := s.get(id, 0)
+	if err != nil {
+		return err
+	}
+	meta.Versions = append(append([]Version(nil), old.Meta.Versions...), Version{
+		ModTime: old.ModTime,
+		Size:    old.Size,
+		Binary:  old.Meta.Binary,
+		Hash:    old.Meta.Hash,
+	})
+	now := clock.Now()
+	ttl, alive := s.ttl(meta, now)
+	if !alive {
+		return ErrPasteNotFound
+	}
+	rec, err := json.Marshal(blobRecord{ModTime: now, Size: int64(len(content)), Meta: meta})
+	if err != nil {
+		return err
+	}
+	// Both rows are in the same partition, so they are written at once
+	return s.session.Exec(s.updateStmt, id[:],
+		id[:], len(meta.Versions), oldContent, ttl,
+		id[:], content, string(rec), ttl)
+}
+
+func (s *CassandraStore) Copy(id ID, content []byte, meta Meta, modTime time.Time, versions [][]byte) error {
+	if len(versions) != len(meta.Versions) {
+		return fmt.Errorf("got %d versions, want %d", len(versions), len(meta.Versions))
+	}
+	ttl, alive := s.ttl(meta, modTime)
+	if !alive {
+		// Expired already
+		return nil
+	}
+	rec, err := json.Marshal(blobRecord{ModTime: modTime, Size: int64(len(content)), Meta: meta})
+	if err != nil {
+		return err
+	}
+	s.writing.Lock()
+	defer s.writing.Unlock()
+	// Drop the versions of a paste being replaced first, as deleting and
+	// writing the same rows at once would lose the writes
+	if err := s.session.Exec(s.trimStmt, id[:], id[:], len(versions)); err != nil {
+		return err
+	}
+	for i, version := range versions {
+		if err := s.session.Exec(s.rowStmt, id[:], id[:], i+1, version, ttl); err != nil {
+			return err
+		}
+	}
+	return s.session.Exec(s.setStmt, id[:], id[:], content, string(rec), ttl)
+}
+
+func (s *CassandraStore) GetVersion(id ID, version int) (Paste, error) {
+	if version < 1 {
+		return nil, ErrPasteNotFound
+	}
+	rec, content, err := s.get(id, version)
+	if err != nil {
+		return nil, err
+	}
+	if version > len(rec.Meta.Versions) {
+		return nil, ErrPasteNotFound
+	}
+	v := rec.Meta.Versions[version-1]
+	return MemPaste{content: bytes.NewReader(content), cache: &memCache{
+		modTime: v.ModTime,
+		size:    v.Size,
+		meta:    rec.Meta.versionMeta(v),
+	}, views: s.view(id)}, nil
+}
+
+func (s *CassandraStore) Iterate(fn func(id ID, info Info) bool) error {
+	var err error
+	iterErr := s.session.Iter(s.listStmt, cassandraPageSize, func(row cqlRow) bool {
+		var id ID
+		if len(row.Bytes(0)) != len(id) || row.Bytes(1) == nil {
+			return true
+		}
+		copy(id[:], row.Bytes(0))
+		var rec blobRecord
+		if err = json.Unmarshal(row.Bytes(1), &rec); err != nil {
+			err = fmt.Errorf("invalid attributes of paste %s: %v", id, err)
+			return false
+		}
+		s.mu.Lock()
+		views := s.views[id]
+		s.mu.Unlock()
+		return fn(id, Info{
+			Meta:    rec.Meta,
+			ModTime: rec.ModTime,
+			Size:    rec.Size,
+			Views:   views,
+		})
+	})
+	if iterErr != nil {
+		return iterErr
+	}
+	return err
+}
@@ -0,0 +1,196 @@
+package storage
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+type fakePartition struct {
+	meta string
+	rows map[int][]byte
+	ttls map[int]int
+}
+
+// fakeSession runs the statements of a CassandraStore on partitions in
+// memory. Cells never expire on their own.
+type fakeSession struct {
+	t          *testing.T
+	created    []string
+	partitions map[string]*fakePartition
+}
+
+func (f *fakeSession) partition(id interface{}) *fakePartition {
+	key := string(id.([]byte))
+	p, e := f.partitions[key]
+	if !e {
+		p = &fakePartition{rows: make(map[int][]byte), ttls: make(map[int]int)}
+		f.partitions[key] = p
+	}
+	return p
+}
+
+func (f *fakeSession) Exec(stmt string, routingKey []byte, args ...interface{}) error {
+	_, err := f.Query(stmt, routingKey, args...)
+	return err
+}
+
+func (f *fakeSession) Query(stmt string, routingKey []byte, args ...interface{}) ([]cqlRow, error) {
+	if strings.HasPrefix(stmt, "CREATE") {
+		f.created = append(f.created, stmt)
+		return nil, nil
+	}
+	if strings.Contains(stmt, "WHERE id IN (") {
+		for _, id := range args {
+			delete(f.partitions, string(id.([]byte)))
+		}
+		return nil, nil
+	}
+	if routingKey == nil || string(routingKey) != string(args[0].([]byte)) {
+		f.t.Errorf("%q not routed by the paste id", stmt)
+	}
+	p := f.partition(args[0])
+	switch {
+	case strings.HasPrefix(stmt, "SELECT content, meta"):
+		content, e := p.rows[args[1].(int)]
+		if !e {
+			return nil, nil
+		}
+		return []cqlRow{{content, []byte(p.meta)}}, nil
+	case strings.HasPrefix(stmt, "BEGIN UNLOGGED BATCH"):
+		p.rows[args[1].(int)], p.ttls[args[1].(int)] = args[2].([]byte), args[3].(int)
+		p.rows[0], p.ttls[0], p.meta = args[5].([]byte), args[7].(int), args[6].(string)
+	case strings.HasSuffix(stmt, "IF NOT EXISTS USING TTL ?"):
+		if _, e := p.rows[0]; e {
+			return []cqlRow{{[]byte{0}}}, nil
+		}
+		p.rows[0], p.ttls[0], p.meta = args[1].([]byte), args[3].(int), args[2].(string)
+		return []cqlRow{{[]byte{1}}}, nil
+	case strings.Contains(stmt, "(id, version, content, meta)"):
+		p.rows[0], p.ttls[0], p.meta = args[1].([]byte), args[3].(int), args[2].(string)
+	case strings.Contains(stmt, "(id, version, content)"):
+		p.rows[args[1].(int)], p.ttls[args[1].(int)] = args[2].([]byte), args[3].(int)
+	case strings.HasSuffix(stmt, "AND version > ?"):
+		for v := range p.rows {
+			if v > args[1].(int) {
+				delete(p.rows, v)
+			}
+		}
+	case strings.HasPrefix(stmt, "DELETE"):
+		delete(f.partitions, string(args[0].([]byte)))
+	default:
+		return nil, fmt.Errorf("unexpected statement %q", stmt)
+	}
+	return nil, nil
+}
+
+func (f *fakeSession) Iter(stmt string, pageSize int, fn func(row cqlRow) bool, args ...interface{}) error {
+	if !strings.HasPrefix(stmt, "SELECT DISTINCT id, meta") {
+		return fmt.Errorf("unexpected statement %q", stmt)
+	}
+	var keys []string
+	for key, p := range f.partitions {
+		if p.meta != "" {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		if !fn(cqlRow{[]byte(key), []byte(f.partitions[key].meta)}) {
+			break
+		}
+	}
+	return nil
+}
+
+func TestCassandraStore(t *testing.T) {
+	f := &fakeSession{t: t, partitions: make(map[string]*fakePartition)}
+	if _, err := newCassandraStore(f, time.Hour, "paste-cat", "1"); err == nil {
+		t.Errorf("newCassandraStore() with an invalid keyspace did not fail")
+	}
+	if _, err := newCassandraStore(f, time.Hour, "pastecat", "dc1=3"); err == nil {
+		t.Errorf("newCassandraStore() with an invalid replication did not fail")
+	}
+	s, err := newCassandraStore(f, time.Hour, "pastecat", "dc1:3;dc2:2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "CREATE KEYSPACE IF NOT EXISTS pastecat WITH replication = " +
+		"{'class': 'NetworkTopologyStrategy', 'dc1': 3, 'dc2': 2}"
+	if len(f.created) != 2 || f.created[0] != want {
+		t.Errorf("created %q, want %q first", f.created, want)
+	}
+
+	id, err := s.Put([]byte("foo"), Meta{LifeTime: 10 * time.Minute})
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := f.partitions[string(id[:])]
+	if ttl := p.ttls[0]; ttl != 601 {
+		t.Errorf("Put() set a ttl of %d, want 601", ttl)
+	}
+	if err := s.Update(id, []byte("barbar"), Meta{LifeTime: 10 * time.Minute}); err != nil {
+		t.Fatal(err)
+	}
+	if ttl := p.ttls[1]; ttl <= 540 || ttl > 601 {
+		t.Errorf("Update() set a ttl of %d, want the rest of 601", ttl)
+	}
+	paste, err := s.Get(id)
+	if got := readPaste(t, paste, err); got != "barbar" {
+		t.Errorf("Get() got %q, want %q", got, "barbar")
+	}
+	paste, err = s.GetVersion(id, 1)
+	if got := readPaste(t, paste, err); got != "foo" {
+		t.Errorf("GetVersion() got %q, want %q", got, "foo")
+	}
+	if _, err := s.GetVersion(id, 2); err != ErrPasteNotFound {
+		t.Errorf("GetVersion() of a missing version got %v, want %v", err, ErrPasteNotFound)
+	}
+
+	other, err := s.Put([]byte("other"), Meta{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ttl := f.partitions[string(other[:])].ttls[0]; ttl != 3601 {
+		t.Errorf("Put() set a ttl of %d, want 3601", ttl)
+	}
+	// Copying a paste over another drops the versions it had
+	if err := s.Copy(id, []byte("copied"), Meta{}, time.Now(), nil); err != nil {
+		t.Fatal(err)
+	}
+	if len(p.rows) != 1 || string(p.rows[0]) != "copied" {
+		t.Errorf("Copy() left %d rows, want only the copied content", len(p.rows))
+	}
+
+	listed := make(map[ID]Info)
+	s.Iterate(func(id ID, info Info) bool {
+		listed[id] = info
+		return true
+	})
+	if len(listed) != 2 || listed[id].Size != 6 || listed[id].Views != 2 {
+		t.Errorf("Iterate() listed %v, want two pastes, one of 6 bytes viewed twice", listed)
+	}
+
+	if err := s.Delete(other); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Get(other); err != ErrPasteNotFound {
+		t.Errorf("Get() of a deleted paste got %v, want %v", err, ErrPasteNotFound)
+	}
+	if err := s.Delete(other); err != ErrPasteNotFound {
+		t.Errorf("Delete() of a deleted paste got %v, want %v", err, ErrPasteNotFound)
+	}
+
+	third, err := s.Put([]byte("third"), Meta{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.DeleteBatch([]ID{id, other, third}); err != nil {
+		t.Fatal(err)
+	}
+	if len(f.partitions) != 0 {
+		t.Errorf("DeleteBatch() left %d pastes, want none", len(f.partitions))
+	}
+}
@@ -0,0 +1,159 @@
+package storage
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeDAV is a WebDAV server keeping its files in memory, with a quota on
+// how many bytes they can take.
+type fakeDAV struct {
+	sync.Mutex
+	files map[string][]byte
+	dirs  map[string]bool
+	quota int
+	used  int
+}
+
+func (f *fakeDAV) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.Lock()
+	defer f.Unlock()
+	p := path.Clean(r.URL.Path)
+	switch r.Method {
+	case "GET":
+		content, e := f.files[p]
+		if !e {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write(content)
+	case "PUT":
+		if !f.dirs[path.Dir(p)] {
+			w.WriteHeader(http.StatusConflict)
+			return
+		}
+		content, _ := ioutil.ReadAll(r.Body)
+		if f.used+len(content)-len(f.files[p]) > f.quota {
+			w.WriteHeader(http.StatusInsufficientStorage)
+			return
+		}
+		f.used += len(content) - len(f.files[p])
+		f.files[p] = content
+		w.WriteHeader(http.StatusCreated)
+	case "DELETE":
+		content, e := f.files[p]
+		if !e {
+			http.NotFound(w, r)
+			return
+		}
+		f.used -= len(content)
+		delete(f.files, p)
+		w.WriteHeader(http.StatusNoContent)
+	case "MKCOL":
+		if f.dirs[p] {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		if !f.dirs[path.Dir(p)] {
+			w.WriteHeader(http.StatusConflict)
+			return
+		}
+		f.dirs[p] = true
+		w.WriteHeader(http.StatusCreated)
+	case "PROPFIND":
+		if r.Header.Get("Depth") != "1" || !f.dirs[p] {
+			http.NotFound(w, r)
+			return
+		}
+		w.WriteHeader(http.StatusMultiStatus)
+		fmt.Fprint(w, `<?xml version="1.0"?><d:multistatus xmlns:d="DAV:">`)
+		entry := func(p string, dir bool) {
+			resType := ""
+			if dir {
+				resType, p = "<d:collection/>", p+"/"
+			}
+			fmt.Fprintf(w, `<d:response><d:href>%s</d:href><d:propstat><d:prop>`+
+				`<d:resourcetype>%s</d:resourcetype></d:prop></d:propstat></d:response>`, p, resType)
+		}
+		entry(p, true)
+		for dir := range f.dirs {
+			if path.Dir(dir) == p && dir != p {
+				entry(dir, true)
+			}
+		}
+		for file := range f.files {
+			if path.Dir(file) == p {
+				entry(file, false)
+			}
+		}
+		fmt.Fprint(w, `</d:multistatus>`)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func TestDAVStore(t *testing.T) {
+	dav := &fakeDAV{
+		files: make(map[string][]byte),
+		dirs:  map[string]bool{"/": true, "/remote": true},
+		quota: 1000,
+	}
+	srv := httptest.NewServer(dav)
+	defer srv.Close()
+	url := srv.URL + "/remote/pastes"
+
+	s, err := NewDAVStore(&Stats{}, nil, 0, url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, err := s.Put([]byte("foo"), Meta{Title: "first"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Update(id, []byte("barbar"), Meta{Title: "second"}); err != nil {
+		t.Fatal(err)
+	}
+	other, err := s.Put([]byte("other"), Meta{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Delete(other); err != nil {
+		t.Fatal(err)
+	}
+	wantPath := "/remote/pastes/" + id.String()[:2] + "/" + id.String()
+	if got := string(dav.files[wantPath]); got != "barbar" {
+		t.Errorf("paste stored at %s is %q, want %q", wantPath, got, "barbar")
+	}
+
+	// A new store finds the pastes already in the directory
+	stats := &Stats{}
+	s2, err := NewDAVStore(stats, nil, 0, url+"/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if num, stg := stats.Report(); num != 1 || stg != 9 {
+		t.Errorf("recovered %d pastes taking %d bytes, want 1 and 9", num, stg)
+	}
+	p, err := s2.Get(id)
+	if got := readPaste(t, p, err); got != "barbar" {
+		t.Errorf("Get() got %q, want %q", got, "barbar")
+	}
+	p, err = s2.GetVersion(id, 1)
+	if got := readPaste(t, p, err); got != "foo" {
+		t.Errorf("GetVersion() got %q, want %q", got, "foo")
+	}
+	if _, err := s2.Get(other); err != ErrPasteNotFound {
+		t.Errorf("Get() of a deleted paste got %v, want %v", err, ErrPasteNotFound)
+	}
+
+	// Running out of quota
+	if _, err := s2.Put([]byte(strings.Repeat("x", 2000)), Meta{}); err != ErrDiskFull {
+		t.Errorf("Put() over the quota got %v, want %v", err, ErrDiskFull)
+	}
+}
@@ -0,0 +1,166 @@
+// Copyright (c) 2014-2015, Daniel Martí <mvdan@mvdan.cc>
+// See LICENSE for licensing information
+
+package storage
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Errors that plugins reply with which have a meaning of their own. Any
+// other error is passed along as it is.
+const (
+	execNotFound = "not found"
+	execFull     = "full"
+)
+
+// execRequest is a line sent to a plugin. Value is only set for puts.
+type execRequest struct {
+	Op    string `json:"op"`
+	Key   string `json:"key,omitempty"`
+	Value []byte `json:"value,omitempty"`
+}
+
+// execResponse is a line a plugin replies with. Value is only set for gets
+// and Keys for lists.
+type execResponse struct {
+	Value []byte   `json:"value,omitempty"`
+	Keys  []string `json:"keys,omitempty"`
+	Error string   `json:"error,omitempty"`
+}
+
+// execPlugin runs a plugin, restarting it if it stops replying, and sends
+// it one request at a time.
+type execPlugin struct {
+	mu    sync.Mutex
+	args  []string
+	cmd   *exec.Cmd
+	stdin io.WriteCloser
+	enc   *json.Encoder
+	dec   *json.Decoder
+}
+
+func (p *execPlugin) start() error {
+	cmd := exec.Command(p.args[0], p.args[1:]...)
+	cmd.Stderr = os.Stderr
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	p.cmd, p.stdin = cmd, stdin
+	p.enc = json.NewEncoder(stdin)
+	p.dec = json.NewDecoder(bufio.NewReader(stdout))
+	return nil
+}
+
+func (p *execPlugin) stop() {
+	p.stdin.Close()
+	p.cmd.Process.Kill()
+	p.cmd.Wait()
+	p.cmd = nil
+}
+
+func (p *execPlugin) call(req execRequest) (execResponse, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	var resp execResponse
+	if p.cmd == nil {
+		if err := p.start(); err != nil {
+			return resp, fmt.Errorf("could not start %s: %v", p.args[0], err)
+		}
+	}
+	if err := p.enc.Encode(req); err != nil {
+		p.stop()
+		return resp, fmt.Errorf("could not send %s to %s: %v", req.Op, p.args[0], err)
+	}
+	if err := p.dec.Decode(&resp); err != nil {
+		p.stop()
+		return resp, fmt.Errorf("no reply to %s from %s: %v", req.Op, p.args[0], err)
+	}
+	switch resp.Error {
+	case "":
+		return resp, nil
+	case execNotFound:
+		return resp, ErrPasteNotFound
+	case execFull:
+		return resp, ErrDiskFull
+	}
+	return resp, fmt.Errorf("%s failed to %s %s: %s", p.args[0], req.Op, req.Key, resp.Error)
+}
+
+func (p *execPlugin) get(key string) ([]byte, error) {
+	resp, err := p.call(execRequest{Op: "get", Key: key})
+	return resp.Value, err
+}
+
+func (p *execPlugin) put(key string, value []byte) error {
+	_, err := p.call(execRequest{Op: "put", Key: key, Value: value})
+	return err
+}
+
+func (p *execPlugin) delete(key string) error {
+	_, err := p.call(execRequest{Op: "delete", Key: key})
+	if err == ErrPasteNotFound {
+		return nil
+	}
+	return err
+}
+
+func (p *execPlugin) list() ([]string, error) {
+	resp, err := p.call(execRequest{Op: "list"})
+	return resp.Keys, err
+}
+
+func init() {
+	Register("exec", map[string]string{"cmd": ""}, func(c Config) (Store, error) {
+		s, err := NewExecStore(c.Stats, c.OnExpire, c.LifeTime, c.Params["cmd"])
+		if err != nil {
+			return nil, err
+		}
+		return s, nil
+	})
+}
+
+// NewExecStore keeps pastes in a plugin, a program that it runs with a
+// command line split on spaces and talks to through its standard input and
+// output. Each request is a line holding a JSON object like
+// {"op":"put","key":"a63d03b9","value":"Zm9vCg=="}, and each reply is
+// another like {"value":"Zm9vCg=="}, with values encoded as base64. The
+// plugin only needs to store values under keys:
+//
+//	get    replies with the value under key
+//	put    stores value under key, replacing any other
+//	delete removes key
+//	list   replies with all the keys, as {"keys":[...]}
+//
+// Failures are replied to with {"error":"..."}, where "not found" means
+// that there is no such key, and "full" that there is no space left. The
+// plugin's standard error is passed along, and it is started again if it
+// exits or replies with something other than a line of JSON.
+func NewExecStore(stats *Stats, onExpire ExpireFunc, lifeTime time.Duration, cmd string) (*BlobStore, error) {
+	args := strings.Fields(cmd)
+	if len(args) == 0 {
+		return nil, errors.New("exec store needs a command to run as cmd")
+	}
+	s, err := newBlobStore(&execPlugin{args: args}, stats, onExpire, lifeTime)
+	if err != nil {
+		return nil, fmt.Errorf("cannot recover pastes from %s: %v", args[0], err)
+	}
+	return s, nil
+}
@@ -0,0 +1,129 @@
+package storage
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+const execPluginDirEnv = "PASTECAT_TEST_EXEC_PLUGIN_DIR"
+
+// TestExecPlugin is not a test, but a plugin run by TestExecStore that
+// keeps each value in a file in a directory.
+func TestExecPlugin(t *testing.T) {
+	dir := os.Getenv(execPluginDirEnv)
+	if dir == "" {
+		t.Skip("only run as a plugin")
+	}
+	dec := json.NewDecoder(os.Stdin)
+	enc := json.NewEncoder(os.Stdout)
+	for {
+		var req execRequest
+		if err := dec.Decode(&req); err != nil {
+			os.Exit(0)
+		}
+		var resp execResponse
+		path := filepath.Join(dir, req.Key)
+		var err error
+		switch req.Op {
+		case "get":
+			resp.Value, err = ioutil.ReadFile(path)
+		case "put":
+			err = ioutil.WriteFile(path, req.Value, 0600)
+		case "delete":
+			err = os.Remove(path)
+		case "list":
+			var fis []os.FileInfo
+			fis, err = ioutil.ReadDir(dir)
+			for _, fi := range fis {
+				resp.Keys = append(resp.Keys, fi.Name())
+			}
+		}
+		if os.IsNotExist(err) {
+			resp.Error = execNotFound
+		} else if err != nil {
+			resp.Error = err.Error()
+		}
+		enc.Encode(resp)
+	}
+}
+
+func readPaste(t *testing.T, p Paste, err error) string {
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+	b, err := ioutil.ReadAll(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b)
+}
+
+func TestExecStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pastecat-exec")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	os.Setenv(execPluginDirEnv, dir)
+	defer os.Unsetenv(execPluginDirEnv)
+	cmd := os.Args[0] + " -test.run=^TestExecPlugin$"
+
+	s, err := NewExecStore(&Stats{}, nil, 0, cmd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, err := s.Put([]byte("foo"), Meta{Title: "first"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Update(id, []byte("barbar"), Meta{Title: "second"}); err != nil {
+		t.Fatal(err)
+	}
+	other, err := s.Put([]byte("other"), Meta{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Delete(other); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Get(other); err != ErrPasteNotFound {
+		t.Errorf("Get() of a deleted paste got %v, want %v", err, ErrPasteNotFound)
+	}
+
+	// A new store finds the pastes already in the plugin
+	stats := &Stats{}
+	s2, err := NewExecStore(stats, nil, 0, cmd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if num, stg := stats.Report(); num != 1 || stg != 9 {
+		t.Errorf("recovered %d pastes taking %d bytes, want 1 and 9", num, stg)
+	}
+	p, err := s2.Get(id)
+	if got := readPaste(t, p, err); got != "barbar" {
+		t.Errorf("Get() got %q, want %q", got, "barbar")
+	}
+	if p.Meta().Title != "second" || len(p.Meta().Versions) != 1 {
+		t.Errorf("Get() got attributes %+v", p.Meta())
+	}
+	p, err = s2.GetVersion(id, 1)
+	if got := readPaste(t, p, err); got != "foo" {
+		t.Errorf("GetVersion() got %q, want %q", got, "foo")
+	}
+
+	// The plugin is started again if it goes away
+	plugin := s2.blobs.(*execPlugin)
+	plugin.cmd.Process.Kill()
+	plugin.cmd.Wait()
+	if _, err := s2.Get(id); err == nil {
+		t.Errorf("Get() from a killed plugin did not fail")
+	}
+	p, err = s2.Get(id)
+	if got := readPaste(t, p, err); got != "barbar" {
+		t.Errorf("Get() after restarting got %q, want %q", got, "barbar")
+	}
+}
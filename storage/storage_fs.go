@@ -4,32 +4,112 @@
 package storage
 
 import (
-	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
+	"log"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 )
 
+// Suffix of the files holding the attributes of the paste with the same
+// path minus the suffix
+const metaSuffix = ".meta"
+
+// Suffix of the files holding a previous version of the paste with the
+// same path minus the suffix, followed by the version's number
+const versionSuffix = ".v"
+
+// Suffix of the files being written to replace the file with the same path
+// minus the suffix
+const tmpSuffix = ".tmp"
+
+// Name of the file locked by the processes sharing a directory
+const lockFile = ".lock"
+
+// Name of the file locked by the processes using a directory for as long as
+// they run
+const holdFile = ".hold"
+
+// Name of the lock file created by the processes sharing a directory on a
+// network filesystem
+const nfsLockFile = ".nfslock"
+
+// How often a store on a network filesystem checks the directory for pastes
+// added or removed by other hosts
+const nfsRescanInterval = time.Minute
+
+var (
+	// ErrDirInUse means that a directory could not be used exclusively,
+	// as other processes are sharing it
+	ErrDirInUse = errors.New("directory in use by other processes")
+	// ErrDirHeld means that a directory is in exclusive use by another
+	// process
+	ErrDirHeld = errors.New("directory in exclusive use by another process")
+)
+
+// errStale means that a cached paste may have been changed by another
+// process sharing the directory
+var errStale = errors.New("stale paste")
+
+// locker is held while changing the pastes in a directory shared by many
+// processes
+type locker interface {
+	lock() error
+	unlock()
+}
+
+// FileStore keeps pastes as files in a directory. Many processes may share
+// the directory, each noticing the changes made by the others when reading
+// a paste. Pastes are only listed by the processes that know about them.
+//
+// The size, modification time and attributes of every paste are kept in
+// memory. Unless the store has its directory to itself, they are checked
+// against the files when reading a paste.
 type FileStore struct {
 	sync.RWMutex
-	cache map[ID]fileCache
-	dir   string
+	cache  map[ID]*fileCache
+	dir    string
+	layout Layout
+	flock  locker
+	// network is whether the directory is on a network filesystem, where
+	// file attributes may be cached by the client
+	network bool
+	// exclusive is whether no other process may use the directory, so
+	// that the pastes kept in memory are always up to date
+	exclusive bool
+
+	stats    *Stats
+	onExpire ExpireFunc
+	lifeTime time.Duration
 }
 
 type fileCache struct {
 	path    string
 	modTime time.Time
 	size    int64
+	meta    Meta
+	views   int64
 	reading sync.WaitGroup
 }
 
+// matches reports whether the cached paste is the one in a file.
+func (c *fileCache) matches(fi os.FileInfo) bool {
+	return c.size == fi.Size() && c.modTime.Equal(fi.ModTime())
+}
+
 type FilePaste struct {
 	file  *os.File
 	cache *fileCache
+	views int64
 }
 
 func (c FilePaste) Read(p []byte) (n int, err error) {
@@ -54,79 +134,573 @@ func (c FilePaste) ModTime() time.Time { return c.cache.modTime }
 
 func (c FilePaste) Size() int64 { return c.cache.size }
 
-func NewFileStore(stats *Stats, lifeTime time.Duration, dir string) (*FileStore, error) {
+func (c FilePaste) Meta() Meta { return c.cache.meta }
+
+func (c FilePaste) Views() int64 { return c.views }
+
+// File returns the file the paste is read from, so that it can be sent by
+// the kernel without copying it. It is closed along with the paste.
+func (c FilePaste) File() *os.File { return c.file }
+
+func init() {
+	Register("fs", map[string]string{"dir": "pastes", "shared": "true"}, func(c Config) (Store, error) {
+		shared, err := strconv.ParseBool(c.Params["shared"])
+		if err != nil {
+			return nil, fmt.Errorf("invalid shared: %v", err)
+		}
+		open := NewFileStore
+		if !shared {
+			open = NewExclusiveFileStore
+		}
+		s, err := open(c.Stats, c.OnExpire, c.LifeTime, c.Params["dir"], c.Layout)
+		if err != nil {
+			return nil, err
+		}
+		return s, nil
+	})
+	Register("fs-nfs", map[string]string{"dir": "pastes"}, func(c Config) (Store, error) {
+		s, err := NewNFSStore(c.Stats, c.OnExpire, c.LifeTime, c.Params["dir"], c.Layout)
+		if err != nil {
+			return nil, err
+		}
+		return s, nil
+	})
+}
+
+func NewFileStore(stats *Stats, onExpire ExpireFunc, lifeTime time.Duration, dir string, layout Layout) (*FileStore, error) {
+	return newFileStore(stats, onExpire, lifeTime, dir, layout, false, false)
+}
+
+// NewExclusiveFileStore is like NewFileStore, but no other process may use
+// the directory while it runs. Reading a paste then needs no more than
+// opening its file, as the pastes kept in memory cannot go stale.
+func NewExclusiveFileStore(stats *Stats, onExpire ExpireFunc, lifeTime time.Duration, dir string, layout Layout) (*FileStore, error) {
+	return newFileStore(stats, onExpire, lifeTime, dir, layout, false, true)
+}
+
+// NewNFSStore is like NewFileStore, but for a directory on a network
+// filesystem like NFS or CIFS shared between hosts. It locks the directory
+// with a lock file instead of advisory locks, checks file attributes with
+// the server instead of trusting the client's cache, and periodically
+// checks the directory for the pastes added or removed by other hosts so
+// that they are listed too.
+func NewNFSStore(stats *Stats, onExpire ExpireFunc, lifeTime time.Duration, dir string, layout Layout) (*FileStore, error) {
+	s, err := newFileStore(stats, onExpire, lifeTime, dir, layout, true, false)
+	if err != nil {
+		return nil, err
+	}
+	go func() {
+		for range time.Tick(nfsRescanInterval) {
+			if err := s.rescan(); err != nil {
+				log.Printf("Could not rescan %s: %v", s.dir, err)
+			}
+		}
+	}()
+	return s, nil
+}
+
+func newFileStore(stats *Stats, onExpire ExpireFunc, lifeTime time.Duration, dir string, layout Layout, network, exclusive bool) (*FileStore, error) {
+	if err := layout.Check(); err != nil {
+		return nil, err
+	}
 	if err := setupTopDir(dir); err != nil {
 		return nil, err
 	}
 	s := new(FileStore)
 	s.dir = dir
-	s.cache = make(map[ID]fileCache)
+	s.layout = layout
+	s.cache = make(map[ID]*fileCache)
+	s.network = network
+	s.exclusive = exclusive
+	s.stats = stats
+	s.onExpire = onExpire
+	s.lifeTime = lifeTime
+	var err error
+	if network {
+		s.flock, err = newLinkLock(nfsLockFile)
+	} else if err = holdDir(holdFile, exclusive); err == nil {
+		s.flock, err = openDirLock(lockFile)
+	}
+	if err != nil {
+		return nil, err
+	}
 
-	insert := func(id ID, path string, modTime time.Time, size int64) error {
-		cached := fileCache{
+	insert := func(id ID, path string, modTime time.Time, size int64, meta Meta) error {
+		s.cache[id] = &fileCache{
 			path:    path,
 			size:    size,
 			modTime: modTime,
+			meta:    meta,
 		}
-		s.cache[id] = cached
 		return nil
 	}
-	if err := setupSubdirs(s.dir, fileRecover(insert, s, stats, lifeTime)); err != nil {
+	// Other processes may be writing pastes
+	if err := s.flock.lock(); err != nil {
+		return nil, err
+	}
+	defer s.flock.unlock()
+	if err := recoverDir(s.dir, layout, fileRecover(insert, s, stats, onExpire, lifeTime)); err != nil {
 		return nil, err
 	}
 	return s, nil
 }
 
+// retry calls get until the cached paste it uses is not stale, reloading
+// the paste from the directory in between.
+func (s *FileStore) retry(id ID, get func() (Paste, error)) (Paste, error) {
+	for try := 0; try < 3; try++ {
+		paste, err := get()
+		if err != errStale {
+			return paste, err
+		}
+		s.Lock()
+		err = s.flock.lock()
+		if err == nil {
+			err = s.reload(id)
+			s.flock.unlock()
+		}
+		s.Unlock()
+		if err != nil && !isStaleHandle(err) {
+			return nil, err
+		}
+	}
+	return nil, ErrPasteNotFound
+}
+
+// isStaleHandle reports whether an error means that a file was replaced or
+// removed by another host on a network filesystem.
+func isStaleHandle(err error) bool {
+	switch pe := err.(type) {
+	case *os.PathError:
+		err = pe.Err
+	case *os.SyscallError:
+		err = pe.Err
+	}
+	return err == syscall.ESTALE
+}
+
+// stat returns the attributes of a file. On a network filesystem, opening
+// the file makes the client get them from the server.
+func (s *FileStore) stat(path string) (os.FileInfo, error) {
+	if !s.network {
+		return os.Stat(path)
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return f.Stat()
+}
+
 func (s *FileStore) Get(id ID) (Paste, error) {
-	s.RLock()
-	defer s.RUnlock()
-	cached, e := s.cache[id]
-	if !e {
-		return nil, ErrPasteNotFound
+	return s.retry(id, func() (Paste, error) {
+		s.RLock()
+		defer s.RUnlock()
+		cached, e := s.cache[id]
+		if !e {
+			return nil, errStale
+		}
+		f, err := os.Open(cached.path)
+		if os.IsNotExist(err) || isStaleHandle(err) {
+			return nil, errStale
+		} else if err != nil {
+			return nil, err
+		}
+		// Only other processes may change the files
+		if !s.exclusive {
+			if fi, err := f.Stat(); err != nil || !cached.matches(fi) {
+				f.Close()
+				if err != nil && !isStaleHandle(err) {
+					return nil, err
+				}
+				return nil, errStale
+			}
+		}
+		cached.reading.Add(1)
+		views := atomic.AddInt64(&cached.views, 1)
+		return FilePaste{file: f, cache: cached, views: views}, nil
+	})
+}
+
+// Stat gets the attributes of a paste without opening its file, checking
+// that another process did not change it unless the store is exclusive.
+func (s *FileStore) Stat(id ID) (Info, error) {
+	var info Info
+	_, err := s.retry(id, func() (Paste, error) {
+		s.RLock()
+		defer s.RUnlock()
+		cached, e := s.cache[id]
+		if !e {
+			return nil, errStale
+		}
+		if !s.exclusive {
+			fi, err := s.stat(cached.path)
+			if os.IsNotExist(err) || isStaleHandle(err) {
+				return nil, errStale
+			} else if err != nil {
+				return nil, err
+			}
+			if !cached.matches(fi) {
+				return nil, errStale
+			}
+		}
+		info = Info{
+			Meta:    cached.meta,
+			ModTime: cached.modTime,
+			Size:    cached.size,
+			Views:   atomic.LoadInt64(&cached.views),
+		}
+		return nil, nil
+	})
+	return info, err
+}
+
+// reload updates the cached paste from the directory, which another
+// process may have changed. s and the directory must be locked.
+func (s *FileStore) reload(id ID) error {
+	pastePath := s.layout.path(id)
+	old, known := s.cache[id]
+	fi, err := s.stat(pastePath)
+	if os.IsNotExist(err) {
+		if known {
+			delete(s.cache, id)
+			s.stats.FreeSpace(old.size + old.meta.VersionsSize())
+		}
+		return ErrPasteNotFound
+	} else if err != nil {
+		return err
+	}
+	if known && old.matches(fi) {
+		return nil
 	}
-	f, err := os.Open(cached.path)
+	meta, err := readMeta(pastePath)
 	if err != nil {
+		return err
+	}
+	var lifeLeft time.Duration
+	if lt := meta.EffectiveLifeTime(s.lifeTime); lt > 0 && !known {
+		deathTime := meta.Created(fi.ModTime()).Add(lt)
+		if lifeLeft = deathTime.Sub(clock.Now()); lifeLeft <= 0 {
+			// Left behind by a process that stopped
+			if err := removePaste(pastePath); err != nil {
+				return err
+			}
+			if s.onExpire != nil {
+				s.onExpire(id, deathTime)
+			}
+			return ErrPasteNotFound
+		}
+	}
+	c := &fileCache{
+		path:    pastePath,
+		size:    fi.Size(),
+		modTime: fi.ModTime(),
+		meta:    meta,
+	}
+	if known {
+		// Readers of the previous version keep the old entry
+		c.views = atomic.LoadInt64(&old.views)
+		s.stats.FreeSpace(old.size + old.meta.VersionsSize())
+	}
+	s.stats.Track(c.size + meta.VersionsSize())
+	s.cache[id] = c
+	if !known {
+		SetupPasteDeletion(s, s.stats, s.onExpire, id, lifeLeft)
+	}
+	return nil
+}
+
+// fresh returns the cached paste after reloading it if another process
+// changed it. s and the directory must be locked.
+func (s *FileStore) fresh(id ID) (*fileCache, error) {
+	cached, e := s.cache[id]
+	if e {
+		fi, err := s.stat(cached.path)
+		if err == nil && cached.matches(fi) {
+			return cached, nil
+		}
+	}
+	if err := s.reload(id); err != nil {
 		return nil, err
 	}
-	cached.reading.Add(1)
-	return FilePaste{file: f, cache: &cached}, nil
+	return s.cache[id], nil
 }
 
-func writeNewFile(filename string, data []byte) error {
+// IsDiskFull reports whether an error means that the disk or the user's
+// quota ran out of space.
+func IsDiskFull(err error) bool {
+	switch pe := err.(type) {
+	case *os.PathError:
+		err = pe.Err
+	case *os.LinkError:
+		err = pe.Err
+	case *os.SyscallError:
+		err = pe.Err
+	}
+	return err == ErrDiskFull || err == syscall.ENOSPC || err == syscall.EDQUOT
+}
+
+// diskFull returns ErrDiskFull in place of the errors meaning that the disk
+// is full.
+func diskFull(err error) error {
+	if err != nil && IsDiskFull(err) {
+		return ErrDiskFull
+	}
+	return err
+}
+
+// makeParent creates the directories a file is in, if needed.
+func makeParent(path string) error {
+	return diskFull(os.MkdirAll(filepath.Dir(path), 0700))
+}
+
+// createFile writes a file that must not exist yet.
+func createFile(filename string, data []byte, sync bool) error {
 	f, err := os.OpenFile(filename, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
 	if err != nil {
-		return err
+		return diskFull(err)
 	}
 	n, err := f.Write(data)
 	if err == nil && n < len(data) {
 		err = io.ErrShortWrite
 	}
+	if err == nil && sync {
+		err = synced(f)
+	}
 	if err1 := f.Close(); err == nil {
 		err = err1
 	}
-	return err
+	return diskFull(err)
+}
+
+// writeTemp writes the content meant for a file to a temporary file next
+// to it, returning its path.
+func writeTemp(filename string, data []byte) (string, error) {
+	tmpPath := filename + tmpSuffix
+	os.Remove(tmpPath)
+	if err := createFile(tmpPath, data, true); err != nil {
+		os.Remove(tmpPath)
+		return "", err
+	}
+	return tmpPath, nil
+}
+
+// writeNewFile writes a file that must not exist yet. It is written in
+// full before it appears, so that a crash cannot leave it truncated.
+func writeNewFile(filename string, data []byte) error {
+	tmpPath, err := writeTemp(filename, data)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpPath)
+	// Unlike renaming, linking fails if the file exists
+	err = os.Link(tmpPath, filename)
+	if err != nil && !os.IsExist(err) {
+		// Not all filesystems support hard links. Changes to the
+		// directory are locked, so the file cannot appear meanwhile.
+		if _, err := os.Lstat(filename); err == nil {
+			return &os.PathError{Op: "link", Path: filename, Err: os.ErrExist}
+		}
+		err = os.Rename(tmpPath, filename)
+	}
+	if err != nil {
+		return diskFull(err)
+	}
+	return syncedDir(filepath.Dir(filename), filename)
+}
+
+func writeMeta(pastePath string, meta Meta) error {
+	if meta.isZero() {
+		return nil
+	}
+	data, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+	return writeNewFile(pastePath+metaSuffix, data)
+}
+
+// replaceMeta writes the attributes of an existing paste, replacing any
+// previous ones.
+func replaceMeta(pastePath string, meta Meta) error {
+	data, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+	metaPath := pastePath + metaSuffix
+	tmpPath, err := writeTemp(metaPath, data)
+	if err != nil {
+		return err
+	}
+	if err := os.Rename(tmpPath, metaPath); err != nil {
+		os.Remove(tmpPath)
+		return diskFull(err)
+	}
+	return syncedDir(filepath.Dir(metaPath), metaPath)
+}
+
+// writeCopy writes a copy of a paste along with its versions, keeping its
+// modification time so that its lifetime is kept too.
+func writeCopy(pastePath string, content []byte, meta Meta, modTime time.Time, versions [][]byte) error {
+	if len(versions) != len(meta.Versions) {
+		return fmt.Errorf("got %d versions, want %d", len(versions), len(meta.Versions))
+	}
+	for i, v := range versions {
+		if err := writeNewFile(versionPath(pastePath, i+1), v); err != nil {
+			removePaste(pastePath)
+			return err
+		}
+	}
+	if err := writeNewFile(pastePath, content); err != nil {
+		removePaste(pastePath)
+		return err
+	}
+	if err := writeMeta(pastePath, meta); err != nil {
+		removePaste(pastePath)
+		return err
+	}
+	if err := os.Chtimes(pastePath, modTime, modTime); err != nil {
+		removePaste(pastePath)
+		return err
+	}
+	return nil
+}
+
+func versionPath(pastePath string, version int) string {
+	return fmt.Sprintf("%s%s%d", pastePath, versionSuffix, version)
+}
+
+// versionOf returns the path of the paste that a file holds a previous
+// version of, if it holds one.
+func versionOf(path string) (string, bool) {
+	i := strings.LastIndex(path, versionSuffix)
+	if i < 0 {
+		return "", false
+	}
+	if _, err := strconv.Atoi(path[i+len(versionSuffix):]); err != nil {
+		return "", false
+	}
+	return path[:i], true
+}
+
+// keepVersion moves the current content of a paste to a new version,
+// writing the new content in its place. Returns the attributes with the
+// version appended.
+func keepVersion(pastePath string, content []byte, meta, old Meta, modTime time.Time, size int64) (Meta, error) {
+	meta.Versions = append(append([]Version(nil), old.Versions...), Version{
+		ModTime: modTime,
+		Size:    size,
+		Binary:  old.Binary,
+		Hash:    old.Hash,
+	})
+	vPath := versionPath(pastePath, len(meta.Versions))
+	if err := os.Rename(pastePath, vPath); err != nil {
+		return meta, err
+	}
+	if err := writeNewFile(pastePath, content); err != nil {
+		os.Rename(vPath, pastePath)
+		return meta, err
+	}
+	if err := replaceMeta(pastePath, meta); err != nil {
+		os.Remove(pastePath)
+		os.Rename(vPath, pastePath)
+		return meta, err
+	}
+	return meta, nil
+}
+
+// openVersion opens a previous version of a paste as a FilePaste.
+func openVersion(pastePath string, meta Meta, version int, views int64) (Paste, error) {
+	if version < 1 || version > len(meta.Versions) {
+		return nil, ErrPasteNotFound
+	}
+	v := meta.Versions[version-1]
+	path := versionPath(pastePath, version)
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	cached := &fileCache{
+		path:    path,
+		modTime: v.ModTime,
+		size:    v.Size,
+		meta:    meta.versionMeta(v),
+	}
+	cached.reading.Add(1)
+	return FilePaste{file: f, cache: cached, views: views}, nil
+}
+
+func readMeta(pastePath string) (meta Meta, err error) {
+	data, err := ioutil.ReadFile(pastePath + metaSuffix)
+	if os.IsNotExist(err) {
+		return meta, nil
+	} else if err != nil {
+		return meta, err
+	}
+	if err := json.Unmarshal(data, &meta); err != nil {
+		return meta, corrupted(err)
+	}
+	return meta, nil
 }
 
-func (s *FileStore) Put(content []byte) (ID, error) {
+func removePaste(pastePath string) error {
+	versions, err := filepath.Glob(pastePath + versionSuffix + "*")
+	if err != nil {
+		return err
+	}
+	for _, path := range append(versions, pastePath+metaSuffix) {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return os.Remove(pastePath)
+}
+
+func (s *FileStore) Put(content []byte, meta Meta) (ID, error) {
 	size := int64(len(content))
+	var writeErr error
 	available := func(id ID) bool {
-		_, e := s.cache[id]
-		return !e
+		if _, e := s.cache[id]; e {
+			return false
+		}
+		pastePath := s.layout.path(id)
+		if writeErr = makeParent(pastePath); writeErr != nil {
+			return true
+		}
+		// Creating the file exclusively also skips the ids used by other
+		// processes, even if the directory listing is cached
+		writeErr = writeNewFile(pastePath, content)
+		return !os.IsExist(writeErr)
 	}
 	s.Lock()
 	defer s.Unlock()
+	if err := s.flock.lock(); err != nil {
+		return ID{}, err
+	}
+	defer s.flock.unlock()
 	id, err := randomID(available)
 	if err != nil {
 		return id, err
 	}
-	pastePath := pathFromID(id)
-	if err = writeNewFile(pastePath, content); err != nil {
+	if writeErr != nil {
+		return id, writeErr
+	}
+	pastePath := s.layout.path(id)
+	if err = writeMeta(pastePath, meta); err != nil {
+		os.Remove(pastePath)
 		return id, err
 	}
-	s.cache[id] = fileCache{
+	fi, err := s.stat(pastePath)
+	if err != nil {
+		removePaste(pastePath)
+		return id, err
+	}
+	s.cache[id] = &fileCache{
 		path:    pastePath,
 		size:    size,
-		modTime: time.Now(),
+		modTime: fi.ModTime(),
+		meta:    meta,
 	}
 	return id, nil
 }
@@ -134,63 +708,222 @@ func (s *FileStore) Put(content []byte) (ID, error) {
 func (s *FileStore) Delete(id ID) error {
 	s.Lock()
 	defer s.Unlock()
-	cached, e := s.cache[id]
-	if !e {
-		return ErrPasteNotFound
+	if err := s.flock.lock(); err != nil {
+		return err
+	}
+	defer s.flock.unlock()
+	cached, err := s.fresh(id)
+	if err != nil {
+		return err
 	}
 	cached.reading.Wait()
-	if err := os.Remove(cached.path); err != nil {
+	if err := removePaste(cached.path); err != nil {
 		return err
 	}
 	delete(s.cache, id)
 	return nil
 }
 
-func pathFromID(id ID) string {
-	hexID := id.String()
-	return filepath.Join(hexID[:2], hexID[2:])
+func (s *FileStore) Update(id ID, content []byte, meta Meta) error {
+	s.Lock()
+	defer s.Unlock()
+	if err := s.flock.lock(); err != nil {
+		return err
+	}
+	defer s.flock.unlock()
+	cached, err := s.fresh(id)
+	if err != nil {
+		return err
+	}
+	meta, err = keepVersion(cached.path, content, meta, cached.meta, cached.modTime, cached.size)
+	if err != nil {
+		return err
+	}
+	fi, err := s.stat(cached.path)
+	if err != nil {
+		return err
+	}
+	// Readers of the previous version keep the old entry
+	s.cache[id] = &fileCache{
+		path:    cached.path,
+		modTime: fi.ModTime(),
+		size:    int64(len(content)),
+		meta:    meta,
+		views:   atomic.LoadInt64(&cached.views),
+	}
+	return nil
 }
 
-func idFromPath(path string) (ID, error) {
-	parts := strings.Split(path, string(filepath.Separator))
-	if len(parts) != 2 {
-		return ID{}, fmt.Errorf("invalid number of directories at %s", path)
+func (s *FileStore) Copy(id ID, content []byte, meta Meta, modTime time.Time, versions [][]byte) error {
+	s.Lock()
+	defer s.Unlock()
+	if err := s.flock.lock(); err != nil {
+		return err
+	}
+	defer s.flock.unlock()
+	pastePath := s.layout.path(id)
+	if cached, e := s.cache[id]; e {
+		cached.reading.Wait()
+		delete(s.cache, id)
+	}
+	// May have been stored by another process too
+	if err := removePaste(pastePath); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err := makeParent(pastePath); err != nil {
+		return err
 	}
-	if len(parts[0]) != 2 {
-		return ID{}, fmt.Errorf("invalid directory name length at %s", path)
+	if err := writeCopy(pastePath, content, meta, modTime, versions); err != nil {
+		return err
 	}
-	hexID := parts[0] + parts[1]
-	return IDFromString(hexID)
+	fi, err := s.stat(pastePath)
+	if err != nil {
+		return err
+	}
+	s.cache[id] = &fileCache{
+		path:    pastePath,
+		size:    int64(len(content)),
+		modTime: fi.ModTime(),
+		meta:    meta,
+	}
+	return nil
 }
 
-type fileInsert func(id ID, path string, modTime time.Time, size int64) error
+func (s *FileStore) GetVersion(id ID, version int) (Paste, error) {
+	return s.retry(id, func() (Paste, error) {
+		s.RLock()
+		defer s.RUnlock()
+		cached, e := s.cache[id]
+		if !e {
+			return nil, errStale
+		}
+		if fi, err := s.stat(cached.path); err != nil || !cached.matches(fi) {
+			if err != nil && !os.IsNotExist(err) && !isStaleHandle(err) {
+				return nil, err
+			}
+			return nil, errStale
+		}
+		views := atomic.AddInt64(&cached.views, 1)
+		return openVersion(cached.path, cached.meta, version, views)
+	})
+}
+
+func (s *FileStore) Iterate(fn func(id ID, info Info) bool) error {
+	s.RLock()
+	defer s.RUnlock()
+	for id, cached := range s.cache {
+		info := Info{
+			Meta:    cached.meta,
+			ModTime: cached.modTime,
+			Size:    cached.size,
+			Views:   atomic.LoadInt64(&cached.views),
+		}
+		if !fn(id, info) {
+			break
+		}
+	}
+	return nil
+}
 
-func fileRecover(insert fileInsert, s Store, stats *Stats, lifeTime time.Duration) filepath.WalkFunc {
-	startTime := time.Now()
+// rescan reloads all the pastes in the directory and all the cached ones,
+// so that the pastes added or removed by other processes are noticed
+// without fetching them.
+func (s *FileStore) rescan() error {
+	ids := make(map[ID]struct{})
+	// Listed without any locks, as it may take a while
+	err := walkLayout(func(path string, fi os.FileInfo, err error) error {
+		if os.IsNotExist(err) || isStaleHandle(err) {
+			return nil
+		}
+		if err != nil || fi.IsDir() || !isPasteFile(path) {
+			return err
+		}
+		if id, err := idFromPath(path); err == nil && path == s.layout.path(id) {
+			ids[id] = struct{}{}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	s.Lock()
+	defer s.Unlock()
+	if err := s.flock.lock(); err != nil {
+		return err
+	}
+	defer s.flock.unlock()
+	for id := range s.cache {
+		ids[id] = struct{}{}
+	}
+	for id := range ids {
+		err := s.reload(id)
+		if err != nil && err != ErrPasteNotFound && !isStaleHandle(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+type fileInsert func(id ID, path string, modTime time.Time, size int64, meta Meta) error
+
+func fileRecover(insert fileInsert, s Store, stats *Stats, onExpire ExpireFunc, lifeTime time.Duration) filepath.WalkFunc {
+	startTime := clock.Now()
 	return func(path string, fileInfo os.FileInfo, err error) error {
+		if os.IsNotExist(err) {
+			// Removed along with its paste
+			return nil
+		}
 		if err != nil || fileInfo.IsDir() {
 			return err
 		}
+		if strings.HasSuffix(path, tmpSuffix) {
+			// Left behind while being written
+			return os.Remove(path)
+		}
+		pastePath, isVersion := versionOf(path)
+		if strings.HasSuffix(path, metaSuffix) {
+			isVersion, pastePath = true, strings.TrimSuffix(path, metaSuffix)
+		}
+		if isVersion {
+			// Read along with its paste, unless it was left behind
+			if _, err := os.Stat(pastePath); os.IsNotExist(err) {
+				return os.Remove(path)
+			}
+			return nil
+		}
 		id, err := idFromPath(path)
 		if err != nil {
 			return err
 		}
+		meta, err := readMeta(path)
+		if err != nil {
+			return err
+		}
 		modTime := fileInfo.ModTime()
-		lifeLeft := modTime.Add(lifeTime).Sub(startTime)
-		if lifeTime > 0 && lifeLeft <= 0 {
-			return os.Remove(path)
+		var lifeLeft time.Duration
+		if lt := meta.EffectiveLifeTime(lifeTime); lt > 0 {
+			deathTime := meta.Created(modTime).Add(lt)
+			if lifeLeft = deathTime.Sub(startTime); lifeLeft <= 0 {
+				if err := removePaste(path); err != nil {
+					return err
+				}
+				if onExpire != nil {
+					onExpire(id, deathTime)
+				}
+				return nil
+			}
 		}
 		size := fileInfo.Size()
 		if size == 0 {
-			return os.Remove(path)
+			return removePaste(path)
 		}
-		if err := stats.MakeSpaceFor(size); err != nil {
+		if err := stats.MakeSpaceFor(size + meta.VersionsSize()); err != nil {
 			return err
 		}
-		if err := insert(id, path, modTime, size); err != nil {
+		if err := insert(id, path, modTime, size, meta); err != nil {
 			return err
 		}
-		SetupPasteDeletion(s, stats, id, size, lifeLeft)
+		SetupPasteDeletion(s, stats, onExpire, id, lifeLeft)
 		return nil
 	}
 }
@@ -201,27 +934,3 @@ func setupTopDir(topdir string) error {
 	}
 	return os.Chdir(topdir)
 }
-
-func setupSubdirs(topdir string, rec filepath.WalkFunc) error {
-	for i := 0; i < 256; i++ {
-		if err := setupSubdir(topdir, rec, byte(i)); err != nil {
-			return err
-		}
-	}
-	return nil
-}
-
-func setupSubdir(topdir string, rec filepath.WalkFunc, h byte) error {
-	dir := hex.EncodeToString([]byte{h})
-	if stat, err := os.Stat(dir); err == nil {
-		if !stat.IsDir() {
-			return fmt.Errorf("%s/%s exists but is not a directory", topdir, dir)
-		}
-		if err := filepath.Walk(dir, rec); err != nil {
-			return fmt.Errorf("cannot recover data directory %s/%s: %v", topdir, dir, err)
-		}
-	} else if err := os.Mkdir(dir, 0700); err != nil {
-		return fmt.Errorf("cannot create data directory %s/%s: %v", topdir, dir, err)
-	}
-	return nil
-}
@@ -5,8 +5,10 @@ package storage
 
 import (
 	"bytes"
+	"fmt"
 	"os"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	memmap "github.com/edsrzf/mmap-go"
@@ -14,74 +16,184 @@ import (
 
 type MmapStore struct {
 	sync.RWMutex
-	cache map[ID]mmapCache
-	dir   string
+	cache  map[ID]*mmapCache
+	dir    string
+	layout Layout
+	// cold is how long a paste may go unread before the memory of its
+	// mapping is released, if positive
+	cold time.Duration
+	// hugePages is the size from which pastes are mapped with huge pages,
+	// if positive
+	hugePages ByteSize
+}
+
+// mmapping is the content of a paste mapped into memory. It holds a
+// reference for the store and one for each paste handle reading it, and is
+// unmapped once the last one is released, so that pastes can be deleted or
+// edited while they are read without waiting for their readers.
+type mmapping struct {
+	data memmap.MMap
+	refs int32
+}
+
+func newMmapping(data memmap.MMap) *mmapping {
+	return &mmapping{data: data, refs: 1}
+}
+
+// acquire takes a reference to the mapping, which must still be held by
+// its store.
+func (m *mmapping) acquire() {
+	atomic.AddInt32(&m.refs, 1)
+}
+
+// release lets go of a reference to the mapping, unmapping it if it was
+// the last one.
+func (m *mmapping) release() error {
+	if atomic.AddInt32(&m.refs, -1) > 0 {
+		return nil
+	}
+	return m.data.Unmap()
 }
 
 type mmapCache struct {
-	reading sync.WaitGroup
 	modTime time.Time
 	path    string
-	mmap    memmap.MMap
+	mapping *mmapping
 	size    int64
+	meta    Meta
+	views   int64
+	// lastRead is when the paste was last read, in Unix nanoseconds
+	lastRead int64
+	// resident is 1 if the paste was read since its memory was released
+	resident int32
 }
 
+// MmapPaste is a handle to a paste in an MmapStore, holding a reference to
+// its mapping until it is closed.
 type MmapPaste struct {
 	content *bytes.Reader
 	cache   *mmapCache
+	views   int64
+	// closed is 1 once the reference to the mapping was released
+	closed int32
 }
 
-func (c MmapPaste) Read(p []byte) (n int, err error) {
+func (c *MmapPaste) Read(p []byte) (n int, err error) {
 	return c.content.Read(p)
 }
 
-func (c MmapPaste) ReadAt(p []byte, off int64) (n int, err error) {
+func (c *MmapPaste) ReadAt(p []byte, off int64) (n int, err error) {
 	return c.content.ReadAt(p, off)
 }
 
-func (c MmapPaste) Seek(offset int64, whence int) (int64, error) {
+func (c *MmapPaste) Seek(offset int64, whence int) (int64, error) {
 	return c.content.Seek(offset, whence)
 }
 
-func (c MmapPaste) Close() error {
-	c.cache.reading.Done()
-	return nil
+// Close releases the mapping, which must not be read from afterwards.
+// Closing a paste more than once does nothing.
+func (c *MmapPaste) Close() error {
+	if !atomic.CompareAndSwapInt32(&c.closed, 0, 1) {
+		return nil
+	}
+	return c.cache.mapping.release()
 }
 
-func (c MmapPaste) ModTime() time.Time { return c.cache.modTime }
+func (c *MmapPaste) ModTime() time.Time { return c.cache.modTime }
 
-func (c MmapPaste) Size() int64 { return c.cache.size }
+func (c *MmapPaste) Size() int64 { return c.cache.size }
 
-func NewMmapStore(stats *Stats, lifeTime time.Duration, dir string) (*MmapStore, error) {
+func (c *MmapPaste) Meta() Meta { return c.cache.meta }
+
+func (c *MmapPaste) Views() int64 { return c.views }
+
+func init() {
+	Register("fs-mmap", map[string]string{
+		"dir":       "pastes",
+		"cold":      "0",
+		"hugepages": "0",
+	}, func(c Config) (Store, error) {
+		cold, err := time.ParseDuration(c.Params["cold"])
+		if err != nil {
+			return nil, fmt.Errorf("invalid cold: %v", err)
+		}
+		hugePages, err := parseBytesize(c.Params["hugepages"])
+		if err != nil {
+			return nil, fmt.Errorf("invalid hugepages: %v", err)
+		}
+		s, err := NewMmapStore(c.Stats, c.OnExpire, c.LifeTime, c.Params["dir"], c.Layout, cold, hugePages)
+		if err != nil {
+			return nil, err
+		}
+		return s, nil
+	})
+}
+
+// NewMmapStore sets up a store mapping its pastes into memory. If cold is
+// positive, the memory of the pastes not read for that long is released. If
+// hugePages is positive, pastes of that size or larger are mapped with huge
+// pages where supported.
+func NewMmapStore(stats *Stats, onExpire ExpireFunc, lifeTime time.Duration, dir string, layout Layout, cold time.Duration, hugePages ByteSize) (*MmapStore, error) {
+	if err := layout.Check(); err != nil {
+		return nil, err
+	}
 	if err := setupTopDir(dir); err != nil {
 		return nil, err
 	}
 	s := new(MmapStore)
 	s.dir = dir
-	s.cache = make(map[ID]mmapCache)
+	s.layout = layout
+	s.cold = cold
+	s.hugePages = hugePages
+	s.cache = make(map[ID]*mmapCache)
 
-	insert := func(id ID, path string, modTime time.Time, size int64) error {
+	insert := func(id ID, path string, modTime time.Time, size int64, meta Meta) error {
 		f, err := os.Open(path)
 		defer f.Close()
-		mmap, err := getMmap(f)
+		mmap, err := s.getMmap(f)
 		if err != nil {
 			return err
 		}
-		cached := mmapCache{
+		s.cache[id] = &mmapCache{
 			modTime: modTime,
 			path:    path,
-			mmap:    mmap,
+			mapping: newMmapping(mmap),
 			size:    size,
+			meta:    meta,
 		}
-		s.cache[id] = cached
 		return nil
 	}
-	if err := setupSubdirs(s.dir, fileRecover(insert, s, stats, lifeTime)); err != nil {
+	if err := recoverDir(s.dir, layout, fileRecover(insert, s, stats, onExpire, lifeTime)); err != nil {
 		return nil, err
 	}
+	if s.cold > 0 {
+		go s.releaseColdLoop()
+	}
 	return s, nil
 }
 
+func (s *MmapStore) releaseColdLoop() {
+	for range time.Tick(s.cold / 2) {
+		s.releaseCold(clock.Now().Add(-s.cold))
+	}
+}
+
+// releaseCold releases the memory of the pastes not read since a time.
+// Their mappings stay in place, so reads that race with it simply bring
+// the pages back in from the files.
+func (s *MmapStore) releaseCold(since time.Time) {
+	s.RLock()
+	defer s.RUnlock()
+	for _, cached := range s.cache {
+		if atomic.LoadInt64(&cached.lastRead) >= since.UnixNano() {
+			continue
+		}
+		if atomic.CompareAndSwapInt32(&cached.resident, 1, 0) {
+			adviseCold(cached.mapping.data)
+		}
+	}
+}
+
 func (s *MmapStore) Get(id ID) (Paste, error) {
 	s.RLock()
 	defer s.RUnlock()
@@ -89,12 +201,35 @@ func (s *MmapStore) Get(id ID) (Paste, error) {
 	if !e {
 		return nil, ErrPasteNotFound
 	}
-	reader := bytes.NewReader(cached.mmap)
-	cached.reading.Add(1)
-	return MmapPaste{content: reader, cache: &cached}, nil
+	cached.mapping.acquire()
+	atomic.StoreInt64(&cached.lastRead, clock.Now().UnixNano())
+	atomic.StoreInt32(&cached.resident, 1)
+	views := atomic.AddInt64(&cached.views, 1)
+	return &MmapPaste{
+		content: bytes.NewReader(cached.mapping.data),
+		cache:   cached,
+		views:   views,
+	}, nil
 }
 
-func (s *MmapStore) Put(content []byte) (ID, error) {
+// Stat gets the attributes of a paste without taking a reference to its
+// mapping.
+func (s *MmapStore) Stat(id ID) (Info, error) {
+	s.RLock()
+	defer s.RUnlock()
+	cached, e := s.cache[id]
+	if !e {
+		return Info{}, ErrPasteNotFound
+	}
+	return Info{
+		Meta:    cached.meta,
+		ModTime: cached.modTime,
+		Size:    cached.size,
+		Views:   atomic.LoadInt64(&cached.views),
+	}, nil
+}
+
+func (s *MmapStore) Put(content []byte, meta Meta) (ID, error) {
 	size := int64(len(content))
 	available := func(id ID) bool {
 		_, e := s.cache[id]
@@ -106,24 +241,34 @@ func (s *MmapStore) Put(content []byte) (ID, error) {
 	if err != nil {
 		return id, err
 	}
-	path := pathFromID(id)
+	path := s.layout.path(id)
+	if err = makeParent(path); err != nil {
+		return id, err
+	}
 	if err = writeNewFile(path, content); err != nil {
 		return id, err
 	}
+	if err = writeMeta(path, meta); err != nil {
+		os.Remove(path)
+		return id, err
+	}
 	f, err := os.Open(path)
-	mmap, err := getMmap(f)
+	mmap, err := s.getMmap(f)
 	if err != nil {
 		return id, err
 	}
-	s.cache[id] = mmapCache{
+	s.cache[id] = &mmapCache{
 		path:    path,
-		modTime: time.Now(),
+		modTime: clock.Now(),
 		size:    size,
-		mmap:    mmap,
+		mapping: newMmapping(mmap),
+		meta:    meta,
 	}
 	return id, nil
 }
 
+// Delete removes a paste right away. Its mapping stays in place until the
+// handles still reading it are closed.
 func (s *MmapStore) Delete(id ID) error {
 	s.Lock()
 	defer s.Unlock()
@@ -131,19 +276,129 @@ func (s *MmapStore) Delete(id ID) error {
 	if !e {
 		return ErrPasteNotFound
 	}
-	cached.reading.Wait()
-	err1 := cached.mmap.Unmap()
-	err2 := os.Remove(cached.path)
-	if err1 != nil {
-		return err1
-	}
-	if err2 != nil {
-		return err2
+	if err := removePaste(cached.path); err != nil {
+		return err
 	}
 	delete(s.cache, id)
+	return cached.mapping.release()
+}
+
+func (s *MmapStore) Update(id ID, content []byte, meta Meta) error {
+	s.Lock()
+	defer s.Unlock()
+	cached, e := s.cache[id]
+	if !e {
+		return ErrPasteNotFound
+	}
+	meta, err := keepVersion(cached.path, content, meta, cached.meta, cached.modTime, cached.size)
+	if err != nil {
+		return err
+	}
+	f, err := os.Open(cached.path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	mmap, err := s.getMmap(f)
+	if err != nil {
+		return err
+	}
+	// The previous content was moved to a version file, so the handles
+	// still reading its mapping are left untouched
+	s.cache[id] = &mmapCache{
+		path:    cached.path,
+		modTime: clock.Now(),
+		size:    int64(len(content)),
+		mapping: newMmapping(mmap),
+		meta:    meta,
+		views:   atomic.LoadInt64(&cached.views),
+	}
+	return cached.mapping.release()
+}
+
+func (s *MmapStore) Copy(id ID, content []byte, meta Meta, modTime time.Time, versions [][]byte) error {
+	s.Lock()
+	defer s.Unlock()
+	path := s.layout.path(id)
+	if cached, e := s.cache[id]; e {
+		err1 := removePaste(cached.path)
+		delete(s.cache, id)
+		err2 := cached.mapping.release()
+		if err1 != nil {
+			return err1
+		}
+		if err2 != nil {
+			return err2
+		}
+	}
+	if err := makeParent(path); err != nil {
+		return err
+	}
+	if err := writeCopy(path, content, meta, modTime, versions); err != nil {
+		return err
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		removePaste(path)
+		return err
+	}
+	defer f.Close()
+	mmap, err := s.getMmap(f)
+	if err != nil {
+		removePaste(path)
+		return err
+	}
+	s.cache[id] = &mmapCache{
+		path:    path,
+		modTime: modTime,
+		size:    int64(len(content)),
+		mapping: newMmapping(mmap),
+		meta:    meta,
+	}
+	return nil
+}
+
+// GetVersion reads previous versions from their files, as they are not
+// mapped into memory.
+func (s *MmapStore) GetVersion(id ID, version int) (Paste, error) {
+	s.RLock()
+	defer s.RUnlock()
+	cached, e := s.cache[id]
+	if !e {
+		return nil, ErrPasteNotFound
+	}
+	views := atomic.AddInt64(&cached.views, 1)
+	return openVersion(cached.path, cached.meta, version, views)
+}
+
+func (s *MmapStore) Iterate(fn func(id ID, info Info) bool) error {
+	s.RLock()
+	defer s.RUnlock()
+	for id, cached := range s.cache {
+		info := Info{
+			Meta:    cached.meta,
+			ModTime: cached.modTime,
+			Size:    cached.size,
+			Views:   atomic.LoadInt64(&cached.views),
+		}
+		if !fn(id, info) {
+			break
+		}
+	}
 	return nil
 }
 
-func getMmap(f *os.File) (memmap.MMap, error) {
-	return memmap.Map(f, memmap.RDONLY, 0)
+func (s *MmapStore) getMmap(f *os.File) (memmap.MMap, error) {
+	mmap, err := memmap.Map(f, memmap.RDONLY, 0)
+	if err != nil {
+		return nil, err
+	}
+	// Only hints, so a failure is not worth losing the mapping over. Huge
+	// pages are faulted in whole, so reading ahead is of no concern there.
+	if s.hugePages > 0 && ByteSize(len(mmap)) >= s.hugePages {
+		adviseHuge(mmap)
+	} else {
+		adviseRandom(mmap)
+	}
+	return mmap, nil
 }
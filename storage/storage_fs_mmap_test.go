@@ -0,0 +1,134 @@
+package storage
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestMmapStoreCold(t *testing.T) {
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir, err := ioutil.TempDir("", "pastecat-mmap")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		os.Chdir(wd)
+		os.RemoveAll(dir)
+	})
+	s, err := NewMmapStore(&Stats{}, nil, 0, dir, DefaultLayout, 0, 0)
+	if err != nil {
+		t.Fatalf("NewMmapStore() errored unexpectedly: %v", err)
+	}
+	read := func(id ID) {
+		t.Helper()
+		p, err := s.Get(id)
+		if err != nil {
+			t.Fatalf("Get() errored unexpectedly: %v", err)
+		}
+		defer p.Close()
+		got, err := ioutil.ReadAll(p)
+		if err != nil {
+			t.Fatalf("Read() errored unexpectedly: %v", err)
+		}
+		if string(got) != "foo" {
+			t.Fatalf("Get() got %q, want %q", got, "foo")
+		}
+	}
+	resident := func(id ID) bool {
+		return atomic.LoadInt32(&s.cache[id].resident) == 1
+	}
+	id, err := s.Put([]byte("foo"), Meta{})
+	if err != nil {
+		t.Fatalf("Put() errored unexpectedly: %v", err)
+	}
+	read(id)
+	if !resident(id) {
+		t.Fatalf("Paste not resident after a read")
+	}
+	// Read since, so still hot
+	s.releaseCold(time.Now().Add(-time.Hour))
+	if !resident(id) {
+		t.Errorf("Paste released despite being read recently")
+	}
+	s.releaseCold(time.Now().Add(time.Second))
+	if resident(id) {
+		t.Errorf("Paste not released after going cold")
+	}
+	// Released pastes are read back from their files
+	read(id)
+	if !resident(id) {
+		t.Errorf("Paste not resident after being read again")
+	}
+}
+
+func TestMmapStoreRefs(t *testing.T) {
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir, err := ioutil.TempDir("", "pastecat-mmap")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		os.Chdir(wd)
+		os.RemoveAll(dir)
+	})
+	s, err := NewMmapStore(&Stats{}, nil, 0, dir, DefaultLayout, 0, 0)
+	if err != nil {
+		t.Fatalf("NewMmapStore() errored unexpectedly: %v", err)
+	}
+	id, err := s.Put([]byte("foo"), Meta{})
+	if err != nil {
+		t.Fatalf("Put() errored unexpectedly: %v", err)
+	}
+	mustRead := func(p Paste, want string) {
+		t.Helper()
+		got, err := ioutil.ReadAll(io.NewSectionReader(p, 0, p.Size()))
+		if err != nil {
+			t.Fatalf("Read() errored unexpectedly: %v", err)
+		}
+		if string(got) != want {
+			t.Fatalf("Read %q, want %q", got, want)
+		}
+	}
+	old, err := s.Get(id)
+	if err != nil {
+		t.Fatalf("Get() errored unexpectedly: %v", err)
+	}
+	mapping := s.cache[id].mapping
+
+	// Neither waits for the paste being read
+	if err := s.Update(id, []byte("barbar"), Meta{}); err != nil {
+		t.Fatalf("Update() errored unexpectedly: %v", err)
+	}
+	cur, err := s.Get(id)
+	if err != nil {
+		t.Fatalf("Get() errored unexpectedly: %v", err)
+	}
+	if err := s.Delete(id); err != nil {
+		t.Fatalf("Delete() errored unexpectedly: %v", err)
+	}
+	mustRead(old, "foo")
+	mustRead(cur, "barbar")
+
+	if refs := atomic.LoadInt32(&mapping.refs); refs != 1 {
+		t.Errorf("Got %d references to a mapping read once, want 1", refs)
+	}
+	for i := 0; i < 2; i++ {
+		if err := old.Close(); err != nil {
+			t.Fatalf("Close() errored unexpectedly: %v", err)
+		}
+	}
+	if refs := atomic.LoadInt32(&mapping.refs); refs != 0 {
+		t.Errorf("Got %d references to a mapping after closing it twice, want 0", refs)
+	}
+	cur.Close()
+}
@@ -0,0 +1,213 @@
+package storage
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+type fileStoreOpener func(stats *Stats, onExpire ExpireFunc, lifeTime time.Duration, dir string, layout Layout) (*FileStore, error)
+
+func TestFileStoreShared(t *testing.T) {
+	testSharedDir(t, NewFileStore)
+}
+
+func TestNFSStoreShared(t *testing.T) {
+	a, b, bStats := testSharedDir(t, NewNFSStore)
+	number0, storage0 := bStats.Report()
+	id, err := a.Put([]byte("foo"), Meta{})
+	if err != nil {
+		t.Fatalf("Put() errored unexpectedly: %v", err)
+	}
+	// Listed once the directory is checked again
+	if err := b.rescan(); err != nil {
+		t.Fatalf("rescan() errored unexpectedly: %v", err)
+	}
+	if number, storage := bStats.Report(); number != number0+1 || storage != storage0+3 {
+		t.Errorf("Paste found by a rescan was counted as %d using %d", number-number0, storage-storage0)
+	}
+	if err := a.Delete(id); err != nil {
+		t.Fatalf("Delete() errored unexpectedly: %v", err)
+	}
+	if err := b.rescan(); err != nil {
+		t.Fatalf("rescan() errored unexpectedly: %v", err)
+	}
+	if number, storage := bStats.Report(); number != number0 || storage != storage0 {
+		t.Errorf("Paste removed before a rescan was counted as %d using %d", number-number0, storage-storage0)
+	}
+}
+
+// testSharedDir checks that two stores sharing a directory notice each
+// other's changes, returning them for further checks.
+func testSharedDir(t *testing.T, open fileStoreOpener) (*FileStore, *FileStore, *Stats) {
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// File stores work from within their directory
+	dir, err := ioutil.TempDir("", "pastecat-fs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		os.Chdir(wd)
+		os.RemoveAll(dir)
+	})
+	// Two processes sharing the directory
+	a, err := open(&Stats{}, nil, 0, dir, DefaultLayout)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bStats := &Stats{}
+	b, err := open(bStats, nil, 0, dir, DefaultLayout)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mustRead := func(s *FileStore, id ID, version int, want string) {
+		var p Paste
+		var err error
+		if version > 0 {
+			p, err = s.GetVersion(id, version)
+		} else {
+			p, err = s.Get(id)
+		}
+		if err != nil {
+			t.Fatalf("Could not get %s version %d: %v", id, version, err)
+		}
+		defer p.Close()
+		got, err := ioutil.ReadAll(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != want {
+			t.Fatalf("Got %q for %s version %d, want %q", got, id, version, want)
+		}
+	}
+
+	id, err := a.Put([]byte("foo"), Meta{})
+	if err != nil {
+		t.Fatalf("Put() errored unexpectedly: %v", err)
+	}
+	mustRead(b, id, 0, "foo")
+	if number, storage := bStats.Report(); number != 1 || storage != 3 {
+		t.Errorf("Paste found in the directory was counted as %d using %d", number, storage)
+	}
+	if err := a.Update(id, []byte("bar2"), Meta{}); err != nil {
+		t.Fatalf("Update() errored unexpectedly: %v", err)
+	}
+	if info, err := b.Stat(id); err != nil || info.Size != 4 {
+		t.Errorf("Stat() of a paste updated elsewhere got size %d and %v, want 4", info.Size, err)
+	}
+	mustRead(b, id, 0, "bar2")
+	mustRead(b, id, 1, "foo")
+	if err := b.Delete(id); err != nil {
+		t.Fatalf("Delete() errored unexpectedly: %v", err)
+	}
+	if _, err := a.Get(id); err != ErrPasteNotFound {
+		t.Errorf("Get() of a paste deleted elsewhere got %v, want %v", err, ErrPasteNotFound)
+	}
+	if _, err := a.Stat(id); err != ErrPasteNotFound {
+		t.Errorf("Stat() of a paste deleted elsewhere got %v, want %v", err, ErrPasteNotFound)
+	}
+	if err := a.Delete(id); err != ErrPasteNotFound {
+		t.Errorf("Delete() of a paste deleted elsewhere got %v, want %v", err, ErrPasteNotFound)
+	}
+	return a, b, bStats
+}
+
+func TestExclusiveFileStore(t *testing.T) {
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	shared, err := ioutil.TempDir("", "pastecat-fs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	exclusive, err := ioutil.TempDir("", "pastecat-fs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		os.Chdir(wd)
+		os.RemoveAll(shared)
+		os.RemoveAll(exclusive)
+	})
+	if _, err := NewFileStore(&Stats{}, nil, 0, shared, DefaultLayout); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewExclusiveFileStore(&Stats{}, nil, 0, shared, DefaultLayout); err == nil {
+		t.Errorf("NewExclusiveFileStore() on a shared directory did not error")
+	}
+	s, err := NewExclusiveFileStore(&Stats{}, nil, 0, exclusive, DefaultLayout)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewFileStore(&Stats{}, nil, 0, exclusive, DefaultLayout); err == nil {
+		t.Errorf("NewFileStore() on an exclusive directory did not error")
+	}
+	id, err := s.Put([]byte("foo"), Meta{})
+	if err != nil {
+		t.Fatalf("Put() errored unexpectedly: %v", err)
+	}
+	p, err := s.Get(id)
+	if err != nil {
+		t.Fatalf("Get() errored unexpectedly: %v", err)
+	}
+	got, err := ioutil.ReadAll(p)
+	p.Close()
+	if err != nil || string(got) != "foo" {
+		t.Errorf("Get() got %q and %v, want %q", got, err, "foo")
+	}
+	if info, err := s.Stat(id); err != nil || info.Size != 3 {
+		t.Errorf("Stat() got size %d and %v, want 3", info.Size, err)
+	}
+	if err := s.Delete(id); err != nil {
+		t.Fatalf("Delete() errored unexpectedly: %v", err)
+	}
+	if _, err := s.Get(id); err != ErrPasteNotFound {
+		t.Errorf("Get() of a deleted paste got %v, want %v", err, ErrPasteNotFound)
+	}
+}
+
+func TestWriteNewFile(t *testing.T) {
+	defer SetSyncPolicy(syncPolicy)
+	SetSyncPolicy(SyncAlways)
+	dir, err := ioutil.TempDir("", "pastecat-write")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "paste")
+	if err := writeNewFile(path, []byte("foo")); err != nil {
+		t.Fatalf("writeNewFile() errored unexpectedly: %v", err)
+	}
+	if err := writeNewFile(path, []byte("bar")); !os.IsExist(err) {
+		t.Fatalf("writeNewFile() over an existing file got %v, want it to exist", err)
+	}
+	if got, err := ioutil.ReadFile(path); err != nil || string(got) != "foo" {
+		t.Fatalf("Got %q, %v after writing over a file, want %q", got, err, "foo")
+	}
+	if err := replaceMeta(path, Meta{Title: "title"}); err != nil {
+		t.Fatalf("replaceMeta() errored unexpectedly: %v", err)
+	}
+	// Only the written files are left
+	names, err := filepath.Glob(filepath.Join(dir, "*"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{path, path + metaSuffix}; !reflect.DeepEqual(names, want) {
+		t.Fatalf("Got files %q, want %q", names, want)
+	}
+	for _, s := range []string{"always", "interval", "never"} {
+		if p, err := ParseSyncPolicy(s); err != nil || p.String() != s {
+			t.Errorf("ParseSyncPolicy(%q) got %v, %v", s, p, err)
+		}
+	}
+	if _, err := ParseSyncPolicy("sometimes"); err == nil {
+		t.Errorf("ParseSyncPolicy() of an unknown policy did not error")
+	}
+}
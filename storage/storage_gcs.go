@@ -0,0 +1,324 @@
+// Copyright (c) 2014-2015, Daniel Martí <mvdan@mvdan.cc>
+// See LICENSE for licensing information
+
+package storage
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"time"
+)
+
+// How long to wait for each request to Google Cloud Storage
+const gcsTimeout = 1 * time.Minute
+
+const gcsEndpoint = "https://storage.googleapis.com"
+
+// gcsBlobs keeps each value in an object in a Google Cloud Storage bucket,
+// named after its key with a prefix.
+type gcsBlobs struct {
+	endpoint string
+	bucket   string
+	prefix   string
+	auth     *gcsAuth
+	client   *http.Client
+}
+
+func init() {
+	Register("gcs", map[string]string{
+		"bucket":      "",
+		"prefix":      "",
+		"credentials": "",
+		"lifecycle":   "false",
+	}, func(c Config) (Store, error) {
+		lifecycle, err := strconv.ParseBool(c.Params["lifecycle"])
+		if err != nil {
+			return nil, fmt.Errorf("invalid lifecycle: %v", err)
+		}
+		s, err := NewGCSStore(c.Stats, c.OnExpire, c.LifeTime, GCSConfig{
+			Bucket:      c.Params["bucket"],
+			Prefix:      c.Params["prefix"],
+			Credentials: c.Params["credentials"],
+			Lifecycle:   lifecycle,
+		})
+		if err != nil {
+			return nil, err
+		}
+		return s, nil
+	})
+}
+
+// GCSConfig is where a GCS store keeps its pastes and how it authenticates
+type GCSConfig struct {
+	Bucket string
+	// Prefix is prepended to the names of all objects, like "pastes/"
+	Prefix string
+	// Credentials is the path to the JSON key of a service account. If
+	// empty, GOOGLE_APPLICATION_CREDENTIALS is used, and if that is not
+	// set either, the service account of the instance pastecat runs on.
+	Credentials string
+	// Lifecycle adds a rule to the bucket deleting the objects older than
+	// the lifetime of all pastes, so that they are deleted even if they
+	// expire while pastecat is not running.
+	Lifecycle bool
+
+	endpoint string
+}
+
+// NewGCSStore keeps pastes in a Google Cloud Storage bucket, using its JSON
+// API.
+func NewGCSStore(stats *Stats, onExpire ExpireFunc, lifeTime time.Duration, c GCSConfig) (*BlobStore, error) {
+	if c.Bucket == "" {
+		return nil, errors.New("gcs store needs a bucket")
+	}
+	if c.Credentials == "" {
+		c.Credentials = os.Getenv("GOOGLE_APPLICATION_CREDENTIALS")
+	}
+	if c.endpoint == "" {
+		c.endpoint = gcsEndpoint
+	}
+	client := &http.Client{Timeout: gcsTimeout}
+	scope := gcsReadWrite
+	if c.Lifecycle {
+		// Needed to update the bucket's rules
+		scope = gcsFullControl
+	}
+	auth, err := newGCSAuth(client, c.Credentials, scope)
+	if err != nil {
+		return nil, err
+	}
+	g := &gcsBlobs{
+		endpoint: c.endpoint,
+		bucket:   c.Bucket,
+		prefix:   c.Prefix,
+		auth:     auth,
+		client:   client,
+	}
+	if c.Lifecycle {
+		if lifeTime == 0 {
+			return nil, errors.New("gcs lifecycle needs pastes to have a lifetime")
+		}
+		if err := g.setLifecycle(lifeTime); err != nil {
+			return nil, fmt.Errorf("cannot set the lifecycle of gs://%s: %v", c.Bucket, err)
+		}
+	}
+	s, err := newBlobStore(g, stats, onExpire, lifeTime)
+	if err != nil {
+		return nil, fmt.Errorf("cannot recover pastes from gs://%s: %v", c.Bucket, err)
+	}
+	return s, nil
+}
+
+func (g *gcsBlobs) bucketURL() string {
+	return g.endpoint + "/storage/v1/b/" + url.PathEscape(g.bucket)
+}
+
+func (g *gcsBlobs) objectURL(key string) string {
+	return g.bucketURL() + "/o/" + url.PathEscape(g.prefix+key)
+}
+
+func (g *gcsBlobs) do(method, rawurl, contentType string, body []byte) (*http.Response, error) {
+	token, err := g.auth.token()
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest(method, rawurl, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	resp, err := g.client.Do(req)
+	if err == nil && resp.StatusCode == http.StatusUnauthorized {
+		// Get a new token on the next request
+		g.auth.expire()
+	}
+	return resp, err
+}
+
+// gcsStatusError turns a reply that was not a success into an error,
+// closing its body.
+func gcsStatusError(resp *http.Response, op, name string) error {
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return ErrPasteNotFound
+	}
+	var reply struct {
+		Error struct {
+			Message string `json:"message"`
+		} `json:"error"`
+	}
+	msg := resp.Status
+	if err := json.NewDecoder(resp.Body).Decode(&reply); err == nil && reply.Error.Message != "" {
+		msg = reply.Error.Message
+	}
+	return withStatusKind(resp.StatusCode, fmt.Errorf("gcs %s of %s failed: %s", op, name, msg))
+}
+
+func (g *gcsBlobs) get(key string) ([]byte, error) {
+	resp, err := g.do("GET", g.objectURL(key)+"?alt=media", "", nil)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, gcsStatusError(resp, "get", key)
+	}
+	defer resp.Body.Close()
+	return ioutil.ReadAll(resp.Body)
+}
+
+func (g *gcsBlobs) put(key string, value []byte) error {
+	u := g.endpoint + "/upload/storage/v1/b/" + url.PathEscape(g.bucket) +
+		"/o?uploadType=media&name=" + url.QueryEscape(g.prefix+key)
+	resp, err := g.do("POST", u, "application/octet-stream", value)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return gcsStatusError(resp, "put", key)
+	}
+	io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+	return nil
+}
+
+func (g *gcsBlobs) delete(key string) error {
+	resp, err := g.do("DELETE", g.objectURL(key), "", nil)
+	if err != nil {
+		return err
+	}
+	switch resp.StatusCode {
+	case http.StatusOK, http.StatusNoContent:
+		resp.Body.Close()
+		return nil
+	}
+	if err := gcsStatusError(resp, "delete", key); err != ErrPasteNotFound {
+		return err
+	}
+	return nil
+}
+
+func (g *gcsBlobs) list() ([]string, error) {
+	var keys []string
+	pageToken := ""
+	for {
+		q := url.Values{}
+		q.Set("prefix", g.prefix)
+		q.Set("fields", "items(name),nextPageToken")
+		if pageToken != "" {
+			q.Set("pageToken", pageToken)
+		}
+		resp, err := g.do("GET", g.bucketURL()+"/o?"+q.Encode(), "", nil)
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode != http.StatusOK {
+			return nil, gcsStatusError(resp, "list", g.bucket)
+		}
+		var page struct {
+			Items []struct {
+				Name string `json:"name"`
+			} `json:"items"`
+			NextPageToken string `json:"nextPageToken"`
+		}
+		err = json.NewDecoder(resp.Body).Decode(&page)
+		resp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		for _, item := range page.Items {
+			keys = append(keys, item.Name[len(g.prefix):])
+		}
+		if pageToken = page.NextPageToken; pageToken == "" {
+			return keys, nil
+		}
+	}
+}
+
+// gcsRule is a bucket lifecycle rule. Only the fields set by pastecat are
+// named, the rest are kept as they are.
+type gcsRule struct {
+	Action struct {
+		Type string `json:"type"`
+	} `json:"action"`
+	Condition map[string]interface{} `json:"condition"`
+}
+
+// setLifecycle adds a rule deleting the objects under the prefix once the
+// lifetime of all pastes has passed since they were written, replacing the
+// one added before, if any. Other rules are kept. Pastes only live as long
+// as their first version, so the objects of their versions are always
+// deleted after they expire.
+func (g *gcsBlobs) setLifecycle(lifeTime time.Duration) error {
+	resp, err := g.do("GET", g.bucketURL()+"?fields=lifecycle", "", nil)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return gcsStatusError(resp, "get", g.bucket)
+	}
+	var bucket struct {
+		Lifecycle struct {
+			Rule []json.RawMessage `json:"rule"`
+		} `json:"lifecycle"`
+	}
+	err = json.NewDecoder(resp.Body).Decode(&bucket)
+	resp.Body.Close()
+	if err != nil {
+		return err
+	}
+	ours := gcsRule{Condition: map[string]interface{}{
+		"age":           int((lifeTime + 24*time.Hour - 1) / (24 * time.Hour)),
+		"matchesPrefix": []string{g.prefix},
+	}}
+	ours.Action.Type = "Delete"
+	rules := []interface{}{ours}
+	for _, raw := range bucket.Lifecycle.Rule {
+		var rule gcsRule
+		if err := json.Unmarshal(raw, &rule); err != nil {
+			return err
+		}
+		if g.isOurs(rule) {
+			continue
+		}
+		rules = append(rules, raw)
+	}
+	body, err := json.Marshal(map[string]interface{}{
+		"lifecycle": map[string]interface{}{"rule": rules},
+	})
+	if err != nil {
+		return err
+	}
+	resp, err = g.do("PATCH", g.bucketURL()+"?fields=lifecycle", "application/json", body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return gcsStatusError(resp, "update", g.bucket)
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// isOurs reports whether a rule only deletes the objects under the prefix
+// by their age, like the ones setLifecycle adds.
+func (g *gcsBlobs) isOurs(rule gcsRule) bool {
+	if rule.Action.Type != "Delete" || len(rule.Condition) != 2 {
+		return false
+	}
+	if _, e := rule.Condition["age"]; !e {
+		return false
+	}
+	prefixes, _ := rule.Condition["matchesPrefix"].([]interface{})
+	return len(prefixes) == 1 && prefixes[0] == g.prefix
+}
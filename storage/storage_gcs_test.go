@@ -0,0 +1,228 @@
+package storage
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeGCS serves the parts of the Cloud Storage JSON API and the OAuth
+// token endpoint that a GCS store uses, for a single bucket.
+type fakeGCS struct {
+	sync.Mutex
+	t       *testing.T
+	bucket  string
+	pub     *rsa.PublicKey
+	tokens  int
+	objects map[string][]byte
+	rules   []interface{}
+}
+
+func (f *fakeGCS) checkJWT(jwt string) bool {
+	parts := strings.Split(jwt, ".")
+	if len(parts) != 3 {
+		return false
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return false
+	}
+	sum := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	return rsa.VerifyPKCS1v15(f.pub, crypto.SHA256, sum[:], sig) == nil
+}
+
+func (f *fakeGCS) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.Lock()
+	defer f.Unlock()
+	if r.URL.Path == "/token" {
+		if !f.checkJWT(r.FormValue("assertion")) {
+			http.Error(w, `{"error_description":"bad signature"}`, http.StatusBadRequest)
+			return
+		}
+		f.tokens++
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"access_token": "secret",
+			"expires_in":   3600,
+		})
+		return
+	}
+	if r.Header.Get("Authorization") != "Bearer secret" {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	bucketPath := "/storage/v1/b/" + f.bucket
+	objPrefix := bucketPath + "/o/"
+	switch {
+	case r.Method == "POST" && r.URL.Path == "/upload/storage/v1/b/"+f.bucket+"/o":
+		body, _ := ioutil.ReadAll(r.Body)
+		f.objects[r.URL.Query().Get("name")] = body
+		w.Write([]byte("{}"))
+	case r.URL.Path == bucketPath+"/o":
+		var names []string
+		for name := range f.objects {
+			if strings.HasPrefix(name, r.URL.Query().Get("prefix")) {
+				names = append(names, name)
+			}
+		}
+		sort.Strings(names)
+		// Two per page, to test paging
+		start := 0
+		if tok := r.URL.Query().Get("pageToken"); tok != "" {
+			start = sort.SearchStrings(names, tok)
+		}
+		page := map[string]interface{}{}
+		var items []map[string]string
+		for i := start; i < len(names) && i < start+2; i++ {
+			items = append(items, map[string]string{"name": names[i]})
+		}
+		page["items"] = items
+		if start+2 < len(names) {
+			page["nextPageToken"] = names[start+2]
+		}
+		json.NewEncoder(w).Encode(page)
+	case strings.HasPrefix(r.URL.Path, objPrefix):
+		name := strings.TrimPrefix(r.URL.Path, objPrefix)
+		content, e := f.objects[name]
+		if !e {
+			http.Error(w, `{"error":{"message":"No such object"}}`, http.StatusNotFound)
+			return
+		}
+		switch r.Method {
+		case "GET":
+			w.Write(content)
+		case "DELETE":
+			delete(f.objects, name)
+			w.WriteHeader(http.StatusNoContent)
+		}
+	case r.URL.Path == bucketPath:
+		if r.Method == "PATCH" {
+			var bucket struct {
+				Lifecycle struct {
+					Rule []interface{} `json:"rule"`
+				} `json:"lifecycle"`
+			}
+			json.NewDecoder(r.Body).Decode(&bucket)
+			f.rules = bucket.Lifecycle.Rule
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"lifecycle": map[string]interface{}{"rule": f.rules},
+		})
+	default:
+		f.t.Errorf("unexpected request %s %s", r.Method, r.URL)
+		w.WriteHeader(http.StatusBadRequest)
+	}
+}
+
+func TestGCSStore(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gcs := &fakeGCS{
+		t:       t,
+		bucket:  "pastes",
+		pub:     &key.PublicKey,
+		objects: make(map[string][]byte),
+		rules: []interface{}{
+			map[string]interface{}{
+				"action":    map[string]interface{}{"type": "SetStorageClass", "storageClass": "COLDLINE"},
+				"condition": map[string]interface{}{"age": 365},
+			},
+		},
+	}
+	srv := httptest.NewServer(gcs)
+	defer srv.Close()
+
+	dir, err := ioutil.TempDir("", "pastecat-gcs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyJSON, err := json.Marshal(gcsKey{
+		ClientEmail: "pastecat@project.iam.gserviceaccount.com",
+		PrivateKey:  string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})),
+		TokenURI:    srv.URL + "/token",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyPath := filepath.Join(dir, "key.json")
+	if err := ioutil.WriteFile(keyPath, keyJSON, 0600); err != nil {
+		t.Fatal(err)
+	}
+	config := GCSConfig{
+		Bucket:      "pastes",
+		Prefix:      "p/",
+		Credentials: keyPath,
+		Lifecycle:   true,
+		endpoint:    srv.URL,
+	}
+
+	s, err := NewGCSStore(&Stats{}, nil, 36*time.Hour, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ids []ID
+	for _, content := range []string{"foo", "bar", "baz"} {
+		id, err := s.Put([]byte(content), Meta{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, id)
+	}
+	if err := s.Update(ids[0], []byte("foofoo"), Meta{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Delete(ids[2]); err != nil {
+		t.Fatal(err)
+	}
+	if got := string(gcs.objects["p/"+ids[1].String()]); got != "bar" {
+		t.Errorf("object of %s holds %q, want %q", ids[1], got, "bar")
+	}
+
+	// A new store finds the pastes already in the bucket, going through
+	// the pages of objects, and replaces its lifecycle rule
+	stats := &Stats{}
+	s2, err := NewGCSStore(stats, nil, 72*time.Hour, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if num, stg := stats.Report(); num != 2 || stg != 12 {
+		t.Errorf("recovered %d pastes taking %d bytes, want 2 and 12", num, stg)
+	}
+	p, err := s2.GetVersion(ids[0], 1)
+	if got := readPaste(t, p, err); got != "foo" {
+		t.Errorf("GetVersion() got %q, want %q", got, "foo")
+	}
+	if _, err := s2.Get(ids[2]); err != ErrPasteNotFound {
+		t.Errorf("Get() of a deleted paste got %v, want %v", err, ErrPasteNotFound)
+	}
+	if gcs.tokens != 2 {
+		t.Errorf("got %d tokens, want one per store", gcs.tokens)
+	}
+	rules, _ := json.Marshal(gcs.rules)
+	want := `[{"action":{"type":"Delete"},"condition":{"age":3,"matchesPrefix":["p/"]}},` +
+		`{"action":{"storageClass":"COLDLINE","type":"SetStorageClass"},"condition":{"age":365}}]`
+	if string(rules) != want {
+		t.Errorf("lifecycle rules are %s, want %s", rules, want)
+	}
+}
@@ -0,0 +1,205 @@
+// Copyright (c) 2014-2015, Daniel Martí <mvdan@mvdan.cc>
+// See LICENSE for licensing information
+
+package storage
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+// How many times a HybridStore tries to put a paste under an id that is not
+// taken in its other store
+const hybridTries = 5
+
+// HybridStore keeps the pastes smaller than a size in one store and the
+// rest in another, like small pastes in memory and large ones on disk.
+// Edited pastes stay in the store they were in, whatever their new size.
+type HybridStore struct {
+	small Store
+	large Store
+	size  ByteSize
+}
+
+func init() {
+	Register("hybrid", map[string]string{
+		"small": "mem",
+		"large": "fs",
+		"size":  "64K",
+	}, func(c Config) (Store, error) {
+		size, err := parseBytesize(c.Params["size"])
+		if err != nil {
+			return nil, fmt.Errorf("invalid size: %v", err)
+		}
+		open := func(key string) (Store, error) {
+			name, params, err := ParseSubSpec(c.Params[key])
+			if err != nil {
+				return nil, err
+			}
+			if name == "hybrid" {
+				return nil, fmt.Errorf("the %s store cannot be hybrid", key)
+			}
+			s, err := Open(name, params, Config{
+				Stats:    c.Stats,
+				OnExpire: c.OnExpire,
+				LifeTime: c.LifeTime,
+				Layout:   c.Layout,
+			})
+			if err != nil {
+				return nil, fmt.Errorf("%s store: %v", key, err)
+			}
+			return s, nil
+		}
+		small, err := open("small")
+		if err != nil {
+			return nil, err
+		}
+		large, err := open("large")
+		if err != nil {
+			return nil, err
+		}
+		return NewHybridStore(small, large, size), nil
+	})
+}
+
+// ParseSubSpec is like ParseSpec, but for a backend given as the parameter
+// of another, with its own parameters separated by semicolons like
+// "fs:dir=pastes;shared=false".
+func ParseSubSpec(spec string) (string, map[string]string, error) {
+	return ParseSpec(strings.Replace(spec, ";", ",", -1))
+}
+
+// FormatSubSpec is the inverse of ParseSubSpec, with the parameters sorted
+// by name.
+func FormatSubSpec(name string, params map[string]string) string {
+	return strings.Replace(FormatSpec(name, params), ",", ";", -1)
+}
+
+// NewHybridStore keeps the pastes smaller than size in small, and the rest
+// in large.
+func NewHybridStore(small, large Store, size ByteSize) *HybridStore {
+	return &HybridStore{small: small, large: large, size: size}
+}
+
+// pick returns the store for a paste's content, and the other one.
+func (s *HybridStore) pick(content []byte) (Store, Store) {
+	if ByteSize(len(content)) < s.size {
+		return s.small, s.large
+	}
+	return s.large, s.small
+}
+
+// find calls fn with the small store and then with the large one, until it
+// does not fail with ErrPasteNotFound.
+func (s *HybridStore) find(fn func(Store) error) error {
+	if err := fn(s.small); err != ErrPasteNotFound {
+		return err
+	}
+	return fn(s.large)
+}
+
+func (s *HybridStore) Get(id ID) (paste Paste, err error) {
+	err = s.find(func(st Store) error {
+		paste, err = st.Get(id)
+		return err
+	})
+	return paste, err
+}
+
+func (s *HybridStore) Stat(id ID) (info Info, err error) {
+	err = s.find(func(st Store) error {
+		info, err = Stat(st, id)
+		return err
+	})
+	return info, err
+}
+
+func (s *HybridStore) GetVersion(id ID, version int) (paste Paste, err error) {
+	err = s.find(func(st Store) error {
+		paste, err = st.GetVersion(id, version)
+		return err
+	})
+	return paste, err
+}
+
+// Put picks the id in the store for the content, and checks afterwards that
+// the other store does not have it. Of two pastes racing for the same id in
+// both stores, at least the last one put sees the other and tries again.
+func (s *HybridStore) Put(content []byte, meta Meta) (ID, error) {
+	st, other := s.pick(content)
+	for try := 0; try < hybridTries; try++ {
+		id, err := st.Put(content, meta)
+		if err != nil {
+			return id, err
+		}
+		_, err = Stat(other, id)
+		if err == ErrPasteNotFound {
+			return id, nil
+		}
+		if err := st.Delete(id); err != nil {
+			return id, err
+		}
+	}
+	return ID{}, ErrNoUnusedIDFound
+}
+
+func (s *HybridStore) Delete(id ID) error {
+	return s.find(func(st Store) error {
+		return st.Delete(id)
+	})
+}
+
+// DeleteBatch deletes the pastes from both stores, as each skips those it
+// does not hold.
+func (s *HybridStore) DeleteBatch(ids []ID) error {
+	if err := DeleteBatch(s.small, ids); err != nil {
+		return err
+	}
+	return DeleteBatch(s.large, ids)
+}
+
+func (s *HybridStore) Update(id ID, content []byte, meta Meta) error {
+	return s.find(func(st Store) error {
+		return st.Update(id, content, meta)
+	})
+}
+
+// Copy puts the paste in the store for its content, removing it from the
+// other one if it was there.
+func (s *HybridStore) Copy(id ID, content []byte, meta Meta, modTime time.Time, versions [][]byte) error {
+	st, other := s.pick(content)
+	if err := st.Copy(id, content, meta, modTime, versions); err != nil {
+		return err
+	}
+	if err := other.Delete(id); err != nil && err != ErrPasteNotFound {
+		return err
+	}
+	return nil
+}
+
+func (s *HybridStore) Iterate(fn func(id ID, info Info) bool) error {
+	done := false
+	err := s.small.Iterate(func(id ID, info Info) bool {
+		done = !fn(id, info)
+		return !done
+	})
+	if err != nil || done {
+		return err
+	}
+	return s.large.Iterate(fn)
+}
+
+// Close closes both stores, if they need to be.
+func (s *HybridStore) Close() error {
+	var err error
+	for _, st := range []Store{s.small, s.large} {
+		if c, ok := st.(io.Closer); ok {
+			if err1 := c.Close(); err == nil {
+				err = err1
+			}
+		}
+	}
+	return err
+}
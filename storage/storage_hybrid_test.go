@@ -0,0 +1,98 @@
+package storage
+
+import (
+	"io/ioutil"
+	"testing"
+	"time"
+)
+
+func TestHybridStore(t *testing.T) {
+	small, _ := NewMemStore()
+	large, _ := NewMemStore()
+	s := NewHybridStore(small, large, 4)
+	mustRead := func(id ID, want string) {
+		t.Helper()
+		p, err := s.Get(id)
+		if err != nil {
+			t.Fatalf("Get(%s) errored unexpectedly: %v", id, err)
+		}
+		defer p.Close()
+		got, _ := ioutil.ReadAll(p)
+		if string(got) != want {
+			t.Errorf("Get(%s) got %q, want %q", id, got, want)
+		}
+	}
+	has := func(st *MemStore, id ID) bool {
+		_, err := st.Stat(id)
+		return err == nil
+	}
+	foo, err := s.Put([]byte("foo"), Meta{})
+	if err != nil {
+		t.Fatalf("Put() errored unexpectedly: %v", err)
+	}
+	foobar, err := s.Put([]byte("foobar"), Meta{})
+	if err != nil {
+		t.Fatalf("Put() errored unexpectedly: %v", err)
+	}
+	if !has(small, foo) || has(large, foo) {
+		t.Errorf("Small paste not kept in the small store alone")
+	}
+	if !has(large, foobar) || has(small, foobar) {
+		t.Errorf("Large paste not kept in the large store alone")
+	}
+	mustRead(foo, "foo")
+	mustRead(foobar, "foobar")
+
+	// Edits stay in the same store, whatever their size
+	if err := s.Update(foo, []byte("foo2bar"), Meta{}); err != nil {
+		t.Fatalf("Update() errored unexpectedly: %v", err)
+	}
+	if !has(small, foo) {
+		t.Errorf("Edited paste moved out of the small store")
+	}
+	mustRead(foo, "foo2bar")
+	if p, err := s.GetVersion(foo, 1); err != nil {
+		t.Errorf("GetVersion() errored unexpectedly: %v", err)
+	} else {
+		p.Close()
+	}
+
+	// Copies go to the store for their size, leaving the other one
+	if err := s.Copy(foobar, []byte("bar"), Meta{}, time.Now(), nil); err != nil {
+		t.Fatalf("Copy() errored unexpectedly: %v", err)
+	}
+	if !has(small, foobar) || has(large, foobar) {
+		t.Errorf("Copy of a small paste not moved to the small store")
+	}
+	mustRead(foobar, "bar")
+
+	n := 0
+	s.Iterate(func(id ID, info Info) bool {
+		n++
+		return true
+	})
+	if n != 2 {
+		t.Errorf("Iterate() went over %d pastes, want 2", n)
+	}
+	for _, id := range []ID{foo, foobar} {
+		if err := s.Delete(id); err != nil {
+			t.Errorf("Delete(%s) errored unexpectedly: %v", id, err)
+		}
+		if _, err := s.Get(id); err != ErrPasteNotFound {
+			t.Errorf("Get(%s) of a deleted paste got %v, want %v", id, err, ErrPasteNotFound)
+		}
+	}
+}
+
+func TestParseSubSpec(t *testing.T) {
+	name, params, err := ParseSubSpec("fs:dir=/srv/pastes;shared=false")
+	if err != nil {
+		t.Fatalf("ParseSubSpec() errored unexpectedly: %v", err)
+	}
+	if name != "fs" || len(params) != 2 || params["dir"] != "/srv/pastes" || params["shared"] != "false" {
+		t.Errorf("ParseSubSpec() got %s %v", name, params)
+	}
+	if got, want := FormatSubSpec(name, params), "fs:dir=/srv/pastes;shared=false"; got != want {
+		t.Errorf("FormatSubSpec() got %q, want %q", got, want)
+	}
+}
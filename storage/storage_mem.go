@@ -4,25 +4,92 @@
 package storage
 
 import (
+	"bufio"
 	"bytes"
+	"encoding/gob"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
 type MemStore struct {
 	sync.RWMutex
-	cache map[ID]memCache
+	cache map[ID]*memCache
+	// snapshot is the file the pastes are saved to, if any
+	snapshot string
+	ticker   *time.Ticker
+	// saving is held while saving a snapshot
+	saving sync.Mutex
+	// spill is the size from which contents are kept in files within
+	// spillDir instead of in memory, if positive
+	spill    ByteSize
+	spillDir string
 }
 
 type memCache struct {
-	buffer  []byte
+	content memContent
 	modTime time.Time
 	size    int64
+	meta    Meta
+	views   int64
+	// versions holds the content of the previous versions
+	versions []memContent
+}
+
+// memContent is the content of a paste or of one of its versions, held in
+// memory unless it was spilled to a file
+type memContent struct {
+	buffer []byte
+	// path is the file holding the content instead, if spilled
+	path string
+}
+
+// memReader reads the content of a paste, and may have to be closed
+type memReader interface {
+	io.Reader
+	io.ReaderAt
+	io.Seeker
+}
+
+func (c memContent) open() (memReader, error) {
+	if c.path == "" {
+		return bytes.NewReader(c.buffer), nil
+	}
+	return os.Open(c.path)
+}
+
+func (c memContent) bytes() ([]byte, error) {
+	if c.path == "" {
+		return c.buffer, nil
+	}
+	return ioutil.ReadFile(c.path)
+}
+
+// remove deletes the file of spilled content. Readers that have it open can
+// still finish.
+func (c memContent) remove() {
+	if c.path != "" {
+		os.Remove(c.path)
+	}
+}
+
+// removeAll deletes the files of a paste's spilled contents.
+func (c *memCache) removeAll() {
+	c.content.remove()
+	for _, v := range c.versions {
+		v.remove()
+	}
 }
 
 type MemPaste struct {
-	content *bytes.Reader
+	content memReader
 	cache   *memCache
+	views   int64
 }
 
 func (ps MemPaste) Read(p []byte) (n int, err error) {
@@ -37,18 +104,298 @@ func (ps MemPaste) Seek(offset int64, whence int) (i int64, err error) {
 	return ps.content.Seek(offset, whence)
 }
 
-func (ps MemPaste) Close() error { return nil }
+func (ps MemPaste) Close() error {
+	if c, ok := ps.content.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
 
 func (ps MemPaste) ModTime() time.Time { return ps.cache.modTime }
 
 func (ps MemPaste) Size() int64 { return ps.cache.size }
 
+func (ps MemPaste) Meta() Meta { return ps.cache.meta }
+
+func (ps MemPaste) Views() int64 { return ps.views }
+
+func init() {
+	Register("mem", map[string]string{
+		"snapshot": "",
+		"interval": "5m",
+		"spill":    "0",
+		"spilldir": "",
+	}, func(c Config) (Store, error) {
+		interval, err := time.ParseDuration(c.Params["interval"])
+		if err != nil {
+			return nil, fmt.Errorf("invalid interval: %v", err)
+		}
+		spill, err := parseBytesize(c.Params["spill"])
+		if err != nil {
+			return nil, fmt.Errorf("invalid spill: %v", err)
+		}
+		s, _ := NewMemStore()
+		if err := s.spillTo(c.Params["spilldir"], spill); err != nil {
+			return nil, err
+		}
+		if err := s.keepSnapshot(c.Stats, c.OnExpire, c.LifeTime, c.Params["snapshot"], interval); err != nil {
+			return nil, err
+		}
+		return s, nil
+	})
+}
+
 func NewMemStore() (s *MemStore, err error) {
 	s = new(MemStore)
-	s.cache = make(map[ID]memCache)
+	s.cache = make(map[ID]*memCache)
 	return
 }
 
+// NewSnapshotMemStore is like NewMemStore, but restores the pastes saved in
+// a snapshot file, if it exists. The pastes are saved to it every interval,
+// if positive, and when the store is closed.
+func NewSnapshotMemStore(stats *Stats, onExpire ExpireFunc, lifeTime time.Duration, path string, interval time.Duration) (*MemStore, error) {
+	s, _ := NewMemStore()
+	if err := s.keepSnapshot(stats, onExpire, lifeTime, path, interval); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// NewSpillMemStore is like NewMemStore, but keeps the contents of spill
+// bytes or more in files, within a new temporary directory in dir or the
+// default one if empty. The directory is removed when the store is closed.
+func NewSpillMemStore(dir string, spill ByteSize) (*MemStore, error) {
+	s, _ := NewMemStore()
+	if err := s.spillTo(dir, spill); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *MemStore) spillTo(dir string, spill ByteSize) error {
+	if spill <= 0 {
+		return nil
+	}
+	// Each store gets its own directory, so that files left behind by
+	// previous processes are never mistaken for its own
+	spillDir, err := ioutil.TempDir(dir, "pastecat-mem")
+	if err != nil {
+		return err
+	}
+	s.spill = spill
+	s.spillDir = spillDir
+	return nil
+}
+
+// newContent holds content in memory, or in a file if it is large enough to
+// be spilled.
+func (s *MemStore) newContent(content []byte) (memContent, error) {
+	if s.spill <= 0 || ByteSize(len(content)) < s.spill {
+		return memContent{buffer: content}, nil
+	}
+	f, err := ioutil.TempFile(s.spillDir, "paste")
+	if err != nil {
+		return memContent{}, diskFull(err)
+	}
+	n, err := f.Write(content)
+	if err == nil && n < len(content) {
+		err = io.ErrShortWrite
+	}
+	if err1 := f.Close(); err == nil {
+		err = err1
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return memContent{}, diskFull(err)
+	}
+	return memContent{path: f.Name()}, nil
+}
+
+func (s *MemStore) keepSnapshot(stats *Stats, onExpire ExpireFunc, lifeTime time.Duration, path string, interval time.Duration) error {
+	if path == "" {
+		return nil
+	}
+	s.snapshot = path
+	if err := s.restore(stats, onExpire, lifeTime); err != nil {
+		return err
+	}
+	if interval > 0 {
+		s.ticker = time.NewTicker(interval)
+		go func() {
+			for range s.ticker.C {
+				if err := s.Snapshot(); err != nil {
+					log.Printf("Could not save a snapshot to %s: %v", s.snapshot, err)
+				}
+			}
+		}()
+	}
+	return nil
+}
+
+// snapshotEntry is a paste as saved in a snapshot
+type snapshotEntry struct {
+	ID       ID
+	ModTime  time.Time
+	Meta     Meta
+	Content  []byte
+	Versions [][]byte
+}
+
+// Snapshot saves all pastes to the snapshot file. The file is replaced
+// once the new one is complete, so a failure keeps the previous one.
+func (s *MemStore) Snapshot() error {
+	if s.snapshot == "" {
+		return nil
+	}
+	// Cached pastes are replaced rather than changed, so they can be
+	// written without holding the lock
+	s.RLock()
+	ids := make([]ID, 0, len(s.cache))
+	cached := make([]*memCache, 0, len(s.cache))
+	for id, c := range s.cache {
+		ids = append(ids, id)
+		cached = append(cached, c)
+	}
+	s.RUnlock()
+	s.saving.Lock()
+	defer s.saving.Unlock()
+	tmpPath := s.snapshot + tmpSuffix
+	f, err := os.OpenFile(tmpPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return diskFull(err)
+	}
+	w := bufio.NewWriter(f)
+	enc := gob.NewEncoder(w)
+	for i, c := range cached {
+		if err = encodeSnapshotEntry(enc, ids[i], c); os.IsNotExist(err) {
+			// Deleted since, along with its spilled files
+			err = nil
+		} else if err != nil {
+			break
+		}
+	}
+	if err == nil {
+		err = w.Flush()
+	}
+	// The snapshot is the only copy of the pastes, whatever the policy
+	if err == nil {
+		err = f.Sync()
+	}
+	if err1 := f.Close(); err == nil {
+		err = err1
+	}
+	if err == nil {
+		err = os.Rename(tmpPath, s.snapshot)
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+	}
+	return diskFull(err)
+}
+
+// encodeSnapshotEntry writes a paste to a snapshot, reading the contents
+// that were spilled to files one paste at a time.
+func encodeSnapshotEntry(enc *gob.Encoder, id ID, c *memCache) error {
+	content, err := c.content.bytes()
+	if err != nil {
+		return err
+	}
+	e := snapshotEntry{
+		ID:       id,
+		ModTime:  c.modTime,
+		Meta:     c.meta,
+		Content:  content,
+		Versions: make([][]byte, len(c.versions)),
+	}
+	for i, v := range c.versions {
+		if e.Versions[i], err = v.bytes(); err != nil {
+			return err
+		}
+	}
+	return enc.Encode(&e)
+}
+
+// restore adds the pastes in the snapshot file, if any, dropping those that
+// expired since.
+func (s *MemStore) restore(stats *Stats, onExpire ExpireFunc, lifeTime time.Duration) error {
+	f, err := os.Open(s.snapshot)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer f.Close()
+	dec := gob.NewDecoder(bufio.NewReader(f))
+	startTime := clock.Now()
+	for {
+		var e snapshotEntry
+		if err := dec.Decode(&e); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("invalid snapshot %s: %v", s.snapshot, err)
+		}
+		var lifeLeft time.Duration
+		if lt := e.Meta.EffectiveLifeTime(lifeTime); lt > 0 {
+			deathTime := e.Meta.Created(e.ModTime).Add(lt)
+			if lifeLeft = deathTime.Sub(startTime); lifeLeft <= 0 {
+				if onExpire != nil {
+					onExpire(e.ID, deathTime)
+				}
+				continue
+			}
+		}
+		size := int64(len(e.Content))
+		if err := stats.MakeSpaceFor(size + e.Meta.VersionsSize()); err != nil {
+			return err
+		}
+		cached, err := s.newCache(e.Content, e.Meta, e.ModTime, e.Versions)
+		if err != nil {
+			return err
+		}
+		s.cache[e.ID] = cached
+		SetupPasteDeletion(s, stats, onExpire, e.ID, lifeLeft)
+	}
+}
+
+// newCache holds a paste along with its previous versions, spilling those
+// that are large enough.
+func (s *MemStore) newCache(content []byte, meta Meta, modTime time.Time, versions [][]byte) (*memCache, error) {
+	cached := &memCache{
+		modTime: modTime,
+		size:    int64(len(content)),
+		meta:    meta,
+	}
+	var err error
+	if cached.content, err = s.newContent(content); err != nil {
+		return nil, err
+	}
+	for _, v := range versions {
+		vc, err := s.newContent(v)
+		if err != nil {
+			cached.removeAll()
+			return nil, err
+		}
+		cached.versions = append(cached.versions, vc)
+	}
+	return cached, nil
+}
+
+// Close stops the periodic snapshots and saves a last one, if the store
+// has a snapshot file. The files of spilled contents are then removed.
+func (s *MemStore) Close() error {
+	if s.ticker != nil {
+		s.ticker.Stop()
+	}
+	err := s.Snapshot()
+	if s.spillDir != "" {
+		if err1 := os.RemoveAll(s.spillDir); err == nil {
+			err = err1
+		}
+	}
+	return err
+}
+
 func (s *MemStore) Get(id ID) (Paste, error) {
 	s.RLock()
 	defer s.RUnlock()
@@ -56,26 +403,51 @@ func (s *MemStore) Get(id ID) (Paste, error) {
 	if !e {
 		return nil, ErrPasteNotFound
 	}
-	reader := bytes.NewReader(cached.buffer)
-	return MemPaste{content: reader, cache: &cached}, nil
+	reader, err := cached.content.open()
+	if err != nil {
+		return nil, err
+	}
+	views := atomic.AddInt64(&cached.views, 1)
+	return MemPaste{content: reader, cache: cached, views: views}, nil
+}
+
+func (s *MemStore) Stat(id ID) (Info, error) {
+	s.RLock()
+	defer s.RUnlock()
+	cached, e := s.cache[id]
+	if !e {
+		return Info{}, ErrPasteNotFound
+	}
+	return Info{
+		Meta:    cached.meta,
+		ModTime: cached.modTime,
+		Size:    cached.size,
+		Views:   atomic.LoadInt64(&cached.views),
+	}, nil
 }
 
-func (s *MemStore) Put(content []byte) (ID, error) {
+func (s *MemStore) Put(content []byte, meta Meta) (ID, error) {
 	size := int64(len(content))
 	available := func(id ID) bool {
 		_, e := s.cache[id]
 		return !e
 	}
+	mc, err := s.newContent(content)
+	if err != nil {
+		return ID{}, err
+	}
 	s.Lock()
 	defer s.Unlock()
 	id, err := randomID(available)
 	if err != nil {
+		mc.remove()
 		return id, err
 	}
-	s.cache[id] = memCache{
-		buffer:  content,
-		modTime: time.Now(),
+	s.cache[id] = &memCache{
+		content: mc,
+		modTime: clock.Now(),
 		size:    size,
+		meta:    meta,
 	}
 	return id, nil
 }
@@ -83,10 +455,95 @@ func (s *MemStore) Put(content []byte) (ID, error) {
 func (s *MemStore) Delete(id ID) error {
 	s.Lock()
 	defer s.Unlock()
-	_, e := s.cache[id]
+	cached, e := s.cache[id]
 	if !e {
 		return ErrPasteNotFound
 	}
 	delete(s.cache, id)
+	cached.removeAll()
+	return nil
+}
+
+func (s *MemStore) Update(id ID, content []byte, meta Meta) error {
+	mc, err := s.newContent(content)
+	if err != nil {
+		return err
+	}
+	s.Lock()
+	defer s.Unlock()
+	cached, e := s.cache[id]
+	if !e {
+		mc.remove()
+		return ErrPasteNotFound
+	}
+	meta.Versions = append(append([]Version(nil), cached.meta.Versions...), Version{
+		ModTime: cached.modTime,
+		Size:    cached.size,
+		Binary:  cached.meta.Binary,
+		Hash:    cached.meta.Hash,
+	})
+	s.cache[id] = &memCache{
+		content:  mc,
+		modTime:  clock.Now(),
+		size:     int64(len(content)),
+		meta:     meta,
+		views:    atomic.LoadInt64(&cached.views),
+		versions: append(append([]memContent(nil), cached.versions...), cached.content),
+	}
+	return nil
+}
+
+func (s *MemStore) Copy(id ID, content []byte, meta Meta, modTime time.Time, versions [][]byte) error {
+	if len(versions) != len(meta.Versions) {
+		return fmt.Errorf("got %d versions, want %d", len(versions), len(meta.Versions))
+	}
+	cached, err := s.newCache(content, meta, modTime, versions)
+	if err != nil {
+		return err
+	}
+	s.Lock()
+	defer s.Unlock()
+	if old, e := s.cache[id]; e {
+		old.removeAll()
+	}
+	s.cache[id] = cached
+	return nil
+}
+
+func (s *MemStore) GetVersion(id ID, version int) (Paste, error) {
+	s.RLock()
+	defer s.RUnlock()
+	cached, e := s.cache[id]
+	if !e || version < 1 || version > len(cached.versions) {
+		return nil, ErrPasteNotFound
+	}
+	v := cached.meta.Versions[version-1]
+	reader, err := cached.versions[version-1].open()
+	if err != nil {
+		return nil, err
+	}
+	views := atomic.AddInt64(&cached.views, 1)
+	return MemPaste{content: reader, cache: &memCache{
+		content: cached.versions[version-1],
+		modTime: v.ModTime,
+		size:    v.Size,
+		meta:    cached.meta.versionMeta(v),
+	}, views: views}, nil
+}
+
+func (s *MemStore) Iterate(fn func(id ID, info Info) bool) error {
+	s.RLock()
+	defer s.RUnlock()
+	for id, cached := range s.cache {
+		info := Info{
+			Meta:    cached.meta,
+			ModTime: cached.modTime,
+			Size:    cached.size,
+			Views:   atomic.LoadInt64(&cached.views),
+		}
+		if !fn(id, info) {
+			break
+		}
+	}
 	return nil
 }
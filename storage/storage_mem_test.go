@@ -0,0 +1,142 @@
+package storage
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestMemStoreSnapshot(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pastecat-mem")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "snapshot")
+	a, err := NewSnapshotMemStore(&Stats{}, nil, 0, path, 0)
+	if err != nil {
+		t.Fatalf("NewSnapshotMemStore() errored unexpectedly: %v", err)
+	}
+	kept, err := a.Put([]byte("foo"), Meta{Title: "kept"})
+	if err != nil {
+		t.Fatalf("Put() errored unexpectedly: %v", err)
+	}
+	if err := a.Update(kept, []byte("bar2"), Meta{Title: "kept"}); err != nil {
+		t.Fatalf("Update() errored unexpectedly: %v", err)
+	}
+	expired, err := a.Put([]byte("baz"), Meta{LifeTime: time.Millisecond})
+	if err != nil {
+		t.Fatalf("Put() errored unexpectedly: %v", err)
+	}
+	if err := a.Close(); err != nil {
+		t.Fatalf("Close() errored unexpectedly: %v", err)
+	}
+	time.Sleep(2 * time.Millisecond)
+
+	stats := &Stats{}
+	var gotExpired []ID
+	onExpire := func(id ID, deathTime time.Time) { gotExpired = append(gotExpired, id) }
+	b, err := NewSnapshotMemStore(stats, onExpire, 0, path, 0)
+	if err != nil {
+		t.Fatalf("NewSnapshotMemStore() errored unexpectedly: %v", err)
+	}
+	mustRead := func(version int, want string) {
+		var p Paste
+		var err error
+		if version > 0 {
+			p, err = b.GetVersion(kept, version)
+		} else {
+			p, err = b.Get(kept)
+		}
+		if err != nil {
+			t.Fatalf("Could not get version %d: %v", version, err)
+		}
+		got, _ := ioutil.ReadAll(p)
+		if string(got) != want {
+			t.Errorf("Got %q for version %d, want %q", got, version, want)
+		}
+		if title := p.Meta().Title; title != "kept" {
+			t.Errorf("Got title %q for version %d, want %q", title, version, "kept")
+		}
+	}
+	mustRead(0, "bar2")
+	mustRead(1, "foo")
+	if _, err := b.Get(expired); err != ErrPasteNotFound {
+		t.Errorf("Get() of an expired paste got %v, want %v", err, ErrPasteNotFound)
+	}
+	if len(gotExpired) != 1 || gotExpired[0] != expired {
+		t.Errorf("Got expired pastes %v, want %v", gotExpired, []ID{expired})
+	}
+	if number, storage := stats.Report(); number != 1 || storage != 7 {
+		t.Errorf("Restored pastes were counted as %d using %d", number, storage)
+	}
+	if _, err := NewSnapshotMemStore(&Stats{}, nil, 0, filepath.Join(dir, "missing"), 0); err != nil {
+		t.Errorf("NewSnapshotMemStore() without a snapshot errored: %v", err)
+	}
+}
+
+func TestMemStoreSpill(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pastecat-mem")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	s, err := NewSpillMemStore(dir, 4)
+	if err != nil {
+		t.Fatalf("NewSpillMemStore() errored unexpectedly: %v", err)
+	}
+	mustRead := func(id ID, version int, want string) {
+		t.Helper()
+		var p Paste
+		var err error
+		if version > 0 {
+			p, err = s.GetVersion(id, version)
+		} else {
+			p, err = s.Get(id)
+		}
+		if err != nil {
+			t.Fatalf("Could not get %s version %d: %v", id, version, err)
+		}
+		defer p.Close()
+		got, _ := ioutil.ReadAll(p)
+		if string(got) != want {
+			t.Errorf("Got %q for %s version %d, want %q", got, id, version, want)
+		}
+	}
+	small, err := s.Put([]byte("foo"), Meta{})
+	if err != nil {
+		t.Fatalf("Put() errored unexpectedly: %v", err)
+	}
+	large, err := s.Put([]byte("foobar"), Meta{})
+	if err != nil {
+		t.Fatalf("Put() errored unexpectedly: %v", err)
+	}
+	if path := s.cache[small].content.path; path != "" {
+		t.Errorf("Small paste was spilled to %s", path)
+	}
+	spilled := s.cache[large].content.path
+	if spilled == "" {
+		t.Fatalf("Large paste was not spilled")
+	}
+	mustRead(small, 0, "foo")
+	mustRead(large, 0, "foobar")
+	if err := s.Update(large, []byte("bar"), Meta{}); err != nil {
+		t.Fatalf("Update() errored unexpectedly: %v", err)
+	}
+	mustRead(large, 0, "bar")
+	mustRead(large, 1, "foobar")
+	if err := s.Delete(large); err != nil {
+		t.Fatalf("Delete() errored unexpectedly: %v", err)
+	}
+	if _, err := os.Stat(spilled); !os.IsNotExist(err) {
+		t.Errorf("Spilled file of a deleted paste was kept: %v", err)
+	}
+	if err := s.Close(); err != nil {
+		t.Fatalf("Close() errored unexpectedly: %v", err)
+	}
+	if _, err := os.Stat(s.spillDir); !os.IsNotExist(err) {
+		t.Errorf("Spill directory was kept after closing: %v", err)
+	}
+}
@@ -0,0 +1,360 @@
+// Copyright (c) 2014-2015, Daniel Martí <mvdan@mvdan.cc>
+// See LICENSE for licensing information
+
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/user"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// Status codes of later versions of the protocol for a full disk, which
+// some servers reply with anyway
+const (
+	sftpNoSpace = 14
+	sftpQuota   = 15
+)
+
+// Extension of OpenSSH to replace files when renaming
+const sftpPosixRename = "posix-rename@openssh.com"
+
+// Suffix of the files being written, which are renamed once complete
+const sftpTempSuffix = ".tmp"
+
+// Maximum time to wait for the SSH server when connecting
+const sshTimeout = 30 * time.Second
+
+// Keys that ssh logs in with by default, in ~/.ssh
+var sshDefaultKeys = []string{"id_ed25519", "id_ecdsa", "id_rsa"}
+
+// sftpBlobs keeps values as files in a directory on a remote host, through
+// an SFTP session. It is started again if it fails. Files are spread among
+// subdirectories like with WebDAV.
+type sftpBlobs struct {
+	mu   sync.Mutex
+	dial func() (*sftp.Client, io.Closer, error)
+	dir  string
+
+	client *sftp.Client
+	// conn is what the session runs on
+	conn        io.Closer
+	posixRename bool
+}
+
+// connect starts a session if there is none. Must be called with mu held.
+func (s *sftpBlobs) connect() error {
+	if s.client != nil {
+		return nil
+	}
+	client, conn, err := s.dial()
+	if err != nil {
+		return fmt.Errorf("could not start sftp session: %v", err)
+	}
+	s.client, s.conn = client, conn
+	_, s.posixRename = client.HasExtension(sftpPosixRename)
+	return nil
+}
+
+// check turns an error of a request into one of the store's, stopping the
+// session unless the server replied with it. Must be called with mu held.
+func (s *sftpBlobs) check(err error) error {
+	var status *sftp.StatusError
+	switch {
+	case err == nil:
+		return nil
+	case errors.Is(err, os.ErrNotExist):
+		return ErrPasteNotFound
+	case errors.Is(err, os.ErrPermission):
+		return err
+	case errors.As(err, &status):
+		if status.Code == sftpNoSpace || status.Code == sftpQuota {
+			return ErrDiskFull
+		}
+		return err
+	}
+	s.client.Close()
+	s.conn.Close()
+	s.client, s.conn = nil, nil
+	return err
+}
+
+// path returns where a key is stored on the remote host.
+func (s *sftpBlobs) path(key string) string {
+	return path.Join(s.dir, davPath(key))
+}
+
+func (s *sftpBlobs) get(key string) ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.connect(); err != nil {
+		return nil, err
+	}
+	f, err := s.client.Open(s.path(key))
+	if err != nil {
+		return nil, s.check(err)
+	}
+	value, err := ioutil.ReadAll(f)
+	if err1 := f.Close(); err == nil {
+		err = err1
+	}
+	return value, s.check(err)
+}
+
+// create opens a file for writing, creating the directories it goes in if
+// needed.
+func (s *sftpBlobs) create(name string) (*sftp.File, error) {
+	flags := os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+	f, err := s.client.OpenFile(name, flags)
+	if !errors.Is(err, os.ErrNotExist) {
+		return f, err
+	}
+	if err := s.client.MkdirAll(path.Dir(name)); err != nil {
+		return nil, err
+	}
+	return s.client.OpenFile(name, flags)
+}
+
+// put writes the value to a temporary file and renames it, so that a file
+// is never seen half written.
+func (s *sftpBlobs) put(key string, value []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.connect(); err != nil {
+		return err
+	}
+	name := s.path(key)
+	tmp := name + sftpTempSuffix
+	f, err := s.create(tmp)
+	if err != nil {
+		return s.check(err)
+	}
+	_, err = f.Write(value)
+	if err1 := f.Close(); err == nil {
+		err = err1
+	}
+	if err != nil {
+		s.client.Remove(tmp)
+		return s.check(err)
+	}
+	if s.posixRename {
+		return s.check(s.client.PosixRename(tmp, name))
+	}
+	// Plain renames fail if the file exists
+	if err := s.client.Remove(name); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return s.check(err)
+	}
+	return s.check(s.client.Rename(tmp, name))
+}
+
+func (s *sftpBlobs) delete(key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.connect(); err != nil {
+		return err
+	}
+	err := s.check(s.client.Remove(s.path(key)))
+	if err == ErrPasteNotFound {
+		return nil
+	}
+	return err
+}
+
+func (s *sftpBlobs) list() ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.connect(); err != nil {
+		return nil, err
+	}
+	dirs, err := s.client.ReadDir(s.dir)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, s.check(s.client.MkdirAll(s.dir))
+	}
+	if err != nil {
+		return nil, s.check(err)
+	}
+	var keys []string
+	for _, dir := range dirs {
+		if !dir.IsDir() || len(dir.Name()) != davDirSize || dir.Name() == ".." {
+			continue
+		}
+		files, err := s.client.ReadDir(path.Join(s.dir, dir.Name()))
+		if err != nil {
+			return nil, s.check(err)
+		}
+		for _, file := range files {
+			name := file.Name()
+			if strings.HasPrefix(name, dir.Name()) && !strings.HasSuffix(name, sftpTempSuffix) {
+				keys = append(keys, name)
+			}
+		}
+	}
+	return keys, nil
+}
+
+// SFTPConfig holds where to keep pastes over SSH
+type SFTPConfig struct {
+	// Host is what to connect to, like "user@storage.my.site", logging in
+	// as the current user if no user is given
+	Host string
+	// Port of the SSH server, if not 22
+	Port string
+	// Dir is the directory the pastes are kept in, relative to the home
+	// directory of the user if not absolute
+	Dir string
+	// Identity is the private key to log in with, if not one of the
+	// default ones in ~/.ssh
+	Identity string
+	// KnownHosts is the file with the keys of the hosts to trust, if not
+	// ~/.ssh/known_hosts
+	KnownHosts string
+
+	// dial replaces connecting over SSH, for tests
+	dial func() (*sftp.Client, io.Closer, error)
+}
+
+func init() {
+	Register("sftp", map[string]string{
+		"host":        "",
+		"port":        "",
+		"dir":         "pastes",
+		"identity":    "",
+		"known_hosts": "",
+	}, func(c Config) (Store, error) {
+		s, err := NewSFTPStore(c.Stats, c.OnExpire, c.LifeTime, SFTPConfig{
+			Host:       c.Params["host"],
+			Port:       c.Params["port"],
+			Dir:        c.Params["dir"],
+			Identity:   c.Params["identity"],
+			KnownHosts: c.Params["known_hosts"],
+		})
+		if err != nil {
+			return nil, err
+		}
+		return s, nil
+	})
+}
+
+// sshSigners returns the keys to log in with, which are the ones of the
+// agent along with the identity, or the default keys that exist if there
+// is no identity. Keys needing a passphrase are left out, unless given as
+// the identity.
+func sshSigners(identity, home string) ([]ssh.Signer, error) {
+	var signers []ssh.Signer
+	if sock := os.Getenv("SSH_AUTH_SOCK"); sock != "" {
+		if conn, err := net.Dial("unix", sock); err == nil {
+			defer conn.Close()
+			if agentSigners, err := agent.NewClient(conn).Signers(); err == nil {
+				signers = append(signers, agentSigners...)
+			}
+		}
+	}
+	if identity != "" {
+		data, err := ioutil.ReadFile(identity)
+		if err != nil {
+			return nil, err
+		}
+		signer, err := ssh.ParsePrivateKey(data)
+		if err != nil {
+			return nil, fmt.Errorf("invalid identity %s: %v", identity, err)
+		}
+		return append(signers, signer), nil
+	}
+	for _, name := range sshDefaultKeys {
+		data, err := ioutil.ReadFile(filepath.Join(home, ".ssh", name))
+		if err != nil {
+			continue
+		}
+		if signer, err := ssh.ParsePrivateKey(data); err == nil {
+			signers = append(signers, signer)
+		}
+	}
+	return signers, nil
+}
+
+// sshDialer returns how to start an SFTP session over SSH as set up in c.
+// Logging in must not need a password, and the host must be known.
+func sshDialer(c SFTPConfig) (func() (*sftp.Client, io.Closer, error), error) {
+	u, err := user.Current()
+	if err != nil {
+		return nil, err
+	}
+	host, username := c.Host, u.Username
+	if i := strings.LastIndexByte(host, '@'); i >= 0 {
+		username, host = host[:i], host[i+1:]
+	}
+	port := c.Port
+	if port == "" {
+		port = "22"
+	}
+	knownHosts := c.KnownHosts
+	if knownHosts == "" {
+		knownHosts = filepath.Join(u.HomeDir, ".ssh", "known_hosts")
+	}
+	hostKeys, err := knownhosts.New(knownHosts)
+	if err != nil {
+		return nil, fmt.Errorf("cannot load the known hosts: %v", err)
+	}
+	addr := net.JoinHostPort(host, port)
+	return func() (*sftp.Client, io.Closer, error) {
+		signers, err := sshSigners(c.Identity, u.HomeDir)
+		if err != nil {
+			return nil, nil, err
+		}
+		conn, err := ssh.Dial("tcp", addr, &ssh.ClientConfig{
+			User:            username,
+			Auth:            []ssh.AuthMethod{ssh.PublicKeys(signers...)},
+			HostKeyCallback: hostKeys,
+			Timeout:         sshTimeout,
+		})
+		if err != nil {
+			return nil, nil, err
+		}
+		client, err := sftp.NewClient(conn)
+		if err != nil {
+			conn.Close()
+			return nil, nil, err
+		}
+		return client, conn, nil
+	}, nil
+}
+
+// NewSFTPStore keeps pastes in a directory on a remote host, opening an
+// SFTP session with it over SSH. Logging in must not need a password, so
+// the keys of the agent and the ones in ~/.ssh are used, and the host must
+// be in the known hosts. The directory is created if needed.
+func NewSFTPStore(stats *Stats, onExpire ExpireFunc, lifeTime time.Duration, c SFTPConfig) (*BlobStore, error) {
+	if c.Host == "" {
+		return nil, errors.New("sftp store needs a host")
+	}
+	if c.Dir == "" {
+		c.Dir = "."
+	}
+	dial := c.dial
+	if dial == nil {
+		var err error
+		if dial, err = sshDialer(c); err != nil {
+			return nil, err
+		}
+	}
+	b := &sftpBlobs{dial: dial, dir: path.Clean(c.Dir)}
+	s, err := newBlobStore(b, stats, onExpire, lifeTime)
+	if err != nil {
+		return nil, fmt.Errorf("cannot recover pastes from %s: %v", c.Host, err)
+	}
+	return s, nil
+}
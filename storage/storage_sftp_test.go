@@ -0,0 +1,125 @@
+package storage
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/pkg/sftp"
+)
+
+// sftpPipes are the two ends of a session between a client and a server in
+// the same process
+type sftpPipes struct {
+	*io.PipeReader
+	*io.PipeWriter
+}
+
+func (p sftpPipes) Close() error {
+	p.PipeReader.Close()
+	return p.PipeWriter.Close()
+}
+
+// dialSFTPServer returns how to start a session with an SFTP server on the
+// files under root, in place of connecting over SSH.
+func dialSFTPServer(root string) func() (*sftp.Client, io.Closer, error) {
+	return func() (*sftp.Client, io.Closer, error) {
+		clientR, serverW := io.Pipe()
+		serverR, clientW := io.Pipe()
+		server, err := sftp.NewServer(sftpPipes{serverR, serverW}, sftp.WithServerWorkingDirectory(root))
+		if err != nil {
+			return nil, nil, err
+		}
+		go server.Serve()
+		client, err := sftp.NewClientPipe(clientR, clientW)
+		if err != nil {
+			return nil, nil, err
+		}
+		return client, sftpPipes{clientR, serverW}, nil
+	}
+}
+
+func TestSFTPStore(t *testing.T) {
+	// With and without renames that replace files
+	for _, extensions := range [][]string{nil, {sftpPosixRename}} {
+		if err := sftp.SetSFTPExtensions(extensions...); err != nil {
+			t.Fatal(err)
+		}
+		root, err := ioutil.TempDir("", "pastecat-sftp")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(root)
+		config := SFTPConfig{
+			Host: "storage",
+			Dir:  "srv/pastes",
+			dial: dialSFTPServer(root),
+		}
+		if err := os.Mkdir(filepath.Join(root, "srv"), 0700); err != nil {
+			t.Fatal(err)
+		}
+
+		s, err := NewSFTPStore(&Stats{}, nil, 0, config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Larger than a chunk, to be written and read in parts
+		large := bytes.Repeat([]byte("0123456789"), 10000)
+		id, err := s.Put(large, Meta{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := s.Update(id, []byte("small"), Meta{}); err != nil {
+			t.Fatal(err)
+		}
+		empty, err := s.Put(nil, Meta{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		other, err := s.Put([]byte("other"), Meta{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := s.Delete(other); err != nil {
+			t.Fatal(err)
+		}
+		path := filepath.Join(root, "srv", "pastes", id.String()[:2], id.String())
+		if got, _ := ioutil.ReadFile(path); string(got) != "small" {
+			t.Errorf("file of %s holds %q, want %q", id, got, "small")
+		}
+
+		// A new store finds the pastes already on the host
+		stats := &Stats{}
+		s2, err := NewSFTPStore(stats, nil, 0, config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if num, stg := stats.Report(); num != 2 || stg != int64(5+len(large)) {
+			t.Errorf("recovered %d pastes taking %d bytes, want 2 and %d", num, stg, 5+len(large))
+		}
+		p, err := s2.GetVersion(id, 1)
+		if got := readPaste(t, p, err); got != string(large) {
+			t.Errorf("GetVersion() got %d bytes, want %d", len(got), len(large))
+		}
+		p, err = s2.Get(empty)
+		if got := readPaste(t, p, err); got != "" {
+			t.Errorf("Get() got %q, want an empty paste", got)
+		}
+		if _, err := s2.Get(other); err != ErrPasteNotFound {
+			t.Errorf("Get() of a deleted paste got %v, want %v", err, ErrPasteNotFound)
+		}
+
+		// The session is started again if it goes away
+		s2.blobs.(*sftpBlobs).conn.Close()
+		if _, err := s2.Get(id); err == nil {
+			t.Errorf("Get() from a killed session did not fail")
+		}
+		p, err = s2.Get(id)
+		if got := readPaste(t, p, err); got != "small" {
+			t.Errorf("Get() after restarting got %q, want %q", got, "small")
+		}
+	}
+}
@@ -5,6 +5,7 @@ import (
 	"reflect"
 	"strings"
 	"testing"
+	"time"
 )
 
 func strRepeat(s string) string {
@@ -92,3 +93,92 @@ func TestRandomID(t *testing.T) {
 		}
 	}
 }
+
+func TestEffectiveLifeTime(t *testing.T) {
+	for _, c := range []struct {
+		in, max, want time.Duration
+	}{
+		{0, 0, 0},
+		{0, time.Hour, time.Hour},
+		{time.Minute, 0, time.Minute},
+		{time.Minute, time.Hour, time.Minute},
+		{2 * time.Hour, time.Hour, time.Hour},
+	} {
+		got := Meta{LifeTime: c.in}.EffectiveLifeTime(c.max)
+		if got != c.want {
+			t.Errorf(`EffectiveLifeTime(%s) for %s got %s, want %s`, c.max, c.in, got, c.want)
+		}
+	}
+}
+
+func TestFileSection(t *testing.T) {
+	meta := Meta{Files: []File{
+		{Name: "a.txt", Size: 3},
+		{Name: "b.txt", Size: 5},
+	}}
+	for _, c := range []struct {
+		name     string
+		wantOff  int64
+		wantSize int64
+		wantOk   bool
+	}{
+		{"a.txt", 0, 3, true},
+		{"b.txt", 3, 5, true},
+		{"c.txt", 0, 0, false},
+	} {
+		off, size, ok := meta.FileSection(c.name)
+		if off != c.wantOff || size != c.wantSize || ok != c.wantOk {
+			t.Errorf(`FileSection("%s") got (%d, %d, %t), want (%d, %d, %t)`,
+				c.name, off, size, ok, c.wantOff, c.wantSize, c.wantOk)
+		}
+	}
+}
+
+func TestCreated(t *testing.T) {
+	modTime := time.Date(2015, 1, 2, 0, 0, 0, 0, time.UTC)
+	first := modTime.Add(-time.Hour)
+	for _, c := range []struct {
+		versions []Version
+		want     time.Time
+	}{
+		{nil, modTime},
+		{[]Version{{ModTime: first, Size: 3}}, first},
+		{[]Version{{ModTime: first, Size: 3}, {ModTime: modTime.Add(-time.Minute), Size: 5}}, first},
+	} {
+		got := Meta{Versions: c.versions}.Created(modTime)
+		if !got.Equal(c.want) {
+			t.Errorf(`Created(%s) with %d versions got %s, want %s`, modTime, len(c.versions), got, c.want)
+		}
+	}
+}
+
+// getOnly hides the Stat method of a store
+type getOnly struct {
+	Store
+}
+
+func TestStat(t *testing.T) {
+	s, _ := NewMemStore()
+	id, err := s.Put([]byte("foo"), Meta{Title: "bar"})
+	if err != nil {
+		t.Fatalf("Put() errored unexpectedly: %v", err)
+	}
+	info, err := Stat(s, id)
+	if err != nil {
+		t.Fatalf("Stat() errored unexpectedly: %v", err)
+	}
+	if info.Size != 3 || info.Title != "bar" || info.Views != 0 {
+		t.Errorf("Stat() got size %d, title %q and %d views, want 3, \"bar\" and 0",
+			info.Size, info.Title, info.Views)
+	}
+	// Falls back to opening the paste, which counts as a view
+	if info, err := Stat(getOnly{s}, id); err != nil {
+		t.Errorf("Stat() without Stater errored unexpectedly: %v", err)
+	} else if info.Size != 3 || info.Views != 1 {
+		t.Errorf("Stat() without Stater got size %d and %d views, want 3 and 1", info.Size, info.Views)
+	}
+	var unknown ID
+	if _, err := Stat(s, unknown); err != ErrPasteNotFound {
+		t.Errorf("Stat() of a missing paste got %v, want %v", err, ErrPasteNotFound)
+	}
+}
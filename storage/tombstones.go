@@ -0,0 +1,59 @@
+// Copyright (c) 2014-2015, Daniel Martí <mvdan@mvdan.cc>
+// See LICENSE for licensing information
+
+package storage
+
+import (
+	"sync"
+	"time"
+)
+
+// Tombstones remembers when the most recently expired pastes were deleted,
+// forgetting the oldest ones once it holds its maximum.
+type Tombstones struct {
+	sync.Mutex
+	expired map[ID]time.Time
+	// Ring of the remembered ids, in order of expiry
+	ring []ID
+	next int
+}
+
+// NewTombstones creates a Tombstones remembering up to max pastes.
+func NewTombstones(max int) *Tombstones {
+	if max < 0 {
+		max = 0
+	}
+	return &Tombstones{
+		expired: make(map[ID]time.Time, max),
+		ring:    make([]ID, 0, max),
+	}
+}
+
+// Add records that the paste known by id expired at the given time.
+func (t *Tombstones) Add(id ID, at time.Time) {
+	t.Lock()
+	defer t.Unlock()
+	if cap(t.ring) == 0 {
+		return
+	}
+	if _, e := t.expired[id]; e {
+		t.expired[id] = at
+		return
+	}
+	if len(t.ring) < cap(t.ring) {
+		t.ring = append(t.ring, id)
+	} else {
+		delete(t.expired, t.ring[t.next])
+		t.ring[t.next] = id
+		t.next = (t.next + 1) % len(t.ring)
+	}
+	t.expired[id] = at
+}
+
+// Get returns when the paste known by id expired, if it is remembered.
+func (t *Tombstones) Get(id ID) (time.Time, bool) {
+	t.Lock()
+	defer t.Unlock()
+	at, e := t.expired[id]
+	return at, e
+}
@@ -0,0 +1,30 @@
+package storage
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTombstones(t *testing.T) {
+	tombs := NewTombstones(2)
+	ids := []ID{{1}, {2}, {3}}
+	for i, id := range ids {
+		tombs.Add(id, time.Unix(int64(i), 0))
+	}
+	if _, e := tombs.Get(ids[0]); e {
+		t.Errorf("Oldest tombstone was not forgotten")
+	}
+	for i, id := range ids[1:] {
+		at, e := tombs.Get(id)
+		if !e {
+			t.Errorf("Tombstone for %s was forgotten", id)
+		} else if want := time.Unix(int64(i+1), 0); !at.Equal(want) {
+			t.Errorf("Tombstone for %s got %v, want %v", id, at, want)
+		}
+	}
+	none := NewTombstones(0)
+	none.Add(ids[0], time.Now())
+	if _, e := none.Get(ids[0]); e {
+		t.Errorf("Tombstone was kept with a maximum of zero")
+	}
+}
@@ -0,0 +1,284 @@
+// Copyright (c) 2014-2015, Daniel Martí <mvdan@mvdan.cc>
+// See LICENSE for licensing information
+
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mvdan/pastecat/storage"
+)
+
+// Prefix of the internal API that replicas pull pastes from
+const syncPrefix = "/sync/"
+
+// Maximum number of changes kept for replicas to catch up with. Replicas
+// further behind get a listing of all pastes instead.
+const maxChanges = 10000
+
+// change is a paste that was stored, edited or deleted. Listings of all
+// pastes also hold the hash and number of versions of each paste, so that
+// replicas can skip the ones they already hold.
+type change struct {
+	ID       string `json:"id"`
+	Deleted  bool   `json:"deleted,omitempty"`
+	Hash     string `json:"hash,omitempty"`
+	Versions int    `json:"versions,omitempty"`
+}
+
+type changesPage struct {
+	// Epoch identifies the primary's run, as changes are numbered
+	// from zero on each run
+	Epoch string `json:"epoch"`
+	// Next is the number to ask for changes since on the next request
+	Next uint64 `json:"next"`
+	// Full is whether the changes list all pastes instead
+	Full    bool     `json:"full,omitempty"`
+	Changes []change `json:"changes"`
+}
+
+type syncedPaste struct {
+	Meta    storage.Meta `json:"meta"`
+	ModTime time.Time    `json:"mod_time"`
+	Content []byte       `json:"content"`
+	// Versions holds the content of the previous versions
+	Versions [][]byte `json:"versions,omitempty"`
+}
+
+// changeLog keeps the latest changes made to the store
+type changeLog struct {
+	sync.Mutex
+	epoch   string
+	next    uint64
+	changes []change
+}
+
+func newChangeLog() (*changeLog, error) {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return nil, err
+	}
+	return &changeLog{epoch: hex.EncodeToString(b)}, nil
+}
+
+func (l *changeLog) add(id storage.ID, deleted bool) {
+	l.Lock()
+	defer l.Unlock()
+	if len(l.changes) == maxChanges {
+		l.changes = append(l.changes[:0], l.changes[maxChanges/2:]...)
+	}
+	l.changes = append(l.changes, change{ID: id.String(), Deleted: deleted})
+	l.next++
+}
+
+// since returns the changes made since the given one, if they are all
+// still kept, along with the number of the next change.
+func (l *changeLog) since(epoch string, seq uint64) ([]change, uint64, bool) {
+	l.Lock()
+	defer l.Unlock()
+	first := l.next - uint64(len(l.changes))
+	if epoch != l.epoch || seq < first || seq > l.next {
+		return nil, l.next, false
+	}
+	return append([]change{}, l.changes[seq-first:]...), l.next, true
+}
+
+// loggedStore records the changes made to a store in a changeLog
+type loggedStore struct {
+	storage.Store
+	log *changeLog
+}
+
+func (s loggedStore) Stat(id storage.ID) (storage.Info, error) {
+	return storage.Stat(s.Store, id)
+}
+
+func (s loggedStore) Put(content []byte, meta storage.Meta) (storage.ID, error) {
+	id, err := s.Store.Put(content, meta)
+	if err == nil {
+		s.log.add(id, false)
+	}
+	return id, err
+}
+
+func (s loggedStore) Update(id storage.ID, content []byte, meta storage.Meta) error {
+	err := s.Store.Update(id, content, meta)
+	if err == nil {
+		s.log.add(id, false)
+	}
+	return err
+}
+
+func (s loggedStore) Copy(id storage.ID, content []byte, meta storage.Meta, modTime time.Time, versions [][]byte) error {
+	err := s.Store.Copy(id, content, meta, modTime, versions)
+	if err == nil {
+		s.log.add(id, false)
+	}
+	return err
+}
+
+func (s loggedStore) Delete(id storage.ID) error {
+	err := s.Store.Delete(id)
+	if err == nil {
+		s.log.add(id, true)
+	}
+	return err
+}
+
+func (s loggedStore) DeleteBatch(ids []storage.ID) error {
+	err := storage.DeleteBatch(s.Store, ids)
+	if err == nil {
+		for _, id := range ids {
+			s.log.add(id, true)
+		}
+	}
+	return err
+}
+
+// syncHandler serves the internal API that replicas pull pastes from.
+// Pastes limited to a number of reads are not replicated, as each replica
+// would allow that many reads.
+type syncHandler struct {
+	h      *httpHandler
+	secret string
+}
+
+func (h syncHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !secretsEqual(bearerToken(r), h.secret) {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	switch {
+	case r.URL.Path == syncPrefix+"changes" && r.Method == "GET":
+		h.handleChanges(w, r)
+	case strings.HasPrefix(r.URL.Path, syncPrefix+"pastes/") && r.Method == "GET":
+		h.handlePaste(w, r)
+	default:
+		http.Error(w, unknownAction, http.StatusBadRequest)
+	}
+}
+
+func (h syncHandler) handleChanges(w http.ResponseWriter, r *http.Request) {
+	since, _ := strconv.ParseUint(r.FormValue("since"), 10, 64)
+	changes, next, ok := h.h.changes.since(r.FormValue("epoch"), since)
+	page := changesPage{Epoch: h.h.changes.epoch, Next: next, Changes: changes}
+	if !ok {
+		page.Full = true
+		page.Changes = []change{}
+		err := h.h.store.Iterate(func(id storage.ID, info storage.Info) bool {
+			if info.MaxReads == 0 {
+				page.Changes = append(page.Changes, change{
+					ID:       id.String(),
+					Hash:     info.Hash,
+					Versions: len(info.Versions),
+				})
+			}
+			return true
+		})
+		if err != nil {
+			h.h.storeError(w, r, err)
+			return
+		}
+	}
+	writeJSON(w, page)
+}
+
+func (h syncHandler) handlePaste(w http.ResponseWriter, r *http.Request) {
+	id, err := storage.IDFromString(r.URL.Path[len(syncPrefix+"pastes/"):])
+	if err != nil {
+		http.Error(w, invalidID, http.StatusBadRequest)
+		return
+	}
+	p, err := h.h.readPaste(id)
+	if err == nil && p.Meta.MaxReads > 0 {
+		err = storage.ErrPasteNotFound
+	}
+	if err != nil {
+		h.h.storeError(w, r, err)
+		return
+	}
+	writeJSON(w, p)
+}
+
+// readPaste reads a paste along with its previous versions.
+func (h *httpHandler) readPaste(id storage.ID) (syncedPaste, error) {
+	paste, err := h.store.Get(id)
+	if err != nil {
+		return syncedPaste{}, err
+	}
+	defer paste.Close()
+	p := syncedPaste{Meta: paste.Meta(), ModTime: paste.ModTime()}
+	if p.Content, err = ioutil.ReadAll(paste); err != nil {
+		return p, err
+	}
+	for i := range p.Meta.Versions {
+		version, err := h.store.GetVersion(id, i+1)
+		if err != nil {
+			return p, err
+		}
+		content, err := ioutil.ReadAll(version)
+		version.Close()
+		if err != nil {
+			return p, err
+		}
+		p.Versions = append(p.Versions, content)
+	}
+	return p, nil
+}
+
+// pasteSize returns the total size of a paste in the store, if it is
+// there, without counting a view.
+func (h *httpHandler) pasteSize(id storage.ID) (int64, bool, error) {
+	info, err := storage.Stat(h.store, id)
+	if err == storage.ErrPasteNotFound {
+		return 0, false, nil
+	} else if err != nil {
+		return 0, false, err
+	}
+	return info.Size + info.VersionsSize(), true, nil
+}
+
+// copyPaste stores a copy of a paste from elsewhere, replacing the paste
+// with the same id, if any.
+func (h *httpHandler) copyPaste(id storage.ID, p syncedPaste) error {
+	oldSize, replaced, err := h.pasteSize(id)
+	if err != nil {
+		return err
+	}
+	size := int64(len(p.Content)) + p.Meta.VersionsSize()
+	if err := h.stats.MakeSpaceFor(size); err != nil {
+		return err
+	}
+	if err := h.store.Copy(id, p.Content, p.Meta, p.ModTime, p.Versions); err != nil {
+		h.stats.FreeSpace(size)
+		return err
+	}
+	if replaced {
+		h.stats.FreeSpace(oldSize)
+	}
+	h.usage.Track(id, p.Meta, p.ModTime, int64(len(p.Content)))
+	return nil
+}
+
+// dropPaste deletes a paste, freeing the space it used.
+func (h *httpHandler) dropPaste(id storage.ID) error {
+	size, e, err := h.pasteSize(id)
+	if err != nil {
+		return err
+	} else if !e {
+		return storage.ErrPasteNotFound
+	}
+	if err := h.store.Delete(id); err != nil {
+		return err
+	}
+	h.stats.FreeSpace(size)
+	h.usage.Forget(id)
+	return nil
+}
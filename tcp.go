@@ -0,0 +1,100 @@
+// Copyright (c) 2014-2015, Daniel Martí <mvdan@mvdan.cc>
+// See LICENSE for licensing information
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"time"
+
+	"github.com/mvdan/pastecat/storage"
+)
+
+// How long to wait for more data before considering a TCP paste complete,
+// since most netcat clients never close their side of the connection
+const tcpIdleTimeout = 2 * time.Second
+
+// serveTCP accepts pastes sent as raw data over TCP connections, like
+// termbin, replying with the url of each paste.
+func (h *httpHandler) serveTCP(l net.Listener) error {
+	for {
+		c, err := l.Accept()
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				log.Printf("Error accepting TCP connection: %v", err)
+				time.Sleep(100 * time.Millisecond)
+				continue
+			}
+			return err
+		}
+		go h.handleConn(c)
+	}
+}
+
+func (h *httpHandler) handleConn(c net.Conn) {
+	defer c.Close()
+	if h.disk.retryAfter() > 0 {
+		fmt.Fprintln(c, storage.ErrDiskFull)
+		return
+	}
+	if _, err := h.admit(""); err != nil {
+		fmt.Fprintln(c, err)
+		return
+	}
+	content, err := readTCPPaste(c, int64(routeMaxSize(apiMaxSize)), *timeout)
+	if err != nil {
+		fmt.Fprintln(c, err)
+		return
+	}
+	host, _, _ := net.SplitHostPort(c.RemoteAddr().String())
+	id, err := h.put(content, storage.Meta{IPHash: uploaderHash(host)})
+	if err != nil {
+		fmt.Fprintln(c, err)
+		return
+	}
+	c.SetWriteDeadline(time.Now().Add(tcpIdleTimeout))
+	fmt.Fprintln(c, pasteURL(id, storage.Meta{}))
+}
+
+// readTCPPaste reads a paste until EOF or until the client stops sending
+// data, giving up if it grows past maxSize or takes longer than timeout.
+func readTCPPaste(c net.Conn, maxSize int64, timeout time.Duration) ([]byte, error) {
+	var deadline time.Time
+	if timeout > 0 {
+		deadline = time.Now().Add(timeout)
+	}
+	var buf bytes.Buffer
+	chunk := make([]byte, 32*1024)
+	for {
+		idle := time.Now().Add(tcpIdleTimeout)
+		if !deadline.IsZero() && idle.After(deadline) {
+			idle = deadline
+		}
+		c.SetReadDeadline(idle)
+		n, err := c.Read(chunk)
+		buf.Write(chunk[:n])
+		if int64(buf.Len()) > maxSize {
+			return nil, fmt.Errorf("paste too large, maximum is %s", storage.ByteSize(maxSize))
+		}
+		if err == io.EOF {
+			break
+		}
+		if ne, ok := err.(net.Error); ok && ne.Timeout() {
+			if !deadline.IsZero() && !time.Now().Before(deadline) {
+				return nil, fmt.Errorf("timed out reading the paste")
+			}
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	if buf.Len() == 0 {
+		return nil, fmt.Errorf("no paste provided")
+	}
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,111 @@
+// Copyright (c) 2014-2015, Daniel Martí <mvdan@mvdan.cc>
+// See LICENSE for licensing information
+
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+)
+
+// Prefix of the routes serving the static assets of the web pages
+const staticPrefix = "/static/"
+
+// Colors of each theme, as the CSS variables that the stylesheet uses
+const (
+	lightColors = `color-scheme: light;
+	--bg: #fff;
+	--fg: #111;
+	--link: #0645ad;
+	--border: #ccc;
+	--field: #fff;`
+	darkColors = `color-scheme: dark;
+	--bg: #1b1d1e;
+	--fg: #ddd;
+	--link: #8ab4f8;
+	--border: #444;
+	--field: #26292b;`
+)
+
+// Rules common to all themes
+const baseStyle = `
+body {
+	background-color: var(--bg);
+	color: var(--fg);
+}
+a {
+	color: var(--link);
+}
+textarea, input, select, button {
+	background-color: var(--field);
+	color: var(--fg);
+	border: 1px solid var(--border);
+}
+table {
+	border-collapse: collapse;
+}
+th, td {
+	padding: 0.2em 0.6em;
+	border-bottom: 1px solid var(--border);
+	text-align: left;
+}
+`
+
+// Stylesheets of the bundled themes. The auto theme follows the browser's
+// preferred color scheme.
+var themes = map[string]string{
+	"light": ":root {\n\t" + lightColors + "\n}\n" + baseStyle,
+	"dark":  ":root {\n\t" + darkColors + "\n}\n" + baseStyle,
+	"auto": ":root {\n\t" + lightColors + "\n}\n" +
+		"@media (prefers-color-scheme: dark) {\n:root {\n\t" + darkColors + "\n}\n}\n" + baseStyle,
+}
+
+// staticAsset is a file served under staticPrefix
+type staticAsset struct {
+	contentType string
+	content     []byte
+	etag        string
+}
+
+func newStaticAsset(contentType, content string) staticAsset {
+	sum := sha256.Sum256([]byte(content))
+	return staticAsset{
+		contentType: contentType,
+		content:     []byte(content),
+		etag:        `"` + hex.EncodeToString(sum[:8]) + `"`,
+	}
+}
+
+// staticHandler serves the static assets of the web pages, which only
+// change between versions or with the flags.
+type staticHandler map[string]staticAsset
+
+// newStaticHandler returns the handler serving the stylesheet of theme.
+func newStaticHandler(theme string) staticHandler {
+	return staticHandler{
+		"style.css": newStaticAsset("text/css; charset=utf-8", themes[theme]),
+	}
+}
+
+func (s staticHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && r.Method != "HEAD" {
+		http.Error(w, unknownAction, http.StatusBadRequest)
+		return
+	}
+	asset, e := s[r.URL.Path[len(staticPrefix):]]
+	if !e {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", asset.contentType)
+	w.Header().Set("Etag", asset.etag)
+	w.Header().Set("Cache-Control", "public, max-age=3600")
+	http.ServeContent(w, r, "", startTime, bytes.NewReader(asset.content))
+}
+
+// staticURL returns the url of a static asset.
+func staticURL(name string) string {
+	return *siteURL + staticPrefix + name
+}
@@ -0,0 +1,49 @@
+// Copyright (c) 2014-2015, Daniel Martí <mvdan@mvdan.cc>
+// See LICENSE for licensing information
+
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+)
+
+// serverTLSConfig returns the configuration of a listener serving the given
+// certificate. If caPath is given, clients presenting a certificate signed
+// by one of the CAs in it are verified as per auth.
+func serverTLSConfig(certPath, keyPath, caPath string, auth tls.ClientAuthType) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(certPath, keyPath)
+	if err != nil {
+		return nil, err
+	}
+	config := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+	if caPath == "" {
+		return config, nil
+	}
+	pem, err := ioutil.ReadFile(caPath)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificates found in %s", caPath)
+	}
+	config.ClientCAs = pool
+	config.ClientAuth = auth
+	return config, nil
+}
+
+// clientCertName returns the common name of the verified certificate the
+// client presented, if any.
+func clientCertName(r *http.Request) string {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 {
+		return ""
+	}
+	return r.TLS.VerifiedChains[0][0].Subject.CommonName
+}
@@ -5,13 +5,18 @@ package main
 
 import "html/template"
 
+// Functions available to all templates
+var templateFuncs = template.FuncMap{
+	"static": staticURL,
+}
+
 var tmpl *template.Template
 
 func loadTemplates() {
 	for name, s := range templates {
 		var t *template.Template
 		if tmpl == nil {
-			tmpl = template.New(name)
+			tmpl = template.New(name).Funcs(templateFuncs)
 		}
 		if name == tmpl.Name() {
 			t = tmpl
@@ -25,49 +30,320 @@ func loadTemplates() {
 }
 
 var templates = map[string]string{
-	"/": `<html>
+	"/": `<html lang="{{.Lang}}">
+<head>
+<meta charset="utf-8">
+{{template "style"}}
+</head>
 <body style="text-align:center">
 <pre style="display:inline-block;text-align:left;margin:2em 2em 2em 0">
-Set up an alias:
+{{call .T "Set up an alias:"}}
 
     $ alias pcat='curl -F "{{.FieldName}}=&lt;-" {{.SiteURL}}'
 
-Upload a new paste:
+{{call .T "Upload a new paste:"}}
 
     $ echo foo | pcat
     {{.SiteURL}}/a63d03b9
 
-Fetch it:
+{{call .T "Fetch it:"}}
 
     $ curl {{.SiteURL}}/a63d03b9
     foo
 
-You can also use the <a href="form">web form</a>.
-{{if gt .MaxSize 0.0}}
-The maximum size per paste is {{.MaxSize}}.
+{{call .T "You can also use the <a href=\"form\">web form</a>."}}
+{{if .Listing}}
+{{call .T "Pastes uploaded with listed=1 are shown among the <a href=\"recent\">recent pastes</a>:"}}
+
+    $ echo foo | curl -F "{{.FieldName}}=&lt;-" -F listed=1 -F title=Foo {{.SiteURL}}
+{{end}}{{if .Login}}{{if .User}}
+{{call .T "Logged in as %s. See <a href=\"me/\">your pastes</a> or <a href=\"auth/logout\">log out</a>." .User}}
+{{else}}
+{{call .T "Uploads require you to <a href=\"auth/login\">log in</a>, or an upload token."}}
+{{end}}{{end}}{{if .Encrypted}}
+{{call .T "The <a href=\"encrypt\">encrypting form</a> encrypts pastes in your browser,\nkeeping the key in the url so that this server cannot read them."}}
+{{end}}{{if gt .MaxSize 0.0}}
+{{call .T "The maximum size per paste is %s." .MaxSize}}
 {{end}}{{if gt .LifeTime 0}}
-Each paste will be deleted after {{.LifeTime}}.
+{{call .T "Each paste will be deleted after %s." .LifeTime}}
+{{end}}{{range .SizeLimits}}
+{{call $.T "Pastes of %s or more will be deleted after %s." .Size .LifeTime}}
+{{end}}{{if .LifeTimes}}
+{{call .T "Each paste may pick its lifetime via the lifetime field, like:"}}
+
+    $ echo foo | curl -F "{{.FieldName}}=&lt;-" -F lifetime={{(index .LifeTimes 0).Name}} {{.SiteURL}}
 {{end}}
+{{call .T "There are currently %s pastes using %s.\nSee <a href=\"stats\">stats</a> for details." .Stats.Pastes .Stats.Storage}}
+
 <a href="http://github.com/mvdan/pastecat">github.com/mvdan/pastecat</a>
 </pre>
 </body>
 </html>
 `,
 	"/form": `<html>
+<head>
+<meta charset="utf-8">
+{{template "style"}}
+</head>
 <body style="text-align:center">
 <div style="inline-block">
 	<form action="{{.SiteURL}}/redirect" method="post" enctype="multipart/form-data">
 		<textarea cols=80 rows=24 name="{{.FieldName}}"></textarea>
 		<br/>
+		{{template "lifetimes" .}}
+		{{template "listing" .}}
 		<button type="submit">Paste text</button>
 	</form>
 	<br/>
 	<form action="{{.SiteURL}}/redirect" method="post" enctype="multipart/form-data">
 		<input type="file" name="{{.FieldName}}"></input>
+		{{template "lifetimes" .}}
+		{{template "listing" .}}
 		<button type="submit">Paste file</button>
 	</form>
 </div>
 </body>
 </html>
+`,
+	"/encrypt": `<html>
+<head>
+<meta charset="utf-8">
+{{template "style"}}
+</head>
+<body style="text-align:center">
+<div style="inline-block">
+	<form id="form">
+		<textarea cols=80 rows=24 name="text"></textarea>
+		<br/>
+		{{template "lifetimes" .}}
+		<button type="submit">Encrypt and paste text</button>
+	</form>
+	<pre id="result"></pre>
+</div>
+<script>
+{{template "crypto"}}
+document.getElementById("form").onsubmit = async function(event) {
+	event.preventDefault();
+	const result = document.getElementById("result");
+	const raw = crypto.getRandomValues(new Uint8Array(32));
+	const iv = crypto.getRandomValues(new Uint8Array(12));
+	const key = await crypto.subtle.importKey("raw", raw, "AES-GCM", false, ["encrypt"]);
+	const text = new TextEncoder().encode(this.elements.text.value);
+	const sealed = await crypto.subtle.encrypt({name: "AES-GCM", iv: iv}, key, text);
+	const body = new FormData();
+	body.append({{.FieldName}}, new Blob([iv, sealed]));
+	body.append("encrypted", "true");
+	if (this.elements.lifetime) {
+		body.append("lifetime", this.elements.lifetime.value);
+	}
+	const resp = await fetch({{.SiteURL}} + "/encrypt", {method: "POST", body: body, headers: {"Accept": "application/json"}});
+	if (!resp.ok) {
+		result.textContent = await resp.text();
+		return;
+	}
+	const created = await resp.json();
+	const link = document.createElement("a");
+	link.href = link.textContent = created.url + "#" + encodeKey(raw);
+	result.textContent = "Your paste is at:\n\n    ";
+	result.appendChild(link);
+};
+</script>
+</body>
+</html>
+`,
+	"decrypt": `<html>
+<head>
+<meta charset="utf-8">
+<title>{{.ID}}</title>
+</head>
+<body style="background-color:#fff;color:#000">
+<pre id="paste" data-paste="{{.Data}}">Decrypting...</pre>
+<script>
+{{template "crypto"}}
+(async function() {
+	const out = document.getElementById("paste");
+	const raw = decodeKey(location.hash.slice(1));
+	if (raw === null || raw.length != 32) {
+		out.textContent = "The key to decrypt this paste is missing from the url.";
+		return;
+	}
+	const data = Uint8Array.from(atob(out.dataset.paste), c => c.charCodeAt(0));
+	const key = await crypto.subtle.importKey("raw", raw, "AES-GCM", false, ["decrypt"]);
+	try {
+		const text = await crypto.subtle.decrypt({name: "AES-GCM", iv: data.slice(0, 12)}, key, data.slice(12));
+		out.textContent = new TextDecoder().decode(text);
+	} catch (e) {
+		out.textContent = "The paste could not be decrypted with the key in the url.";
+	}
+})();
+</script>
+</body>
+</html>
+`,
+	// Keys are kept in urls as unpadded base64url
+	"crypto": `function encodeKey(raw) {
+	return btoa(String.fromCharCode.apply(null, raw)).replace(/\+/g, "-").replace(/\//g, "_").replace(/=+$/, "");
+}
+function decodeKey(s) {
+	try {
+		return Uint8Array.from(atob(s.replace(/-/g, "+").replace(/_/g, "/")), c => c.charCodeAt(0));
+	} catch (e) {
+		return null;
+	}
+}`,
+	"lifetimes": `{{if .LifeTimes}}<select name="lifetime">
+			<option value="">{{if gt .LifeTime 0}}{{.LifeTime}}{{else}}forever{{end}}</option>
+			{{range .LifeTimes}}<option value="{{.Name}}">{{.Name}}</option>
+			{{end}}
+		</select>{{end}}`,
+	"listing": `{{if .Listing}}<input type="text" name="title" maxlength="100" placeholder="Title"></input>
+			<label><input type="checkbox" name="listed" value="1"></input>List publicly</label>{{end}}`,
+	"recent": `<html>
+<head>
+<meta charset="utf-8">
+{{template "style"}}
+<title>Recent pastes</title>
+</head>
+<body style="text-align:center">
+<div style="display:inline-block;text-align:left;margin:2em">
+<p>Recent public pastes</p>
+<table>
+	<tr><th>Paste</th><th>Size</th><th>Created</th></tr>
+	{{- range .}}
+	<tr>
+		<td><a href="{{.URL}}">{{if .Title}}{{.Title}}{{else}}{{.ID}}{{end}}</a></td>
+		<td>{{.Size}}</td>
+		<td>{{.Created.Format "2006-01-02 15:04"}}</td>
+	</tr>
+	{{- else}}
+	<tr><td colspan="3">No pastes have been listed yet.</td></tr>
+	{{- end}}
+</table>
+</div>
+</body>
+</html>
+`,
+	"style": `<link rel="stylesheet" href="{{static "style.css"}}">`,
+	"view": `<html>
+<head>
+<meta charset="utf-8">
+<title>{{.ID}}</title>
+</head>
+<body style="background-color:#fff;color:#000">
+{{.Content}}
+</body>
+</html>
+`,
+	"me": `<html>
+<head>
+<meta charset="utf-8">
+{{template "style"}}
+<title>Pastes of {{.User}}</title>
+</head>
+<body style="text-align:center">
+<div style="display:inline-block;text-align:left;margin:2em">
+<p>Live pastes of {{.User}}: {{.Total}}{{if gt .Total (len .Pastes)}}, showing the {{len .Pastes}} newest{{end}}</p>
+<table>
+	<tr><th>Paste</th><th>Size</th><th>Created</th><th>Expires in</th><th></th></tr>
+	{{- range .Pastes}}
+	<tr id="{{.ID}}">
+		<td><a href="{{.URL}}">{{.ID}}</a></td>
+		<td>{{.Size}}</td>
+		<td>{{.Created.Format "2006-01-02 15:04"}}</td>
+		<td{{if not .Expires.IsZero}} data-expires="{{.Expires.Unix}}"{{end}}>never</td>
+		<td><button onclick="deletePaste('{{.ID}}')">Delete</button></td>
+	</tr>
+	{{- end}}
+</table>
+</div>
+<script>
+async function deletePaste(id) {
+	if (!confirm("Delete " + id + "?")) {
+		return;
+	}
+	const resp = await fetch("{{.SiteURL}}/me/pastes/" + id, {method: "DELETE", credentials: "same-origin"});
+	if (resp.ok || resp.status == 404) {
+		document.getElementById(id).remove();
+	} else {
+		alert(await resp.text());
+	}
+}
+function countdown() {
+	const now = Date.now() / 1000;
+	for (const cell of document.querySelectorAll("[data-expires]")) {
+		let left = Math.max(0, Math.floor(cell.dataset.expires - now));
+		const parts = [];
+		for (const [unit, secs] of [["d", 86400], ["h", 3600], ["m", 60], ["s", 1]]) {
+			if (left >= secs || parts.length > 0 || unit == "s") {
+				parts.push(Math.floor(left / secs) + unit);
+				left %= secs;
+			}
+		}
+		cell.textContent = parts.join(" ");
+	}
+}
+countdown();
+setInterval(countdown, 1000);
+</script>
+</body>
+</html>
+`,
+	"error": `<html lang="{{.Lang}}">
+<head>
+<meta charset="utf-8">
+{{template "style"}}
+<title>{{.Status}} {{.Title}}</title>
+</head>
+<body style="text-align:center">
+<pre style="display:inline-block;text-align:left;margin:2em 2em 2em 0">
+{{.Status}} {{.Title}}
+
+{{.Message}}
+</pre>
+</body>
+</html>
+`,
+	"stats": `<html>
+<head>
+<meta charset="utf-8">
+{{template "style"}}
+<title>Stats</title>
+</head>
+<body style="text-align:center">
+<pre style="display:inline-block;text-align:left;margin:2em 2em 2em 0">
+Up for {{.UptimeText}}.
+
+Pastes:   {{.Pastes}}{{if gt .MaxPastes 0}} out of {{.MaxPastes}} ({{printf "%.1f" .PastesUsed}}%){{end}}
+Storage:  {{.Storage}}{{if gt .MaxStorage 0.0}} out of {{.MaxStorage}} ({{printf "%.1f" .StorageUsed}}%){{end}}
+Max size: {{if gt .MaxSize 0.0}}{{.MaxSize}}{{else}}none{{end}}
+Lifetime: {{if gt .LifeTimeText 0}}{{.LifeTimeText}}{{else}}forever{{end}}
+
+Uploads:   {{.Uploads}}
+Downloads: {{.Downloads}}
+
+Activity in the last {{.Hours}} hours:
+
+    uploads   {{.UploadsLine}}
+    downloads {{.DownloadsLine}}
+
+Clients not asking for HTML get this report as JSON.
+</pre>
+</body>
+</html>
+`,
+	"created": `<html>
+<head>
+<meta charset="utf-8">
+{{template "style"}}
+</head>
+<body style="text-align:center">
+<pre style="display:inline-block;text-align:left;margin:2em 2em 2em 0">
+{{if eq (len .) 1}}Your paste is at:{{else}}Your pastes are at:{{end}}
+{{range $i, $c := .}}
+    <a id="url{{$i}}" href="{{$c.URL}}">{{$c.URL}}</a> <button onclick="navigator.clipboard.writeText(document.getElementById('url{{$i}}').href)">Copy url</button>
+{{- end}}
+</pre>
+</body>
+</html>
 `,
 }
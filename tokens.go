@@ -0,0 +1,206 @@
+// Copyright (c) 2014-2015, Daniel Martí <mvdan@mvdan.cc>
+// See LICENSE for licensing information
+
+package main
+
+import (
+	"bufio"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/mvdan/pastecat/storage"
+)
+
+var (
+	errUnknownToken  = errors.New("unknown token")
+	errQuotaExceeded = errors.New("storage quota exceeded")
+)
+
+// Prefix of the secrets in the token file which are instead the common name
+// of a client certificate
+const certPrefix = "cert:"
+
+// Name of the tier applying to uploads without a token
+const anonymousTier = "anonymous"
+
+// uploadToken is a named secret allowing uploads
+type uploadToken struct {
+	name string
+	// Limits of the token, either its own or those of its tier
+	tokenLimits
+}
+
+// tokenLimits are the limits of the uploads made with a token. Zero means no
+// limit.
+type tokenLimits struct {
+	// maxSize overrides the maximum size of the pastes uploaded with the
+	// token
+	maxSize storage.ByteSize
+	// lifeTime caps the lifetime of the pastes uploaded with the token
+	lifeTime time.Duration
+	// quota is the total size that the pastes uploaded with the token may
+	// use at once
+	quota storage.ByteSize
+}
+
+// tokenSet maps the secret of each upload token to the token. The empty
+// secret holds the limits of uploads without a token.
+type tokenSet map[string]uploadToken
+
+// parseTier parses the limits of a tier, as a maximum size, a maximum
+// lifetime and a quota, each of which may be "-" for no limit.
+func parseTier(fields []string) (tokenLimits, error) {
+	var limits tokenLimits
+	if fields[0] != "-" {
+		if err := limits.maxSize.Set(fields[0]); err != nil {
+			return limits, err
+		}
+		if limits.maxSize > 1*storage.EB {
+			return limits, fmt.Errorf("size would overflow int64")
+		}
+	}
+	if fields[1] != "-" {
+		lt, err := parseLifeTime(fields[1])
+		if err != nil {
+			return limits, err
+		}
+		limits.lifeTime = lt
+	}
+	if fields[2] != "-" {
+		if err := limits.quota.Set(fields[2]); err != nil {
+			return limits, err
+		}
+		if limits.quota > 1*storage.EB {
+			return limits, fmt.Errorf("quota would overflow int64")
+		}
+	}
+	return limits, nil
+}
+
+// loadTokens reads a token file, holding one "name secret" pair per line,
+// optionally followed by either the maximum size of the pastes uploaded
+// with it or the name of its tier. A secret like "cert:name" matches client
+// certificates with that common name.
+//
+// Tiers are defined before their tokens by lines like "tier name size
+// lifetime quota". The tier named "anonymous" applies to uploads without a
+// token. Empty lines and lines starting with '#' are ignored.
+func loadTokens(path string) (tokenSet, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	tokens := make(tokenSet)
+	tiers := make(map[string]tokenLimits)
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || text[0] == '#' {
+			continue
+		}
+		fields := strings.Fields(text)
+		if fields[0] == "tier" && len(fields) == 5 {
+			limits, err := parseTier(fields[2:])
+			if err != nil {
+				return nil, fmt.Errorf("%s:%d: %v", path, line, err)
+			}
+			tiers[fields[1]] = limits
+			if fields[1] == anonymousTier {
+				tokens[""] = uploadToken{tokenLimits: limits}
+			}
+			continue
+		}
+		if len(fields) != 2 && len(fields) != 3 {
+			return nil, fmt.Errorf("%s:%d: expected a name, a secret and an optional size or tier", path, line)
+		}
+		token := uploadToken{name: fields[0]}
+		if len(fields) == 3 {
+			if limits, e := tiers[fields[2]]; e {
+				token.tokenLimits = limits
+			} else if err := token.maxSize.Set(fields[2]); err != nil {
+				return nil, fmt.Errorf("%s:%d: unknown tier or invalid size %q", path, line, fields[2])
+			} else if token.maxSize > 1*storage.EB {
+				return nil, fmt.Errorf("%s:%d: size would overflow int64", path, line)
+			}
+		}
+		tokens[fields[1]] = token
+	}
+	return tokens, scanner.Err()
+}
+
+func bearerToken(r *http.Request) string {
+	auth := r.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, "Bearer ") {
+		return ""
+	}
+	return strings.TrimSpace(auth[len("Bearer "):])
+}
+
+// get returns the token the request was made with, if any, or else the
+// one matching its client certificate. Requests without a token get the
+// limits of the anonymous tier, if any. Tokens are ignored if none are
+// configured.
+func (t tokenSet) get(r *http.Request) (uploadToken, error) {
+	secret := bearerToken(r)
+	if t == nil {
+		return uploadToken{}, nil
+	}
+	if secret == "" {
+		if name := clientCertName(r); name != "" {
+			if token, e := t[certPrefix+name]; e {
+				return token, nil
+			}
+		}
+		// Certificates without a token upload like anyone else
+		return t[""], nil
+	}
+	token, e := t[secret]
+	if !e || strings.HasPrefix(secret, certPrefix) {
+		return uploadToken{}, errUnknownToken
+	}
+	return token, nil
+}
+
+// maxSize returns the largest maximum size of any of the tokens.
+func (t tokenSet) maxSize() storage.ByteSize {
+	var max storage.ByteSize
+	for _, token := range t {
+		if token.maxSize > max {
+			max = token.maxSize
+		}
+	}
+	return max
+}
+
+// hasQuota returns whether any of the tokens has a quota.
+func (t tokenSet) hasQuota() bool {
+	for _, token := range t {
+		if token.quota > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// reserveQuota counts size more bytes towards the quota of the token,
+// returning errQuotaExceeded if that would take it over. release must be
+// called once the paste is stored, or failed to be.
+func (h *httpHandler) reserveQuota(token uploadToken, size int64) (release func(), err error) {
+	if token.quota == 0 {
+		return func() {}, nil
+	}
+	if !h.usage.Reserve(token.name, size, int64(token.quota)) {
+		return nil, errQuotaExceeded
+	}
+	return func() { h.usage.Release(token.name, size) }, nil
+}
+
+func secretsEqual(a, b string) bool {
+	return subtle.ConstantTimeCompare([]byte(a), []byte(b)) == 1
+}
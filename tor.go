@@ -0,0 +1,156 @@
+// Copyright (c) 2014-2015, Daniel Martí <mvdan@mvdan.cc>
+// See LICENSE for licensing information
+
+package main
+
+import (
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/textproto"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// torOnion is an onion service published via Tor's control port. The
+// service is removed by Tor once the control connection is closed.
+type torOnion struct {
+	conn      *textproto.Conn
+	ServiceID string
+}
+
+// publishOnion publishes a v3 onion service forwarding port 80 to target.
+// The private key of the service is read from keyPath if it exists, and
+// written to it otherwise, so that the onion address persists.
+func publishOnion(controlAddr, password, keyPath, target string) (*torOnion, error) {
+	c, err := textproto.Dial("tcp", controlAddr)
+	if err != nil {
+		return nil, err
+	}
+	o := &torOnion{conn: c}
+	if err := o.authenticate(password); err != nil {
+		c.Close()
+		return nil, err
+	}
+	key := "NEW:ED25519-V3"
+	if keyPath != "" {
+		if data, err := ioutil.ReadFile(keyPath); err == nil {
+			key = strings.TrimSpace(string(data))
+		} else if !os.IsNotExist(err) {
+			c.Close()
+			return nil, err
+		}
+	}
+	lines, err := o.command("ADD_ONION %s Port=80,%s", key, target)
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+	var privateKey string
+	for _, line := range lines {
+		switch {
+		case strings.HasPrefix(line, "ServiceID="):
+			o.ServiceID = line[len("ServiceID="):]
+		case strings.HasPrefix(line, "PrivateKey="):
+			privateKey = line[len("PrivateKey="):]
+		}
+	}
+	if o.ServiceID == "" {
+		c.Close()
+		return nil, fmt.Errorf("tor did not return an onion service id")
+	}
+	if keyPath != "" && privateKey != "" {
+		if err := ioutil.WriteFile(keyPath, []byte(privateKey+"\n"), 0600); err != nil {
+			c.Close()
+			return nil, err
+		}
+	}
+	return o, nil
+}
+
+// URL returns the url the onion service is reachable at
+func (o *torOnion) URL() string {
+	return fmt.Sprintf("http://%s.onion", o.ServiceID)
+}
+
+func (o *torOnion) Close() error {
+	return o.conn.Close()
+}
+
+// command sends a command to the control port, returning the lines of its
+// reply.
+func (o *torOnion) command(format string, args ...interface{}) ([]string, error) {
+	id, err := o.conn.Cmd(format, args...)
+	if err != nil {
+		return nil, err
+	}
+	o.conn.StartResponse(id)
+	defer o.conn.EndResponse(id)
+	_, msg, err := o.conn.ReadResponse(250)
+	if err != nil {
+		return nil, fmt.Errorf("tor control: %v", err)
+	}
+	return strings.Split(msg, "\n"), nil
+}
+
+// authenticate authenticates with the control port, via a password if
+// given, or else via cookie or no authentication as allowed by Tor.
+func (o *torOnion) authenticate(password string) error {
+	if password != "" {
+		_, err := o.command("AUTHENTICATE %s", strconv.Quote(password))
+		return err
+	}
+	lines, err := o.command("PROTOCOLINFO 1")
+	if err != nil {
+		return err
+	}
+	var methods, cookieFile string
+	for _, line := range lines {
+		if !strings.HasPrefix(line, "AUTH ") {
+			continue
+		}
+		for _, field := range strings.Fields(line[len("AUTH "):]) {
+			switch {
+			case strings.HasPrefix(field, "METHODS="):
+				methods = field[len("METHODS="):]
+			case strings.HasPrefix(field, "COOKIEFILE="):
+				cookieFile, err = strconv.Unquote(field[len("COOKIEFILE="):])
+				if err != nil {
+					return fmt.Errorf("invalid tor cookie file: %v", err)
+				}
+			}
+		}
+	}
+	allowed := make(map[string]bool)
+	for _, method := range strings.Split(methods, ",") {
+		allowed[method] = true
+	}
+	switch {
+	case allowed["NULL"]:
+		_, err = o.command("AUTHENTICATE")
+	case allowed["COOKIE"] && cookieFile != "":
+		var cookie []byte
+		if cookie, err = ioutil.ReadFile(cookieFile); err != nil {
+			return err
+		}
+		_, err = o.command("AUTHENTICATE %s", hex.EncodeToString(cookie))
+	default:
+		err = fmt.Errorf("unsupported tor authentication methods '%s'", methods)
+	}
+	return err
+}
+
+// onionTarget returns the address Tor should forward onion connections to
+// for the given listen address, defaulting to localhost.
+func onionTarget(listen string) (string, error) {
+	host, port, err := net.SplitHostPort(listen)
+	if err != nil {
+		return "", err
+	}
+	if host == "" || host == "0.0.0.0" || host == "::" {
+		host = "127.0.0.1"
+	}
+	return net.JoinHostPort(host, port), nil
+}
@@ -0,0 +1,267 @@
+// Copyright (c) 2014-2015, Daniel Martí <mvdan@mvdan.cc>
+// See LICENSE for licensing information
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// Maximum number of spans to send to the collector at once
+	traceBatchSize = 256
+	// How often to send the finished spans to the collector
+	traceFlushInterval = 5 * time.Second
+	// Number of finished spans to hold before dropping new ones
+	traceQueueSize = 4096
+	// Maximum time to wait for the collector to take a batch
+	traceExportTimeout = 10 * time.Second
+
+	// OTLP span kinds and status codes
+	spanKindInternal = 1
+	spanKindServer   = 2
+	spanStatusError  = 2
+)
+
+type spanKey struct{}
+
+// tracer records spans of the HTTP requests and their store operations,
+// sending them to an OpenTelemetry collector via OTLP over HTTP.
+type tracer struct {
+	endpoint string
+	client   *http.Client
+	queue    chan *span
+}
+
+type span struct {
+	tracer  *tracer
+	traceID [16]byte
+	id      [8]byte
+	parent  [8]byte
+	name    string
+	kind    int
+	start   time.Time
+	end     time.Time
+	attrs   map[string]string
+	err     error
+}
+
+func newTracer(endpoint string) *tracer {
+	t := &tracer{
+		endpoint: strings.TrimSuffix(endpoint, "/") + "/v1/traces",
+		client:   &http.Client{Timeout: traceExportTimeout},
+		queue:    make(chan *span, traceQueueSize),
+	}
+	go t.run()
+	return t
+}
+
+func (t *tracer) newSpan(name string, kind int) *span {
+	sp := &span{
+		tracer: t,
+		name:   name,
+		kind:   kind,
+		start:  time.Now(),
+		attrs:  make(map[string]string),
+	}
+	rand.Read(sp.id[:])
+	return sp
+}
+
+// parseTraceParent extracts the trace and parent span ids from a W3C
+// traceparent header.
+func parseTraceParent(value string, sp *span) bool {
+	parts := strings.Split(value, "-")
+	if len(parts) != 4 || len(parts[1]) != 32 || len(parts[2]) != 16 {
+		return false
+	}
+	if _, err := hex.Decode(sp.traceID[:], []byte(parts[1])); err != nil {
+		return false
+	}
+	if _, err := hex.Decode(sp.parent[:], []byte(parts[2])); err != nil {
+		return false
+	}
+	return true
+}
+
+// wrap starts a span for each request handled by h.
+func (t *tracer) wrap(h http.Handler) http.Handler {
+	if t == nil {
+		return h
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		sp := t.newSpan(r.Method+" "+r.URL.Path, spanKindServer)
+		if !parseTraceParent(r.Header.Get("Traceparent"), sp) {
+			rand.Read(sp.traceID[:])
+		}
+		sp.attrs["http.method"] = r.Method
+		// Not the query, as it may hold the tokens to write and delete
+		sp.attrs["http.target"] = r.URL.Path
+		sw := &statusWriter{ResponseWriter: w}
+		h.ServeHTTP(sw, r.WithContext(context.WithValue(r.Context(), spanKey{}, sp)))
+		sp.attrs["http.status_code"] = strconv.Itoa(sw.status)
+		if sw.status >= 500 {
+			sp.err = fmt.Errorf("status %d", sw.status)
+		}
+		sp.finish()
+	})
+}
+
+// childSpan starts a span as a child of the request's span, if the request
+// is being traced.
+func childSpan(r *http.Request, name string) *span {
+	parent, _ := r.Context().Value(spanKey{}).(*span)
+	if parent == nil {
+		return nil
+	}
+	sp := parent.tracer.newSpan(name, spanKindInternal)
+	sp.traceID = parent.traceID
+	sp.parent = parent.id
+	return sp
+}
+
+// endWith finishes the span, marking it as failed if err is not nil.
+func (sp *span) endWith(err error) {
+	if sp == nil {
+		return
+	}
+	sp.err = err
+	sp.finish()
+}
+
+func (sp *span) finish() {
+	sp.end = time.Now()
+	select {
+	case sp.tracer.queue <- sp:
+	default:
+		// The collector can't keep up; better to lose spans than to
+		// block requests
+	}
+}
+
+type otlpAttr struct {
+	Key   string `json:"key"`
+	Value struct {
+		StringValue string `json:"stringValue"`
+	} `json:"value"`
+}
+
+func otlpAttrs(m map[string]string) []otlpAttr {
+	attrs := make([]otlpAttr, 0, len(m))
+	for k, v := range m {
+		a := otlpAttr{Key: k}
+		a.Value.StringValue = v
+		attrs = append(attrs, a)
+	}
+	return attrs
+}
+
+type otlpSpan struct {
+	TraceID      string     `json:"traceId"`
+	SpanID       string     `json:"spanId"`
+	ParentSpanID string     `json:"parentSpanId,omitempty"`
+	Name         string     `json:"name"`
+	Kind         int        `json:"kind"`
+	Start        string     `json:"startTimeUnixNano"`
+	End          string     `json:"endTimeUnixNano"`
+	Attributes   []otlpAttr `json:"attributes,omitempty"`
+	Status       struct {
+		Code    int    `json:"code,omitempty"`
+		Message string `json:"message,omitempty"`
+	} `json:"status"`
+}
+
+func (sp *span) otlp() otlpSpan {
+	s := otlpSpan{
+		TraceID:    hex.EncodeToString(sp.traceID[:]),
+		SpanID:     hex.EncodeToString(sp.id[:]),
+		Name:       sp.name,
+		Kind:       sp.kind,
+		Start:      strconv.FormatInt(sp.start.UnixNano(), 10),
+		End:        strconv.FormatInt(sp.end.UnixNano(), 10),
+		Attributes: otlpAttrs(sp.attrs),
+	}
+	if sp.parent != [8]byte{} {
+		s.ParentSpanID = hex.EncodeToString(sp.parent[:])
+	}
+	if sp.err != nil {
+		s.Status.Code = spanStatusError
+		s.Status.Message = sp.err.Error()
+	}
+	return s
+}
+
+type otlpScopeSpans struct {
+	Scope struct {
+		Name string `json:"name"`
+	} `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpResourceSpans struct {
+	Resource struct {
+		Attributes []otlpAttr `json:"attributes"`
+	} `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+func (t *tracer) export(spans []*span) error {
+	var ss otlpScopeSpans
+	ss.Scope.Name = "pastecat"
+	for _, sp := range spans {
+		ss.Spans = append(ss.Spans, sp.otlp())
+	}
+	var rs otlpResourceSpans
+	rs.Resource.Attributes = otlpAttrs(map[string]string{"service.name": "pastecat"})
+	rs.ScopeSpans = []otlpScopeSpans{ss}
+	req := struct {
+		ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+	}{[]otlpResourceSpans{rs}}
+	body, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+	resp, err := t.client.Post(t.endpoint, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("collector replied with %s", resp.Status)
+	}
+	return nil
+}
+
+func (t *tracer) run() {
+	ticker := time.NewTicker(traceFlushInterval)
+	var batch []*span
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+		if err := t.export(batch); err != nil {
+			log.Printf("Could not export %d spans: %v", len(batch), err)
+		}
+		batch = batch[:0]
+	}
+	for {
+		select {
+		case sp := <-t.queue:
+			if batch = append(batch, sp); len(batch) >= traceBatchSize {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		}
+	}
+}
@@ -0,0 +1,399 @@
+// Copyright (c) 2014-2015, Daniel Martí <mvdan@mvdan.cc>
+// See LICENSE for licensing information
+
+package main
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mvdan/pastecat/storage"
+)
+
+const (
+	tusVersion    = "1.0.0"
+	tusExtensions = "creation,termination"
+	tusPrefix     = "/files/"
+
+	// How long unfinished uploads are kept since they were last written to
+	tusIdleTimeout = 24 * time.Hour
+	// Maximum number of unfinished uploads per client
+	tusMaxPerClient = 16
+	// Suffix of the files uploads are staged in, so that only those are
+	// ever removed from the directory
+	tusSuffix = ".tus"
+)
+
+var errTooManyUploads = errors.New("too many unfinished uploads")
+
+// tusUpload is a resumable upload, staged in a file until it is complete
+type tusUpload struct {
+	sync.Mutex
+	path   string
+	client string
+	length int64
+	// counted is whether length is counted against the storage
+	counted    bool
+	offset     int64
+	meta       storage.Meta
+	lastActive time.Time
+	// url of the paste, once the upload is complete
+	url string
+}
+
+// tusHandler implements the core tus protocol for resumable uploads, along
+// with its creation and termination extensions.
+type tusHandler struct {
+	h   *httpHandler
+	dir string
+
+	sync.Mutex
+	uploads map[string]*tusUpload
+	// Number of unfinished uploads by client
+	pending map[string]int
+}
+
+// newTusHandler sets up a tus handler staging uploads in dir. Uploads left
+// behind by a previous run are removed, as they can't be resumed.
+func newTusHandler(h *httpHandler, dir string) (*tusHandler, error) {
+	// The store may change the working directory later on
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return nil, err
+	}
+	if err := cleanTusDir(dir); err != nil {
+		return nil, err
+	}
+	t := &tusHandler{
+		h:       h,
+		dir:     dir,
+		uploads: make(map[string]*tusUpload),
+		pending: make(map[string]int),
+	}
+	go func() {
+		for range time.Tick(time.Hour) {
+			t.removeIdle()
+		}
+	}()
+	return t, nil
+}
+
+// cleanTusDir creates dir, or removes the uploads staged in it. Anything
+// else in it makes it be refused, as it may not be a directory for tus
+// uploads at all.
+func cleanTusDir(dir string) error {
+	infos, err := ioutil.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return os.MkdirAll(dir, 0700)
+	} else if err != nil {
+		return err
+	}
+	for _, info := range infos {
+		if !info.Mode().IsRegular() || !strings.HasSuffix(info.Name(), tusSuffix) {
+			return fmt.Errorf("%s holds %s, which is not a tus upload", dir, info.Name())
+		}
+	}
+	for _, info := range infos {
+		if err := os.Remove(filepath.Join(dir, info.Name())); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// unstage removes the file of an unfinished upload, no longer counting it
+// against the storage and its client's uploads. Must be called with the
+// upload locked.
+func (t *tusHandler) unstage(u *tusUpload) {
+	os.Remove(u.path)
+	if u.counted {
+		t.h.stats.Shrink(u.length)
+		u.counted = false
+	}
+	t.Lock()
+	if t.pending[u.client]--; t.pending[u.client] <= 0 {
+		delete(t.pending, u.client)
+	}
+	t.Unlock()
+}
+
+func (t *tusHandler) removeIdle() {
+	t.Lock()
+	uploads := make(map[string]*tusUpload, len(t.uploads))
+	for id, u := range t.uploads {
+		uploads[id] = u
+	}
+	t.Unlock()
+	for id, u := range uploads {
+		u.Lock()
+		idle := u.url == "" && time.Since(u.lastActive) > tusIdleTimeout
+		if idle {
+			t.unstage(u)
+		}
+		u.Unlock()
+		if idle {
+			t.Lock()
+			delete(t.uploads, id)
+			t.Unlock()
+		}
+	}
+}
+
+func (t *tusHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Tus-Resumable", tusVersion)
+	if r.Method == "OPTIONS" {
+		w.Header().Set("Tus-Version", tusVersion)
+		w.Header().Set("Tus-Extension", tusExtensions)
+		w.Header().Set("Tus-Max-Size", strconv.FormatInt(int64(routeMaxSize(apiMaxSize)), 10))
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	if r.Header.Get("Tus-Resumable") != tusVersion {
+		w.Header().Set("Tus-Version", tusVersion)
+		http.Error(w, "unsupported tus version", http.StatusPreconditionFailed)
+		return
+	}
+	id := r.URL.Path[len(tusPrefix):]
+	switch {
+	case id == "" && r.Method == "POST":
+		t.handleCreate(w, r)
+	case id != "" && r.Method == "HEAD":
+		t.handleHead(w, r, id)
+	case id != "" && r.Method == "PATCH":
+		t.handlePatch(w, r, id)
+	case id != "" && r.Method == "DELETE":
+		t.handleDelete(w, r, id)
+	default:
+		http.Error(w, unknownAction, http.StatusBadRequest)
+	}
+}
+
+// parseTusMetadata parses an Upload-Metadata header, made of comma
+// separated keys and base64 encoded values.
+func parseTusMetadata(header string) (map[string]string, error) {
+	meta := make(map[string]string)
+	for _, pair := range strings.Split(header, ",") {
+		fields := strings.Fields(pair)
+		switch len(fields) {
+		case 0:
+			continue
+		case 1:
+			meta[fields[0]] = ""
+		case 2:
+			value, err := base64.StdEncoding.DecodeString(fields[1])
+			if err != nil {
+				return nil, fmt.Errorf("invalid metadata value for '%s'", fields[0])
+			}
+			meta[fields[0]] = string(value)
+		default:
+			return nil, fmt.Errorf("invalid metadata '%s'", pair)
+		}
+	}
+	return meta, nil
+}
+
+func (t *tusHandler) handleCreate(w http.ResponseWriter, r *http.Request) {
+	meta, ok := t.h.uploadMeta(w, r)
+	if !ok {
+		return
+	}
+	length, err := strconv.ParseInt(r.Header.Get("Upload-Length"), 10, 64)
+	if err != nil || length <= 0 {
+		http.Error(w, "invalid Upload-Length", http.StatusBadRequest)
+		return
+	}
+	if limit := t.h.sizeLimit(r, apiMaxSize); length > limit {
+		http.Error(w, fmt.Sprintf("upload too large, maximum is %s", storage.ByteSize(limit)),
+			http.StatusRequestEntityTooLarge)
+		return
+	}
+	uploadMeta, err := parseTusMetadata(r.Header.Get("Upload-Metadata"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	b := make([]byte, 16)
+	var id string
+	// Shards only take the uploads that routers send to them
+	for id == "" || t.h.shard != nil && !t.h.shard.owns([]byte(id)) {
+		if _, err := rand.Read(b); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		id = hex.EncodeToString(b)
+	}
+	meta.Filename = compat.filename(uploadMeta["filename"])
+	u := &tusUpload{
+		path:       filepath.Join(t.dir, id+tusSuffix),
+		client:     clientKey(r),
+		length:     length,
+		meta:       meta,
+		lastActive: time.Now(),
+	}
+	t.Lock()
+	if t.pending[u.client] >= tusMaxPerClient {
+		t.Unlock()
+		http.Error(w, errTooManyUploads.Error(), http.StatusTooManyRequests)
+		return
+	}
+	t.pending[u.client]++
+	t.Unlock()
+	// The whole length is counted from the start, so that uploads can't
+	// go over the maximum storage once they are underway
+	u.Lock()
+	defer u.Unlock()
+	if err := t.h.stats.Grow(length); err != nil {
+		t.unstage(u)
+		t.h.storeError(w, r, err)
+		return
+	}
+	u.counted = true
+	if err := ioutil.WriteFile(u.path, nil, 0600); err != nil {
+		t.unstage(u)
+		if storage.IsDiskFull(err) {
+			t.h.disk.full()
+			t.h.disk.refuse(w)
+			return
+		}
+		log.Printf("Could not stage tus upload: %v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	t.Lock()
+	t.uploads[id] = u
+	t.Unlock()
+	w.Header().Set("Location", *siteURL+tusPrefix+id)
+	w.WriteHeader(http.StatusCreated)
+}
+
+func (t *tusHandler) upload(w http.ResponseWriter, id string) *tusUpload {
+	t.Lock()
+	u := t.uploads[id]
+	t.Unlock()
+	if u == nil {
+		http.Error(w, "upload could not be found", http.StatusNotFound)
+	}
+	return u
+}
+
+func (t *tusHandler) handleHead(w http.ResponseWriter, r *http.Request, id string) {
+	u := t.upload(w, id)
+	if u == nil {
+		return
+	}
+	u.Lock()
+	defer u.Unlock()
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Upload-Offset", strconv.FormatInt(u.offset, 10))
+	w.Header().Set("Upload-Length", strconv.FormatInt(u.length, 10))
+	if u.url != "" {
+		w.Header().Set("X-Paste-Url", u.url)
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+func (t *tusHandler) handlePatch(w http.ResponseWriter, r *http.Request, id string) {
+	if r.Header.Get("Content-Type") != "application/offset+octet-stream" {
+		http.Error(w, "invalid Content-Type", http.StatusUnsupportedMediaType)
+		return
+	}
+	u := t.upload(w, id)
+	if u == nil {
+		return
+	}
+	u.Lock()
+	defer u.Unlock()
+	offset, err := strconv.ParseInt(r.Header.Get("Upload-Offset"), 10, 64)
+	if err != nil || offset != u.offset || u.url != "" {
+		http.Error(w, "mismatched Upload-Offset", http.StatusConflict)
+		return
+	}
+	f, err := os.OpenFile(u.path, os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	done := timePhase(r, "read body")
+	// Whatever was received counts even if the connection drops, so that
+	// the client can resume from there.
+	n, err := io.Copy(f, io.LimitReader(r.Body, u.length-u.offset))
+	done()
+	if err1 := f.Close(); err == nil {
+		err = err1
+	}
+	u.offset += n
+	u.lastActive = time.Now()
+	if storage.IsDiskFull(err) {
+		t.h.disk.full()
+		t.h.disk.refuse(w)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Upload-Offset", strconv.FormatInt(u.offset, 10))
+	if u.offset == u.length && !t.complete(w, r, id, u) {
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// complete turns a finished upload into a paste, replying with an error if
+// it cannot be stored.
+func (t *tusHandler) complete(w http.ResponseWriter, r *http.Request, id string, u *tusUpload) bool {
+	content, err := ioutil.ReadFile(u.path)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return false
+	}
+	// The paste takes over the space counted for the upload
+	t.h.stats.Shrink(u.length)
+	u.counted = false
+	pasteID, ok := t.h.newPaste(w, r, content, u.meta)
+	if !ok {
+		// Kept for the client to retry, counted again if it still fits
+		u.counted = t.h.stats.Grow(u.length) == nil
+		return false
+	}
+	t.unstage(u)
+	u.url = pasteURL(pasteID, u.meta)
+	w.Header().Set("X-Paste-Url", u.url)
+	// Keep the finished upload around for a while, so that clients can
+	// still find the url of the paste via HEAD
+	time.AfterFunc(tusIdleTimeout, func() {
+		t.Lock()
+		delete(t.uploads, id)
+		t.Unlock()
+	})
+	return true
+}
+
+func (t *tusHandler) handleDelete(w http.ResponseWriter, r *http.Request, id string) {
+	t.Lock()
+	u := t.uploads[id]
+	delete(t.uploads, id)
+	t.Unlock()
+	if u == nil {
+		http.Error(w, "upload could not be found", http.StatusNotFound)
+		return
+	}
+	u.Lock()
+	defer u.Unlock()
+	if u.url == "" {
+		t.unstage(u)
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
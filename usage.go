@@ -0,0 +1,91 @@
+// Copyright (c) 2014-2015, Daniel Martí <mvdan@mvdan.cc>
+// See LICENSE for licensing information
+
+package main
+
+import (
+	"log"
+	"net/http"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/mvdan/pastecat/storage"
+)
+
+// usageTmpl is the index for command line clients, which get plain text
+// instead of a page.
+var usageTmpl = template.Must(template.New("usage").Parse(`pastecat - {{.SiteURL}}
+
+Upload a paste:
+
+    $ echo foo | curl -F '{{.FieldName}}=<-' {{.SiteURL}}
+    {{.SiteURL}}/a63d03b9
+
+Upload a file:
+
+    $ curl -F '{{.FieldName}}=@foo.txt' {{.SiteURL}}
+
+Fetch it:
+
+    $ curl {{.SiteURL}}/a63d03b9
+    foo
+
+Set up an alias:
+
+    $ alias pcat='curl -F "{{.FieldName}}=<-" {{.SiteURL}}'
+{{if .Listing}}
+Pastes uploaded with listed=1 are shown at {{.SiteURL}}/recent:
+
+    $ echo foo | curl -F '{{.FieldName}}=<-' -F listed=1 -F title=Foo {{.SiteURL}}
+{{end}}{{if .LifeTimes}}
+Each paste may pick its lifetime via the lifetime field, like:
+
+    $ echo foo | curl -F '{{.FieldName}}=<-' -F lifetime={{(index .LifeTimes 0).Name}} {{.SiteURL}}
+{{end}}
+Limits:
+{{if gt .MaxSize 0.0}}
+    Maximum size per paste: {{.MaxSize}}{{end}}{{if gt .LifeTime 0}}
+    Pastes are deleted after: {{.LifeTime}}{{end}}{{range .SizeLimits}}
+    Pastes of {{.Size}} or more are deleted after: {{.LifeTime}}{{end}}
+    Pastes stored: {{.Stats.Pastes}}, using {{.Stats.Storage}}
+`))
+
+// wantsUsage returns whether a request for the index comes from a command
+// line client like curl or wget, or one preferring plain text.
+func wantsUsage(r *http.Request) bool {
+	ua := strings.ToLower(r.UserAgent())
+	if strings.HasPrefix(ua, "curl/") || strings.HasPrefix(ua, "wget/") {
+		return true
+	}
+	return negotiate(r, "text/html", "text/plain") == "text/plain"
+}
+
+// serveUsage serves the index as plain text, with example commands and the
+// limits of the instance.
+func (h *httpHandler) serveUsage(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Add("Vary", "Accept, User-Agent")
+	err := usageTmpl.Execute(w, struct {
+		SiteURL    string
+		FieldName  string
+		MaxSize    storage.ByteSize
+		LifeTime   time.Duration
+		LifeTimes  []lifeTimePreset
+		SizeLimits sizeLifeTimes
+		Listing    bool
+		Stats      instanceStats
+	}{
+		SiteURL:    *siteURL,
+		FieldName:  fieldName,
+		MaxSize:    routeMaxSize(apiMaxSize),
+		LifeTime:   *lifeTime,
+		LifeTimes:  lifeTimeOptions(),
+		SizeLimits: sizeLimits,
+		Listing:    *recentCount > 0,
+		Stats:      h.instanceStats(),
+	})
+	if err != nil {
+		log.Printf("Error executing template for %s: %v", r.URL.Path, err)
+	}
+}
@@ -0,0 +1,120 @@
+// Copyright (c) 2014-2015, Daniel Martí <mvdan@mvdan.cc>
+// See LICENSE for licensing information
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"runtime"
+	"runtime/debug"
+	"sort"
+
+	"github.com/mvdan/pastecat/storage"
+)
+
+// Path of the version and capabilities of the instance
+const versionPath = "/version"
+
+// version is set when building releases, like:
+//
+//	go build -ldflags "-X main.version=v1.2.0"
+//
+// Otherwise, it is taken from the build info, if there is any.
+var version string
+
+// buildVersion returns the version of the binary.
+func buildVersion() string {
+	if version != "" {
+		return version
+	}
+	if info, ok := debug.ReadBuildInfo(); ok && info.Main.Version != "" {
+		return info.Main.Version
+	}
+	return "unknown"
+}
+
+// versionInfo describes the build of an instance and what it supports, so
+// that clients can adapt to it.
+type versionInfo struct {
+	Version   string `json:"version"`
+	GoVersion string `json:"go_version"`
+	// Backends compiled in, and the one in use
+	Backends []string `json:"backends"`
+	Store    string   `json:"store"`
+	// Ways to identify uploaders, besides anonymous uploads
+	Auth []string `json:"auth"`
+	// Compatibility layers enabled
+	Compat []string `json:"compat"`
+	// Optional features enabled
+	Features []string `json:"features"`
+	MaxSize  int64    `json:"max_size"`
+	LifeTime float64  `json:"lifetime"`
+}
+
+// versionInfo returns the version and capabilities of the instance. tus
+// tells whether resumable uploads are enabled.
+func (h *httpHandler) versionInfo(tus bool) versionInfo {
+	info := versionInfo{
+		Version:   buildVersion(),
+		GoVersion: runtime.Version(),
+		Backends:  storage.Backends(),
+		Store:     h.storeType,
+		Auth:      []string{},
+		Compat:    []string{},
+		Features:  []string{},
+		MaxSize:   int64(routeMaxSize(apiMaxSize)),
+		LifeTime:  lifeTime.Seconds(),
+	}
+	for _, auth := range []struct {
+		name    string
+		enabled bool
+	}{
+		{"token", h.tokens != nil},
+		{"oidc", h.oidc != nil},
+		{"proxy", h.proxy != nil},
+	} {
+		if auth.enabled {
+			info.Auth = append(info.Auth, auth.name)
+		}
+	}
+	for name := range compat {
+		info.Compat = append(info.Compat, name)
+	}
+	sort.Strings(info.Compat)
+	for _, feature := range []struct {
+		name    string
+		enabled bool
+	}{
+		{"binary", !*rejectBinary},
+		{"cluster", h.cluster != nil},
+		{"dedup", h.dups != nil},
+		{"encrypted", *encryptedMode},
+		{"lifetimes", *minLifeTime > 0 || *maxLifeTime > 0},
+		{"recent", *recentCount > 0},
+		{"replica", *replicaOf != ""},
+		{"signatures", h.signer != nil},
+		{"tcp", *tcpListen != ""},
+		{"tus", tus},
+	} {
+		if feature.enabled {
+			info.Features = append(info.Features, feature.name)
+		}
+	}
+	return info
+}
+
+// versionHandler serves the version and capabilities of the instance.
+type versionHandler struct {
+	h   *httpHandler
+	tus bool
+}
+
+func (v versionHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, v.h.versionInfo(v.tus))
+}
+
+// printVersion prints the version of the binary, for -version.
+func printVersion() {
+	fmt.Printf("pastecat %s %s %s/%s\n", buildVersion(), runtime.Version(), runtime.GOOS, runtime.GOARCH)
+}
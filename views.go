@@ -0,0 +1,96 @@
+// Copyright (c) 2014-2015, Daniel Martí <mvdan@mvdan.cc>
+// See LICENSE for licensing information
+
+package main
+
+import (
+	"fmt"
+	"html/template"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"sort"
+
+	"github.com/mvdan/pastecat/storage"
+)
+
+// Name of the query parameter to pick an HTML view of a paste with
+const viewParam = "view"
+
+type pasteView struct {
+	// render renders the content of the paste at path
+	render func(path string, content []byte) template.HTML
+	// suits reports whether the view suits a paste, given the start of
+	// its content
+	suits func(start []byte) bool
+	// binary is whether the view suits binary pastes rather than text
+	binary bool
+}
+
+// pasteViews render the content of a paste as HTML, by name
+var pasteViews = map[string]pasteView{
+	"ansi":  {textView(renderANSI), hasANSIColors, false},
+	"diff":  {textView(renderDiff), isUnifiedDiff, false},
+	"image": {renderImage, isImage, true},
+}
+
+// textView adapts the rendering of text, which does not need the path of
+// the paste.
+func textView(render func(content []byte) template.HTML) func(string, []byte) template.HTML {
+	return func(_ string, content []byte) template.HTML {
+		return render(content)
+	}
+}
+
+// setViewLinks advertises the views that suit a paste via Link headers,
+// pointing to the paste's path with a view.
+func setViewLinks(header http.Header, path string, paste storage.Paste, content io.ReaderAt) {
+	if paste.Meta().Encrypted {
+		return
+	}
+	start := make([]byte, sniffLen)
+	n, _ := content.ReadAt(start, 0)
+	start = start[:n]
+	var names []string
+	for name := range pasteViews {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		view := pasteViews[name]
+		if view.binary == paste.Meta().Binary && view.suits(start) {
+			header.Add("Link", fmt.Sprintf(`<%s?%s=%s>; rel="alternate"; type="text/html"`,
+				path, viewParam, name))
+		}
+	}
+}
+
+// serveView serves an HTML view of a paste's content, while the plain
+// endpoint keeps serving the original bytes.
+func serveView(w http.ResponseWriter, r *http.Request, name string, id storage.ID, paste storage.Paste, content io.Reader) {
+	path := r.URL.EscapedPath()
+	view, e := pasteViews[name]
+	if !e {
+		http.Error(w, "unknown view", http.StatusBadRequest)
+		return
+	}
+	done := timePhase(r, "read paste")
+	b, err := ioutil.ReadAll(content)
+	done()
+	if err != nil {
+		replyStoreError(w, r, err)
+		return
+	}
+	setHeaders(w.Header(), id, paste)
+	// The view is a different representation of the paste
+	w.Header().Del("Etag")
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	err = tmpl.ExecuteTemplate(w, "view", struct {
+		ID      storage.ID
+		Content template.HTML
+	}{id, view.render(path, b)})
+	if err != nil {
+		log.Printf("Error executing template for %s: %v", r.URL.Path, err)
+	}
+}
@@ -0,0 +1,96 @@
+// Copyright (c) 2014-2015, Daniel Martí <mvdan@mvdan.cc>
+// See LICENSE for licensing information
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"time"
+
+	"github.com/mvdan/pastecat/internal/dirwatch"
+	"github.com/mvdan/pastecat/storage"
+)
+
+// fileVersion tells apart the contents a file had, so that a file that
+// could not be imported is only tried again once it changes
+type fileVersion struct {
+	size    int64
+	modTime time.Time
+}
+
+// importer turns the files dropped into the store's directory by other
+// tools into pastes, removing each file once stored
+type importer struct {
+	h      *httpHandler
+	failed map[string]fileVersion
+}
+
+func newImporter(h *httpHandler) *importer {
+	return &importer{h: h, failed: make(map[string]fileVersion)}
+}
+
+func (im *importer) run(w *dirwatch.Watcher) {
+	for name := range w.Files() {
+		if err := im.importFile(name); err != nil {
+			log.Printf("Could not import %s: %v", name, err)
+		}
+	}
+	log.Printf("Stopped watching the store directory: %v", w.Err())
+}
+
+func (im *importer) importFile(name string) error {
+	fi, err := os.Stat(name)
+	if os.IsNotExist(err) {
+		// Imported already, possibly by another process
+		return nil
+	} else if err != nil {
+		return err
+	}
+	// Empty files may still be written to
+	if !fi.Mode().IsRegular() || fi.Size() == 0 {
+		return nil
+	}
+	version := fileVersion{size: fi.Size(), modTime: fi.ModTime()}
+	if im.failed[name] == version {
+		return nil
+	}
+	delete(im.failed, name)
+	if max := int64(routeMaxSize(apiMaxSize)); fi.Size() > max {
+		im.failed[name] = version
+		return fmt.Errorf("paste too large, maximum is %s", storage.ByteSize(max))
+	}
+	// Claimed by renaming it, so that processes sharing the directory
+	// don't import it twice. Hidden names are not reported.
+	claimed := fmt.Sprintf(".%s.%d.import", name, os.Getpid())
+	if err := os.Rename(name, claimed); os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	id, meta, err := im.store(claimed, name)
+	if err != nil {
+		im.failed[name] = version
+		if err := os.Rename(claimed, name); err != nil {
+			log.Printf("Could not put back %s: %v", name, err)
+		}
+		return err
+	}
+	if err := os.Remove(claimed); err != nil {
+		return err
+	}
+	log.Printf("Imported %s as %s", name, pasteURL(id, meta))
+	return nil
+}
+
+func (im *importer) store(path, name string) (storage.ID, storage.Meta, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return storage.ID{}, storage.Meta{}, err
+	}
+	meta := storage.Meta{Filename: compat.filename(name)}
+	id, err := im.h.put(content, meta)
+	return id, meta, err
+}